@@ -0,0 +1,246 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+	"mime"
+	"net/http"
+	"net/url"
+)
+
+// AdminHandler serves a small web UI over the DB, for local development and
+// debugging: browse the keys by prefix, view and edit the entries as JSON
+// (TTL included), create and delete them, and follow the entry count, queue
+// lengths and read hit rate on live charts. It talks to the JSON API of
+// HTTPHandler, which it serves under api/ with authorizer, so mount it with
+// its own prefix stripped:
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", db.AdminHandler(nil)))
+//
+// With a nil authorizer anyone who reaches it can read and write every key:
+// keep it on loopback then. With one, the UI asks for the token to send.
+// Either way, the writes must be JSON from a page of the same origin, so that
+// another site open in the browser can't make them.
+func (db *DB[T]) AdminHandler(authorizer Authorizer) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/api/", http.StripPrefix("/api", sameOrigin(db.HTTPHandler(authorizer))))
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write([]byte(adminPage))
+	})
+	return mux
+}
+
+// sameOrigin rejects the writes a page of another origin could send from a
+// browser: the ones that aren't JSON, which a form can post without the
+// browser asking the server first, and the ones the browser says come from
+// another origin, through Sec-Fetch-Site or, in older browsers, Origin.
+func sameOrigin(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+			writeAPIError(w, dbError.InvalidRequest("writes must be sent as application/json"))
+			return
+		}
+		if !sameOriginRequest(r) {
+			writeAPIError(w, dbError.AccessDenied("cross-origin request"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func sameOriginRequest(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true // not sent by a browser
+	}
+	parsed, err := url.Parse(origin)
+	return err == nil && parsed.Host == r.Host
+}
+
+// adminPage is the whole UI: it only uses relative URLs, so it works under
+// any prefix.
+const adminPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>local-key-value-DB admin</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: grid; grid-template-columns: 22em 1fr; height: 100vh; }
+aside { border-right: 1px solid #ccc; padding: 1em; overflow: auto; }
+main { padding: 1em; overflow: auto; }
+ul { list-style: none; padding: 0; margin: .5em 0; }
+li { padding: .2em .3em; cursor: pointer; font-family: monospace; word-break: break-all; }
+li:hover, li.selected { background: #e8eefc; }
+textarea { width: 100%; height: 18em; font-family: monospace; }
+input { font-family: monospace; }
+#error { color: #b00020; white-space: pre-wrap; }
+.charts { display: flex; gap: 1em; flex-wrap: wrap; margin-top: 1.5em; }
+.chart { border: 1px solid #ccc; padding: .5em; }
+.chart svg { display: block; }
+.chart span { font-size: .85em; color: #555; }
+</style>
+</head>
+<body>
+<aside>
+  <input id="token" type="password" placeholder="token" size="24">
+  <input id="prefix" placeholder="key prefix" size="24">
+  <ul id="keys"></ul>
+  <button id="more" hidden>more</button>
+</aside>
+<main>
+  <div>
+    <input id="key" placeholder="key" size="40">
+    <button id="load">Load</button>
+    <button id="save">Save</button>
+    <button id="create">Create</button>
+    <button id="delete">Delete</button>
+  </div>
+  <p><span id="expires"></span></p>
+  <textarea id="entry" spellcheck="false">{"value": null, "ttl": ""}</textarea>
+  <div id="error"></div>
+  <div class="charts" id="charts"></div>
+</main>
+<script>
+const $ = id => document.getElementById(id);
+let next = "";
+
+async function api(method, path, body) {
+  const headers = {};
+  if (method !== "GET") headers["Content-Type"] = "application/json";
+  if ($("token").value) headers["Authorization"] = "Bearer " + $("token").value;
+  const response = await fetch("api/v1/" + path, {method, headers, body});
+  const text = await response.text();
+  const data = text ? JSON.parse(text) : null;
+  if (!response.ok) {
+    throw new Error(data && data.message ? data.message + (data.info ? ", " + data.info : "") : response.statusText);
+  }
+  return data;
+}
+
+function showError(err) { $("error").textContent = err ? err.message : ""; }
+
+function keyPath(key) { return "keys/" + key.split("/").map(encodeURIComponent).join("/"); }
+
+async function listKeys(reset) {
+  if (reset) { $("keys").replaceChildren(); next = ""; }
+  const query = new URLSearchParams({prefix: $("prefix").value, limit: "100"});
+  if (next) query.set("after", next);
+  try {
+    const page = await api("GET", "keys?" + query);
+    for (const key of page.keys) {
+      const item = document.createElement("li");
+      item.textContent = key;
+      item.onclick = () => { $("key").value = key; loadEntry(); };
+      $("keys").append(item);
+    }
+    next = page.next;
+    $("more").hidden = !next;
+    showError(null);
+  } catch (err) { showError(err); }
+}
+
+async function loadEntry() {
+  try {
+    const entry = await api("GET", keyPath($("key").value));
+    $("entry").value = JSON.stringify(entry, null, 2);
+    $("expires").textContent = expiry(entry);
+    for (const item of $("keys").children) item.classList.toggle("selected", item.textContent === $("key").value);
+    showError(null);
+  } catch (err) { showError(err); }
+}
+
+function expiry(entry) {
+  if (entry.expires_at) return "expires at " + new Date(entry.expires_at).toLocaleString();
+  if (!entry.ttl) return "no expiration";
+  const at = new Date(new Date(entry.created_at).getTime() + Number(entry.ttl) * 1000);
+  return "ttl " + entry.ttl + "s, expires at " + at.toLocaleString();
+}
+
+async function write(method) {
+  try {
+    const entry = JSON.parse($("entry").value);
+    if (method === "POST" && !entry.created_at) entry.created_at = new Date().toISOString();
+    await api(method, keyPath($("key").value), JSON.stringify(entry));
+    await loadEntry();
+    if (method === "POST") listKeys(true);
+  } catch (err) { showError(err); }
+}
+
+async function remove() {
+  if (!confirm("Delete " + $("key").value + "?")) return;
+  try {
+    await api("DELETE", keyPath($("key").value));
+    $("entry").value = "";
+    $("expires").textContent = "";
+    listKeys(true);
+  } catch (err) { showError(err); }
+}
+
+// live charts of the last 60 samples of the stats
+const series = {
+  "entries": s => s.Entries,
+  "read queue": s => s.ReadQueue,
+  "write queue": s => s.WriteQueue,
+  "read hit rate %": (s, previous) => {
+    if (!previous) return 0;
+    const hits = s.ReadHits - previous.ReadHits, misses = s.ReadMisses - previous.ReadMisses;
+    return hits + misses ? Math.round(100 * hits / (hits + misses)) : 0;
+  },
+};
+const samples = Object.fromEntries(Object.keys(series).map(name => [name, []]));
+let previousStats = null;
+
+function drawChart(name, values) {
+  let chart = document.querySelector('[data-chart="' + name + '"]');
+  if (!chart) {
+    chart = document.createElement("div");
+    chart.className = "chart";
+    chart.dataset.chart = name;
+    chart.innerHTML = '<svg width="240" height="60" viewBox="0 0 240 60"><polyline fill="none" stroke="#3060c0" stroke-width="1.5"/></svg><span></span>';
+    $("charts").append(chart);
+  }
+  const top = Math.max(1, ...values);
+  const points = values.map((value, i) => (i * 4) + "," + (58 - 56 * value / top)).join(" ");
+  chart.querySelector("polyline").setAttribute("points", points);
+  chart.querySelector("span").textContent = name + ": " + (values.length ? values[values.length - 1] : "") + " (max " + top + ")";
+}
+
+async function pollStats() {
+  try {
+    const stats = await api("GET", "stats");
+    for (const [name, value] of Object.entries(series)) {
+      samples[name].push(value(stats, previousStats));
+      if (samples[name].length > 60) samples[name].shift();
+      drawChart(name, samples[name]);
+    }
+    previousStats = stats;
+  } catch (err) { showError(err); }
+}
+
+$("token").value = sessionStorage.getItem("token") || "";
+$("token").onchange = () => { sessionStorage.setItem("token", $("token").value); listKeys(true); };
+$("prefix").oninput = () => listKeys(true);
+$("more").onclick = () => listKeys(false);
+$("load").onclick = loadEntry;
+$("save").onclick = () => write("PUT");
+$("create").onclick = () => write("POST");
+$("delete").onclick = remove;
+listKeys(true);
+pollStats();
+setInterval(pollStats, 2000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+)
+
+// OpResult is the outcome of one op of Apply.
+type OpResult struct {
+	Err error
+	Seq uint64 // Sequence number of the entry an OpPut stored, see DbData.Seq
+}
+
+// Apply queues ops as a single operation, which the write worker applies in
+// one go, in order, with a single sync: submitting many writes costs one
+// round trip through the write queue instead of one per write. Unlike
+// BatchWrite, every op stands on its own: an op that fails, for instance a
+// delete of a missing key, is reported in its OpResult while the others are
+// applied, and a key may appear in several ops, a later one seeing what the
+// earlier ones did. A put of a new key over WithMaxEntries fails with
+// ErrEntryLimitReached. Only running out of space, checked once for all of
+// them, or a failed sync fails every op that was applied, which are all
+// rolled back. An error is returned when the ops can't be
+// queued at all.
+func (db *DB[T]) Apply(ops []Op[T]) ([]OpResult, error) {
+	if db.closed.Load() {
+		return nil, dbError.DBAlreadyClosed("")
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, 0, len(ops))
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if !seen[op.Key] {
+			seen[op.Key] = true
+			keys = append(keys, op.Key)
+		}
+	}
+	result := db.submitWrite(operation[T]{
+		action:    "apply",
+		batchKeys: keys,
+		batchOps:  ops,
+		response:  make(chan operationResult[T], 1),
+	})
+	if result.applied == nil {
+		return nil, result.err
+	}
+	return result.applied, nil
+}
+
+// apply applies ops one by one, then syncs once. The caller holds the
+// per-key locks of every key involved.
+func (db *DB[T]) apply(ops []Op[T]) []OpResult {
+	results := make([]OpResult, len(ops))
+	undo := newWriteUndo[T](len(ops))
+	records := make([]OplogRecord[T], 0, len(ops))
+	applied := make([]int, 0, len(ops))
+	totalSizeKB := 0.0
+	for i, op := range ops {
+		live := db.data.has(op.Key) && !db.isExpired(op.Key)
+		owned, entrySize, err := db.prepareOp(op, live, nil)
+		if err == nil && op.Kind == OpPut && !live {
+			// Purging the expired entries syncs, and would lock the keys
+			// held for the ops: they count until the cleanup removes them.
+			err = db.entryLimitReached(1)
+		}
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		totalSizeKB += entrySize
+		records = append(records, db.applyOp(op, owned, entrySize, live, undo))
+		if op.Kind == OpPut {
+			results[i].Seq = db.data.entry(op.Key).Seq
+		}
+		applied = append(applied, i)
+	}
+	if len(applied) == 0 {
+		return results
+	}
+	err := db.checkSpace(totalSizeKB)
+	if err == nil {
+		err = db.sync()
+	}
+	if err != nil {
+		db.rollback(undo)
+		for _, i := range applied {
+			results[i] = OpResult{Err: err}
+		}
+		return results
+	}
+	db.logOps(records...)
+	return results
+}
+
+// checkSpace is checkAvailableSpace as an error.
+func (db *DB[T]) checkSpace(sizeKB float64) error {
+	isSpaceAvailable, _, err := db.checkAvailableSpace(sizeKB)
+	if err == nil && !isSpaceAvailable {
+		err = dbError.NotAvailabeSpace("")
+	}
+	return err
+}
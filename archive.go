@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"sync"
+	"time"
+)
+
+// ArchivedEntry is one line of the expired entries archive.
+type ArchivedEntry[T any] struct {
+	Key       string    `json:"key"`
+	Entry     DbData[T] `json:"entry"`
+	ExpiredAt time.Time `json:"expired_at"` // when it was removed
+}
+
+// expiredArchive appends expired entries to a JSON Lines file.
+type expiredArchive[T any] struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (a *expiredArchive[T]) append(key string, entry DbData[T]) error {
+	line, err := json.Marshal(ArchivedEntry[T]{Key: key, Entry: entry, ExpiredAt: time.Now()})
+	if err != nil {
+		return dbError.FailedToArchiveEntry(fmt.Sprintf("%s", err))
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	file, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return dbError.FailedToArchiveEntry(fmt.Sprintf("%s", err))
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return dbError.FailedToArchiveEntry(fmt.Sprintf("%s", err))
+	}
+	return nil
+}
+
+// ReadExpiredArchive returns every entry of an archive written with
+// WithExpiredArchive, oldest first. An entry whose removal failed to sync may
+// appear more than once.
+func ReadExpiredArchive[T any](path string) ([]ArchivedEntry[T], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []ArchivedEntry[T]
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*KB), (MaxEntrySizeLimitMB+1)*MB)
+	for scanner.Scan() {
+		var entry ArchivedEntry[T]
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// archiveExpired records an expired entry before it is removed. Without
+// WithExpiredArchive it does nothing.
+func (db *DB[T]) archiveExpired(key string, entry DbData[T]) error {
+	if db.archive == nil {
+		return nil
+	}
+	return db.archive.append(key, entry)
+}
+
+// expireEntry archives and removes one expired entry, then syncs. The entry
+// stays if it can't be archived.
+func (db *DB[T]) expireEntry(key string) error {
+	if err := db.archiveExpired(key, db.data.entry(key)); err != nil {
+		return err
+	}
+	return db.deleteEntry(key, OplogExpire)
+}
+
+// queueExpire asks the write worker to remove key, which a read found
+// expired. Like every write queued by queueFromRead it is registered on the
+// write fence, so later reads of the key see it gone, and dropped if the
+// write queue is full; the cleanup worker removes the entry then.
+func (db *DB[T]) queueExpire(key string) {
+	db.queueFromRead(operation[T]{
+		action:   "expire",
+		key:      key,
+		response: make(chan operationResult[T], 1),
+	})
+}
+
+// queueFromRead hands a write a read needs done to the write worker, without
+// waiting for it.
+func (db *DB[T]) queueFromRead(op operation[T]) {
+	keys := op.keys()
+	op.fenceSeq = db.fence.begin(keys)
+	select {
+	case db.writeOps <- op:
+	default:
+		db.fence.end(keys, op.fenceSeq)
+	}
+}
+
+// expireIfExpired removes key if it is still expired once its turn comes.
+func (db *DB[T]) expireIfExpired(key string) error {
+	if exists := db.data.has(key); !exists || !db.isExpired(key) {
+		return nil
+	}
+	return db.expireEntry(key)
+}
@@ -0,0 +1,95 @@
+package main
+
+import "local-key-value-DB/dbError"
+
+// The async variants queue the operation and return right away with a
+// channel receiving its error (nil on success) once it is applied. Writes
+// are applied in the order they were queued, per key with WithParallelValidation,
+// so a producer can pipeline many operations on the same key and collect
+// the results later. Queueing still waits while the write queue is full,
+// bounded by WithOpTimeout.
+
+func (db *DB[T]) CreateAsync(key string, value DbData[T]) <-chan error {
+	return db.submitWriteAsync(operation[T]{
+		action: "create",
+		key:    key,
+		value:  value,
+	})
+}
+
+func (db *DB[T]) BatchCreateAsync(batchData map[string]DbData[T]) <-chan error {
+	return db.submitWriteAsync(operation[T]{
+		action:    "batchCreate",
+		batchData: batchData,
+	})
+}
+
+func (db *DB[T]) UpdateAsync(key string, value DbData[T]) <-chan error {
+	return db.submitWriteAsync(operation[T]{
+		action: "update",
+		key:    key,
+		value:  value,
+	})
+}
+
+func (db *DB[T]) DeleteAsync(key string) <-chan error {
+	return db.submitWriteAsync(operation[T]{
+		action: "delete",
+		key:    key,
+	})
+}
+
+// ReadAsync queues a read and returns the channel receiving its result. The
+// read sees every write queued before it.
+func (db *DB[T]) ReadAsync(key string) <-chan operationResult[T] {
+	response := make(chan operationResult[T], 1)
+	if db.closed.Load() {
+		response <- operationResult[T]{err: dbError.DBAlreadyClosed("")}
+		close(response)
+		return response
+	}
+	op := operation[T]{
+		action:   "read",
+		key:      key,
+		response: response,
+		fenceSeq: db.fence.last(key),
+	}
+	if err := db.throttle(readKind, op); err != nil {
+		response <- operationResult[T]{err: err}
+		close(response)
+		return response
+	}
+	_, timeout, stop := db.opDeadline()
+	defer stop()
+	if err := db.enqueue(db.readOps, op, timeout); err != nil {
+		response <- operationResult[T]{err: err}
+		close(response)
+	}
+	return response
+}
+
+func (db *DB[T]) submitWriteAsync(op operation[T]) <-chan error {
+	op.errorResp = make(chan error, 1)
+	if db.closed.Load() {
+		op.errorResp <- dbError.DBAlreadyClosed("")
+		close(op.errorResp)
+		return op.errorResp
+	}
+	_, timeout, stop := db.opDeadline()
+	defer stop()
+	queued := false
+	err := db.intercept(op, func(op operation[T]) error {
+		if err := db.enqueueWrite(op, timeout); err != nil {
+			return err
+		}
+		queued = true
+		return nil
+	})
+	// once queued, the worker reports the result; an error a middleware
+	// returns after that is lost
+	if err != nil && !queued {
+		op.errorResp <- err
+		close(op.errorResp)
+	}
+	return op.errorResp
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Authorizer decides whether the caller presenting token may run action
+// ("read", "create", "delete", ...) on key; key is empty for the actions
+// without one, such as "stats". A server in front of the DB calls it before
+// every operation: a nil error lets the operation through, Unauthorized
+// means the token isn't known, AccessDenied that it doesn't cover the
+// operation.
+type Authorizer interface {
+	Authorize(token string, action string, key string) error
+}
+
+// Grant is one rule of a TokenAuthorizer: it allows, or with Deny forbids,
+// Actions on the keys starting with Prefix.
+type Grant struct {
+	Prefix  string   // "" for every key, and for the actions without one
+	Actions []string // nil for every action
+	Deny    bool
+}
+
+func (grant Grant) covers(action string, key string) bool {
+	return strings.HasPrefix(key, grant.Prefix) && (grant.Actions == nil || slices.Contains(grant.Actions, action))
+}
+
+// TokenAuthorizer is an Authorizer holding the grants of every API token.
+// Of the grants of a token covering an operation, the one with the longest
+// Prefix decides, a Deny winning a tie; an operation no grant covers is
+// denied. It is safe for concurrent use, and tokens can be granted and
+// revoked while the server runs.
+type TokenAuthorizer struct {
+	mu     sync.RWMutex
+	tokens map[string][]Grant
+}
+
+// NewTokenAuthorizer returns a TokenAuthorizer knowing no token yet.
+func NewTokenAuthorizer() *TokenAuthorizer {
+	return &TokenAuthorizer{tokens: make(map[string][]Grant)}
+}
+
+// Grant adds grants to token, registering it if needed.
+func (authorizer *TokenAuthorizer) Grant(token string, grants ...Grant) {
+	authorizer.mu.Lock()
+	defer authorizer.mu.Unlock()
+	authorizer.tokens[token] = append(authorizer.tokens[token], grants...)
+}
+
+// Revoke forgets token and its grants.
+func (authorizer *TokenAuthorizer) Revoke(token string) {
+	authorizer.mu.Lock()
+	defer authorizer.mu.Unlock()
+	delete(authorizer.tokens, token)
+}
+
+func (authorizer *TokenAuthorizer) Authorize(token string, action string, key string) error {
+	authorizer.mu.RLock()
+	grants, exists := authorizer.tokens[token]
+	authorizer.mu.RUnlock()
+	if token == "" || !exists {
+		return dbError.Unauthorized("unknown token")
+	}
+	var decision *Grant
+	for i, grant := range grants {
+		if !grant.covers(action, key) {
+			continue
+		}
+		if decision == nil || len(grant.Prefix) > len(decision.Prefix) ||
+			(len(grant.Prefix) == len(decision.Prefix) && grant.Deny) {
+			decision = &grants[i]
+		}
+	}
+	if decision == nil || decision.Deny {
+		return dbError.AccessDenied(fmt.Sprintf("%s on key %q", action, key))
+	}
+	return nil
+}
+
+// AuthorizeHTTP wraps handler so that it only serves the requests whose
+// "Authorization: Bearer <token>" header authorizer allows action for, such
+// as DebugHandler under "debug". The others get 401 or 403.
+func AuthorizeHTTP(authorizer Authorizer, action string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := authorizer.Authorize(bearerToken(r), action, ""); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// bearerToken returns the token of the Authorization header of r, "" if
+// there is none.
+func bearerToken(r *http.Request) string {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backups are snapshots of the whole data set, tombstones included, written
+// to "backup-<UTC time>.json" (".bin" for gob encoded databases) in the
+// backup directory, in the format of the database file: a backup can be
+// opened with OpenPath or copied over the database file as is. Under
+// WithBackupEncryption the file is encrypted and gets an extra ".enc"
+// extension. Each backup comes with a manifest, "<backup>.manifest", that
+// VerifyBackup and RestoreBackup check it against.
+
+const (
+	backupPrefix        = "backup-"
+	encryptedExtension  = ".enc"
+	manifestExtension   = ".manifest"
+	backupFormatVersion = 1 // Of the backup files and their manifest
+)
+
+// BackupManifest describes a backup file, to tell it is complete and
+// untouched.
+type BackupManifest struct {
+	Path          string    `json:"-"`
+	FormatVersion int       `json:"format_version"` // 0 for a backup without manifest
+	CreatedAt     time.Time `json:"created_at"`
+	Seq           uint64    `json:"seq"` // Checkpoint sequence number of the data, see SyncCheckpoint
+	Entries       int       `json:"entries"`
+	SizeBytes     int64     `json:"size_bytes"`
+	Checksum      string    `json:"checksum"` // SHA-256 of the file as written, encrypted if it is
+	Encrypted     bool      `json:"encrypted"`
+}
+
+// BackupStatus is the state of the automatic backups, see WithAutoBackup.
+type BackupStatus struct {
+	Runs     int
+	LastPath string    // Last backup written
+	LastRun  time.Time // Zero before the first run
+	Err      error     // Error of the last run, nil if it succeeded
+	Pruned   int       // Backups removed past the retention, in total
+}
+
+// autoBackup runs Backup every interval and prunes the backups older than
+// retention, see WithAutoBackup.
+type autoBackup struct {
+	dir       string
+	interval  time.Duration
+	retention time.Duration
+	done      chan struct{} // Closed once the backup goroutine returned
+	mu        sync.Mutex    // Protects status
+	status    BackupStatus
+}
+
+func openAutoBackup(dir string, interval time.Duration, retention time.Duration) (*autoBackup, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+	return &autoBackup{dir: dir, interval: interval, retention: retention, done: make(chan struct{})}, nil
+}
+
+// Backup writes a snapshot of the data to a new backup file in dir, created
+// if missing, next to its manifest, and returns its path. It goes through the admin lane, so the
+// snapshot is consistent: no write is half applied.
+func (db *DB[T]) Backup(dir string) (string, error) {
+	if db.closed.Load() {
+		return "", dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "backup",
+		key:      dir,
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submit(db.adminOps, op)
+	if result.err != nil {
+		return "", result.err
+	}
+	return result.keys[0], nil
+}
+
+func (db *DB[T]) backup(dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+	target := &LocalStorage[T]{seq: db.Checkpoint().Seq}
+	if local, ok := db.localStorage(); ok {
+		target.binary = local.binary
+		target.header = local.header
+	}
+	manifest := BackupManifest{FormatVersion: backupFormatVersion, CreatedAt: time.Now().UTC(), Seq: target.seq}
+	extension := ".json"
+	if target.binary {
+		extension = ".bin"
+	}
+	data := db.persisted()
+	manifest.Entries = len(data)
+	var encoded bytes.Buffer
+	if err := target.encode(&encoded, data); err != nil {
+		return "", dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	contents := encoded.Bytes()
+	if key := db.opts().backupKey; key != nil {
+		encrypted, err := encryptBackup(key, contents)
+		if err != nil {
+			return "", err
+		}
+		contents = encrypted
+		manifest.Encrypted = true
+		extension += encryptedExtension
+	}
+	checksum := sha256.Sum256(contents)
+	manifest.Checksum = hex.EncodeToString(checksum[:])
+	manifest.SizeBytes = int64(len(contents))
+	manifest.Path = filepath.Join(dir, backupPrefix+manifest.CreatedAt.Format(generationTimeFormat)+extension)
+	encodedManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	// the manifest last: a backup without one is incomplete
+	if err := writeBytesAtomically(manifest.Path, contents); err != nil {
+		return "", err
+	}
+	if err := writeBytesAtomically(manifest.Path+manifestExtension, encodedManifest); err != nil {
+		return "", err
+	}
+	return manifest.Path, nil
+}
+
+func writeBytesAtomically(path string, contents []byte) error {
+	if err := writeFileAtomically(path, func(file *os.File) error {
+		_, err := file.Write(contents)
+		return err
+	}); err != nil {
+		return dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	return nil
+}
+
+// encryptBackup seals contents with AES-GCM under key, the nonce first.
+func encryptBackup(key []byte, contents []byte) ([]byte, error) {
+	gcm, err := backupCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(contents)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	return gcm.Seal(nonce, nonce, contents, nil), nil
+}
+
+// decryptBackup opens what encryptBackup sealed.
+func decryptBackup(key []byte, encrypted []byte) ([]byte, error) {
+	gcm, err := backupCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(encrypted) < gcm.NonceSize() {
+		return nil, dbError.BackupCorrupted("encrypted backup is truncated")
+	}
+	contents, err := gcm.Open(nil, encrypted[:gcm.NonceSize()], encrypted[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, dbError.InvalidBackupKey("wrong key or tampered backup")
+	}
+	return contents, nil
+}
+
+func backupCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, dbError.InvalidBackupKey(fmt.Sprintf("%s", err))
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, dbError.InvalidBackupKey(fmt.Sprintf("%s", err))
+	}
+	return gcm, nil
+}
+
+// ListBackups returns the backups in the directory of WithAutoBackup,
+// oldest first, with their manifest. A backup without one only has its Path
+// and CreatedAt set.
+func (db *DB[T]) ListBackups() ([]BackupManifest, error) {
+	dir := db.opts().backupDir
+	if dir == "" {
+		return nil, dbError.BackupNotEnabled("see WithAutoBackup")
+	}
+	paths, err := backupPaths(dir)
+	if err != nil {
+		return nil, err
+	}
+	manifests := make([]BackupManifest, 0, len(paths))
+	for _, path := range paths {
+		manifest, err := readBackupManifest(path)
+		if err != nil {
+			manifest = BackupManifest{Path: path}
+			manifest.CreatedAt, _ = backupTime(path)
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// VerifyBackup checks the backup at path against its manifest: size,
+// checksum, and, once decrypted and decoded, the entry count and the schema
+// of T. It fails with BackupCorrupted, InvalidBackupKey or ErrTypeMismatch.
+func (db *DB[T]) VerifyBackup(path string) (BackupManifest, error) {
+	manifest, _, err := db.readBackup(path)
+	return manifest, err
+}
+
+// RestoreBackup verifies the backup at path, as VerifyBackup does, and
+// writes its data to the new database file fileName in dir. The live
+// database is left untouched.
+func (db *DB[T]) RestoreBackup(path string, fileName string, dir string) error {
+	_, data, err := db.readBackup(path)
+	if err != nil {
+		return err
+	}
+	return restoreInto(data, fileName, dir)
+}
+
+// RestoreInPlace verifies the backup at path, as VerifyBackup does, and
+// replaces the live data with it, tombstones included, with a single sync:
+// the keys missing from the backup are removed, immutable ones too, and the
+// others take the version of the backup. See PlanRestore for what it would
+// change. It goes through the admin lane, see WithAdminPriority.
+func (db *DB[T]) RestoreInPlace(path string) error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	if db.readOnly.Load() {
+		return dbError.ReadOnlyDatabase("restore")
+	}
+	op := operation[T]{
+		action:   "restoreInPlace",
+		key:      path,
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submit(db.adminOps, op).err
+}
+
+func (db *DB[T]) restoreInPlace(path string) error {
+	_, restored, err := db.readBackup(path)
+	if err != nil {
+		return err
+	}
+	previous := db.persisted()
+	keys := slices.Collect(maps.Keys(previous))
+	for key := range restored {
+		if _, exists := previous[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	unlock := db.lockKeys(keys)
+	defer unlock()
+	db.replaceData(restored, previous, db.setEntry, db.setTombstone)
+	if err := db.sync(); err != nil {
+		db.replaceData(previous, nil, db.setLoaded, db.setLoaded) // rollback
+		return err
+	}
+	records := make([]OplogRecord[T], 0, len(keys))
+	for key, entry := range previous {
+		if restoredEntry, kept := restored[key]; entry.Deleted_at == nil && (!kept || restoredEntry.Deleted_at != nil) {
+			records = append(records, OplogRecord[T]{Op: OplogDelete, Key: key})
+		}
+	}
+	for key, entry := range restored {
+		if entry.Deleted_at != nil {
+			continue
+		}
+		if previousEntry, exists := previous[key]; exists && sameData(previousEntry, entry) {
+			continue
+		}
+		records = append(records, entryRecord(OplogCreate, key, db.data.entry(key)))
+	}
+	db.logOps(records...)
+	return nil
+}
+
+// replaceData makes data, tombstones included, the whole content of the DB,
+// storing the entries with set and the tombstones with setTombstone. The
+// ones holding the same data in previous are left as they are.
+func (db *DB[T]) replaceData(data map[string]DbData[T], previous map[string]DbData[T], set func(string, DbData[T]), setTombstone func(string, DbData[T])) {
+	for _, key := range db.data.keys() {
+		if entry, kept := data[key]; !kept || entry.Deleted_at != nil {
+			db.removeEntry(key)
+		}
+	}
+	for key := range db.tombstones {
+		if entry, kept := data[key]; !kept || entry.Deleted_at == nil {
+			db.removeTombstone(key)
+		}
+	}
+	for key, entry := range data {
+		if previousEntry, exists := previous[key]; exists && sameData(previousEntry, entry) {
+			continue
+		}
+		if entry.Deleted_at != nil {
+			setTombstone(key, entry)
+		} else {
+			set(key, entry)
+		}
+	}
+}
+
+func readBackupManifest(path string) (BackupManifest, error) {
+	encoded, err := os.ReadFile(path + manifestExtension)
+	if err != nil {
+		return BackupManifest{}, dbError.BackupCorrupted(fmt.Sprintf("no manifest: %s", err))
+	}
+	manifest := BackupManifest{}
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return BackupManifest{}, dbError.BackupCorrupted(fmt.Sprintf("invalid manifest: %s", err))
+	}
+	manifest.Path = path
+	return manifest, nil
+}
+
+// readBackup verifies the backup at path and decodes its data.
+func (db *DB[T]) readBackup(path string) (BackupManifest, map[string]DbData[T], error) {
+	manifest, err := readBackupManifest(path)
+	if err != nil {
+		return manifest, nil, err
+	}
+	if manifest.FormatVersion > backupFormatVersion {
+		return manifest, nil, dbError.BackupCorrupted(fmt.Sprintf("format version %d is newer than %d", manifest.FormatVersion, backupFormatVersion))
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return manifest, nil, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	checksum := sha256.Sum256(contents)
+	if int64(len(contents)) != manifest.SizeBytes || hex.EncodeToString(checksum[:]) != manifest.Checksum {
+		return manifest, nil, dbError.BackupCorrupted(fmt.Sprintf("%s does not match its manifest checksum", path))
+	}
+	if manifest.Encrypted {
+		key := db.opts().backupKey
+		if key == nil {
+			return manifest, nil, dbError.InvalidBackupKey("the backup is encrypted, see WithBackupEncryption")
+		}
+		if contents, err = decryptBackup(key, contents); err != nil {
+			return manifest, nil, err
+		}
+	}
+	data := make(map[string]DbData[T])
+	var header *schemaHeader
+	if filepath.Ext(strings.TrimSuffix(path, encryptedExtension)) == ".bin" {
+		header, err = decodeGobFile(bytes.NewReader(contents), &data)
+	} else {
+		header, err = decodeJSONFile(bytes.NewReader(contents), &data)
+	}
+	if err != nil {
+		return manifest, nil, dbError.BackupCorrupted(fmt.Sprintf("%s", err))
+	}
+	if header != nil {
+		if err := header.check(schemaOf[T]()); err != nil {
+			return manifest, nil, err
+		}
+	}
+	if len(data) != manifest.Entries {
+		return manifest, nil, dbError.BackupCorrupted(fmt.Sprintf("%d entries, the manifest says %d", len(data), manifest.Entries))
+	}
+	return manifest, data, nil
+}
+
+// backupPaths lists the backup files in dir, oldest first.
+func backupPaths(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, backupPrefix+"*"))
+	if err != nil {
+		return nil, dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
+	}
+	backups := paths[:0]
+	for _, path := range paths {
+		if _, ok := backupTime(path); ok {
+			backups = append(backups, path)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// backupTime is when the backup at path was taken, from its name. Files
+// other than backups, such as manifests, are not.
+func backupTime(path string) (time.Time, bool) {
+	name := strings.TrimPrefix(filepath.Base(path), backupPrefix)
+	if len(name) < len(generationTimeFormat) {
+		return time.Time{}, false
+	}
+	switch strings.TrimSuffix(name[len(generationTimeFormat):], encryptedExtension) {
+	case ".json", ".bin":
+	default:
+		return time.Time{}, false
+	}
+	at, err := time.Parse(generationTimeFormat, name[:len(generationTimeFormat)])
+	return at, err == nil
+}
+
+// pruneBackups removes the backups in dir taken more than retention before
+// now, with their manifest, always keeping the newest one, and returns how
+// many it removed.
+func pruneBackups(dir string, retention time.Duration, now time.Time) (int, error) {
+	paths, err := backupPaths(dir)
+	if err != nil || len(paths) == 0 {
+		return 0, err
+	}
+	pruned := 0
+	for _, path := range paths[:len(paths)-1] {
+		if at, _ := backupTime(path); now.Sub(at) <= retention {
+			break // the next ones are newer
+		}
+		if err := os.Remove(path); err != nil {
+			return pruned, dbError.FailedToDeleteFile(fmt.Sprintf("%s", err))
+		}
+		if err := os.Remove(path + manifestExtension); err != nil && !os.IsNotExist(err) {
+			return pruned, dbError.FailedToDeleteFile(fmt.Sprintf("%s", err))
+		}
+		pruned++
+	}
+	return pruned, nil
+}
+
+// runAutoBackup takes a backup every interval until the DB closes.
+func (db *DB[T]) runAutoBackup() {
+	defer close(db.backups.done)
+	ticker := time.NewTicker(db.backups.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.closeCh:
+			return
+		}
+		path, err := db.Backup(db.backups.dir)
+		pruned := 0
+		if err == nil && db.backups.retention > 0 {
+			pruned, err = pruneBackups(db.backups.dir, db.backups.retention, time.Now())
+		}
+		if err != nil {
+			db.recordError(operation[T]{action: "backup"}, err)
+		}
+		db.backups.mu.Lock()
+		status := &db.backups.status
+		status.Runs++
+		status.LastRun = time.Now()
+		status.Err = err
+		status.Pruned += pruned
+		if path != "" {
+			status.LastPath = path
+		}
+		db.backups.mu.Unlock()
+	}
+}
+
+// LastBackup returns the state of the automatic backups, the zero status
+// without WithAutoBackup.
+func (db *DB[T]) LastBackup() BackupStatus {
+	if db.backups == nil {
+		return BackupStatus{}
+	}
+	db.backups.mu.Lock()
+	defer db.backups.mu.Unlock()
+	return db.backups.status
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+	"sort"
+)
+
+// ConflictPolicy says what a create does with the keys that already hold a
+// live entry, and with the entries rejected, see WithCreatePolicy. Expired
+// entries are always replaced.
+type ConflictPolicy int
+
+const (
+	FailAll      ConflictPolicy = iota // Reject the whole batch if any key exists or any entry is invalid, the default
+	SkipExisting                       // Keep the existing entries, create the other valid ones
+	Overwrite                          // Replace the existing entries, create the other valid ones
+)
+
+// Per-key outcomes of a batch create.
+const (
+	BatchCreated     = "created"
+	BatchSkipped     = "skipped"     // the key exists, see SkipExisting
+	BatchOverwritten = "overwritten" // see Overwrite
+	BatchFailed      = "failed"      // the entry was rejected, see BatchEntryResult.Err
+	BatchAborted     = "aborted"     // valid, but not applied since the batch as a whole failed
+
+	batchPending = "" // valid, until the batch is applied
+)
+
+// BatchEntryResult is what a batch create did with one key.
+type BatchEntryResult struct {
+	Status string
+	Err    error // Why the entry was rejected, with BatchFailed: the typed dbError of the size, key or TTL rule it broke
+}
+
+// BatchResult reports a batch create key by key. Err is set when the batch as
+// a whole failed: nothing was applied then.
+type BatchResult struct {
+	Entries map[string]BatchEntryResult
+	Applied int // Created or overwritten
+	Skipped int
+	Failed  int // Rejected entries
+	Aborted int // Valid entries of a batch that failed as a whole
+	Err     error
+}
+
+// FailedKeys returns the keys of the rejected entries, sorted, to fix and
+// retry them.
+func (result BatchResult) FailedKeys() []string {
+	var keys []string
+	for key, entry := range result.Entries {
+		if entry.Status == BatchFailed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (result *BatchResult) set(key string, status string, err error) {
+	result.Entries[key] = BatchEntryResult{Status: status, Err: err}
+}
+
+// abort fails the whole batch with err: every valid entry is reported
+// aborted.
+func (result *BatchResult) abort(err error) BatchResult {
+	for key, entry := range result.Entries {
+		if entry.Status == batchPending {
+			result.set(key, BatchAborted, nil)
+		}
+	}
+	result.Err = err
+	result.summarize()
+	return *result
+}
+
+func (result *BatchResult) summarize() {
+	result.Applied, result.Skipped, result.Failed, result.Aborted = 0, 0, 0, 0
+	for _, entry := range result.Entries {
+		switch entry.Status {
+		case BatchCreated, BatchOverwritten:
+			result.Applied++
+		case BatchSkipped:
+			result.Skipped++
+		case BatchFailed:
+			result.Failed++
+		case BatchAborted:
+			result.Aborted++
+		}
+	}
+}
+
+// BatchCreateWithPolicy is BatchCreate with a choice of what to do with the
+// keys that exist already and with invalid entries, reporting the outcome for
+// every key.
+func (db *DB[T]) BatchCreateWithPolicy(batchData map[string]DbData[T], policy ConflictPolicy) BatchResult {
+	if db.closed.Load() {
+		return BatchResult{Err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:    "batchCreate",
+		batchData: batchData,
+		policy:    policy,
+		response:  make(chan operationResult[T], 1),
+	}
+	result := db.submitWrite(op)
+	if result.batch == nil {
+		return BatchResult{Err: result.err}
+	}
+	return *result.batch
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"slices"
+	"time"
+)
+
+// Kinds of Op.
+const (
+	OpPut    = "put"    // Creates the key or replaces its entry
+	OpDelete = "delete" // Removes the key, which must hold a live entry
+)
+
+// Op is one write of a BatchWrite.
+type Op[T any] struct {
+	Kind  string
+	Key   string
+	Entry DbData[T] // OpPut only
+}
+
+// PutOp creates key, or replaces its entry, with entry.
+func PutOp[T any](key string, entry DbData[T]) Op[T] {
+	return Op[T]{Kind: OpPut, Key: key, Entry: entry}
+}
+
+// DeleteOp removes key.
+func DeleteOp[T any](key string) Op[T] {
+	return Op[T]{Kind: OpDelete, Key: key}
+}
+
+// Conditions of a Precondition. An expired entry counts as absent.
+const (
+	CondExists = "exists" // The key holds a live entry
+	CondAbsent = "absent" // The key holds no live entry
+	CondSeq    = "seq"    // The key holds a live entry with the given Seq
+)
+
+// Precondition is a check on the current state of a key that a BatchWrite
+// must pass to be applied.
+type Precondition struct {
+	Key  string
+	Cond string
+	Seq  uint64 // CondSeq only, see DbData.Seq
+}
+
+// KeyExists requires key to hold a live entry.
+func KeyExists(key string) Precondition {
+	return Precondition{Key: key, Cond: CondExists}
+}
+
+// KeyAbsent requires key to hold no live entry.
+func KeyAbsent(key string) Precondition {
+	return Precondition{Key: key, Cond: CondAbsent}
+}
+
+// VersionEquals requires key to hold a live entry last written at sequence
+// number seq, as read from its Seq: nobody wrote it since.
+func VersionEquals(key string, seq uint64) Precondition {
+	return Precondition{Key: key, Cond: CondSeq, Seq: seq}
+}
+
+// BatchWrite applies ops all together, with a single sync, if every
+// precondition holds; otherwise, or if any op is invalid, nothing is applied.
+// Preconditions are checked on the write worker right before the ops are
+// applied, so no other write runs in between: this keeps invariants spanning
+// several keys without a transaction. A key may appear in one op only.
+func (db *DB[T]) BatchWrite(ops []Op[T], preconditions []Precondition) error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	if len(ops) > BatchLimit {
+		return dbError.BatchLimitCountExceeds("")
+	}
+	keys := make([]string, 0, len(ops)+len(preconditions))
+	seen := make(map[string]bool, cap(keys))
+	for _, op := range ops {
+		if seen[op.Key] {
+			return dbError.InvalidBatch(fmt.Sprintf("key : %s appears in more than one op", op.Key))
+		}
+		seen[op.Key] = true
+		keys = append(keys, op.Key)
+	}
+	for _, precondition := range preconditions {
+		if !seen[precondition.Key] {
+			seen[precondition.Key] = true
+			keys = append(keys, precondition.Key)
+		}
+	}
+	op := operation[T]{
+		action:        "batchWrite",
+		batchKeys:     keys,
+		batchOps:      ops,
+		preconditions: preconditions,
+		response:      make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op).err
+}
+
+// checkPrecondition fails with PreconditionFailed unless precondition holds.
+func (db *DB[T]) checkPrecondition(precondition Precondition) error {
+	entry, exists := db.data.get(precondition.Key)
+	live := exists && !db.isExpired(precondition.Key)
+	switch precondition.Cond {
+	case CondExists:
+		if !live {
+			return dbError.PreconditionFailed(fmt.Sprintf("key : %s does not exist", precondition.Key))
+		}
+	case CondAbsent:
+		if live {
+			return dbError.PreconditionFailed(fmt.Sprintf("key : %s exists", precondition.Key))
+		}
+	case CondSeq:
+		if !live {
+			return dbError.PreconditionFailed(fmt.Sprintf("key : %s does not exist", precondition.Key))
+		}
+		if entry.Seq != precondition.Seq {
+			return dbError.PreconditionFailed(fmt.Sprintf("key : %s is at seq %d, expected %d", precondition.Key, entry.Seq, precondition.Seq))
+		}
+	default:
+		return dbError.InvalidBatch(fmt.Sprintf("unknown precondition %q", precondition.Cond))
+	}
+	return nil
+}
+
+// batchWrite checks the preconditions and ops, then applies the ops and
+// syncs once, rolling all of them back if the sync fails. The caller holds
+// the per-key locks of every key involved.
+func (db *DB[T]) batchWrite(ops []Op[T], preconditions []Precondition) error {
+	for _, precondition := range preconditions {
+		if err := db.checkPrecondition(precondition); err != nil {
+			return err
+		}
+	}
+	totalSizeKB := 0.0
+	created := 0
+	owned := make([]DbData[T], len(ops))
+	sizesKB := make([]float64, len(ops))
+	wasLive := make([]bool, len(ops))
+	hashes := make(map[valueHash]string) // values of the batch, for WithUniqueValues
+	for i, op := range ops {
+		wasLive[i] = db.data.has(op.Key) && !db.isExpired(op.Key)
+		entry, entrySize, err := db.prepareOp(op, wasLive[i], hashes)
+		if err != nil {
+			return err
+		}
+		owned[i] = entry
+		sizesKB[i] = entrySize
+		totalSizeKB += entrySize
+		if op.Kind == OpDelete {
+			created--
+		} else if !wasLive[i] {
+			created++
+		}
+	}
+	held := func(key string) bool {
+		return slices.ContainsFunc(ops, func(op Op[T]) bool { return op.Key == key }) ||
+			slices.ContainsFunc(preconditions, func(precondition Precondition) bool { return precondition.Key == key })
+	}
+	if err := db.checkEntryLimit(created, held); err != nil {
+		return err
+	}
+	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(totalSizeKB)
+	if spaceErr != nil {
+		return spaceErr
+	}
+	if !isSpaceAvailable {
+		return dbError.BatchSizeLimitCrossed("")
+	}
+
+	undo := newWriteUndo[T](len(ops))
+	records := make([]OplogRecord[T], 0, len(ops))
+	for i, op := range ops {
+		records = append(records, db.applyOp(op, owned[i], sizesKB[i], wasLive[i], undo))
+	}
+	if err := db.sync(); err != nil {
+		db.rollback(undo)
+		return err
+	}
+	db.logOps(records...)
+	return nil
+}
+
+// prepareOp checks op against the current state of its key, live or not,
+// and returns the entry an OpPut stores, along with its size. hashes holds
+// the values of the other puts of the batch, for WithUniqueValues, nil if
+// they are applied already.
+func (db *DB[T]) prepareOp(op Op[T], live bool, hashes map[valueHash]string) (DbData[T], float64, error) {
+	if err := db.checkMutable(op.Key); err != nil {
+		return DbData[T]{}, 0, err
+	}
+	switch op.Kind {
+	case OpPut:
+		entrySize, err := db.validateEntry(op.Key, op.Entry)
+		if err == nil {
+			err = db.validate(op.Key, op.Entry.Value)
+		}
+		if err == nil {
+			err = db.checkUnique(op.Key, op.Entry, hashes)
+		}
+		if err != nil {
+			return DbData[T]{}, 0, err
+		}
+		owned, err := db.ownCopy(op.Entry)
+		if err != nil {
+			return DbData[T]{}, 0, err
+		}
+		owned.Deleted_at = nil // only the DB makes tombstones
+		owned.Pinned = live && db.data.entry(op.Key).Pinned
+		owned.Immutable = owned.Immutable && !live
+		return owned, entrySize, nil
+	case OpDelete:
+		if !live {
+			return DbData[T]{}, 0, dbError.KeyNotFound(fmt.Sprintf("key : %s", op.Key))
+		}
+		return DbData[T]{}, 0, nil
+	default:
+		return DbData[T]{}, 0, dbError.InvalidBatch(fmt.Sprintf("unknown op %q", op.Kind))
+	}
+}
+
+// applyOp applies an op prepareOp passed, owned being the entry it returned
+// and sizeKB its size, saves what the key held before in undo and returns the
+// oplog record of the op.
+func (db *DB[T]) applyOp(op Op[T], owned DbData[T], sizeKB float64, live bool, undo *writeUndo[T]) OplogRecord[T] {
+	undo.save(db, op.Key)
+	previous, _ := db.data.get(op.Key)
+	db.removeTombstone(op.Key)
+	if op.Kind == OpDelete {
+		db.removeEntry(op.Key)
+		if db.opts().softDelete {
+			deletedAt := time.Now()
+			previous.Deleted_at = &deletedAt
+			db.setTombstone(op.Key, previous)
+		}
+		return OplogRecord[T]{Op: OplogDelete, Key: op.Key}
+	}
+	db.setEntry(op.Key, owned)
+	if live {
+		return sizedRecord(OplogUpdate, op.Key, owned, sizeKB)
+	}
+	return sizedRecord(OplogCreate, op.Key, owned, sizeKB)
+}
+
+// writeUndo is what the keys written by a batch held before it, to roll the
+// batch back if its sync fails. Only the first write of a key saves it.
+type writeUndo[T any] struct {
+	keys     map[string]bool
+	previous map[string]DbData[T] // entries replaced or removed
+	replaced map[string]DbData[T] // tombstones replaced
+}
+
+func newWriteUndo[T any](size int) *writeUndo[T] {
+	return &writeUndo[T]{
+		keys:     make(map[string]bool, size),
+		previous: make(map[string]DbData[T], size),
+		replaced: make(map[string]DbData[T]),
+	}
+}
+
+func (undo *writeUndo[T]) save(db *DB[T], key string) {
+	if undo.keys[key] {
+		return
+	}
+	undo.keys[key] = true
+	if entry, exists := db.data.get(key); exists {
+		undo.previous[key] = entry
+	}
+	if tombstone, exists := db.tombstones[key]; exists {
+		undo.replaced[key] = tombstone
+	}
+}
+
+// rollback puts back what the keys held before the batch undo saved them for.
+func (db *DB[T]) rollback(undo *writeUndo[T]) {
+	for key := range undo.keys {
+		db.removeTombstone(key)
+		if entry, existed := undo.previous[key]; existed {
+			db.setEntry(key, entry)
+		} else {
+			db.removeEntry(key)
+		}
+	}
+	for key, tombstone := range undo.replaced {
+		db.setTombstone(key, tombstone)
+	}
+}
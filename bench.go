@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Benchmark workloads, shared by the Go benchmarks and `kvcli bench`.
+const (
+	benchCreate = "create"
+	benchRead   = "read"
+	benchBatch  = "batch"
+	benchMixed  = "mixed"
+)
+
+var benchWorkloads = []string{benchCreate, benchRead, benchBatch, benchMixed}
+
+// benchPopulation is how many entries the read and mixed workloads work on.
+const benchPopulation = 1000
+
+// benchBatchSize is how many entries one op of the batch workload creates.
+const benchBatchSize = 10
+
+// BenchResult is the outcome of one workload run, as printed by kvcli bench.
+type BenchResult struct {
+	Workload  string          `json:"workload"`
+	Ops       int             `json:"ops"`
+	Workers   int             `json:"workers"`
+	Errors    int             `json:"errors"`
+	Seconds   float64         `json:"seconds"`
+	OpsPerSec float64         `json:"ops_per_sec"`
+	P50Micros float64         `json:"p50_us"`
+	P90Micros float64         `json:"p90_us"`
+	P99Micros float64         `json:"p99_us"`
+	MaxMicros float64         `json:"max_us"`
+	Histogram []LatencyBucket `json:"histogram"`
+}
+
+// LatencyBucket counts the operations that took longer than the bucket
+// before and up to UpToMicros. Buckets double, from 1µs.
+type LatencyBucket struct {
+	UpToMicros float64 `json:"le_us"`
+	Count      int     `json:"count"`
+}
+
+// prepareBenchmark loads the entries the workload reads and updates.
+func prepareBenchmark(db *DB[TestVal], workload string) error {
+	if workload != benchRead && workload != benchMixed {
+		return nil
+	}
+	return populateBenchmark(db, "bench")
+}
+
+// populateBenchmark creates the benchPopulation entries read by the
+// benchmarks, named name.
+func populateBenchmark(db *DB[TestVal], name string) error {
+	batch := make(map[string]DbData[TestVal], BatchLimit)
+	for i := 0; i < benchPopulation; i++ {
+		batch[benchKey(i)] = TestEntry(name, i, "")
+		if len(batch) == BatchLimit || i == benchPopulation-1 {
+			if err := db.BatchCreate(batch).err; err != nil {
+				return err
+			}
+			batch = make(map[string]DbData[TestVal], BatchLimit)
+		}
+	}
+	return nil
+}
+
+func benchKey(i int) string {
+	return fmt.Sprintf("bench-%d", i)
+}
+
+// benchOp runs the i-th operation of the workload. The mixed workload is 80%
+// reads, 15% updates and 5% creates.
+func benchOp(db *DB[TestVal], workload string, i int) error {
+	switch workload {
+	case benchCreate:
+		return db.Create(benchKey(i), TestEntry("bench", i, "")).err
+	case benchRead:
+		return db.Read(benchKey(i % benchPopulation)).err
+	case benchBatch:
+		batch := make(map[string]DbData[TestVal], benchBatchSize)
+		for j := 0; j < benchBatchSize; j++ {
+			batch[benchKey(i*benchBatchSize+j)] = TestEntry("bench", j, "")
+		}
+		return db.BatchCreate(batch).err
+	case benchMixed:
+		switch {
+		case i%20 == 0:
+			return db.Create(benchKey(benchPopulation+i), TestEntry("bench", i, "")).err
+		case i%20 < 4:
+			return db.Update(benchKey(i%benchPopulation), TestEntry("bench", i, "")).err
+		default:
+			return db.Read(benchKey(i % benchPopulation)).err
+		}
+	default:
+		return fmt.Errorf("unknown workload %q", workload)
+	}
+}
+
+// runBenchmark runs ops operations of the workload from workers goroutines,
+// timing each of them.
+func runBenchmark(db *DB[TestVal], workload string, ops int, workers int) (BenchResult, error) {
+	if !slices.Contains(benchWorkloads, workload) {
+		return BenchResult{}, fmt.Errorf("unknown workload %q", workload)
+	}
+	if err := prepareBenchmark(db, workload); err != nil {
+		return BenchResult{}, err
+	}
+	workers = max(workers, 1)
+	latencies := make([]time.Duration, ops)
+	var next, failed atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= ops {
+					return
+				}
+				opStart := time.Now()
+				if benchOp(db, workload, i) != nil {
+					failed.Add(1)
+				}
+				latencies[i] = time.Since(opStart)
+			}
+		}()
+	}
+	wg.Wait()
+	return summarizeBenchmark(workload, workers, latencies, int(failed.Load()), time.Since(start)), nil
+}
+
+// summarizeBenchmark sums up the latencies of a run, in any order, into its
+// result.
+func summarizeBenchmark(workload string, workers int, latencies []time.Duration, errors int, elapsed time.Duration) BenchResult {
+	slices.Sort(latencies)
+	ops := len(latencies)
+	result := BenchResult{
+		Workload: workload,
+		Ops:      ops,
+		Workers:  workers,
+		Errors:   errors,
+		Seconds:  elapsed.Seconds(),
+	}
+	if ops == 0 {
+		return result
+	}
+	micros := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Microsecond)
+	}
+	result.OpsPerSec = float64(ops) / elapsed.Seconds()
+	result.P50Micros = micros(latencies[ops*50/100])
+	result.P90Micros = micros(latencies[ops*90/100])
+	result.P99Micros = micros(latencies[ops*99/100])
+	result.MaxMicros = micros(latencies[ops-1])
+	bound := time.Microsecond
+	for i := 0; i < ops; bound *= 2 {
+		bucket := LatencyBucket{UpToMicros: micros(bound)}
+		for ; i < ops && latencies[i] <= bound; i++ {
+			bucket.Count++
+		}
+		if bucket.Count > 0 || len(result.Histogram) > 0 {
+			result.Histogram = append(result.Histogram, bucket)
+		}
+	}
+	return result
+}
+
+// runLoadBenchmark creates writes entries of about valueSize bytes from
+// writers goroutines while readers goroutines keep reading the
+// benchPopulation entries created first, and returns the results of the
+// writes and of the reads.
+func runLoadBenchmark(db *DB[TestVal], writes int, writers int, readers int, valueSize int) ([]BenchResult, error) {
+	value := strings.Repeat("x", max(valueSize, 1))
+	if err := populateBenchmark(db, value); err != nil {
+		return nil, err
+	}
+	writers = max(writers, 1)
+	writeLatencies := make([]time.Duration, writes)
+	readLatencies := make([][]time.Duration, readers)
+	var next, writeErrors, readErrors atomic.Int64
+	var writesDone atomic.Bool
+	var writing, reading sync.WaitGroup
+	start := time.Now()
+	for r := 0; r < readers; r++ {
+		reading.Add(1)
+		go func() {
+			defer reading.Done()
+			random := rand.New(rand.NewSource(int64(r)))
+			for !writesDone.Load() {
+				opStart := time.Now()
+				if db.Read(benchKey(random.Intn(benchPopulation))).err != nil {
+					readErrors.Add(1)
+				}
+				readLatencies[r] = append(readLatencies[r], time.Since(opStart))
+			}
+		}()
+	}
+	for w := 0; w < writers; w++ {
+		writing.Add(1)
+		go func() {
+			defer writing.Done()
+			for {
+				i := int(next.Add(1) - 1)
+				if i >= writes {
+					return
+				}
+				opStart := time.Now()
+				if db.Create(benchKey(benchPopulation+i), TestEntry(value, i, "")).err != nil {
+					writeErrors.Add(1)
+				}
+				writeLatencies[i] = time.Since(opStart)
+			}
+		}()
+	}
+	writing.Wait()
+	elapsed := time.Since(start)
+	writesDone.Store(true)
+	reading.Wait()
+
+	results := []BenchResult{summarizeBenchmark("write", writers, writeLatencies, int(writeErrors.Load()), elapsed)}
+	if readers > 0 {
+		results = append(results, summarizeBenchmark("read", readers, slices.Concat(readLatencies...), int(readErrors.Load()), elapsed))
+	}
+	return results, nil
+}
+
+// replayBenchmark applies the records of an oplog, as recorded by WithOplog,
+// to db from workers goroutines as fast as they go, timing each of them. The
+// records of a key are all applied by the same goroutine, in order. Entries
+// are moved in time as if the oplog started now, so they don't come out
+// expired.
+func replayBenchmark(db *DB[json.RawMessage], records []OplogRecord[json.RawMessage], workers int) BenchResult {
+	workers = max(workers, 1)
+	latencies := make([]time.Duration, len(records))
+	var failed atomic.Int64
+	var shift time.Duration
+	if len(records) > 0 {
+		shift = time.Since(records[0].Timestamp)
+	}
+	queues := make([]chan int, workers)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := range queues {
+		queues[w] = make(chan int, 64)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queues[w] {
+				opStart := time.Now()
+				if replayRecord(db, records[i], shift) != nil {
+					failed.Add(1)
+				}
+				latencies[i] = time.Since(opStart)
+			}
+		}()
+	}
+	for i, record := range records {
+		hash := fnv.New32a()
+		hash.Write([]byte(record.Key))
+		queues[hash.Sum32()%uint32(workers)] <- i
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+	return summarizeBenchmark("replay", workers, latencies, int(failed.Load()), time.Since(start))
+}
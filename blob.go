@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blobs: with WithBlobDir, CreateFromReader streams a large value into a file
+// of its own in the blob directory instead of the data file, and the entry
+// only references it. Only CreateFromReader sets that reference: the one of
+// any other write is dropped, the caller can't point an entry at a file of
+// its own. The blob counts towards the entry size limit and the
+// storage limit like an inline value. Blob files are never rewritten; the
+// ones no entry, tombstone or rotated generation references anymore are
+// removed by Compact.
+
+const blobSuffix = ".blob"
+
+// BlobRef is the reference an entry holds to its blob file.
+type BlobRef struct {
+	File string `json:"file"` // Name of the file in the blob directory
+	Size int64  `json:"size"`
+}
+
+// blobStore tracks the blob files written but not referenced by an entry
+// yet, which Compact must not collect.
+type blobStore struct {
+	dir     string
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func openBlobStore(dir string) (*blobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+	return &blobStore{dir: dir, pending: make(map[string]bool)}, nil
+}
+
+// CreateFromReader creates key with a value streamed from reader into a blob
+// file, without holding it in memory. It needs WithBlobDir. The entry's
+// Value is left zero; read the blob back with ReadToWriter.
+func (db *DB[T]) CreateFromReader(key string, reader io.Reader) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	if db.blobs == nil {
+		return operationResult[T]{err: dbError.BlobsNotEnabled("")}
+	}
+	ref, err := db.blobs.write(reader, db.entryLimitKB(key))
+	if err != nil {
+		return operationResult[T]{err: err}
+	}
+	defer db.blobs.settle(ref.File)
+	result := db.submitWrite(operation[T]{
+		action:   "create",
+		key:      key,
+		value:    DbData[T]{Created_at: time.Now()},
+		policy:   db.opts().createPolicy,
+		blob:     &ref,
+		response: make(chan operationResult[T], 1),
+	})
+	if result.err != nil {
+		os.Remove(filepath.Join(db.blobs.dir, ref.File))
+	}
+	return result
+}
+
+// ReadToWriter copies the blob of key to writer. It fails with NotABlob if
+// key holds an inline value.
+func (db *DB[T]) ReadToWriter(key string, writer io.Writer) (int64, error) {
+	result := db.Read(key)
+	if result.err != nil {
+		return 0, result.err
+	}
+	if result.value.Blob == nil || db.blobs == nil {
+		return 0, dbError.NotABlob(fmt.Sprintf("key : %s", key))
+	}
+	name := result.value.Blob.File
+	if name != filepath.Base(name) || !strings.HasSuffix(name, blobSuffix) {
+		// only CreateFromReader sets a blob, this one came from the file
+		return 0, dbError.NotABlob(fmt.Sprintf("key %s: invalid blob file %q", key, name))
+	}
+	file, err := os.Open(filepath.Join(db.blobs.dir, name))
+	if err != nil {
+		return 0, dbError.ReadOperationFailed(fmt.Sprintf("blob of key %s: %s", key, err))
+	}
+	defer file.Close()
+	return io.Copy(writer, file)
+}
+
+// write streams reader into a new blob file, up to limitKB. The file stays
+// pending until settle.
+func (blobs *blobStore) write(reader io.Reader, limitKB float64) (BlobRef, error) {
+	token, err := randomToken()
+	if err != nil {
+		return BlobRef{}, err
+	}
+	ref := BlobRef{File: token + blobSuffix}
+	blobs.mu.Lock()
+	blobs.pending[ref.File] = true
+	blobs.mu.Unlock()
+	err = writeFileAtomically(filepath.Join(blobs.dir, ref.File), func(file *os.File) error {
+		// one byte over the limit tells an oversized value apart
+		limit := int64(limitKB * KB)
+		written, err := io.Copy(file, io.LimitReader(reader, limit+1))
+		ref.Size = written
+		if err == nil && written > limit {
+			err = dbError.EntrySizeExceedsLimit(fmt.Sprintf("blob over the limit of %.0f KB", limitKB))
+		}
+		return err
+	})
+	if err != nil {
+		blobs.settle(ref.File)
+		if _, ok := err.(*dbError.DBError); ok {
+			return BlobRef{}, err
+		}
+		return BlobRef{}, dbError.WriteOperationFailed(fmt.Sprintf("blob: %s", err))
+	}
+	return ref, nil
+}
+
+// settle ends the pending state of a blob file, referenced or removed by now.
+func (blobs *blobStore) settle(file string) {
+	blobs.mu.Lock()
+	delete(blobs.pending, file)
+	blobs.mu.Unlock()
+}
+
+// collectBlobs removes the blob files nothing references anymore. It runs on
+// the write worker, after Compact synced.
+func (db *DB[T]) collectBlobs() error {
+	referenced := make(map[string]bool)
+	for _, entries := range []map[string]DbData[T]{db.data.snapshot(), db.tombstones} {
+		for _, entry := range entries {
+			if entry.Blob != nil {
+				referenced[entry.Blob.File] = true
+			}
+		}
+	}
+	if db.generations != nil {
+		if err := db.generations.blobs(referenced); err != nil {
+			return err
+		}
+	}
+	files, err := os.ReadDir(db.blobs.dir)
+	if err != nil {
+		return dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
+	}
+	db.blobs.mu.Lock()
+	defer db.blobs.mu.Unlock()
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, blobSuffix) || referenced[name] || db.blobs.pending[name] {
+			continue
+		}
+		os.Remove(filepath.Join(db.blobs.dir, name))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// encodeBuffer is where a file is encoded before it is written in one go,
+// with a JSON encoder writing to it. Both are pooled across syncs, so a sync
+// doesn't allocate a buffer of the size of the file, nor grow one to it, every
+// time.
+type encodeBuffer struct {
+	bytes.Buffer
+	encoder *json.Encoder
+}
+
+var encodeBuffers = sync.Pool{
+	New: func() any {
+		buffer := &encodeBuffer{}
+		buffer.encoder = json.NewEncoder(&buffer.Buffer)
+		return buffer
+	},
+}
+
+// getEncodeBuffer returns an empty buffer that can hold sizeHint bytes,
+// typically the size of the file last written, without growing.
+func getEncodeBuffer(sizeHint int) *encodeBuffer {
+	buffer := encodeBuffers.Get().(*encodeBuffer)
+	buffer.Grow(sizeHint)
+	return buffer
+}
+
+func putEncodeBuffer(buffer *encodeBuffer) {
+	buffer.Reset()
+	encodeBuffers.Put(buffer)
+}
+
+// encodeJSON appends the JSON encoding of v, as json.Marshal encodes it.
+func (buffer *encodeBuffer) encodeJSON(v any) error {
+	if err := buffer.encoder.Encode(v); err != nil {
+		return err
+	}
+	buffer.Truncate(buffer.Len() - 1) // the newline Encode ends with
+	return nil
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cliUsage = `usage: kvcli <command> [arguments]
+
+commands:
+  verify [-json] <file>   check the integrity of a database file
+  cleanup [-dry-run] [-json] <file>
+                          remove the expired entries of a closed database
+  delete [-dry-run] [-json] <file> <pattern>
+                          delete the entries whose key matches a glob pattern
+  compact [-dry-run] [-json] <file>
+                          drop the expired entries and old tombstones, rewriting the file
+  restore [-dry-run] [-json] <file> <backup>
+                          replace the data of a database with a backup
+  status [-json] <status file>
+                          show the state of an instance opened with WithStatusFile
+  bench [-workload name] [-ops n] [-workers n] [-dir dir]
+        [-writes n] [-readers n] [-value-size 1kb] [-replay oplog]
+                          measure throughput and latency, as JSON
+  load -file data.csv -key-column id [-ttl-column ttl] [-format csv|json]
+       [-batch n] [-policy skip|overwrite] [-json] <file>
+                          bulk load the rows of a CSV or JSON file into a database
+`
+
+// runCLI runs the kvcli command in args (without the program name) and
+// returns the process exit code.
+func runCLI(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	switch args[0] {
+	case "verify":
+		return runVerify(args[1:], stdout, stderr)
+	case "cleanup":
+		return runCleanup(args[1:], stdout, stderr)
+	case "delete":
+		return runDelete(args[1:], stdout, stderr)
+	case "compact":
+		return runCompact(args[1:], stdout, stderr)
+	case "restore":
+		return runRestore(args[1:], stdout, stderr)
+	case "status":
+		return runStatus(args[1:], stdout, stderr)
+	case "bench":
+		return runBench(args[1:], stdout, stderr)
+	case "load":
+		return runLoad(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n%s", args[0], cliUsage)
+		return 2
+	}
+}
+
+// runVerify exits with 1 when issues were found, so scripts can act on it.
+func runVerify(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	// the values are not interpreted, only checked to be valid JSON
+	report, err := VerifyFile[json.RawMessage](flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		fmt.Fprintf(stdout, "file:     %s\n", report.Path)
+		fmt.Fprintf(stdout, "sha256:   %s\n", report.Checksum)
+		fmt.Fprintf(stdout, "size:     %d bytes\n", report.SizeBytes)
+		fmt.Fprintf(stdout, "entries:  %d\n", report.Entries)
+		fmt.Fprintf(stdout, "issues:   %d\n", len(report.Issues))
+		for _, issue := range report.Issues {
+			if issue.Key != "" {
+				fmt.Fprintf(stdout, "  [%s] %s: %s\n", issue.Check, issue.Key, issue.Message)
+			} else {
+				fmt.Fprintf(stdout, "  [%s] %s\n", issue.Check, issue.Message)
+			}
+		}
+	}
+	if !report.OK() {
+		return 1
+	}
+	return 0
+}
+
+// runCleanup purges the expired entries of the database file, or with
+// -dry-run only lists them.
+func runCleanup(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dryRun := flags.Bool("dry-run", false, "list what would be removed without removing it")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	db, err := OpenPath[json.RawMessage](flags.Arg(0), WithCleanupInterval(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer db.Close()
+	preview, err := db.PreviewCleanup()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !*dryRun {
+		if result := db.PurgeExpired(); result.err != nil {
+			fmt.Fprintln(stderr, result.err)
+			return 2
+		}
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			DryRun bool `json:"dry_run"`
+			CleanupPreview
+		}{*dryRun, preview})
+		return 0
+	}
+	verb := "removed"
+	if *dryRun {
+		verb = "would remove"
+	}
+	fmt.Fprintf(stdout, "%s %d expired entries, %d bytes\n", verb, len(preview.Keys), preview.Bytes)
+	for _, key := range preview.Keys {
+		fmt.Fprintf(stdout, "  %s\n", key)
+	}
+	return 0
+}
+
+// runDelete deletes the entries matching the pattern, pinned and immutable
+// ones aside, or with -dry-run only lists them.
+func runDelete(args []string, stdout io.Writer, stderr io.Writer) int {
+	return runPlanned("delete", 2, args, stdout, stderr, func(db *DB[json.RawMessage], args []string) (ChangePlan, func() error, error) {
+		plan, err := db.PlanDeleteMatching(args[1])
+		return plan, func() error {
+			for {
+				deleted, err := db.DeleteMatching(args[1])
+				if err != nil || deleted == 0 {
+					return err
+				}
+			}
+		}, err
+	})
+}
+
+// runCompact compacts the database file, or with -dry-run only lists what
+// it would drop.
+func runCompact(args []string, stdout io.Writer, stderr io.Writer) int {
+	return runPlanned("compact", 1, args, stdout, stderr, func(db *DB[json.RawMessage], args []string) (ChangePlan, func() error, error) {
+		plan, err := db.PlanCompact()
+		return plan, func() error { return db.Compact().err }, err
+	})
+}
+
+// runRestore replaces the data of the database file with the backup, or
+// with -dry-run only lists what that would change.
+func runRestore(args []string, stdout io.Writer, stderr io.Writer) int {
+	return runPlanned("restore", 2, args, stdout, stderr, func(db *DB[json.RawMessage], args []string) (ChangePlan, func() error, error) {
+		plan, err := db.PlanRestore(args[1])
+		return plan, func() error { return db.RestoreInPlace(args[1]) }, err
+	})
+}
+
+// runPlanned runs a destructive command taking the database file and
+// nargs-1 more arguments: plan returns what it would change and the function
+// applying it, which -dry-run skips. Both report the plan.
+func runPlanned(name string, nargs int, args []string, stdout io.Writer, stderr io.Writer, plan func(*DB[json.RawMessage], []string) (ChangePlan, func() error, error)) int {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	dryRun := flags.Bool("dry-run", false, "report what would change without changing it")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != nargs {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	db, err := OpenPath[json.RawMessage](flags.Arg(0), WithCleanupInterval(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer db.Close()
+	changes, apply, err := plan(db, flags.Args())
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if !*dryRun {
+		if err := apply(); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			DryRun bool `json:"dry_run"`
+			ChangePlan
+		}{*dryRun, changes})
+		return 0
+	}
+	format := "removed %d, added %d and changed %d keys, reclaiming %d bytes\n"
+	if *dryRun {
+		format = "would remove %d, add %d and change %d keys, reclaiming %d bytes\n"
+	}
+	fmt.Fprintf(stdout, format, len(changes.Removed), len(changes.Added), len(changes.Changed), changes.BytesReclaimed)
+	for _, key := range changes.Removed {
+		fmt.Fprintf(stdout, "  - %s\n", key)
+	}
+	for _, key := range changes.Added {
+		fmt.Fprintf(stdout, "  + %s\n", key)
+	}
+	for _, key := range changes.Changed {
+		fmt.Fprintf(stdout, "  ~ %s\n", key)
+	}
+	return 0
+}
+
+// runStatus exits with 1 when the instance isn't running anymore.
+func runStatus(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+
+	status, err := ReadStatusFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(struct {
+			InstanceStatus
+			Running bool `json:"running"`
+		}{status, status.Running})
+	} else {
+		state := "running"
+		if !status.Running && status.Closed {
+			state = "closed"
+		} else if !status.Running {
+			state = "not running (crashed?)"
+		}
+		fmt.Fprintf(stdout, "state:      %s\n", state)
+		fmt.Fprintf(stdout, "pid:        %d\n", status.PID)
+		fmt.Fprintf(stdout, "entries:    %d\n", status.Entries)
+		fmt.Fprintf(stdout, "tombstones: %d\n", status.Tombstones)
+		fmt.Fprintf(stdout, "size:       %.2f KB\n", status.SizeKB)
+		fmt.Fprintf(stdout, "last sync:  %s\n", status.LastSync.Format(time.RFC3339))
+		if status.SyncErr != "" {
+			fmt.Fprintf(stdout, "sync error: %s\n", status.SyncErr)
+		}
+		fmt.Fprintf(stdout, "updated:    %s\n", status.UpdatedAt.Format(time.RFC3339))
+	}
+	if !status.Running {
+		return 1
+	}
+	return 0
+}
+
+// runBench runs each workload (or the one asked for) on a fresh database in a
+// temporary directory and prints one JSON result per line. With -writes or
+// -readers it runs the load test instead, and with -replay the replay of an
+// oplog.
+func runBench(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	workload := flags.String("workload", "", "workload to run: "+strings.Join(benchWorkloads, ", ")+" (default all)")
+	ops := flags.Int("ops", 1000, "operations per workload (batches for the batch workload)")
+	workers := flags.Int("workers", 8, "concurrent goroutines issuing operations (writes with -writes)")
+	dir := flags.String("dir", "", "directory for the database files (default a temporary one)")
+	writes := flags.Int("writes", 0, "load test: entries to create, while the readers read")
+	readers := flags.Int("readers", 0, "load test: concurrent goroutines reading during the writes")
+	valueSizeFlag := flags.String("value-size", "100", "load test: size of the values written, such as 512, 1kb or 2mb")
+	replay := flags.String("replay", "", "oplog file to replay on an empty database, see WithOplog")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	valueSize, err := parseByteSize(*valueSizeFlag)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	workloads := benchWorkloads
+	switch {
+	case *workload != "":
+		workloads = []string{*workload}
+	case *replay != "":
+		workloads = []string{"replay"}
+	case *writes > 0 || *readers > 0:
+		workloads = []string{"load"}
+		if *writes == 0 {
+			*writes = *ops
+		}
+	}
+
+	encoder := json.NewEncoder(stdout)
+	for _, workload := range workloads {
+		benchDir, err := os.MkdirTemp(*dir, "kvcli-bench-")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		var results []BenchResult
+		switch workload {
+		case "replay":
+			results, err = runReplay(benchDir, *replay, *workers)
+		case "load":
+			results, err = runBenchDB(benchDir, func(db *DB[TestVal]) ([]BenchResult, error) {
+				return runLoadBenchmark(db, *writes, *workers, *readers, valueSize)
+			})
+		default:
+			results, err = runBenchDB(benchDir, func(db *DB[TestVal]) ([]BenchResult, error) {
+				result, err := runBenchmark(db, workload, *ops, *workers)
+				return []BenchResult{result}, err
+			})
+		}
+		os.RemoveAll(benchDir)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+		for _, result := range results {
+			encoder.Encode(result)
+		}
+	}
+	return 0
+}
+
+// runBenchDB runs a benchmark on a new database in dir.
+func runBenchDB(dir string, run func(*DB[TestVal]) ([]BenchResult, error)) ([]BenchResult, error) {
+	db, err := NewDB[TestVal]("bench", dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return run(db)
+}
+
+// runReplay replays the oplog at path on a new database in dir.
+func runReplay(dir string, path string, workers int) ([]BenchResult, error) {
+	records, err := ReadOplog[json.RawMessage](path, 0)
+	if err != nil {
+		return nil, err
+	}
+	db, err := NewDB[json.RawMessage]("bench", dir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return []BenchResult{replayBenchmark(db, records, workers)}, nil
+}
+
+// parseByteSize parses a size in bytes, such as 512, 1kb or 2MB.
+func parseByteSize(size string) (int, error) {
+	number, unit := strings.ToLower(strings.TrimSpace(size)), 1
+	for _, suffix := range []struct {
+		name string
+		size int
+	}{{"kb", KB}, {"mb", MB}, {"b", 1}} {
+		if trimmed, found := strings.CutSuffix(number, suffix.name); found {
+			number, unit = trimmed, suffix.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * unit, nil
+}
+
+// runLoad loads a CSV or JSON file into the database file, printing its
+// progress on stderr, and exits with 1 if any row failed.
+func runLoad(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	file := flags.String("file", "", "CSV (with a header) or JSON file to load")
+	format := flags.String("format", "", "csv or json (default from the file extension)")
+	keyColumn := flags.String("key-column", "", "column holding the key of each row")
+	ttlColumn := flags.String("ttl-column", "", "column holding the TTL in seconds, if any")
+	batchSize := flags.Int("batch", 100, fmt.Sprintf("rows per batch, %d at most", BatchLimit))
+	policyName := flags.String("policy", "skip", "what to do with the keys that exist: skip or overwrite")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *file == "" || *keyColumn == "" {
+		fmt.Fprint(stderr, cliUsage)
+		return 2
+	}
+	if *format == "" {
+		*format = "json"
+		if strings.EqualFold(filepath.Ext(*file), ".csv") {
+			*format = "csv"
+		}
+	}
+	policy := SkipExisting
+	switch *policyName {
+	case "skip":
+	case "overwrite":
+		policy = Overwrite
+	default:
+		fmt.Fprintf(stderr, "unknown policy %q\n", *policyName)
+		return 2
+	}
+
+	input, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer input.Close()
+	var size int64
+	if info, err := input.Stat(); err == nil {
+		size = info.Size()
+	}
+	db, err := OpenPath[json.RawMessage](flags.Arg(0), WithCleanupInterval(0))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	defer db.Close()
+
+	lastProgress := time.Now()
+	report, err := Load(db, input, LoadOptions{
+		Format:    *format,
+		KeyColumn: *keyColumn,
+		TTLColumn: *ttlColumn,
+		BatchSize: *batchSize,
+		Policy:    policy,
+		Progress: func(progress LoadReport) {
+			if time.Since(lastProgress) < time.Second {
+				return
+			}
+			lastProgress = time.Now()
+			fmt.Fprintf(stderr, "%d rows, %d loaded, %d failed, %s\n", progress.Rows, progress.Loaded, progress.Failed, percentOf(progress.BytesRead, size))
+		},
+	})
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	} else {
+		fmt.Fprintf(stdout, "rows:     %d\n", report.Rows)
+		fmt.Fprintf(stdout, "loaded:   %d\n", report.Loaded)
+		fmt.Fprintf(stdout, "skipped:  %d\n", report.Skipped)
+		fmt.Fprintf(stdout, "failed:   %d\n", report.Failed)
+		fmt.Fprintf(stdout, "elapsed:  %s\n", report.Elapsed.Round(time.Millisecond))
+		for _, failure := range report.Failures {
+			fmt.Fprintf(stdout, "  row %d %s: %s\n", failure.Row, failure.Key, failure.Err)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// percentOf formats how much of a file of size bytes read is.
+func percentOf(read int64, size int64) string {
+	if size <= 0 {
+		return fmt.Sprintf("%d bytes read", read)
+	}
+	return fmt.Sprintf("%.0f%% of %d bytes", 100*float64(min(read, size))/float64(size), size)
+}
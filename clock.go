@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where a DB reads the time from to decide whether an entry has
+// expired, and how the cleanup worker is woken up. The default is the wall
+// clock; WithClock swaps in another one, such as a ManualClock in tests.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the part of time.Ticker the DB uses.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// wallClock is the Clock of the time package.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) NewTicker(d time.Duration) Ticker {
+	return wallTicker{time.NewTicker(d)}
+}
+
+type wallTicker struct {
+	*time.Ticker
+}
+
+func (t wallTicker) C() <-chan time.Time { return t.Ticker.C }
+
+// ManualClock is a Clock that only moves when told to, so expiration can be
+// tested without sleeping. Its tickers fire from Advance, once per period
+// elapsed, dropping ticks nobody received like time.Ticker does.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+// NewManualClock returns a ManualClock reading start.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &manualTicker{clock: c, ch: make(chan time.Time, 1)}
+	ticker.reset(d)
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward by d and fires the tickers due meanwhile.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, ticker := range c.tickers {
+		if ticker.period <= 0 || ticker.next.After(c.now) {
+			continue
+		}
+		select {
+		case ticker.ch <- c.now:
+		default: // the last tick wasn't received yet
+		}
+		missed := c.now.Sub(ticker.next) / ticker.period
+		ticker.next = ticker.next.Add((missed + 1) * ticker.period)
+	}
+}
+
+type manualTicker struct {
+	clock  *ManualClock
+	ch     chan time.Time
+	period time.Duration // 0 once stopped
+	next   time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.ch }
+
+func (t *manualTicker) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.reset(d)
+}
+
+func (t *manualTicker) reset(d time.Duration) {
+	t.period = d
+	t.next = t.clock.now.Add(d)
+}
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.period = 0
+}
+
+// now returns the time on the DB's clock.
+func (db *DB[T]) now() time.Time {
+	return db.opts().clock.Now()
+}
@@ -0,0 +1,92 @@
+package main
+
+import "time"
+
+// writeCoalescer defers the sync of updates to hot keys, see
+// WithWriteCoalescing. An update of a key whose last update was synced less
+// than window ago is applied in memory and acknowledged right away; a single
+// sync, window after the first deferred update, persists all of them. Any
+// other sync meanwhile persists them too. Only the write worker uses it.
+type writeCoalescer struct {
+	window     time.Duration
+	lastSynced map[string]time.Time // When an update of the key was last synced
+	deferred   map[string]bool      // Keys updated since the last sync
+	timer      *time.Timer          // Fires when the deferred updates are due, nil when none are
+}
+
+// coalesceSweepAt is how many keys lastSynced holds before the ones that
+// aren't hot anymore are dropped.
+const coalesceSweepAt = 4096
+
+func newWriteCoalescer(window time.Duration) *writeCoalescer {
+	return &writeCoalescer{window: window, lastSynced: make(map[string]time.Time), deferred: make(map[string]bool)}
+}
+
+// due returns the channel the write worker waits on for the flush, nil when
+// nothing is deferred (or without coalescing).
+func (c *writeCoalescer) due() <-chan time.Time {
+	if c == nil || c.timer == nil {
+		return nil
+	}
+	return c.timer.C
+}
+
+// deferUpdate reports whether the update of key can skip its sync, and if so
+// makes sure a flush is scheduled.
+func (c *writeCoalescer) deferUpdate(key string, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	last, ok := c.lastSynced[key]
+	if !ok || now.Sub(last) >= c.window {
+		return false
+	}
+	c.deferred[key] = true
+	if c.timer == nil {
+		c.timer = time.NewTimer(c.window)
+	}
+	return true
+}
+
+// synced records that the data was persisted at now, key's update included
+// if it isn't empty.
+func (c *writeCoalescer) synced(key string, now time.Time) {
+	if c == nil {
+		return
+	}
+	if key != "" {
+		c.lastSynced[key] = now
+	}
+	for deferredKey := range c.deferred {
+		c.lastSynced[deferredKey] = now
+	}
+	clear(c.deferred)
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.lastSynced) >= coalesceSweepAt {
+		for hotKey, last := range c.lastSynced {
+			if now.Sub(last) >= c.window {
+				delete(c.lastSynced, hotKey)
+			}
+		}
+	}
+}
+
+// flushCoalesced syncs the deferred updates. A failed flush is retried
+// window later; the updates stay in memory meanwhile.
+func (db *DB[T]) flushCoalesced() {
+	c := db.coalescer
+	if c == nil || len(c.deferred) == 0 {
+		return
+	}
+	db.commitGroup() // its sync persists them, sync doesn't within a group
+	if len(c.deferred) == 0 {
+		return
+	}
+	if err := db.sync(); err != nil {
+		db.recordError(operation[T]{action: "flush"}, err)
+		c.timer = time.NewTimer(c.window)
+	}
+}
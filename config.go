@@ -0,0 +1,86 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+	"reflect"
+	"strings"
+)
+
+// opts returns the options in effect. The snapshot is never modified, so it
+// can be read without locking.
+func (db *DB[T]) opts() *dbOptions {
+	return db.options.Load()
+}
+
+// setHotOptions copies the options SetOption may change at runtime from
+// from to to.
+func setHotOptions(to *dbOptions, from *dbOptions) {
+	to.cleanupInterval = from.cleanupInterval
+	to.cleanupBatchSize = from.cleanupBatchSize
+	to.cleanupJitter = from.cleanupJitter
+	to.opTimeout = from.opTimeout
+	to.adminPriority = from.adminPriority
+	to.maxOpsPerSecond = from.maxOpsPerSecond
+	to.maxReadsPerSecond = from.maxReadsPerSecond
+	to.maxWritesPerSecond = from.maxWritesPerSecond
+	to.maxEntries = from.maxEntries
+	to.slidingTTL = from.slidingTTL
+	to.entrySizeLimitKB = from.entrySizeLimitKB
+	to.entrySizeLimits = from.entrySizeLimits
+}
+
+// SetOption changes tunables of an open database without closing it, so the
+// queued operations are kept. Only these options can be changed:
+// WithCleanupInterval (0 pauses the cleanup worker), WithCleanupBatchSize,
+// WithCleanupJitter, WithOpTimeout, WithAdminPriority, the rate limits,
+// WithMaxEntries, WithSlidingTTL and the entry size limits. Any other option fails the whole call
+// with OptionNotReloadable and nothing is changed. New rate limits start with
+// full buckets.
+func (db *DB[T]) SetOption(opts ...Option) error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	db.optionsMu.Lock()
+	defer db.optionsMu.Unlock()
+
+	current := db.opts()
+	next := *current
+	for _, opt := range opts {
+		opt(&next)
+	}
+	// with the tunables put back, anything left changed is not reloadable
+	probe := next
+	setHotOptions(&probe, current)
+	if reflect.ValueOf(probe.loadProgress).Pointer() != reflect.ValueOf(current.loadProgress).Pointer() {
+		return dbError.OptionNotReloadable("WithLoadProgress")
+	}
+	unchanged := *current
+	probe.loadProgress, unchanged.loadProgress = nil, nil
+	if !reflect.DeepEqual(probe, unchanged) {
+		return dbError.OptionNotReloadable("only the cleanup, timeout, priority, rate and entry limit and sliding TTL options can change")
+	}
+
+	if next.maxOpsPerSecond != current.maxOpsPerSecond ||
+		next.maxReadsPerSecond != current.maxReadsPerSecond ||
+		next.maxWritesPerSecond != current.maxWritesPerSecond {
+		db.limiter.Store(newRateLimiter(next))
+	}
+	db.options.Store(&next)
+	select {
+	case db.reconfigured <- struct{}{}:
+	default: // already signaled
+	}
+	return nil
+}
+
+// entryLimitKB returns the entry size limit applying to key.
+func (db *DB[T]) entryLimitKB(key string) float64 {
+	opts := db.opts()
+	limit, longest := opts.entrySizeLimitKB, -1
+	for prefix, prefixLimit := range opts.entrySizeLimits {
+		if len(prefix) > longest && strings.HasPrefix(key, prefix) {
+			limit, longest = prefixLimit, len(prefix)
+		}
+	}
+	return float64(limit)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"local-key-value-DB/dbError"
+	"time"
+)
+
+// PutContent stores value under a key derived from it, the first 128 bits of
+// the SHA-256 of its JSON encoding in hex (the 32 characters of
+// KeySizeLimit), and returns the key. Putting the same value again is a no-op
+// returning the same key, which suits caches and dedup stores where the
+// caller has no key of its own.
+func (db *DB[T]) PutContent(value T) (string, error) {
+	if db.closed.Load() {
+		return "", dbError.DBAlreadyClosed("")
+	}
+	key, err := ContentKey(value)
+	if err != nil {
+		return "", err
+	}
+	op := operation[T]{
+		action:   "putContent",
+		key:      key,
+		value:    DbData[T]{Value: value, Created_at: time.Now()},
+		response: make(chan operationResult[T], 1),
+	}
+	if err := db.submitWrite(op).err; err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// ContentKey returns the key PutContent stores value under.
+func ContentKey[T any](value T) (string, error) {
+	hash, err := hashOf(value)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash[:KeySizeLimit/2]), nil
+}
+
+// putContent creates the entry unless the key already holds it: the key
+// being the hash of the value, a live entry under it holds the same value.
+func (db *DB[T]) putContent(key string, entry DbData[T]) error {
+	if db.data.has(key) {
+		if !db.isExpired(key) {
+			return nil
+		}
+		if err := db.expireEntry(key); err != nil {
+			return err
+		}
+	}
+	return db.create(key, entry)
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt" // Adjust the import path based on your setup
 	"local-key-value-DB/dbError"
-	"strconv"
+	"maps"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,15 +22,34 @@ import (
 // 500 entries * 16 KB = 8 MB
 const BatchLimit int = 500
 
+// EntrySizeLimitMB is the default limit of an encoded entry, see
+// WithEntrySizeLimit.
 const EntrySizeLimitMB = 16
 
+// MaxEntrySizeLimitMB bounds the limit WithEntrySizeLimit can set.
+const MaxEntrySizeLimitMB = 64
+
+// KeySizeLimit is the maximum key length, in bytes.
+const KeySizeLimit = 32
+
 const StorageLimitMB = 1024
 
 const cleanpInterval = time.Minute
 
+const adminQueueSize = 10
+
 type operationResult[T any] struct {
-	err   error
-	value DbData[T]
+	err       error
+	value     DbData[T]
+	count     int
+	keys      []string
+	report    *VerifyReport
+	reconcile *ReconcileReport
+	batch     *BatchResult
+	applied   []OpResult           // apply only
+	entries   map[string]DbData[T] // readMatching only
+	exists    bool
+	meta      *OpMetadata // Set with WithOpMetadata
 }
 type operation[T any] struct {
 	action    string
@@ -31,213 +57,1123 @@ type operation[T any] struct {
 	value     DbData[T]
 	batchData map[string]DbData[T]
 	response  chan operationResult[T]
+	errorResp chan error // set instead of response by the async writes
+	fenceSeq  uint64     // writes: sequence taken on db.fence; reads: last write to wait for
+	batchKeys []string
+	ttl       string
+	policy    ConflictPolicy // create, batchCreate and rename only
+	deadline  time.Time      // When the caller stops waiting, zero for never; the op is dropped if still queued then
+
+	batchOps      []Op[T]        // batchWrite and apply only
+	preconditions []Precondition // batchWrite only
+
+	visibility time.Duration    // dequeue only, see Queue
+	receipt    string           // queueAck only, see Queue.Ack
+	queuedAt   time.Time        // Set with WithOpMetadata
+	traceCtx   context.Context  // Context of the enqueue span, with WithTracer
+	release    chan struct{}    // view and freeze only, closed when the write worker may go on, see View and Freeze
+	blob       *BlobRef         // create only, the blob CreateFromReader wrote for value
+	checked    *checkedEntry[T] // create and update only, set by the validation shard that checked value, see WithParallelValidation
+	reusable   bool             // response comes from db.responses: it is left open, to be put back once answered
 }
+
+// DB data map concurrency: only the write worker mutates db.data, a
+// shardedMap whose buckets each have their own lock, so reads of different
+// keys don't contend on a single one. The tombstones and the key and value
+// indexes are only changed by the write worker too, under dataMu.Lock; every
+// other goroutine reads them under dataMu.RLock, while the write worker reads
+// them without locking. Work that needs to change the data from elsewhere
+// (the cleanup worker, reads finding an expired entry) is queued to the write
+// worker as an operation.
 type DB[T any] struct {
-	localStorage  *LocalStorage[T]
-	data          map[string]DbData[T]
+	storage       Storage[T]
+	data          *shardedMap[T]
+	tombstones    map[string]DbData[T] // Soft deleted entries, see WithSoftDelete
+	dataMu        sync.RWMutex         // See above
 	writeOps      chan operation[T]
 	readOps       chan operation[T]
-	mu            sync.Mutex             // Protects access to the locks map
-	locks         map[string]*sync.Mutex // Per-key locks
-	wg            sync.WaitGroup         // To track ongoing operations
-	closed        bool                   // To signal when DB is closing
-	closeCh       chan struct{}          // To signal all goroutines to stop
-	stopCleanupCh chan struct{}          // Signal to stop the cleanup workercleann
+	shards        *validationShards[T]        // Between writeOps and the write worker, nil without WithParallelValidation
+	responses     sync.Pool                   // Response channels of Read, reused once answered
+	adminOps      chan operation[T]           // Maintenance ops (Compact), see WithAdminPriority
+	locks         *keyLocks                   // Per-key locks, only for keys in use
+	fence         *writeFence                 // Holds reads back until earlier writes on the key are applied
+	expiries      *expiryQueue                // When each key with a TTL expires, for the cleanup worker
+	archive       *expiredArchive[T]          // Where expired entries go before removal, nil if not archiving
+	oplog         *oplog[T]                   // Log of the applied mutations, nil without WithOplog
+	history       *keyHistory[T]              // Recent versions of each key, nil without WithHistory
+	watchers      *keyWatchers                // Callers of WaitFor
+	validators    []Validator[T]              // See AddValidator
+	validatorsMu  sync.Mutex                  // Protects validators
+	closeHooks    []func()                    // See OnClose
+	flushHooks    []func(FlushStats)          // See OnFlush
+	hooksMu       sync.Mutex                  // Protects closeHooks and flushHooks
+	middleware    []Middleware[T]             // See Use
+	middlewareMu  sync.Mutex                  // Protects middleware
+	freezeRelease chan struct{}               // Set while frozen, see Freeze
+	freezeMu      sync.Mutex                  // Protects freezeRelease
+	generations   *generations[T]             // Archived by rotation, nil without WithRotation
+	blobs         *blobStore                  // Nil without WithBlobDir
+	syncMeter     syncMeter                   // Syncs of the write being processed, with WithOpMetadata
+	writeTraceCtx context.Context             // Context of the write being processed, with WithTracer
+	recentErrors  errorLog                    // Last failed operations, see DebugHandler
+	keyIndex      *keyIndex                   // Live keys in order, see ListKeys; guarded by dataMu
+	decodeIssues  []DecodeIssue               // Set by load under WithStrictDecode
+	status        *statusFile                 // Nil without WithStatusFile
+	servers       []*Server                   // Started by Serve, shut down by Close
+	serversMu     sync.Mutex                  // Protects servers
+	backups       *autoBackup                 // Nil without WithAutoBackup
+	hotKeys       *hotKeySketch               // Nil without WithHotKeys
+	readHits      atomic.Uint64               // Reads that found a live entry
+	readMisses    atomic.Uint64               // Reads of missing or expired keys
+	io            ioCounters                  // See IOStats
+	coalescer     *writeCoalescer             // Nil without WithWriteCoalescing, only used by the write worker
+	group         *commitGroup[T]             // Writes waiting for their sync, see WithGroupCommit; only used by the write worker
+	values        *valueIndex                 // Value hashes, nil without WithDedup; guarded by dataMu
+	queues        map[string]*queueState      // Per queue prefix, only touched by the write worker, see Queue
+	limiter       atomic.Pointer[rateLimiter] // Nil without rate limits
+	readOnly      atomic.Bool                 // Follower mode, see WithFollower
+	stopFollowCh  chan struct{}               // Signal to stop the follow worker
+	followDone    chan struct{}               // Closed once the follow worker returned
+	wg            sync.WaitGroup              // To track the write worker
+	readWG        sync.WaitGroup              // To track the read workers and the reads they parked
+	cleanupWG     sync.WaitGroup              // To track the cleanup worker
+	closed        atomic.Bool                 // To signal when DB is closing
+	closeMu       sync.RWMutex                // Held for reading while queueing, so Close never closes a queue under a sender
+	closeCh       chan struct{}               // To signal all goroutines to stop
+	stopCleanupCh chan struct{}               // Signal to stop the cleanup workercleann
+	cleanupMu     sync.Mutex                  // Protects cleanupStats
+	cleanupStats  CleanupStats                // Last run of the cleanup worker
+	checkpointMu  sync.Mutex                  // Protects checkpoint
+	checkpoint    SyncCheckpoint              // How far the storage matches the data, see sync
+	ready         chan struct{}               // Closed once the data is loaded
+	loadErr       error                       // Set before ready is closed if loading failed
+	loadedVersion string                      // Storage version the data was loaded at, for followers
+	recovery      RecoveryReport              // Set by load, see Recovery
+	options       atomic.Pointer[dbOptions]   // Replaced as a whole by SetOption, see opts
+	optionsMu     sync.Mutex                  // Serializes SetOption calls
+	reconfigured  chan struct{}               // Signals the cleanup worker that SetOption changed its settings
 }
 
-func NewDB[T any](fileName string, dir string) (*DB[T], error) {
-	loadedData := make(map[string]DbData[T])
-	localStorage, err := NewLocalStorage(fileName, dir, &loadedData)
+func NewDB[T any](fileName string, dir string, opts ...Option) (*DB[T], error) {
+	localStorage, err := newLayoutStorage[T](fileName, dir, false, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBWithStorage[T](localStorage, opts...)
+}
+
+// OpenPath opens the database file at path, absolute or relative, without the
+// name rules of NewDB: the name is used as is, of any length. The extension
+// picks the format, ".json" or ".bin" (gob); pass WithAnyExtension to accept
+// any other, stored as JSON. The directory must exist, as for NewDB; the file
+// is created if missing.
+func OpenPath[T any](path string, opts ...Option) (*DB[T], error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if ext := filepath.Ext(path); !options.anyExtension && ext != ".json" && ext != ".bin" {
+		return nil, dbError.InvalidFileName(fmt.Sprintf("extension %q is neither .json nor .bin, see WithAnyExtension", ext))
+	}
+	localStorage, err := NewLocalStorageAtPath[T](path)
 	if err != nil {
 		return nil, err
 	}
+	return NewDBWithStorage[T](localStorage, opts...)
+}
+
+// NewBytesDB opens a DB of raw binary values persisted in a gob encoded
+// ".bin" file, so values are neither base64 inflated on disk nor in the size
+// checks.
+func NewBytesDB(fileName string, dir string, opts ...Option) (*DB[[]byte], error) {
+	binaryStorage, err := newLayoutStorage[[]byte](fileName, dir, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	return NewDBWithStorage[[]byte](binaryStorage, opts...)
+}
+
+// newLayoutStorage opens the LocalStorage of NewDB and NewBytesDB in the
+// layout picked by the options.
+func newLayoutStorage[T any](fileName string, dir string, binary bool, opts []Option) (*LocalStorage[T], error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.directoryLayout {
+		return NewDirLocalStorage[T](fileName, dir, binary)
+	}
+	return newLocalStorage[T](fileName, dir, binary)
+}
+
+// NewDBWithStorage opens a DB on top of any Storage backend. The storage is
+// locked for the lifetime of the DB and released by Close.
+func NewDBWithStorage[T any](storage Storage[T], opts ...Option) (*DB[T], error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.rotationDir != "" && !(options.rotateAtKB > 0) {
+		return nil, dbError.InvalidRequest(fmt.Sprintf("rotation size of %v KB, it must be above 0", options.rotateAtKB))
+	}
+	if options.replicaDir != "" {
+		replicated, err := newReplicatedStorage(storage, options.replicaDir)
+		if err != nil {
+			return nil, err
+		}
+		storage = replicated
+	}
+	if !options.follower {
+		if err := storage.Lock(); err != nil {
+			return nil, dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
+		}
+	}
 	db := &DB[T]{
-		localStorage:  localStorage,
-		data:          loadedData,
-		writeOps:      make(chan operation[T], 100),
-		readOps:       make(chan operation[T], 100),
-		locks:         make(map[string]*sync.Mutex),
+		storage:       storage,
+		data:          newShardedMap[T](),
+		tombstones:    make(map[string]DbData[T]),
+		keyIndex:      newKeyIndex(),
+		watchers:      newKeyWatchers(),
+		queues:        make(map[string]*queueState),
+		writeOps:      make(chan operation[T], options.writeQueueSize),
+		readOps:       make(chan operation[T], options.readQueueSize),
+		adminOps:      make(chan operation[T], adminQueueSize),
+		locks:         newKeyLocks(),
+		fence:         newWriteFence(),
+		expiries:      newExpiryQueue(),
 		closeCh:       make(chan struct{}),
 		stopCleanupCh: make(chan struct{}),
-		closed:        false,
+		ready:         make(chan struct{}),
+		reconfigured:  make(chan struct{}, 1),
+	}
+	db.responses.New = func() any { return make(chan operationResult[T], 1) }
+	if options.expiredArchivePath != "" {
+		db.archive = &expiredArchive[T]{path: options.expiredArchivePath}
+	}
+	if options.rotationDir != "" {
+		generations, err := openGenerations[T](options.rotationDir)
+		if err != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, err
+		}
+		db.generations = generations
+	}
+	if options.blobDir != "" {
+		blobs, err := openBlobStore(options.blobDir)
+		if err != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, err
+		}
+		db.blobs = blobs
+	}
+	if options.dedup {
+		db.values = newValueIndex()
+	}
+	if options.hotKeys {
+		db.hotKeys = newHotKeySketch()
+	}
+	if options.coalesceWindow > 0 {
+		db.coalescer = newWriteCoalescer(options.coalesceWindow)
+	}
+	if options.historySize > 0 {
+		db.history = newKeyHistory[T](options.historySize)
+	}
+	if options.oplogPath != "" {
+		oplog, records, err := openOplog[T](options.oplogPath, options.follower)
+		if err != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, err
+		}
+		db.oplog = oplog
+		if db.history != nil {
+			db.history.record(records)
+		}
+	}
+
+	db.readOnly.Store(options.follower)
+	db.options.Store(&options)
+	db.limiter.Store(newRateLimiter(options))
+
+	if options.lazyLoad {
+		go db.load(options.loadProgress)
+	} else {
+		db.load(options.loadProgress)
+		if db.loadErr != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, db.loadErr
+		}
+	}
+
+	if options.statusPath != "" {
+		status, err := openStatusFile(options.statusPath, options.statusInterval)
+		if err != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, err
+		}
+		db.status = status
+	}
+
+	if options.backupDir != "" && options.backupInterval > 0 {
+		backups, err := openAutoBackup(options.backupDir, options.backupInterval, options.backupRetention)
+		if err != nil {
+			if !options.follower {
+				storage.Unlock()
+			}
+			return nil, err
+		}
+		db.backups = backups
 	}
 
+	if options.validationShards > 1 {
+		db.startValidationShards(options.validationShards, options.writeQueueSize)
+	}
+	db.wg.Add(1)
 	go db.writeWorker()
-	go db.readWorker()
+	db.readWG.Add(options.readWorkers)
+	for range options.readWorkers {
+		go db.readWorker()
+	}
+	db.cleanupWG.Add(1)
 	go db.startCleanupWorker()
+	if db.status != nil {
+		go db.runStatusFile()
+	}
+	if db.backups != nil {
+		go db.runAutoBackup()
+	}
+	if options.follower {
+		db.startFollowing()
+	}
 
 	return db, nil
 }
 
-func (db *DB[T]) getLock(key string) *sync.Mutex {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if _, exists := db.locks[key]; !exists {
-		db.locks[key] = &sync.Mutex{}
+// load fills db.data from the storage and closes db.ready. The workers don't
+// touch the data before ready is closed.
+func (db *DB[T]) load(progress func(loadedBytes int64, totalBytes int64)) {
+	defer close(db.ready)
+	loadedData := make(map[string]DbData[T])
+	if versioned, ok := db.storage.(VersionedStorage); ok {
+		// taken before loading: a change made meanwhile is picked up later
+		db.loadedVersion, _ = versioned.Version()
+	}
+	var err error
+	if strictLoader, ok := db.storage.(StrictLoader[T]); ok && db.opts().strictDecode {
+		db.decodeIssues, err = strictLoader.LoadStrict(&loadedData, progress)
+	} else if progressLoader, ok := db.storage.(ProgressLoader[T]); ok && progress != nil {
+		err = progressLoader.LoadWithProgress(&loadedData, progress)
+	} else {
+		err = db.storage.Load(&loadedData)
+	}
+	_, local := db.localStorage()
+	recovering := db.oplog != nil && local && !db.readOnly.Load()
+	if err != nil {
+		if !recovering || !db.recoverCheckpoint(&loadedData, err) {
+			db.loadErr = dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+			return
+		}
+	} else if local, ok := db.localStorage(); ok && local.header != nil {
+		db.recovery.CheckpointSeq = local.header.Seq
+	}
+	db.seenSeq(db.recovery.CheckpointSeq) // deletes leave no entry to resume from
+	if recovering {
+		if err := db.replayOplog(loadedData); err != nil {
+			db.loadErr = dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+			return
+		}
+	}
+	for key, entry := range loadedData {
+		db.setLoaded(key, entry)
+	}
+	if db.recovery.Recovered() {
+		db.sync() // on failure, the checkpoint is left diverged
+		return
+	}
+	db.loaded()
+}
+
+// WaitLoaded blocks until the data is loaded and returns the load error, if
+// any. Only useful with WithLazyLoad, otherwise NewDB already waited.
+func (db *DB[T]) WaitLoaded() error {
+	<-db.ready
+	return db.loadErr
+}
+
+// keyLock is the mutex of one key, shared by everyone currently working on
+// that key. refs counts them; the lock is dropped from db.locks once nobody
+// uses it, so the map stays as small as the set of keys in flight.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// freeKeyLocks holds the keyLocks of the keys no longer in use, so that a
+// read of a key nobody else holds doesn't allocate one.
+var freeKeyLocks = sync.Pool{New: func() any { return &keyLock{} }}
+
+// keyLocks holds the keyLocks in use, split into buckets like the data map,
+// so that looking a key's lock up only contends with keys of the same bucket.
+type keyLocks struct {
+	shards [dataShards]keyLockShard
+}
+
+type keyLockShard struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+func newKeyLocks() *keyLocks {
+	l := &keyLocks{}
+	for i := range l.shards {
+		l.shards[i].locks = make(map[string]*keyLock)
+	}
+	return l
+}
+
+// inUse returns how many keys have a lock.
+func (l *keyLocks) inUse() int {
+	total := 0
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		total += len(shard.locks)
+		shard.mu.Unlock()
 	}
-	return db.locks[key]
+	return total
 }
 
-func (db *DB[T]) Create(key string, value DbData[T]) operationResult[T] {
-	if db.closed {
+// getLock returns the key's lock with a reference taken on it. Every getLock
+// must be paired with a putLock once the caller is done with the key.
+func (db *DB[T]) getLock(key string) *keyLock {
+	shard := &db.locks.shards[shardOf(key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entryLock, exists := shard.locks[key]
+	if !exists {
+		entryLock = freeKeyLocks.Get().(*keyLock)
+		shard.locks[key] = entryLock
+	}
+	entryLock.refs++
+	return entryLock
+}
+
+func (db *DB[T]) putLock(key string, entryLock *keyLock) {
+	shard := &db.locks.shards[shardOf(key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	entryLock.refs--
+	if entryLock.refs == 0 {
+		delete(shard.locks, key)
+		freeKeyLocks.Put(entryLock) // unlocked, as nobody refers to it
+	}
+}
+
+// lockKey locks a single key and returns the matching unlock func.
+func (db *DB[T]) lockKey(key string) func() {
+	entryLock := db.getLock(key)
+	entryLock.Lock()
+	return func() {
+		entryLock.Unlock()
+		db.putLock(key, entryLock)
+	}
+}
+
+// lockKeys takes the per-key locks of all keys in sorted order, so that two
+// multi-key lockers can't deadlock each other, and returns the unlock func.
+func (db *DB[T]) lockKeys(keys []string) func() {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	unlocks := make([]func(), 0, len(sorted))
+	for _, key := range sorted {
+		unlocks = append(unlocks, db.lockKey(key))
+	}
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
+
+// keylessActions work on the whole data set and take the per-key locks of the
+// keys they change themselves.
+var keylessActions = map[string]bool{"compact": true, "purgeExpired": true, "expiredKeys": true, "reload": true, "verify": true, "cleanup": true, "reconcile": true, "backup": true, "restoreInPlace": true, "exportSnapshot": true, "deleteMatching": true, "view": true, "freeze": true, "ping": true}
+
+// reply hands the result over to the caller, only its error for async ops.
+func (op operation[T]) reply(result operationResult[T]) {
+	if op.errorResp != nil {
+		op.errorResp <- result.err
+		close(op.errorResp)
+		return
+	}
+	op.response <- result
+	if !op.reusable {
+		close(op.response)
+	}
+}
+
+// keys returns every key the operation touches.
+func (op operation[T]) keys() []string {
+	if keylessActions[op.action] {
+		return nil
+	}
+	if op.batchKeys != nil {
+		return op.batchKeys
+	}
+	if op.batchData == nil {
+		return []string{op.key}
+	}
+	keys := make([]string, 0, len(op.batchData))
+	for key := range op.batchData {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Create stores value under key. What happens if key holds a live entry
+// already depends on the policy, WithCreatePolicy's unless one is passed:
+// FailAll fails with EntryAlreadyExists, SkipExisting keeps the entry and
+// succeeds, Overwrite replaces it.
+func (db *DB[T]) Create(key string, value DbData[T], policy ...ConflictPolicy) operationResult[T] {
+	if db.closed.Load() {
 		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
 	}
 	op := operation[T]{
 		action:   "create",
 		key:      key,
 		value:    value,
+		policy:   db.opts().createPolicy,
 		response: make(chan operationResult[T], 1),
 	}
-	db.writeOps <- op
-	return <-op.response
+	if len(policy) > 0 {
+		op.policy = policy[0]
+	}
+	return db.submitWrite(op)
 }
 
+// Read returns the entry stored under key. Unless the DB was opened with
+// WithCopyOnRead, the value shares memory with the store: pointers, slices and
+// maps inside it must be treated as read-only.
 func (db *DB[T]) Read(key string) operationResult[T] {
-	if db.closed {
+	if db.closed.Load() {
 		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
 	}
 	op := operation[T]{
 		action:   "read",
 		key:      key,
-		response: make(chan operationResult[T], 1),
+		response: db.responses.Get().(chan operationResult[T]),
+		fenceSeq: db.fence.last(key),
+		reusable: true,
 	}
 
-	db.readOps <- op
-	return <-op.response
+	return db.submit(db.readOps, op)
 }
 
+// BatchCreate creates the entries of batchData with a single sync, under the
+// policy of WithCreatePolicy; see BatchCreateWithPolicy for the outcome of
+// every key.
 func (db *DB[T]) BatchCreate(batchData map[string]DbData[T]) operationResult[T] {
-	if db.closed {
+	if db.closed.Load() {
 		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
 	}
 	op := operation[T]{
 		action:    "batchCreate",
 		batchData: batchData,
+		policy:    db.opts().createPolicy,
 		response:  make(chan operationResult[T], 1),
 	}
 
-	db.writeOps <- op
-	return <-op.response
+	return db.submitWrite(op)
+}
+
+// submit queues op and waits for its result, honoring the op timeout.
+func (db *DB[T]) submit(queue chan operation[T], op operation[T]) operationResult[T] {
+	kind := readKind
+	if queue == db.adminOps {
+		kind = adminKind
+	}
+	if err := db.throttle(kind, op); err != nil {
+		db.recycle(op)
+		return operationResult[T]{err: err}
+	}
+	deadline, timeout, stop := db.opDeadline()
+	defer stop()
+	op.deadline = deadline
+	if err := db.enqueue(queue, op, timeout); err != nil {
+		db.recycle(op)
+		return operationResult[T]{err: err}
+	}
+	result, answered := db.await(op, timeout)
+	if answered {
+		db.recycle(op)
+	}
+	return result
+}
+
+// recycle puts the response channel of op back for another Read, once
+// nothing sends on it anymore.
+func (db *DB[T]) recycle(op operation[T]) {
+	if op.reusable {
+		db.responses.Put(op.response)
+	}
+}
+
+// submitWrite registers op on the write fence before queueing it, so reads
+// issued from now on wait for it. The worker releases the fence once the op
+// is applied; here it is only released if the op never got queued. The
+// middleware chain wraps it all.
+func (db *DB[T]) submitWrite(op operation[T]) operationResult[T] {
+	deadline, timeout, stop := db.opDeadline()
+	defer stop()
+	op.deadline = deadline
+	var result operationResult[T]
+	result.err = db.intercept(op, func(op operation[T]) error {
+		if err := db.enqueueWrite(op, timeout); err != nil {
+			result = operationResult[T]{err: err}
+		} else {
+			result, _ = db.await(op, timeout)
+		}
+		return result.err
+	})
+	return result
+}
+
+// leaseActions are the writes that set the Owner of an entry.
+var leaseActions = map[string]bool{"acquireLease": true, "renewLease": true, "releaseLease": true}
+
+// clearInternalFields drops what only the DB sets from the entries of a
+// write, before anything checks them: the blob reference but the one
+// CreateFromReader wrote, the lease owner but for the lease ops, and the
+// sequence number of a queue's marker entry. A
+// caller could otherwise point an entry at any file, or at a negative size
+// that passes the size and quota checks. The caller's batch is copied
+// before it is changed.
+func (op *operation[T]) clearInternalFields() {
+	op.value.Blob, op.value.QueueSeq = op.blob, 0
+	if !leaseActions[op.action] {
+		op.value.Owner = ""
+	}
+	internal := func(entry DbData[T]) bool { return entry.Blob != nil || entry.Owner != "" || entry.QueueSeq != 0 }
+	for _, entry := range op.batchData {
+		if !internal(entry) {
+			continue
+		}
+		op.batchData = maps.Clone(op.batchData)
+		for key, entry := range op.batchData {
+			entry.Blob, entry.Owner, entry.QueueSeq = nil, "", 0
+			op.batchData[key] = entry
+		}
+		break
+	}
+	if slices.ContainsFunc(op.batchOps, func(batchOp Op[T]) bool { return internal(batchOp.Entry) }) {
+		op.batchOps = slices.Clone(op.batchOps)
+		for i := range op.batchOps {
+			op.batchOps[i].Entry.Blob, op.batchOps[i].Entry.Owner, op.batchOps[i].Entry.QueueSeq = nil, "", 0
+		}
+	}
+}
+
+// enqueueWrite is the queueing half of submitWrite.
+func (db *DB[T]) enqueueWrite(op operation[T], timeout <-chan time.Time) error {
+	if db.readOnly.Load() {
+		return dbError.ReadOnlyDatabase(op.action)
+	}
+	if err := db.throttle(writeKind, op); err != nil {
+		return err
+	}
+	op.clearInternalFields()
+	keys := op.keys()
+	op.fenceSeq = db.fence.begin(keys)
+	if err := db.enqueue(db.writeOps, op, timeout); err != nil {
+		db.fence.end(keys, op.fenceSeq)
+		return err
+	}
+	return nil
+}
+
+// opDeadline returns when the op timeout is over, the channel firing then
+// (zero and nil, so never firing, without WithOpTimeout) and the func
+// releasing its timer.
+func (db *DB[T]) opDeadline() (time.Time, <-chan time.Time, func()) {
+	timeout := db.opts().opTimeout
+	if timeout <= 0 {
+		return time.Time{}, nil, noStop
+	}
+	timer := time.NewTimer(timeout)
+	return time.Now().Add(timeout), timer.C, func() { timer.Stop() }
+}
+
+// noStop is the func releasing the timer of opDeadline when there is none.
+func noStop() {}
+
+// enqueue queues op unless the DB is closed or the timeout fires first.
+func (db *DB[T]) enqueue(queue chan operation[T], op operation[T], timeout <-chan time.Time) (err error) {
+	var span Span
+	op.traceCtx, span = db.startSpan(op.traceCtx, "kv.enqueue", op)
+	defer func() { endSpan(span, err) }()
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	if db.opts().opMetadata {
+		op.queuedAt = time.Now()
+	}
+	select {
+	case queue <- op:
+		return nil
+	case <-timeout:
+		return dbError.ErrDBTimeout(fmt.Sprintf("%s not queued in %v", op.action, db.opts().opTimeout))
+	case <-db.closeCh:
+		// Close is waiting for the queueing ones to give up
+		return dbError.ErrClosed(op.action)
+	}
+}
+
+// await waits for the result of op, and reports whether it came before the
+// timeout.
+func (db *DB[T]) await(op operation[T], timeout <-chan time.Time) (operationResult[T], bool) {
+	select {
+	case result := <-op.response:
+		return result, true
+	case <-timeout:
+		// the response channel is buffered, the worker won't block on it
+		return operationResult[T]{err: dbError.ErrDBTimeout(fmt.Sprintf("%s not completed in %v", op.action, db.opts().opTimeout))}, false
+	}
+}
+
+// QueueDepth reports how many operations are waiting in the read and write
+// queues, so callers can back off before the queues fill up.
+func (db *DB[T]) QueueDepth() (reads int, writes int) {
+	return len(db.readOps), len(db.writeOps) + db.shards.queued()
 }
 
 func (db *DB[T]) writeWorker() {
-	db.wg.Add(1)
 	defer db.wg.Done()
-	for op := range db.writeOps {
-		var result operationResult[T]
-		entryLock := db.getLock(op.key)
-		entryLock.Lock()
+	<-db.ready
+	writeOps, adminOps := db.writeOps, db.adminOps
+	if db.shards != nil {
+		writeOps = db.shards.applied
+	}
+	for writeOps != nil || adminOps != nil {
+		var op operation[T]
+		var ok bool
+		if db.opts().adminPriority && len(adminOps) > 0 {
+			// queued items are still received after close, ok is always true here
+			op, ok = <-adminOps
+		} else {
+			select {
+			case op, ok = <-writeOps:
+				if !ok {
+					writeOps = nil
+					continue
+				}
+			case op, ok = <-adminOps:
+				if !ok {
+					adminOps = nil
+					continue
+				}
+			case <-db.coalescer.due():
+				db.flushCoalesced()
+				continue
+			case <-db.group.due():
+				db.commitGroup()
+				continue
+			}
+		}
+		db.processWrite(op)
+	}
+	db.commitGroup()
+	db.flushCoalesced() // the updates deferred until now
+}
 
-		switch op.action {
-		case "create":
-			err := db.create(op.key, op.value)
-			result = operationResult[T]{err: err}
-		case "batchCreate":
-			err := db.batchCreate(op.batchData)
-			result = operationResult[T]{err: err}
-		case "delete":
-			err := db.delete(op.key)
-			result = operationResult[T]{err: err}
-		case "update":
-			err := db.update(op.key, op.value)
-			result = operationResult[T]{err: err}
-		default:
-			err := dbError.UnkownOperation(op.action)
-			result = operationResult[T]{err: err}
+func (db *DB[T]) processWrite(op operation[T]) {
+	grouped := db.groupable(op)
+	if db.group != nil && (!grouped || !db.group.admits(op.key)) {
+		db.commitGroup()
+	}
+	if err := db.rejection(op); err != nil {
+		if op.fenceSeq != 0 {
+			db.fence.end(op.keys(), op.fenceSeq)
 		}
-		entryLock.Unlock()
-		op.response <- result
-		close(op.response)
+		op.reply(operationResult[T]{err: err})
+		return
+	}
+	if op.action == "view" || op.action == "freeze" {
+		db.pause(op)
+		return
+	}
+	meter := db.metered(op)
+	var span Span
+	db.writeTraceCtx, span = db.startSpan(op.traceCtx, "kv.process", op)
+	var result operationResult[T]
+	unlock := db.lockKeys(op.keys())
+	if grouped {
+		db.joinGroup(op.key)
+	}
+
+	switch op.action {
+	case "create":
+		var prepared map[string]checkedEntry[T]
+		if op.checked != nil {
+			prepared = map[string]checkedEntry[T]{op.key: *op.checked}
+		}
+		batch := db.createEntries(map[string]DbData[T]{op.key: op.value}, op.policy, dbError.NotAvailabeSpace, prepared)
+		err := batch.Err
+		if err == nil { // the other policies report a rejected entry per key only
+			err = batch.Entries[op.key].Err
+		}
+		result = operationResult[T]{err: err}
+	case "batchCreate":
+		batch := db.batchCreate(op.batchData, op.policy)
+		result = operationResult[T]{err: batch.Err, batch: &batch}
+	case "batchWrite":
+		err := db.batchWrite(op.batchOps, op.preconditions)
+		result = operationResult[T]{err: err}
+	case "apply":
+		result = operationResult[T]{applied: db.apply(op.batchOps)}
+	case "delete":
+		err := db.delete(op.key)
+		result = operationResult[T]{err: err}
+	case "update":
+		err := db.update(op.key, op.value, op.checked)
+		result = operationResult[T]{err: err}
+	case "compact":
+		count, err := db.compact()
+		result = operationResult[T]{err: err, count: count}
+	case "reload":
+		err := db.reload()
+		result = operationResult[T]{err: err}
+	case "setTTLBatch":
+		err := db.setTTLBatch(op.batchKeys, op.ttl)
+		result = operationResult[T]{err: err}
+	case "getAndDelete":
+		value, err := db.getAndDelete(op.key)
+		result = operationResult[T]{err: err, value: value}
+	case "purgeExpired":
+		count, err := db.purgeExpired()
+		result = operationResult[T]{err: err, count: count}
+	case "cleanup":
+		count, err := db.cleanupDueKeys(db.opts().cleanupBatchSize)
+		result = operationResult[T]{err: err, count: count}
+	case "expire":
+		err := db.expireIfExpired(op.key)
+		result = operationResult[T]{err: err}
+	case "touch":
+		err := db.touch(op.key, *op.value.Expires_at)
+		result = operationResult[T]{err: err}
+	case "putContent":
+		err := db.putContent(op.key, op.value)
+		result = operationResult[T]{err: err}
+	case "enqueue":
+		key, err := db.enqueueItem(op.key, op.value.Value)
+		result = operationResult[T]{err: err, keys: []string{key}}
+	case "dequeue", "queuePeek":
+		key, receipt, value, err := db.nextItem(op.key, op.action == "dequeue", op.visibility)
+		result = operationResult[T]{err: err, keys: []string{key, receipt}, value: value}
+	case "queueAck":
+		err := db.ackItem(op.key, op.receipt)
+		result = operationResult[T]{err: err}
+	case "acquireLease":
+		err := db.acquireLease(op.key, op.value)
+		result = operationResult[T]{err: err}
+	case "renewLease":
+		err := db.renewLease(op.key, op.value)
+		result = operationResult[T]{err: err}
+	case "releaseLease":
+		err := db.releaseLease(op.key, op.value.Owner)
+		result = operationResult[T]{err: err}
+	case "ping":
+		result = operationResult[T]{}
+	case "undelete":
+		value, err := db.undelete(op.key)
+		result = operationResult[T]{err: err, value: value}
+	case "verify":
+		report, err := db.verify()
+		result = operationResult[T]{err: err, report: &report}
+	case "reconcile":
+		report, err := db.reconcile()
+		result = operationResult[T]{err: err, reconcile: &report}
+	case "backup":
+		path, err := db.backup(op.key)
+		result = operationResult[T]{err: err, keys: []string{path}}
+	case "restoreInPlace":
+		err := db.restoreInPlace(op.key)
+		result = operationResult[T]{err: err}
+	case "exportSnapshot":
+		checksum, err := db.exportSnapshot(op.key)
+		result = operationResult[T]{err: err, keys: []string{checksum}}
+	case "pin", "unpin":
+		err := db.setPinned(op.key, op.action == "pin")
+		result = operationResult[T]{err: err}
+	case "rename":
+		err := db.rename(op.batchKeys[0], op.batchKeys[len(op.batchKeys)-1], op.policy)
+		result = operationResult[T]{err: err}
+	case "deleteMatching":
+		count, err := db.deleteMatching(op.key)
+		result = operationResult[T]{err: err, count: count}
+	default:
+		err := dbError.UnkownOperation(op.action)
+		result = operationResult[T]{err: err}
+	}
+	if grouped {
+		db.stamp(meter, &result)
+		db.group.hold(groupedWrite[T]{op: op, result: result, unlock: unlock, span: span})
+		return
+	}
+	if result.err == nil && db.generations != nil {
+		// before the reply, once op's keys are released: rotate locks them all
+		unlock()
+		unlock = func() {}
+		db.rotateIfDue(op)
+	}
+	db.finishWrite(op, result, unlock, meter, span)
+}
+
+// finishWrite releases the keys of op and answers it.
+func (db *DB[T]) finishWrite(op operation[T], result operationResult[T], unlock func(), meter opMeter, span Span) {
+	unlock()
+	if op.fenceSeq != 0 {
+		db.fence.end(op.keys(), op.fenceSeq)
 	}
+	db.stamp(meter, &result)
+	endSpan(span, result.err)
+	db.recordError(op, result.err)
+	op.reply(result)
 }
 
 func (db *DB[T]) readWorker() {
-	db.wg.Add(1)
-	defer db.wg.Done()
+	defer db.readWG.Done()
+	<-db.ready
 	for op := range db.readOps {
-		var result operationResult[T]
+		if err := db.rejection(op); err != nil {
+			op.reply(operationResult[T]{err: err})
+			continue
+		}
 		entryLock := db.getLock(op.key)
-		entryLock.Lock()
-		switch op.action {
-		case "read":
-			value, err := db.read(op.key)
-			result = operationResult[T]{err: err, value: value}
-		default:
-			err := dbError.UnkownOperation(op.action)
-			result = operationResult[T]{err: err}
+		if db.fence.isPending(op.key, op.fenceSeq) || !entryLock.TryLock() {
+			// The key has a write queued before this read or is held by one,
+			// possibly a whole batch being synced. Wait for it off the worker
+			// so reads of other keys keep flowing.
+			db.readWG.Add(1)
+			go func(op operation[T]) {
+				defer db.readWG.Done()
+				db.fence.wait(op.key, op.fenceSeq)
+				entryLock.Lock()
+				db.processRead(op, entryLock)
+			}(op)
+			continue
 		}
-		entryLock.Unlock()
-		op.response <- result
-		close(op.response)
+		db.processRead(op, entryLock)
 	}
 }
 
-func (db *DB[T]) create(key string, value DbData[T]) error {
-	entrySize, entryErr := db.isEntryValid(key, value)
-	if entryErr != nil {
-		return entryErr
-	}
-	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(entrySize)
-	if spaceErr != nil {
-		return spaceErr
+// processRead runs a read op holding the key's lock and releases it. It
+// takes the lock rather than a func releasing it, which would escape along
+// with op: a read of a live key allocates nothing but what it returns.
+func (db *DB[T]) processRead(op operation[T], entryLock *keyLock) {
+	meter := db.metered(op)
+	_, span := db.startSpan(op.traceCtx, "kv.process", op)
+	var result operationResult[T]
+	expired := false
+	var slid *time.Time
+	switch op.action {
+	case "read":
+		value, err := db.read(op.key)
+		if exists := db.data.has(op.key); !exists && db.generations != nil && db.opts().chainedReads {
+			value, err = db.chainedRead(op.key)
+		}
+		expired = err != nil && db.isExpired(op.key)
+		if expired {
+			if stale, ok := db.staleRead(op.key); ok {
+				value, err, expired = stale, nil, false
+			}
+		}
+		result = operationResult[T]{err: err, value: value}
+		if err == nil {
+			db.readHits.Add(1)
+		} else {
+			db.readMisses.Add(1)
+		}
+		if db.hotKeys != nil {
+			db.hotKeys.add(op.key)
+		}
+		if err == nil && !value.Stale {
+			slid = db.slidExpiry(value)
+		}
+	case "expiredKeys":
+		result = operationResult[T]{keys: db.expiredKeys()}
+	case "readMatching":
+		entries, err := db.readMatching(op.key)
+		result = operationResult[T]{err: err, entries: entries}
+	case "exists":
+		result = operationResult[T]{exists: db.exists(op.key)}
+	case "ping":
+		result = operationResult[T]{}
+	default:
+		err := dbError.UnkownOperation(op.action)
+		result = operationResult[T]{err: err}
 	}
-	if !isSpaceAvailable {
-		return dbError.NotAvailabeSpace("")
+	if expired && !db.readOnly.Load() {
+		db.queueExpire(op.key)
 	}
-	db.data[key] = value
-	err := db.localStorage.Sync(db.data)
-	if err != nil {
-		println("---------------Rollback---------------------")
-		delete(db.data, key)
-		return err
+	if slid != nil && !db.readOnly.Load() {
+		result.value.Expires_at = slid
+		db.queueTouch(op.key, *slid)
 	}
+	entryLock.Unlock()
+	db.putLock(op.key, entryLock)
+	db.stamp(meter, &result)
+	endSpan(span, result.err)
+	db.recordError(op, result.err)
+	op.reply(result)
+}
 
-	return nil
+// create is Create with FailAll, for the DB's own keys.
+func (db *DB[T]) create(key string, value DbData[T]) error {
+	return db.createEntries(map[string]DbData[T]{key: value}, FailAll, dbError.NotAvailabeSpace, nil).Err
 }
 
-func (db *DB[T]) batchCreate(batchData map[string]DbData[T]) error {
+func (db *DB[T]) batchCreate(batchData map[string]DbData[T], policy ConflictPolicy) BatchResult {
 	// A batch limit of 100-500 entries ensures efficient performance without overloading the system.
 	// This range strikes a balance between throughput and manageable data size (1.6 MB to 8 MB), as large batch sizes are uncommon in typical use cases.
 	// 100 entries * 16 KB = 1.6 MB
 	// 500 entries * 16 KB = 8 MB
 	if len(batchData) > BatchLimit {
-		return dbError.BatchLimitCountExceeds("")
+		return BatchResult{Err: dbError.BatchLimitCountExceeds("")}
 	}
-	for key := range batchData {
-		_, entryErr := db.isEntryValid(key, batchData[key])
+	return db.createEntries(batchData, policy, dbError.BatchSizeLimitCrossed, nil)
+}
+
+// createEntries is the single code path behind create and batchCreate: every
+// entry is validated, the space check covers all of them at once, and the
+// data is synced a single time. policy says what happens to the keys that
+// already exist and to the entries rejected: with FailAll nothing is applied
+// if any is, with the other policies the valid entries are. A failed sync
+// rolls all of them back. The caller holds the per-key locks of every key.
+func (db *DB[T]) createEntries(entries map[string]DbData[T], policy ConflictPolicy, noSpaceErr func(info string) error, prepared map[string]checkedEntry[T]) BatchResult {
+	result := BatchResult{Entries: make(map[string]BatchEntryResult, len(entries))}
+	totalSizeKB := 0.0
+	owned := make(map[string]DbData[T], len(entries))
+	sizesKB := make(map[string]float64, len(entries))
+	previous := make(map[string]DbData[T]) // live entries being overwritten
+	hashes := make(map[valueHash]string)   // values of the batch, for WithUniqueValues
+	for key, value := range entries {
+		if exists := db.data.has(key); exists && policy != FailAll {
+			if db.isExpired(key) {
+				if err := db.expireEntry(key); err != nil {
+					return result.abort(err)
+				}
+			} else if policy == SkipExisting {
+				result.set(key, BatchSkipped, nil)
+				continue
+			} else if err := db.checkMutable(key); err != nil {
+				result.set(key, BatchFailed, err)
+				continue
+			} else {
+				previous[key] = db.data.entry(key)
+			}
+		}
+		var entryErr error
+		if _, overwriting := previous[key]; !overwriting {
+			entryErr = db.checkAbsent(key)
+		}
+		checked, isPrepared := prepared[key]
+		if entryErr == nil && !isPrepared {
+			checked = db.checkEntry(key, value)
+		}
+		if entryErr == nil {
+			entryErr = checked.err
+		}
+		if entryErr == nil {
+			entryErr = db.checkUnique(key, value, hashes)
+		}
 		if entryErr != nil {
-			return entryErr
+			delete(previous, key)
+			result.set(key, BatchFailed, entryErr)
+			continue
 		}
+		ownedValue := checked.entry
+		ownedValue.Deleted_at = nil // only the DB makes tombstones
+		ownedValue.Pinned = previous[key].Pinned
+		owned[key] = ownedValue
+		sizesKB[key] = checked.sizeKB
+		totalSizeKB += checked.sizeKB
+		result.set(key, batchPending, nil)
 	}
-	jsonBatchedData, jsonErr := json.Marshal(batchData)
-	if jsonErr != nil {
-		return jsonErr
+	if policy == FailAll {
+		if failed := result.FailedKeys(); len(failed) > 0 {
+			return result.abort(result.Entries[failed[0]].Err)
+		}
+	}
+	if len(owned) == 0 {
+		result.summarize()
+		return result
+	}
+	held := func(key string) bool { _, ok := entries[key]; return ok }
+	if err := db.checkEntryLimit(len(owned)-len(previous), held); err != nil {
+		return result.abort(err)
 	}
-	jsonBatchedDataSizeKb := BytesToKB(len(jsonBatchedData))
-	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(jsonBatchedDataSizeKb)
+	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(totalSizeKB)
 	if spaceErr != nil {
-		return spaceErr
+		return result.abort(spaceErr)
 	}
 	if !isSpaceAvailable {
-		return dbError.BatchSizeLimitCrossed("")
+		return result.abort(noSpaceErr(""))
 	}
-	// fmt.Printf("Batch Operation :%.2f mb, %.2f\n", kbToMb(jsonBatchedDataSizeKb), jsonBatchedDataSizeKb)
-	for key, value := range batchData {
-		db.data[key] = value
+	replaced := make(map[string]DbData[T])
+	for key, value := range owned {
+		if tombstone, exists := db.tombstones[key]; exists {
+			replaced[key] = tombstone
+			db.removeTombstone(key)
+		}
+		db.setEntry(key, value)
 	}
-	err := db.localStorage.Sync(db.data)
+	err := db.sync()
 	if err != nil {
-		for key := range batchData { // rollback
-			delete(db.data, key)
+		println("---------------Rollback---------------------")
+		for key := range owned {
+			if entry, overwritten := previous[key]; overwritten {
+				db.setEntry(key, entry)
+			} else {
+				db.removeEntry(key)
+			}
 		}
-		return err
+		for key, tombstone := range replaced {
+			db.setTombstone(key, tombstone)
+		}
+		return result.abort(err)
 	}
-	// val, _ := db.localStorage.getFileSizeInKB()
-	// fmt.Printf("After writing file size :%.2f mb", kbToMb(val))
-	return nil
+	keys := make([]string, 0, len(owned))
+	for key := range owned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]OplogRecord[T], 0, len(keys))
+	for _, key := range keys {
+		if _, overwritten := previous[key]; overwritten {
+			result.set(key, BatchOverwritten, nil)
+			records = append(records, sizedRecord(OplogUpdate, key, owned[key], sizesKB[key]))
+		} else {
+			result.set(key, BatchCreated, nil)
+			records = append(records, sizedRecord(OplogCreate, key, owned[key], sizesKB[key]))
+		}
+	}
+	db.logOps(records...)
+	result.summarize()
+	return result
 }
 func (db *DB[T]) Delete(key string) operationResult[T] {
-	if db.closed {
+	if db.closed.Load() {
 		return operationResult[T]{err: dbError.DatabaseAlreadyClose("")}
 	}
 	op := operation[T]{
@@ -246,14 +1182,18 @@ func (db *DB[T]) Delete(key string) operationResult[T] {
 		response: make(chan operationResult[T], 1),
 	}
 
-	db.writeOps <- op
-	return <-op.response
+	return db.submitWrite(op)
 }
 
 func (db *DB[T]) delete(key string) error {
-	if _, exists := db.data[key]; exists {
-		isExpired := db.IsExpired(key)
-		err := db.deleteEntry(key)
+	if db.data.has(key) {
+		isExpired := db.isExpired(key)
+		var err error
+		if isExpired {
+			err = db.expireEntry(key)
+		} else if err = db.checkMutable(key); err == nil {
+			err = db.deleteEntry(key, OplogDelete)
+		}
 		if err != nil && !isExpired {
 			return err
 		} else if isExpired {
@@ -264,34 +1204,60 @@ func (db *DB[T]) delete(key string) error {
 	return dbError.KeyNotFound("")
 }
 
+// read looks key up without changing anything; the caller removes an entry
+// found expired.
 func (db *DB[T]) read(key string) (DbData[T], error) {
 
-	if valueObj, exists := db.data[key]; exists {
-		if db.IsExpired(key) {
-			db.deleteEntry(key)
+	if valueObj, exists := db.data.get(key); exists {
+		if db.isExpired(key) {
 			return DbData[T]{}, dbError.KeyExpired("")
 		}
-		return valueObj, nil
+		return db.ownCopy(valueObj)
 	}
 	return DbData[T]{}, dbError.KeyNotFound("")
 }
-func (db *DB[T]) IsExpired(key string) bool {
-	if db.data[key].Ttl == "" {
-		return false
+
+// ownCopy deep-copies the entry's value when WithCopyOnRead is set, so the
+// entry crossing the API boundary doesn't share memory with the store.
+func (db *DB[T]) ownCopy(entry DbData[T]) (DbData[T], error) {
+	if !db.opts().copyOnRead {
+		return entry, nil
 	}
-	seconds, err := strconv.Atoi(db.data[key].Ttl)
+	copied, err := deepCopy(entry.Value)
 	if err != nil {
-		return false // todo : handle
+		return DbData[T]{}, dbError.FailedToConvertMapToJson(fmt.Sprintf("%s", err))
+	}
+	entry.Value = copied
+	return entry, nil
+}
+func (db *DB[T]) IsExpired(key string) bool {
+	return db.isExpired(key)
+}
+
+func (db *DB[T]) isExpired(key string) bool {
+	expiresAt, ok := db.data.entry(key).expiresAt()
+	if !ok {
+		return false
 	}
-	return time.Now().After(db.data[key].Created_at.Add(time.Duration(seconds) * time.Second))
+	return db.now().After(expiresAt)
 }
 
 func (db *DB[T]) PrintValue(key string) {
-	data := db.data[key]
+	data := db.data.entry(key)
 	fmt.Printf("DbData:\n  Value: %v\n  Ttl: %v\n  Created_at: %v\n", data.Value, data.Ttl, data.Created_at)
 }
 
-func (db *DB[T]) isValidJson(data DbData[T]) (float64, error) {
+func (db *DB[T]) isValidJson(key string, data DbData[T]) (float64, error) {
+	sizeKB, err := entrySizeKB(data, db.entryLimitKB(key))
+	if err != nil {
+		return sizeKB, dbError.JsonSizeExceedsLimit(fmt.Sprintf("key %s: %s", key, err.(*dbError.DBError).AdditionalInfo))
+	}
+	return sizeKB, nil
+}
+
+// entrySizeKB returns the encoded size of an entry, which must stay within
+// limitKB.
+func entrySizeKB[T any](data DbData[T], limitKB float64) (float64, error) {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return 0, dbError.FailedToConvertMapToJson(fmt.Sprintf("%s", err))
@@ -301,13 +1267,21 @@ func (db *DB[T]) isValidJson(data DbData[T]) (float64, error) {
 	// fmt.Printf("Entry Value: %+v\n", data)
 	// fmt.Printf("Size in kilobytes: %.2f KB\n", BytesToKB(len(jsonData)))
 	jsonSize := BytesToKB(len(jsonData))
-	if jsonSize > EntrySizeLimitMB*KB {
-		return jsonSize, dbError.JsonSizeExceedsLimit("")
+	if raw, ok := any(data.Value).([]byte); ok {
+		// JSON carries []byte as base64, a third bigger than the raw value
+		// that binary storage keeps; count the raw bytes.
+		jsonSize -= BytesToKB(base64.StdEncoding.EncodedLen(len(raw)) - len(raw))
+	}
+	if data.Blob != nil {
+		jsonSize += float64(data.Blob.Size) / KB
+	}
+	if jsonSize > limitKB {
+		return jsonSize, dbError.JsonSizeExceedsLimit(fmt.Sprintf("entry is %.2f KB, the limit is %.0f KB", jsonSize, limitKB))
 	}
 	return jsonSize, nil
 }
 func (db *DB[T]) checkAvailableSpace(entrySizeKB float64) (bool, float64, error) {
-	FileSizekB, err := db.localStorage.getFileSizeInKB()
+	FileSizekB, err := db.storage.Size()
 	if err != nil {
 		return false, 0, dbError.FailedToGetFileSize("")
 	}
@@ -315,84 +1289,415 @@ func (db *DB[T]) checkAvailableSpace(entrySizeKB float64) (bool, float64, error)
 	if FileSizekB+entrySizeKB > StorageLimitMB*KB {
 		return false, FileSizekB, nil
 	}
+	if quota := db.opts().quota; quota != nil && !quota.allow(db.opts().quotaTenant, FileSizekB, entrySizeKB) {
+		return false, FileSizekB, dbError.NotAvailabeSpace(fmt.Sprintf("the storage quota of %.0f KB shared by the tenants is used up", quota.limitKB))
+	}
+	for _, dir := range storageDirs(db.storage) {
+		// a sync rewrites the whole file: fail now rather than halfway through
+		if err := checkDiskSpace(dir, FileSizekB+entrySizeKB); err != nil {
+			return false, FileSizekB, err
+		}
+	}
 
 	return true, FileSizekB, nil
 }
-func (db *DB[T]) Close() error {
 
-	if db.closed {
-		return dbError.DBAlreadyClosed("")
+// rejection is why a worker doesn't run op: the load failed, the DB is
+// closing, or the caller stopped waiting for it (see WithOpTimeout). Nil if
+// it should run.
+func (db *DB[T]) rejection(op operation[T]) error {
+	if db.loadErr != nil {
+		return db.loadErr
 	}
+	select {
+	case <-db.closeCh:
+		return dbError.ErrClosed(op.action)
+	default:
+	}
+	if !op.deadline.IsZero() && time.Now().After(op.deadline) {
+		return dbError.ErrDBTimeout(fmt.Sprintf("%s dropped, still queued at its deadline", op.action))
+	}
+	return nil
+}
 
-	db.closed = true
+// Close shuts the DB down. An operation being applied completes; the ones
+// still queued are not applied and fail with ErrClosed, as do the callers
+// waiting for room in a full queue. Once Close returns nothing is written
+// anymore.
+func (db *DB[T]) Close() error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	// let the requests the servers are handling complete first
+	db.stopServers()
+	if !db.closed.CompareAndSwap(false, true) {
+		return dbError.DBAlreadyClosed("")
+	}
+	db.stopServers() // started meanwhile
+	// the workers reject whatever they take from now on, and the callers
+	// waiting to queue give up
+	close(db.closeCh)
+	// wait for those still queueing: then no op is queued anymore
+	db.closeMu.Lock()
+	db.closeMu.Unlock()
 
+	if db.followDone != nil {
+		// it queues reloads, stop it before the queues are closed
+		<-db.followDone
+	}
+	// the cleanup and backup workers queue their runs as well
+	if db.backups != nil {
+		<-db.backups.done
+	}
 	close(db.stopCleanupCh)
+	db.cleanupWG.Wait()
 
-	// Close channels - any existing operations in the channels
-	// will still be processed.
-	close(db.writeOps)
+	// Close channels - the workers reject the operations left in them.
+	// Reads go first since they can queue the removal of the expired
+	// entries they find.
 	close(db.readOps)
+	db.readWG.Wait()
+	close(db.writeOps)
+	close(db.adminOps)
 
 	db.wg.Wait()
+	db.closeStatusFile()
+	db.runCloseHooks()
+
+	if db.readOnly.Load() {
+		return nil
+	}
+	return db.storage.Unlock()
+}
 
-	return db.localStorage.releaseLock()
+// CleanupStats describes the last run of the cleanup worker.
+type CleanupStats struct {
+	Runs     int           // Runs since the DB was opened
+	LastRun  time.Time     // Start of the last run, zero before the first one
+	Duration time.Duration // How long the last run took
+	Removed  int           // Expired entries removed by the last run
+	Synced   bool          // Whether the last run had anything to sync
+	Err      error         // Sync error of the last run
+}
+
+// LastCleanup returns the stats of the cleanup worker's last run.
+func (db *DB[T]) LastCleanup() CleanupStats {
+	db.cleanupMu.Lock()
+	defer db.cleanupMu.Unlock()
+	return db.cleanupStats
 }
 
 func (db *DB[T]) startCleanupWorker() {
-	db.wg.Add(1)
-	defer db.wg.Done()
+	defer db.cleanupWG.Done()
+	if db.readOnly.Load() {
+		return
+	}
 
-	ticker := time.NewTicker(cleanpInterval)
+	select {
+	case <-db.ready:
+		if db.loadErr != nil {
+			return
+		}
+	case <-db.stopCleanupCh:
+		return
+	}
+
+	ticker := db.opts().clock.NewTicker(time.Hour)
+	db.armCleanupTimer(ticker, db.nextCleanupDelay())
 	defer ticker.Stop()
 	for {
 		select {
-		case <-ticker.C:
-			db.cleanupExpiredKeys()
+		case <-db.expiries.wake:
+			db.armCleanupTimer(ticker, db.nextCleanupDelay())
+		case <-db.reconfigured:
+			db.armCleanupTimer(ticker, db.nextCleanupDelay())
+		case <-ticker.C():
+			start := time.Now()
+			result := db.submit(db.adminOps, operation[T]{
+				action:   "cleanup",
+				response: make(chan operationResult[T], 1),
+			})
+			removed, err := result.count, result.err
+			db.cleanupMu.Lock()
+			db.cleanupStats = CleanupStats{
+				Runs:     db.cleanupStats.Runs + 1,
+				LastRun:  start,
+				Duration: time.Since(start),
+				Removed:  removed,
+				Synced:   removed > 0,
+				Err:      err,
+			}
+			db.cleanupMu.Unlock()
+			if err != nil {
+				// the failed keys are due again right away, don't spin on them
+				db.armCleanupTimer(ticker, db.opts().cleanupInterval)
+			} else {
+				db.armCleanupTimer(ticker, db.nextCleanupDelay())
+			}
 		case <-db.stopCleanupCh:
 			return
 		}
 	}
 }
 
-func (db *DB[T]) cleanupExpiredKeys() {
-	for key := range db.data {
-		if db.IsExpired(key) {
-			entryLock := db.getLock(key)
-			entryLock.Lock()
-			defer entryLock.Unlock()
-			delete(db.data, key)
+// armCleanupTimer schedules the next cleanup run after delay, or none while
+// the cleanup interval is 0.
+func (db *DB[T]) armCleanupTimer(ticker Ticker, delay time.Duration) {
+	ticker.Stop()
+	if db.opts().cleanupInterval > 0 {
+		ticker.Reset(max(delay, 1)) // a ticker can't be due right away
+	}
+}
+
+// nextCleanupDelay is the time until the next key expires, capped by the
+// cleanup interval plus a random jitter (so several instances opened together
+// don't sweep and sync in lockstep).
+func (db *DB[T]) nextCleanupDelay() time.Duration {
+	options := db.opts()
+	delay := options.cleanupInterval
+	if options.cleanupJitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(options.cleanupJitter)))
+	}
+	if nextExpiry, ok := db.expiries.next(); ok {
+		untilNext := max(nextExpiry.Sub(db.now()), 0)
+		delay = min(delay, untilNext)
+	}
+	return delay
+}
+
+// Compact drops every expired entry and the tombstones past their retention
+// (see WithSoftDelete), and rewrites the storage. It goes through the admin
+// lane, see WithAdminPriority. The result count is the number of entries and
+// tombstones dropped.
+func (db *DB[T]) Compact() operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	if db.readOnly.Load() {
+		return operationResult[T]{err: dbError.ReadOnlyDatabase("compact")}
+	}
+	op := operation[T]{
+		action:   "compact",
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submit(db.adminOps, op)
+}
+
+func (db *DB[T]) compact() (int, error) {
+	db.io.rewrites.Add(1)
+	purged := db.purgeTombstones()
+	removed, err := db.cleanupExpiredKeys(0, nil)
+	if err == nil && removed == 0 {
+		// nothing expired, still rewrite the storage
+		err = db.sync()
+	}
+	if err != nil && removed == 0 { // nothing synced
+		for key, tombstone := range purged { // rollback
+			db.setTombstone(key, tombstone)
+		}
+		return 0, err
+	}
+	if err == nil && db.blobs != nil {
+		err = db.collectBlobs()
+	}
+	return removed + len(purged), err
+}
+
+// cleanupExpiredKeys scans the whole data set and removes up to limit
+// expired entries (all of them when limit is 0), syncing once if anything was
+// removed. Each key's lock is only held while that key is checked and removed;
+// held, if not nil, reports the keys the caller holds the locks of already.
+func (db *DB[T]) cleanupExpiredKeys(limit int, held func(key string) bool) (int, error) {
+	var expiredKeys []string
+	for _, key := range db.data.keys() {
+		if db.isExpired(key) {
+			expiredKeys = append(expiredKeys, key)
+			if limit > 0 && len(expiredKeys) == limit {
+				break
+			}
+		}
+	}
+	return db.removeExpired(expiredKeys, held)
+}
+
+// cleanupDueKeys is the cleanup worker's pass: it only looks at the keys the
+// expiry queue reports as due, up to limit of them.
+func (db *DB[T]) cleanupDueKeys(limit int) (int, error) {
+	return db.removeExpired(db.expiries.popDue(db.now(), limit), nil)
+}
+
+// removeExpired removes the given keys that are still expired, then syncs
+// once if anything was removed. On a failed sync they are put back, and so
+// rescheduled for the next run. The locks of the keys held reports, if not
+// nil, are held by the caller already.
+func (db *DB[T]) removeExpired(keys []string, held func(key string) bool) (int, error) {
+	lock := func(key string) func() {
+		if held != nil && held(key) {
+			return func() {}
+		}
+		return db.lockKey(key)
+	}
+	removed := make(map[string]DbData[T], len(keys))
+	var archiveErr error
+	for _, key := range keys {
+		unlock := lock(key)
+		// it may have been updated since it was picked
+		if entry, exists := db.data.get(key); exists {
+			if !db.isExpired(key) {
+				db.setEntry(key, entry) // reschedules it
+			} else if err := db.archiveExpired(key, entry); err != nil {
+				archiveErr = err
+				db.setEntry(key, entry) // kept until it can be archived
+			} else {
+				removed[key] = entry
+				db.removeEntry(key)
+			}
+		}
+		unlock()
+	}
+	if len(removed) == 0 {
+		return 0, archiveErr
+	}
+	err := db.sync()
+	if err != nil {
+		for key, entry := range removed { // rollback
+			unlock := lock(key)
+			if !db.data.has(key) {
+				db.setEntry(key, entry)
+			}
+			unlock()
 		}
+		return 0, err
+	}
+	for key := range removed {
+		db.logOps(OplogRecord[T]{Op: OplogExpire, Key: key})
 	}
-	db.localStorage.Sync(db.data)
+	return len(removed), archiveErr
 }
-func (db *DB[T]) deleteEntry(key string) error {
-	entry := db.data[key]
-	delete(db.data, key)
-	err := db.localStorage.Sync(db.data)
+
+// deleteEntry removes key and syncs; op is what the oplog records it as
+// (OplogDelete or OplogExpire).
+func (db *DB[T]) deleteEntry(key string, op string) error {
+	if op == OplogDelete && db.opts().softDelete {
+		return db.softDeleteEntry(key)
+	}
+	entry := db.data.entry(key)
+	db.removeEntry(key)
+	err := db.sync()
 	if err != nil {
 		// rollback
-		db.data[key] = entry
+		db.setEntry(key, entry)
+		return err
+	}
+	db.logOps(OplogRecord[T]{Op: op, Key: key})
+	return nil
+}
+
+// setEntry stores entry under key and keeps the expiry queue in step. Every
+// change to db.data goes through setEntry or removeEntry.
+func (db *DB[T]) setEntry(key string, entry DbData[T]) {
+	db.setEntryAt(key, entry, time.Now())
+}
+
+// setEntryAt is setEntry for an entry last written at updated.
+func (db *DB[T]) setEntryAt(key string, entry DbData[T], updated time.Time) {
+	entry.Seq = db.changed()
+	db.putEntry(key, entry, updated)
+}
+
+// putEntry is setEntryAt keeping the sequence number of entry, for entries
+// read from the storage.
+func (db *DB[T]) putEntry(key string, entry DbData[T], updated time.Time) {
+	entry = withMonotonic(entry, time.Now())
+	entry.Stale = false
+	var hash valueHash
+	var indexed bool
+	if db.values != nil {
+		hash, indexed = hashValue(entry)
+	}
+	db.data.set(key, entry)
+	db.dataMu.Lock()
+	db.keyIndex.put(key, entry.Created_at, updated)
+	if db.values != nil {
+		db.values.put(key, hash, indexed)
+	}
+	db.dataMu.Unlock()
+	if expiresAt, ok := entry.expiresAt(); ok {
+		db.expiries.set(key, expiresAt.Add(db.opts().staleGrace))
+	} else {
+		db.expiries.remove(key)
 	}
-	return err
 }
-func (db *DB[T]) isEntryValid(key string, value DbData[T]) (float64, error) {
-	if len(key) > 32 {
-		return 0, dbError.KeySizeExceedsLimit(32, "")
+
+func (db *DB[T]) removeEntry(key string) {
+	if !db.data.has(key) {
+		return
 	}
-	if _, exists := db.data[key]; exists {
-		if db.IsExpired(key) {
-			db.deleteEntry(key) // no need to pass the error (will get roll back)
+	db.data.delete(key)
+	db.dataMu.Lock()
+	db.keyIndex.remove(key)
+	if db.values != nil {
+		db.values.remove(key)
+	}
+	db.dataMu.Unlock()
+	db.changed()
+	db.expiries.remove(key)
+}
+
+// checkAbsent fails with EntryAlreadyExists if key holds an entry, which
+// goes if it expired.
+func (db *DB[T]) checkAbsent(key string) error {
+	if len(key) > KeySizeLimit {
+		return dbError.KeySizeExceedsLimit(KeySizeLimit, "")
+	}
+	if db.data.has(key) {
+		if db.isExpired(key) {
+			db.expireEntry(key) // no need to pass the error (will get roll back)
 		}
-		return 0, dbError.EntryAlreadyExists(fmt.Sprintf("key : %s", key))
+		return dbError.EntryAlreadyExists(fmt.Sprintf("key : %s", key))
 	}
-	valueSize, valErr := db.isValidJson(value)
+	return nil
+}
+
+// checkedEntry is an entry that went through checkEntry: the copy to store,
+// its size and the check that failed, if any.
+type checkedEntry[T any] struct {
+	entry  DbData[T]
+	sizeKB float64
+	err    error
+}
+
+// checkEntry runs the checks of an entry that don't depend on the data, key
+// size, TTL, encoded size and validators, and takes the copy of it to store.
+func (db *DB[T]) checkEntry(key string, value DbData[T]) checkedEntry[T] {
+	var checked checkedEntry[T]
+	checked.sizeKB, checked.err = db.validateEntry(key, value)
+	if checked.err == nil {
+		checked.err = db.validate(key, value.Value)
+	}
+	if checked.err == nil {
+		checked.entry, checked.err = db.ownCopy(value)
+	}
+	return checked
+}
+
+// validateEntry checks the entry itself, wherever it goes: key size, TTL and
+// encoded size.
+func (db *DB[T]) validateEntry(key string, value DbData[T]) (float64, error) {
+	if len(key) > KeySizeLimit {
+		return 0, dbError.KeySizeExceedsLimit(KeySizeLimit, "")
+	}
+	if ttlErr := validateTTL(value); ttlErr != nil {
+		return 0, ttlErr
+	}
+	valueSize, valErr := db.isValidJson(key, value)
 	if valErr != nil {
 		return 0, valErr
 	}
 	return valueSize, nil
 }
 func (db *DB[T]) Update(key string, value DbData[T]) operationResult[T] {
-	if db.closed {
+	if db.closed.Load() {
 		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
 	}
 	op := operation[T]{
@@ -401,39 +1706,60 @@ func (db *DB[T]) Update(key string, value DbData[T]) operationResult[T] {
 		value:    value,
 		response: make(chan operationResult[T], 1),
 	}
-	db.writeOps <- op
-	return <-op.response
+	return db.submitWrite(op)
 }
 
-func (db *DB[T]) update(key string, updatedVal DbData[T]) error {
-	_, entryExists := db.data[key]
+// update replaces the entry of key. checked is updatedVal through
+// checkEntry if a validation shard did it already, nil otherwise.
+func (db *DB[T]) update(key string, updatedVal DbData[T], checked *checkedEntry[T]) error {
+	entryExists := db.data.has(key)
 	if !entryExists {
 		return dbError.EntryNotExists("")
 	}
-	if db.IsExpired(key) {
-		delete(db.data, key)
+	if db.isExpired(key) {
+		db.expireEntry(key)
 		return dbError.EntryExpired("")
 	}
-	entrySize, _ := db.isEntryValid(key, updatedVal)
-	// TODO: handle entryErr here
-	// if entryErr != nil && !errors.As(entryErr, dbError.EntryAlreadyExists("").Error()) {
-	// 	return entryErr
-	// }
-	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(entrySize)
+	if err := db.checkMutable(key); err != nil {
+		return err
+	}
+	if checked == nil {
+		unprepared := db.checkEntry(key, updatedVal)
+		checked = &unprepared
+	}
+	if checked.err != nil {
+		return checked.err
+	}
+	if err := db.checkUnique(key, updatedVal, nil); err != nil {
+		return err
+	}
+	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(checked.sizeKB)
 	if spaceErr != nil {
 		return spaceErr
 	}
 	if !isSpaceAvailable {
 		return dbError.NotAvailabeSpace("")
 	}
-	previousVal := db.data[key]
-	db.data[key] = updatedVal
-	err := db.localStorage.Sync(db.data)
+	ownedVal := checked.entry
+	ownedVal.Deleted_at = nil
+	previousVal := db.data.entry(key)
+	ownedVal.Pinned = previousVal.Pinned
+	ownedVal.Immutable = false // only a create makes an entry immutable
+	db.setEntry(key, ownedVal)
+	if db.coalescer.deferUpdate(key, time.Now()) {
+		db.logOps(sizedRecord(OplogUpdate, key, ownedVal, checked.sizeKB))
+		return nil
+	}
+	err := db.sync()
 	if err != nil {
 		println("---------------Rollback---------------------")
-		db.data[key] = previousVal
+		db.setEntry(key, previousVal)
 		return err
 	}
+	if db.group == nil { // else once the group is
+		db.coalescer.synced(key, time.Now())
+	}
+	db.logOps(entryRecord(OplogUpdate, key, ownedVal))
 
 	return nil
 }
@@ -151,3 +151,205 @@ func FailedToGetFileInfo(info string) error {
 func FailedToLoadFile(info string) error {
 	return NewDBError("Faield to load file", info)
 }
+
+func FailedToUploadSnapshot(info string) error {
+	return NewDBError("Failed to upload snapshot", info)
+}
+
+func ObjectStorageRequestFailed(info string) error {
+	return NewDBError("Object storage request failed", info)
+}
+
+func InvalidTTL(info string) error {
+	return NewDBError("Invalid TTL", info)
+}
+
+func FailedToArchiveEntry(info string) error {
+	return NewDBError("Failed to archive expired entry", info)
+}
+
+func ReadOnlyDatabase(info string) error {
+	return NewDBError("Database is read-only", info)
+}
+
+func OplogNotEnabled(info string) error {
+	return NewDBError("Oplog is not enabled", info)
+}
+
+func RestoreTargetNotEmpty(info string) error {
+	return NewDBError("Restore target already holds data", info)
+}
+
+func ErrRateLimited(info string) error {
+	return NewDBError("Rate limit exceeded", info)
+}
+
+func ErrEntryLimitReached(info string) error {
+	return NewDBError("Entry limit reached", info)
+}
+
+func OptionNotReloadable(info string) error {
+	return NewDBError("Option can't be changed on an open database", info)
+}
+
+func HistoryNotEnabled(info string) error {
+	return NewDBError("History is not enabled", info)
+}
+
+func VersionNotFound(info string) error {
+	return NewDBError("Version not found", info)
+}
+
+func ErrClosed(info string) error {
+	return NewDBError("DB closed before the operation was applied", info)
+}
+
+func InvalidQueueName(info string) error {
+	return NewDBError("Invalid queue name", info)
+}
+
+func QueueEmpty(info string) error {
+	return NewDBError("Queue is empty", info)
+}
+
+func ReceiptInvalid(info string) error {
+	return NewDBError("Queue item is not held with this receipt", info)
+}
+
+func LeaseHeld(info string) error {
+	return NewDBError("Lease is held by another owner", info)
+}
+
+func LeaseLost(info string) error {
+	return NewDBError("Lease is not held anymore", info)
+}
+
+// ValidationError is returned when a write is rejected by a validator, whose
+// error it wraps.
+type ValidationError struct {
+	DBError
+	Err error
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func ValidationFailed(info string, err error) error {
+	return &ValidationError{
+		DBError: DBError{Message: "Validation failed: " + err.Error(), AdditionalInfo: info},
+		Err:     err,
+	}
+}
+
+func DatabaseFrozen(info string) error {
+	return NewDBError("Database is frozen", info)
+}
+
+func DatabaseNotFrozen(info string) error {
+	return NewDBError("Database is not frozen", info)
+}
+
+func BlobsNotEnabled(info string) error {
+	return NewDBError("Blobs are not enabled", info)
+}
+
+func NotABlob(info string) error {
+	return NewDBError("Entry is not a blob", info)
+}
+
+func ErrDiskFull(info string) error {
+	return NewDBError("Not enough free disk space", info)
+}
+
+func InvalidListToken(info string) error {
+	return NewDBError("Invalid list continuation token", info)
+}
+
+func DedupNotEnabled(info string) error {
+	return NewDBError("Dedup is not enabled", info)
+}
+
+func DuplicateValue(info string) error {
+	return NewDBError("Value already stored", info)
+}
+
+func MigrationFailed(info string) error {
+	return NewDBError("Migration failed", info)
+}
+
+func HotKeysNotEnabled(info string) error {
+	return NewDBError("Hot key tracking is not enabled", info)
+}
+
+func InvalidBatch(info string) error {
+	return NewDBError("Invalid batch", info)
+}
+
+func PreconditionFailed(info string) error {
+	return NewDBError("Precondition failed", info)
+}
+
+func ErrTypeMismatch(info string) error {
+	return NewDBError("Type mismatch", info)
+}
+
+func NoDatabaseForKey(info string) error {
+	return NewDBError("No database for key", info)
+}
+
+func FailedToDeleteFile(info string) error {
+	return NewDBError("Failed to delete file", info)
+}
+
+func BackupCorrupted(info string) error {
+	return NewDBError("Backup is corrupted", info)
+}
+
+func InvalidBackupKey(info string) error {
+	return NewDBError("Invalid backup key", info)
+}
+
+func BackupNotEnabled(info string) error {
+	return NewDBError("Backup directory is not set", info)
+}
+
+func SnapshotCorrupted(info string) error {
+	return NewDBError("Snapshot is corrupted", info)
+}
+
+func InvalidPattern(info string) error {
+	return NewDBError("Invalid key pattern", info)
+}
+
+func ErrTooManyMatches(info string) error {
+	return NewDBError("Too many keys match", info)
+}
+
+func ErrImmutableEntry(info string) error {
+	return NewDBError("Entry is immutable", info)
+}
+
+func Unauthorized(info string) error {
+	return NewDBError("Unauthorized", info)
+}
+
+func AccessDenied(info string) error {
+	return NewDBError("Access denied", info)
+}
+
+func ServerFailed(info string) error {
+	return NewDBError("Server failed", info)
+}
+
+func InvalidRequest(info string) error {
+	return NewDBError("Invalid request", info)
+}
+
+func OplogCorrupted(info string) error {
+	return NewDBError("Oplog is corrupted", info)
+}
+
+func OplogAppendFailed(info string) error {
+	return NewDBError("Failed to append to the oplog", info)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DBSet is several databases of the same value type opened together, each
+// a bucket named after its file (without the extension). Keys are routed to
+// the bucket whose name is their longest prefix, so "users:42" goes to
+// users.json; Bucket gives direct access. The set is closed as a whole.
+type DBSet[T any] struct {
+	names   []string // Sorted
+	buckets map[string]*DB[T]
+}
+
+// OpenSet opens the database files at paths, as OpenPath does, under one
+// handle. Two files can't share a name. If any fails to open, the ones
+// already open are closed again.
+func OpenSet[T any](paths ...string) (*DBSet[T], error) {
+	set := &DBSet[T]{buckets: make(map[string]*DB[T], len(paths))}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, exists := set.buckets[name]; exists {
+			set.Close()
+			return nil, dbError.InvalidFileName(fmt.Sprintf("two databases named %s", name))
+		}
+		db, err := OpenPath[T](path)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		set.buckets[name] = db
+		set.names = append(set.names, name)
+	}
+	sort.Strings(set.names)
+	return set, nil
+}
+
+// Buckets returns the bucket names, sorted.
+func (set *DBSet[T]) Buckets() []string {
+	return append([]string(nil), set.names...)
+}
+
+// Bucket returns the database of bucket name.
+func (set *DBSet[T]) Bucket(name string) (*DB[T], error) {
+	db, exists := set.buckets[name]
+	if !exists {
+		return nil, dbError.NoDatabaseForKey(fmt.Sprintf("no bucket %s", name))
+	}
+	return db, nil
+}
+
+// For returns the database key is routed to.
+func (set *DBSet[T]) For(key string) (*DB[T], error) {
+	route := ""
+	for _, name := range set.names {
+		if strings.HasPrefix(key, name) && len(name) > len(route) {
+			route = name
+		}
+	}
+	if route == "" {
+		return nil, dbError.NoDatabaseForKey(fmt.Sprintf("key : %s", key))
+	}
+	return set.buckets[route], nil
+}
+
+func (set *DBSet[T]) Create(key string, value DbData[T], policy ...ConflictPolicy) operationResult[T] {
+	db, err := set.For(key)
+	if err != nil {
+		return operationResult[T]{err: err}
+	}
+	return db.Create(key, value, policy...)
+}
+
+func (set *DBSet[T]) Read(key string) operationResult[T] {
+	db, err := set.For(key)
+	if err != nil {
+		return operationResult[T]{err: err}
+	}
+	return db.Read(key)
+}
+
+func (set *DBSet[T]) Update(key string, value DbData[T]) operationResult[T] {
+	db, err := set.For(key)
+	if err != nil {
+		return operationResult[T]{err: err}
+	}
+	return db.Update(key, value)
+}
+
+func (set *DBSet[T]) Delete(key string) operationResult[T] {
+	db, err := set.For(key)
+	if err != nil {
+		return operationResult[T]{err: err}
+	}
+	return db.Delete(key)
+}
+
+// Stats returns the stats of every bucket, by name.
+func (set *DBSet[T]) Stats() map[string]Stats {
+	stats := make(map[string]Stats, len(set.buckets))
+	for name, db := range set.buckets {
+		stats[name] = db.Stats()
+	}
+	return stats
+}
+
+// Close closes every database of the set, even if some fail, and returns
+// the first error.
+func (set *DBSet[T]) Close() error {
+	var firstErr error
+	for _, name := range set.names {
+		if err := set.buckets[name].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -1,19 +1,56 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"local-key-value-DB/dbError"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 )
 
 var MaxTestEntries = 500
 
+// NewTestDB opens a DB in a temporary directory of the test, so no data or
+// lock file is left behind. It is closed when the test ends; the test fails
+// right away if it can't be opened. Options are passed on to NewDB.
+func NewTestDB[T any](t testing.TB, opts ...Option) *DB[T] {
+	t.Helper()
+	db, err := NewDB[T]("test", t.TempDir(), opts...)
+	if err != nil {
+		t.Fatalf("opening test DB: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
 func TestFileNameValidation(t *testing.T) {
 	testFiles := []string{
 		"image.jpg",
@@ -35,11 +72,7 @@ func TestFileNameValidation(t *testing.T) {
 }
 
 func TestStoreInit(t *testing.T) {
-	dbIns, err := NewDB[TestVal]("TestStoreInit"+GenerateRandomKey(), "")
-	if err != nil {
-		return
-	}
-	defer dbIns.Close()
+	dbIns := NewTestDB[TestVal](t)
 	key := "storeInit" + GenerateRandomKey()
 	entry := TestEntry("value here,", 12, "")
 	dbIns.Create(key, entry)
@@ -51,20 +84,21 @@ func TestStoreInit(t *testing.T) {
 }
 
 func TestAllowOnlyOneClientConnection(t *testing.T) {
-	fileName := "allowOneConnection" + GenerateRandomKey()
-	dbIns_1, err_1 := NewDB[TestVal](fileName, "")
+	fileName, dir := "allowOneConnection", t.TempDir()
+	dbIns_1, err_1 := NewDB[TestVal](fileName, dir)
 	if err_1 != nil {
 		panic(err_1)
 	}
 	key := "key-1" + GenerateRandomKey()
-	_, err_2 := NewDB[TestVal](fileName, "")
+	_, err_2 := NewDB[TestVal](fileName, dir)
 	require.ErrorContains(t, err_2, dbError.FailedToAcquireLock("").Error())
 	dbIns_1.Close()
 
-	dbsIns_3, err_3 := NewDB[TestVal](fileName, "")
+	dbsIns_3, err_3 := NewDB[TestVal](fileName, dir)
 	require.Equal(t, nil, err_3)
 	entry_3 := TestEntry("value 1", 43, "")
 	dbsIns_3.create(key, entry_3)
+	entry_3.Seq = 1 // the first write of the database
 
 	res := dbsIns_3.Read(key)
 
@@ -74,11 +108,7 @@ func TestAllowOnlyOneClientConnection(t *testing.T) {
 }
 
 func TestBasicCrdOperation(t *testing.T) {
-	db, err := NewDB[TestVal]("basicCRD"+GenerateRandomKey(), "")
-	if err != nil {
-		panic(err)
-	}
-	defer db.Close()
+	db := NewTestDB[TestVal](t)
 	key_1 := "one" + GenerateRandomKey()
 	key_2 := "two" + GenerateRandomKey()
 	entry_1 := TestEntry("value_1", 12, "")
@@ -97,29 +127,34 @@ func TestBasicCrdOperation(t *testing.T) {
 }
 
 func TestTTLChecking(t *testing.T) {
-	db, err := NewDB[TestVal]("testTTL"+GenerateRandomKey(), "")
-	if err != nil {
-		panic(err)
-	}
+	clock := NewManualClock(time.Now())
+	db := NewTestDB[TestVal](t, WithClock(clock))
 	key := "ttl" + GenerateRandomKey()
 	entry := TestEntry("value here", 34, "5")
+	entry.Created_at = clock.Now()
 	db.create(key, entry)
-	time.Sleep(2 * time.Second)
+	entry.Seq = 1 // the first write of the database
+	clock.Advance(2 * time.Second)
 	res_1 := db.Read(key)
 	require.Equal(t, entry, res_1.value)
+	require.False(t, db.IsExpired(key))
+	clock.Advance(4 * time.Second)
+	require.True(t, db.IsExpired(key))
 	res_2 := db.Read(key)
-	require.Equal(t, entry, res_2.value)
-	time.Sleep(3 * time.Second)
-	res_3 := db.Read(key)
-	require.ErrorContains(t, res_3.err, dbError.KeyExpired("").Error())
-	db.Close()
+	// the cleanup worker wakes when the key expires, it may have removed it already
+	require.Error(t, res_2.err)
+	require.Contains(t, []string{dbError.KeyExpired("").Error(), dbError.KeyNotFound("").Error()}, res_2.err.Error())
+
+	// the cleanup worker runs on the clock's ticks too
+	db.create(key, entry)
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Second)
+		return !db.data.has(key)
+	}, time.Second, 10*time.Millisecond)
 }
 
 func TestBatchCreation(t *testing.T) {
-	db, err := NewDB[TestVal]("batchCreation"+GenerateRandomKey(), "")
-	if err != nil {
-		panic(err)
-	}
+	db := NewTestDB[TestVal](t)
 	dataMap := make(map[string]DbData[TestVal])
 	for i := 1; i <= MaxTestEntries; i++ {
 		key := GenerateRandomKey() + GenerateRandomKey() + GenerateRandomKey()
@@ -135,13 +170,11 @@ func TestBatchCreation(t *testing.T) {
 }
 
 func TestNotOverwriting(t *testing.T) {
-	db, err := NewDB[TestVal]("testotoverwrite"+GenerateRandomKey(), "")
-	if err != nil {
-		panic(err)
-	}
+	db := NewTestDB[TestVal](t)
 	key := "key-overwrite" + GenerateRandomKey()
 	entry_1 := TestEntry("sample value", 34, "")
 	db.create(key, entry_1)
+	entry_1.Seq = 1 // the first write of the database
 	readRes := db.Read(key)
 	require.Equal(t, entry_1, readRes.value)
 
@@ -153,8 +186,8 @@ func TestNotOverwriting(t *testing.T) {
 }
 
 func TestLoadExistinFile(t *testing.T) {
-	fileName := "loadExist" + GenerateRandomKey()
-	dbIns_1, err_1 := NewDB[TestVal](fileName, "")
+	fileName, dir := "loadExist", t.TempDir()
+	dbIns_1, err_1 := NewDB[TestVal](fileName, dir)
 	if err_1 != nil {
 		panic(err_1)
 	}
@@ -163,7 +196,7 @@ func TestLoadExistinFile(t *testing.T) {
 	dbIns_1.create(key, entry)
 	dbIns_1.Close()
 
-	dbIns_2, err_2 := NewDB[TestVal](fileName, "")
+	dbIns_2, err_2 := NewDB[TestVal](fileName, dir)
 
 	if err_2 != nil {
 		panic(err_2)
@@ -176,11 +209,7 @@ func TestLoadExistinFile(t *testing.T) {
 }
 
 func TestConcurrentCreateRead(t *testing.T) {
-	db, err := NewDB[TestVal]("testdata"+GenerateRandomKey(), "")
-	if err != nil {
-		t.Fatalf("Failed to initialize DB: %v", err)
-	}
-	defer db.Close()
+	db := NewTestDB[TestVal](t)
 
 	// Test data
 	testKey := "test_key"
@@ -275,18 +304,14 @@ func TestConcurrentCreateRead(t *testing.T) {
 		require.Equal(t, checkEntry.Value, result.value.Value)
 	}
 
-	require.Equal(t, len(db.data), numOps+numOps)
-	fmt.Printf("The map size is %v\n", len(db.data))
+	require.Equal(t, db.data.len(), numOps+numOps)
+	fmt.Printf("The map size is %v\n", db.data.len())
 
 	fmt.Printf("Total Time taken to run %v concurrent reads and writes: %s\n", numOps, totalDuration)
 }
 func TestUpdate(t *testing.T) {
 	numOps := 500
-	db, err := NewDB[Animals]("test_concurrency"+GenerateRandomKey(), "")
-
-	if err != nil {
-		panic(err)
-	}
+	db := NewTestDB[Animals](t)
 	db.Create("key1", AnimalEntry("godzilla", "japan", 0, ""))
 	for i := 1; i <= numOps; i++ {
 		readRes := db.Read("key1")
@@ -304,10 +329,7 @@ func TestUpdate(t *testing.T) {
 func TestDBClose(t *testing.T) {
 	var wg sync.WaitGroup
 	count := 5
-	db, err := NewDB[string]("dbclose"+GenerateRandomKey(), "")
-	if err != nil {
-		t.Fatalf("Failed to create DB: %v", err)
-	}
+	db := NewTestDB[string](t)
 
 	var successOps, failedOps, inProgressOps atomic.Int32
 	var closeOnce sync.Once
@@ -347,7 +369,9 @@ func TestDBClose(t *testing.T) {
 			result := db.Create(key, NewDbData(entry, ""))
 
 			if result.err != nil {
-				if result.err.Error() == dbError.DBAlreadyClosed("").Error() {
+				// rejected once closed, or cancelled while queued
+				if result.err.Error() == dbError.DBAlreadyClosed("").Error() ||
+					strings.Contains(result.err.Error(), dbError.ErrClosed("").Error()) {
 					failedOps.Add(1)
 				} else {
 					t.Errorf("Unexpected error for key %s: %v", key, result.err)
@@ -369,12 +393,8 @@ func TestDBClose(t *testing.T) {
 		t.Errorf("Expected %d total operations, got %d",
 			count, successOps.Load()+failedOps.Load())
 	}
-	// Verify in-progress operations completed
-	if successOps.Load() < inProgressOps.Load() {
-		t.Errorf("Some in-progress operations failed: "+
-			"In-progress: %d, Successful: %d",
-			inProgressOps.Load(), successOps.Load())
-	}
+	// In-progress operations either completed or, if still queued at
+	// Close, were cancelled with ErrClosed: both are counted above.
 
 	// Verify some operations failed after close
 	if failedOps.Load() == 0 {
@@ -385,3 +405,3703 @@ func TestDBClose(t *testing.T) {
 	finalResult := db.Read("1")
 	require.ErrorContains(t, finalResult.err, dbError.DBAlreadyClosed("").Error())
 }
+
+func TestMemoryStorageBackend(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	db, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+
+	_, err = NewDBWithStorage[TestVal](storage)
+	require.ErrorContains(t, err, dbError.FailedToAcquireLock("").Error())
+
+	entry := TestEntry("memory", 7, "")
+	require.NoError(t, db.Create("mem1", entry).err)
+	require.NoError(t, db.Close())
+
+	reopened, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer reopened.Close()
+	res := reopened.Read("mem1")
+	require.NoError(t, res.err)
+	require.Equal(t, entry.Value, res.value.Value)
+}
+
+func TestObjectStorageBootstrap(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(body)
+		}
+	}))
+	defer server.Close()
+	client := NewS3Client(server.URL, "bucket", "us-east-1", "key", "secret")
+
+	db, err := NewDBWithStorage[TestVal](NewObjectStorage[TestVal](NewMemoryStorage[TestVal](), client, "db.json", time.Hour))
+	require.NoError(t, err)
+	entry := TestEntry("in the bucket", 3, "")
+	require.NoError(t, db.Create("s3key", entry).err)
+	require.NoError(t, db.Close())
+	require.Contains(t, objects, "/bucket/db.json")
+
+	// a fresh instance with empty local state bootstraps from the bucket
+	fresh, err := NewDBWithStorage[TestVal](NewObjectStorage[TestVal](NewMemoryStorage[TestVal](), client, "db.json", time.Hour))
+	require.NoError(t, err)
+	defer fresh.Close()
+	res := fresh.Read("s3key")
+	require.NoError(t, res.err)
+	require.Equal(t, entry.Value, res.value.Value)
+}
+
+func TestLazyLoadWithProgress(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("lazyLoad", dir)
+	require.NoError(t, err)
+	entry := TestEntry("lazy", 5, "")
+	require.NoError(t, db.Create("lazy1", entry).err)
+	require.NoError(t, db.Close())
+
+	var lastLoaded, lastTotal atomic.Int64
+	lazyDB, err := NewDB[TestVal]("lazyLoad", dir, WithLazyLoad(), WithLoadProgress(func(loaded int64, total int64) {
+		lastLoaded.Store(loaded)
+		lastTotal.Store(total)
+	}))
+	require.NoError(t, err)
+	defer lazyDB.Close()
+
+	// queued until the background load finishes
+	res := lazyDB.Read("lazy1")
+	require.NoError(t, res.err)
+	require.Equal(t, entry.Value, res.value.Value)
+	require.NoError(t, lazyDB.WaitLoaded())
+	require.NotZero(t, lastTotal.Load())
+	require.Equal(t, lastTotal.Load(), lastLoaded.Load())
+}
+
+func TestBatchCreateIsAllOrNothing(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("existing", TestEntry("old", 1, "")).err)
+
+	res := db.BatchCreate(map[string]DbData[TestVal]{
+		"fresh1":   TestEntry("new", 2, ""),
+		"fresh2":   TestEntry("new", 3, ""),
+		"existing": TestEntry("new", 4, ""),
+	})
+	require.ErrorContains(t, res.err, dbError.EntryAlreadyExists("").Error())
+	require.ErrorContains(t, db.Read("fresh1").err, dbError.KeyNotFound("").Error())
+
+	res = db.BatchCreate(map[string]DbData[TestVal]{
+		"fresh1": TestEntry("new", 2, ""),
+		"fresh2": TestEntry("new", 3, ""),
+	})
+	require.NoError(t, res.err)
+	require.Equal(t, 3, db.Read("fresh2").value.Value.Age)
+}
+
+// blockingStorage holds Load until release is closed.
+type blockingStorage[T any] struct {
+	*MemoryStorage[T]
+	release chan struct{}
+}
+
+func (bs *blockingStorage[T]) Load(dataToLoad *map[string]DbData[T]) error {
+	<-bs.release
+	return bs.MemoryStorage.Load(dataToLoad)
+}
+
+func TestOpTimeoutAndQueueDepth(t *testing.T) {
+	storage := &blockingStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal](), release: make(chan struct{})}
+	db, err := NewDBWithStorage[TestVal](storage, WithLazyLoad(), WithQueueSizes(1, 1), WithOpTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// queued, but the worker is waiting for the load
+	res := db.Create("k1", TestEntry("v", 1, ""))
+	require.ErrorContains(t, res.err, dbError.ErrDBTimeout("").Error())
+	_, writes := db.QueueDepth()
+	require.Equal(t, 1, writes)
+
+	// the queue is full
+	res = db.Create("k2", TestEntry("v", 2, ""))
+	require.ErrorContains(t, res.err, dbError.ErrDBTimeout("").Error())
+
+	close(storage.release)
+	require.NoError(t, db.WaitLoaded())
+	// still queued at its deadline, so dropped rather than applied late
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 0 }, time.Second, 10*time.Millisecond)
+	require.ErrorContains(t, db.Read("k1").err, dbError.KeyNotFound("").Error())
+}
+
+// gatedStorage blocks every Sync while gate is set, until it is closed.
+type gatedStorage[T any] struct {
+	*MemoryStorage[T]
+	gate atomic.Pointer[chan struct{}]
+}
+
+func (gs *gatedStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	if gate := gs.gate.Load(); gate != nil {
+		<-*gate
+	}
+	return gs.MemoryStorage.Sync(data)
+}
+
+func TestReadsBypassBlockedBatch(t *testing.T) {
+	storage := &gatedStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+
+	gate := make(chan struct{})
+	storage.gate.Store(&gate)
+	batchDone := make(chan operationResult[TestVal])
+	go func() { batchDone <- db.BatchCreate(map[string]DbData[TestVal]{"b": TestEntry("b", 2, "")}) }()
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 0 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	blockedRead := make(chan operationResult[TestVal])
+	go func() { blockedRead <- db.Read("b") }()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Read("a").err)
+
+	storage.gate.Store(nil)
+	close(gate)
+	require.NoError(t, (<-batchDone).err)
+	require.NoError(t, (<-blockedRead).err)
+}
+
+func TestCompactDropsExpiredEntries(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithAdminPriority(), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	expired := DbData[TestVal]{Value: NewTestVal("old", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("expired", expired).err)
+	require.NoError(t, db.Create("live", TestEntry("live", 2, "")).err)
+
+	res := db.Compact()
+	require.NoError(t, res.err)
+	require.Equal(t, 1, res.count)
+	require.NoError(t, db.Read("live").err)
+}
+
+func TestKeyLocksAreReclaimed(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		key := "lock" + strconv.Itoa(i)
+		require.NoError(t, db.Create(key, TestEntry("v", i, "")).err)
+		require.NoError(t, db.Read(key).err)
+		require.NoError(t, db.Delete(key).err)
+	}
+	require.Zero(t, db.locks.inUse())
+}
+
+func TestReadYourWrites(t *testing.T) {
+	storage := &gatedStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// hold the write worker on a first create so the second one stays queued
+	gate := make(chan struct{})
+	storage.gate.Store(&gate)
+	go db.Create("first", TestEntry("first", 1, ""))
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 0 }, time.Second, time.Millisecond)
+	go db.Create("second", TestEntry("second", 2, ""))
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 1 }, time.Second, time.Millisecond)
+
+	readDone := make(chan operationResult[TestVal])
+	go func() { readDone <- db.Read("second") }()
+	time.Sleep(10 * time.Millisecond)
+	storage.gate.Store(nil)
+	close(gate)
+
+	res := <-readDone
+	require.NoError(t, res.err)
+	require.Equal(t, 2, res.value.Value.Age)
+}
+
+func TestBytesDBStoresRawValues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewBytesDB("binary", dir)
+	require.NoError(t, err)
+	value := make([]byte, 30*KB)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	require.NoError(t, db.Create("blob", NewDbData(value, "")).err)
+	require.NoError(t, db.Close())
+
+	reopened, err := NewBytesDB("binary", dir)
+	require.NoError(t, err)
+	defer reopened.Close()
+	res := reopened.Read("blob")
+	require.NoError(t, res.err)
+	require.Equal(t, value, res.value.Value)
+
+	sizeKB, err := reopened.storage.Size()
+	require.NoError(t, err)
+	require.Less(t, sizeKB, 31.0) // base64 JSON would be 40 KB
+}
+
+func TestCopyOnReadIsolatesCallers(t *testing.T) {
+	db, err := NewDBWithStorage[[]int](NewMemoryStorage[[]int](), WithCopyOnRead())
+	require.NoError(t, err)
+	defer db.Close()
+
+	value := []int{1, 2, 3}
+	require.NoError(t, db.Create("slice", NewDbData(value, "")).err)
+	value[0] = 100
+
+	res := db.Read("slice")
+	require.NoError(t, res.err)
+	require.Equal(t, []int{1, 2, 3}, res.value.Value)
+	res.value.Value[1] = 200
+	require.Equal(t, []int{1, 2, 3}, db.Read("slice").value.Value)
+}
+
+func TestBulkTTLOperations(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	expired := DbData[TestVal]{Value: NewTestVal("old", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("expired", expired).err)
+	require.NoError(t, db.Create("a", TestEntry("a", 2, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 3, "")).err)
+
+	require.Equal(t, []string{"expired"}, db.ExpiredKeys().keys)
+
+	res := db.SetTTLBatch([]string{"a", "missing"}, "60")
+	require.ErrorContains(t, res.err, dbError.KeyNotFound("").Error())
+	require.Equal(t, "", db.Read("a").value.Ttl)
+	require.ErrorContains(t, db.SetTTLBatch([]string{"a"}, "soon").err, dbError.InvalidTTL("").Error())
+
+	require.NoError(t, db.SetTTLBatch([]string{"a", "b"}, "0").err)
+	require.Equal(t, []string{"a", "b", "expired"}, db.ExpiredKeys().keys)
+
+	res = db.PurgeExpired()
+	require.NoError(t, res.err)
+	require.Equal(t, 3, res.count)
+	require.Empty(t, db.ExpiredKeys().keys)
+}
+
+func TestConfigurableCleanupWorker(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](),
+		WithCleanupInterval(20*time.Millisecond), WithCleanupJitter(5*time.Millisecond), WithCleanupBatchSize(1))
+	require.NoError(t, err)
+	defer db.Close()
+	expired := DbData[TestVal]{Value: NewTestVal("old", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("expired1", expired).err)
+	require.NoError(t, db.Create("expired2", expired).err)
+
+	// one entry per run, then runs with nothing to sync
+	require.Eventually(t, func() bool {
+		stats := db.LastCleanup()
+		return stats.Runs >= 3 && stats.Removed == 0 && !stats.Synced
+	}, 2*time.Second, 5*time.Millisecond)
+	require.Empty(t, db.ExpiredKeys().keys)
+	require.ErrorContains(t, db.Read("expired1").err, dbError.KeyNotFound("").Error())
+}
+
+func TestCleanupWakesAtNextExpiry(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithCleanupInterval(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("long", TestEntry("long", 1, "3600")).err)
+	require.NoError(t, db.Create("short", TestEntry("short", 2, "1")).err)
+
+	// well before the hourly interval, right after "short" expires
+	require.Eventually(t, func() bool { return db.LastCleanup().Removed == 1 }, 3*time.Second, 10*time.Millisecond)
+	require.ErrorContains(t, db.Read("short").err, dbError.KeyNotFound("").Error())
+	require.NoError(t, db.Read("long").err)
+	next, ok := db.expiries.next()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(time.Hour), next, time.Minute)
+}
+
+func TestExpiredEntriesAreArchived(t *testing.T) {
+	archivePath := t.TempDir() + "/expired.jsonl"
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithExpiredArchive(archivePath), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	expired := DbData[TestVal]{Value: NewTestVal("old", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("viaRead", expired).err)
+	require.NoError(t, db.Create("viaPurge", expired).err)
+
+	require.ErrorContains(t, db.Read("viaRead").err, dbError.KeyExpired("").Error())
+	require.Equal(t, 1, db.PurgeExpired().count)
+
+	archived, err := ReadExpiredArchive[TestVal](archivePath)
+	require.NoError(t, err)
+	require.Len(t, archived, 2)
+	require.Equal(t, "viaRead", archived[0].Key)
+	require.Equal(t, "viaPurge", archived[1].Key)
+	require.Equal(t, expired.Value, archived[1].Entry.Value)
+}
+
+func TestFollowerReloadsAndPromotes(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	leader, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	follower, err := NewDBWithStorage[TestVal](storage, WithFollower(), WithFollowInterval(10*time.Millisecond))
+	require.NoError(t, err)
+	defer follower.Close()
+
+	require.NoError(t, leader.Create("shared", TestEntry("shared", 1, "")).err)
+	require.Eventually(t, func() bool { return follower.Read("shared").err == nil }, time.Second, 10*time.Millisecond)
+	require.ErrorContains(t, follower.Create("mine", TestEntry("mine", 2, "")).err, dbError.ReadOnlyDatabase("").Error())
+
+	require.ErrorContains(t, follower.Promote(), dbError.FailedToAcquireLock("").Error())
+	require.NoError(t, leader.Delete("shared").err)
+	require.NoError(t, leader.Close())
+
+	require.NoError(t, follower.Promote())
+	require.ErrorContains(t, follower.Read("shared").err, dbError.KeyNotFound("").Error())
+	require.NoError(t, follower.Create("mine", TestEntry("mine", 2, "")).err)
+}
+
+func TestReplicaMirrorsAndPromotes(t *testing.T) {
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+	db, err := NewDB[TestVal]("replicated", primaryDir, WithReplica(replicaDir))
+	require.NoError(t, err)
+	entry := TestEntry("mirrored", 8, "")
+	require.NoError(t, db.Create("rep1", entry).err)
+
+	_, err = PromoteReplica[TestVal]("replicated", replicaDir)
+	require.ErrorContains(t, err, dbError.FailedToAcquireLock("").Error())
+	require.NoError(t, db.Close())
+
+	promoted, err := PromoteReplica[TestVal]("replicated", replicaDir)
+	require.NoError(t, err)
+	defer promoted.Close()
+	res := promoted.Read("rep1")
+	require.NoError(t, res.err)
+	require.Equal(t, entry.Value, res.value.Value)
+}
+
+// emptyBucket is an ObjectClient holding nothing and dropping what it's given.
+type emptyBucket struct{}
+
+func (emptyBucket) PutObject(ctx context.Context, key string, body []byte) error { return nil }
+
+func (emptyBucket) GetObject(ctx context.Context, key string) ([]byte, bool, error) {
+	return nil, false, nil
+}
+
+func TestReplicaHealth(t *testing.T) {
+	primaryDir, replicaDir := t.TempDir(), t.TempDir()
+	db, err := NewDB[TestVal]("replicatedHealth", primaryDir, WithReplica(replicaDir))
+	require.NoError(t, err)
+	defer db.Close()
+	_, versioned := db.storage.(VersionedStorage)
+	require.True(t, versioned)
+	checks := func() map[string]HealthStatus {
+		byName := make(map[string]HealthStatus)
+		for _, status := range db.HealthCheck(context.Background()).Checks {
+			byName[status.Name] = status
+		}
+		return byName
+	}
+	report := checks()
+	for _, name := range []string{"lock", "writable", "disk"} {
+		require.True(t, report[name].Healthy, "%s: %+v", name, report[name])
+	}
+
+	// a full replica disk fails the writes and the disk check
+	realFree := diskFreeBytes
+	defer func() { diskFreeBytes = realFree }()
+	diskFreeBytes = func(dir string) (uint64, error) {
+		if dir == replicaDir {
+			return 10, nil
+		}
+		return realFree(dir)
+	}
+	err = db.Create("rep", TestEntry("rep", 1, "")).err
+	require.ErrorContains(t, err, dbError.ErrDiskFull("").Error())
+	require.ErrorContains(t, err, replicaDir)
+	require.False(t, checks()["disk"].Healthy)
+	diskFreeBytes = realFree
+
+	// so does losing the replica's lock
+	require.NoError(t, os.Remove(filepath.Join(replicaDir, "replicatedHealth.json.lock")))
+	require.False(t, checks()["lock"].Healthy)
+
+	// an object storage reports on its local backend
+	objects, err := NewDBWithStorage[TestVal](NewObjectStorage[TestVal](NewMemoryStorage[TestVal](), emptyBucket{}, "db.json", time.Hour))
+	require.NoError(t, err)
+	defer objects.Close()
+	names := []string{}
+	for _, status := range objects.HealthCheck(context.Background()).Checks {
+		names = append(names, status.Name)
+	}
+	require.Contains(t, names, "lock")
+	require.Contains(t, names, "writable")
+}
+
+func TestOplogRecordsMutations(t *testing.T) {
+	oplogPath := t.TempDir() + "/changes.oplog"
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithOplog(oplogPath))
+	require.NoError(t, err)
+	require.NoError(t, db.Create("op1", TestEntry("first", 1, "")).err)
+	require.NoError(t, db.Update("op1", TestEntry("second", 2, "")).err)
+	require.NoError(t, db.SetTTLBatch([]string{"op1"}, "60").err)
+	require.NoError(t, db.Delete("op1").err)
+
+	records, err := db.TailOplog(0)
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	ops := []string{}
+	for i, record := range records {
+		require.Equal(t, uint64(i+1), record.Seq)
+		require.Equal(t, "op1", record.Key)
+		ops = append(ops, record.Op)
+	}
+	require.Equal(t, []string{OplogCreate, OplogUpdate, OplogTTL, OplogDelete}, ops)
+	require.Equal(t, NewTestVal("second", 2), records[1].Value.Value)
+	require.Nil(t, records[3].Value)
+
+	tail, err := db.TailOplog(3)
+	require.NoError(t, err)
+	require.Len(t, tail, 2)
+	require.NoError(t, db.Close())
+
+	// sequence numbers continue across reopenings
+	db, err = NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithOplog(oplogPath))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("op2", TestEntry("third", 3, "")).err)
+	tail, err = db.TailOplog(5)
+	require.NoError(t, err)
+	require.Len(t, tail, 1)
+	require.Equal(t, uint64(5), tail[0].Seq)
+}
+
+func TestOplogAppendFailures(t *testing.T) {
+	oplogPath := t.TempDir() + "/changes.oplog"
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithOplog(oplogPath))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+
+	// the oplog can't be written: the write is applied, the loss reported
+	require.NoError(t, os.Remove(oplogPath))
+	require.NoError(t, os.Mkdir(oplogPath, 0755))
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	require.NoError(t, db.Read("b").err)
+	require.Equal(t, uint64(1), db.IOStats().OplogFailures)
+	require.Equal(t, "oplog", db.recentErrors.recent()[0].Action)
+	healthy := func() bool {
+		for _, check := range db.HealthCheck(context.Background()).Checks {
+			if check.Name == "oplog" {
+				return check.Healthy
+			}
+		}
+		t.Fatal("no oplog check")
+		return false
+	}
+	require.False(t, healthy())
+
+	require.NoError(t, os.Remove(oplogPath))
+	require.NoError(t, db.Create("c", TestEntry("c", 3, "")).err)
+	require.True(t, healthy())
+
+	// a record that doesn't encode takes no sequence number
+	log := &oplog[any]{path: oplogPath}
+	log.seq = 1
+	records := []OplogRecord[any]{
+		{Op: OplogCreate, Key: "bad", Value: &DbData[any]{Value: make(chan int)}},
+		{Op: OplogCreate, Key: "good", Value: &DbData[any]{Value: 1}},
+	}
+	require.ErrorContains(t, log.append(records), dbError.OplogAppendFailed("").Error())
+	require.Equal(t, uint64(0), records[0].Seq)
+	require.Equal(t, uint64(2), records[1].Seq)
+	require.Equal(t, uint64(1), log.failed.Load())
+}
+
+func TestRestoreFromOplog(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithOplog(dir+"/changes.oplog"))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.BatchCreate(map[string]DbData[TestVal]{
+		"keep": TestEntry("keep", 1, ""),
+		"lost": TestEntry("lost", 2, ""),
+	}).err)
+	require.NoError(t, db.Update("keep", TestEntry("kept", 3, "")).err)
+	time.Sleep(10 * time.Millisecond)
+	beforeDelete := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Delete("lost").err)
+
+	require.NoError(t, db.RestoreTo(beforeDelete, "restored", dir))
+	restored, err := NewDB[TestVal]("restored", dir)
+	require.NoError(t, err)
+	require.Equal(t, NewTestVal("kept", 3), restored.Read("keep").value.Value)
+	require.NoError(t, restored.Read("lost").err)
+	require.NoError(t, restored.Close())
+
+	require.ErrorContains(t, db.RestoreToSeq(2, "restored", dir), dbError.RestoreTargetNotEmpty("").Error())
+	require.NoError(t, db.RestoreToSeq(2, "seq2", dir))
+	restored, err = NewDB[TestVal]("seq2", dir)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.Equal(t, NewTestVal("keep", 1), restored.Read("keep").value.Value)
+}
+
+func TestVerifyReportsIssues(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("verified", dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("ok", TestEntry("ok", 1, "60")).err)
+	report, err := db.Verify()
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%+v", report.Issues)
+	require.Equal(t, 1, report.Entries)
+	require.Len(t, report.Checksum, 64)
+	require.NoError(t, db.Close())
+
+	created := time.Now().UTC().Format(time.RFC3339)
+	corrupt := `{"dup":{"value":{"name":"a"},"ttl":"","created_at":"` + created + `"},` +
+		`"dup":{"value":{"name":"b"},"ttl":"-5","created_at":"` + created + `"},` +
+		`"a-key-that-is-way-longer-than-32-bytes":{"value":{},"ttl":"","created_at":"0001-01-01T00:00:00Z"}}`
+	path := dir + "/corrupt.json"
+	require.NoError(t, os.WriteFile(path, []byte(corrupt), 0644))
+	report, err = VerifyFile[TestVal](path)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Entries)
+	checks := []string{}
+	for _, issue := range report.Issues {
+		checks = append(checks, issue.Check)
+	}
+	require.Equal(t, []string{CheckDuplicate, CheckTTL, CheckKeySize, CheckTTL}, checks)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"broken":`), 0644))
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 1, runCLI([]string{"verify", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "["+CheckJSON+"]")
+	require.Equal(t, 0, runCLI([]string{"verify", "-json", dir + "/verified.json"}, &stdout, &stderr))
+	require.Equal(t, 2, runCLI([]string{"verify"}, &stdout, &stderr))
+}
+
+func TestGetHelpers(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	fallback := NewTestVal("fallback", 0)
+	require.NoError(t, db.Create("present", TestEntry("present", 1, "")).err)
+	require.NoError(t, db.Create("expired", DbData[TestVal]{Value: NewTestVal("old", 2), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}).err)
+
+	require.Equal(t, NewTestVal("present", 1), db.GetOrDefault("present", fallback))
+	require.Equal(t, fallback, db.GetOrDefault("missing", fallback))
+	require.True(t, db.Exists("present"))
+	require.False(t, db.Exists("missing"))
+	require.False(t, db.Exists("expired"))
+
+	popped := db.GetAndDelete("present")
+	require.NoError(t, popped.err)
+	require.Equal(t, NewTestVal("present", 1), popped.value.Value)
+	require.False(t, db.Exists("present"))
+	require.ErrorContains(t, db.GetAndDelete("present").err, dbError.KeyNotFound("").Error())
+	require.ErrorContains(t, db.GetAndDelete("expired").err, dbError.KeyExpired("").Error())
+}
+
+func TestAsyncWritesArePipelined(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	results := []<-chan error{db.CreateAsync("async", TestEntry("v", 0, ""))}
+	for i := 1; i <= 50; i++ {
+		results = append(results, db.UpdateAsync("async", TestEntry("v", i, "")))
+	}
+	read := db.ReadAsync("async")
+	results = append(results, db.CreateAsync("async", TestEntry("dup", 0, "")))
+	for i, result := range results[:len(results)-1] {
+		require.NoError(t, <-result, "op %d", i)
+	}
+	require.ErrorContains(t, <-results[len(results)-1], dbError.EntryAlreadyExists("").Error())
+	readResult := <-read
+	require.NoError(t, readResult.err)
+	require.Equal(t, 50, readResult.value.Value.Age)
+
+	require.NoError(t, <-db.DeleteAsync("async"))
+	require.NoError(t, <-db.BatchCreateAsync(map[string]DbData[TestVal]{"a1": TestEntry("a1", 1, "")}))
+	require.NoError(t, db.Close())
+	require.ErrorContains(t, <-db.CreateAsync("late", TestEntry("late", 1, "")), dbError.DBAlreadyClosed("").Error())
+}
+
+func TestParallelValidationKeepsKeyOrder(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithParallelValidation(4), WithHistory(100))
+	require.NoError(t, err)
+	defer db.Close()
+
+	keys := []string{"k0", "k1", "k2", "k3", "k4", "k5", "k6", "k7"}
+	var results []<-chan error
+	for _, key := range keys {
+		results = append(results, db.CreateAsync(key, TestEntry(key, 0, "")))
+	}
+	for i := 1; i <= 30; i++ {
+		for _, key := range keys {
+			results = append(results, db.UpdateAsync(key, TestEntry(key, i, "")))
+		}
+	}
+	// waits for every write on k0 and k1 queued before, and holds back those after
+	batch := db.BatchWrite([]Op[TestVal]{PutOp("k0", TestEntry("k0", 100, ""))}, []Precondition{KeyExists("k1")})
+	results = append(results, db.UpdateAsync("k0", TestEntry("k0", 101, "")))
+	results = append(results, db.UpdateAsync("k2", TestEntry("k2", -1, "-1"))) // invalid TTL
+	for i, result := range results[:len(results)-1] {
+		require.NoError(t, <-result, "op %d", i)
+	}
+	require.ErrorContains(t, <-results[len(results)-1], dbError.InvalidTTL("").Error())
+	require.NoError(t, batch)
+
+	for _, key := range keys {
+		history, err := db.History(key)
+		require.NoError(t, err)
+		for i, version := range history[:31] {
+			require.Equal(t, i, version.Value.Value.Age, "key %s", key)
+		}
+	}
+	require.Equal(t, 101, db.Read("k0").value.Value.Age)
+	require.Equal(t, 30, db.Read("k2").value.Value.Age)
+}
+
+func TestRateLimits(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithMaxWritesPerSecond(5), WithMaxOpsPerSecond(20))
+	require.NoError(t, err)
+	defer db.Close()
+
+	limited := 0
+	for i := 0; i < 10; i++ {
+		err := db.Create(fmt.Sprintf("rl%d", i), TestEntry("rl", i, "")).err
+		if err != nil {
+			require.ErrorContains(t, err, dbError.ErrRateLimited("").Error())
+			limited++
+		}
+	}
+	require.GreaterOrEqual(t, limited, 4)
+	require.LessOrEqual(t, limited, 5)
+
+	// reads are only subject to the overall limit, which the writes used up partly
+	reads := 0
+	for i := 0; i < 30; i++ {
+		if db.Read("rl0").err == nil {
+			reads++
+		}
+	}
+	require.Less(t, reads, 20)
+
+	require.Eventually(t, func() bool { return db.Create("later", TestEntry("later", 1, "")).err == nil }, time.Second, 50*time.Millisecond)
+}
+
+func TestIncrementalSync(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("incremental", dir, WithSoftDelete(time.Hour))
+	require.NoError(t, err)
+	defer db.Close()
+	local, ok := db.localStorage()
+	require.True(t, ok)
+
+	requireFullEncoding := func() {
+		t.Helper()
+		synced, err := os.ReadFile(filepath.Join(dir, "incremental.json"))
+		require.NoError(t, err)
+		var full bytes.Buffer
+		require.NoError(t, local.encode(&full, db.persisted()))
+		require.Equal(t, full.String(), string(synced))
+	}
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Create(benchKey(i), TestEntry("first", i, "")).err)
+	}
+	requireFullEncoding()
+	require.NoError(t, db.Update(benchKey(3), TestEntry("second", 3, "")).err)
+	require.NoError(t, db.Delete(benchKey(4)).err) // a tombstone now
+	require.NoError(t, db.Rename(benchKey(5), "<renamed>&").err)
+	requireFullEncoding()
+	require.Len(t, local.encoded.members, 20)
+	require.NoError(t, db.Undelete(benchKey(4)).err)
+	_, err = db.DeleteMatching("bench-1*")
+	require.NoError(t, err)
+	requireFullEncoding()
+}
+
+func TestParallelEncode(t *testing.T) {
+	data := make(map[string]DbData[TestVal])
+	for i := 0; i < parallelEncodeMin+7; i++ {
+		data[benchKey(i)] = DbData[TestVal]{Value: NewTestVal("<parallel>", i), Created_at: time.Now(), Seq: uint64(i + 1)}
+	}
+	header := schemaOf[TestVal]()
+	encoded, err := json.Marshal(data)
+	require.NoError(t, err)
+	parallel := getEncodeBuffer(0)
+	defer putEncodeBuffer(parallel)
+	require.NoError(t, appendJSONHeader(parallel, header))
+	expected := parallel.String() + "," + string(encoded[1:]) + "\n"
+
+	parallel.Reset()
+	require.NoError(t, appendJSONFile(parallel, header, data))
+	require.Equal(t, expected, parallel.String())
+
+	cache := newEncodedEntries()
+	parallel.Reset()
+	require.NoError(t, appendJSONFileIncremental(parallel, header, data, cache))
+	require.Equal(t, expected, parallel.String())
+	require.Len(t, cache.members, len(data))
+}
+
+func TestReadAllocations(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	require.NoError(t, db.Create("hot", TestEntry("hot", 1, "")).err)
+	allocs := testing.AllocsPerRun(1000, func() {
+		if result := db.Read("hot"); result.err != nil {
+			t.Fatal(result.err)
+		}
+	})
+	require.Zero(t, allocs)
+	require.Equal(t, "hot", db.Read("hot").value.Value.Name)
+}
+
+func benchmarkWorkload(b *testing.B, workload string) {
+	db, err := NewDB[TestVal]("bench", b.TempDir())
+	require.NoError(b, err)
+	defer db.Close()
+	require.NoError(b, prepareBenchmark(db, workload))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := benchOp(db, workload, i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreate(b *testing.B)      { benchmarkWorkload(b, benchCreate) }
+func BenchmarkRead(b *testing.B)        { benchmarkWorkload(b, benchRead) }
+func BenchmarkBatchCreate(b *testing.B) { benchmarkWorkload(b, benchBatch) }
+
+// BenchmarkSync rewrites a file of benchPopulation entries after one of
+// them changed, as every write does.
+func BenchmarkSync(b *testing.B) {
+	storage, err := NewLocalStorage[TestVal]("bench", b.TempDir())
+	require.NoError(b, err)
+	defer storage.Unlock()
+	data := make(map[string]DbData[TestVal], benchPopulation)
+	seq := uint64(0)
+	for i := 0; i < benchPopulation; i++ {
+		seq++
+		data[benchKey(i)] = DbData[TestVal]{Value: NewTestVal("bench", i), Created_at: time.Now(), Seq: seq}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		seq++
+		data[benchKey(i%benchPopulation)] = DbData[TestVal]{Value: NewTestVal("changed", i), Created_at: time.Now(), Seq: seq}
+		if _, err := storage.Sync(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkApply puts 100 entries per Apply, each op timed on its own.
+func BenchmarkApply(b *testing.B) {
+	db, err := NewDB[TestVal]("bench", b.TempDir())
+	require.NoError(b, err)
+	defer db.Close()
+	ops := make([]Op[TestVal], 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(ops) {
+		for j := range ops {
+			ops[j] = PutOp(benchKey((i+j)%benchPopulation), TestEntry("bench", i+j, ""))
+		}
+		results, err := db.Apply(ops)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, result := range results {
+			if result.Err != nil {
+				b.Fatal(result.Err)
+			}
+		}
+	}
+}
+
+func BenchmarkMixed(b *testing.B) {
+	db, err := NewDB[TestVal]("bench", b.TempDir())
+	require.NoError(b, err)
+	defer db.Close()
+	require.NoError(b, prepareBenchmark(db, benchMixed))
+	var next atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := benchOp(db, benchMixed, int(next.Add(1))); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
+func TestReplayOplog(t *testing.T) {
+	oplog := filepath.Join(t.TempDir(), "ops.jsonl")
+	source := NewTestDB[TestVal](t, WithOplog(oplog))
+	require.NoError(t, source.Create("user:1", TestEntry("a", 1, "")).err)
+	require.NoError(t, source.Create("user:2", TestEntry("b", 2, "")).err)
+	require.NoError(t, source.Create("order:1", TestEntry("c", 3, "")).err)
+	time.Sleep(10 * time.Millisecond)
+	cut := time.Now()
+	require.NoError(t, source.Update("user:1", TestEntry("a2", 1, "")).err)
+	require.NoError(t, source.Delete("user:2").err)
+	require.NoError(t, source.Delete("order:1").err)
+
+	replay := func(filters ...ReplayFilter) (*DB[TestVal], ReplayReport) {
+		file, err := os.Open(oplog)
+		require.NoError(t, err)
+		defer file.Close()
+		target := NewTestDB[TestVal](t)
+		report, err := ReplayOplog(file, target, filters...)
+		require.NoError(t, err)
+		require.Zero(t, report.Failed, report.Failures)
+		return target, report
+	}
+	clone, report := replay()
+	require.Equal(t, ReplayReport{Records: 6, Applied: 6}, report)
+	require.Equal(t, 1, clone.Stats().Entries)
+	require.Equal(t, "a2", clone.Read("user:1").value.Value.Name)
+
+	before, report := replay(ReplayTimeRange(time.Time{}, cut))
+	require.Equal(t, 3, report.Applied)
+	require.Equal(t, 3, report.Filtered)
+	require.Equal(t, 3, before.Stats().Entries)
+	require.Equal(t, "a", before.Read("user:1").value.Value.Name)
+
+	users, report := replay(ReplayKeyPrefix("user:"), ReplayTimeRange(cut, time.Time{}))
+	require.Equal(t, 2, report.Applied) // the delete of user:2 has nothing to remove
+	require.Equal(t, 1, users.Stats().Entries)
+
+	target := NewTestDB[TestVal](t)
+	_, err := ReplayOplog(strings.NewReader("{\"seq\": 1, \"op\": \"create\"\n"), target)
+	require.EqualError(t, err, dbError.OplogCorrupted("line 1").Error())
+}
+
+func TestManager(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(root, "existing.json"), []byte(`{"k": {"value": {"name": "x", "age": 1}, "ttl": "", "created_at": "2024-01-01T00:00:00Z"}}`), 0644))
+	manager, err := NewManager[TestVal](root, ManagerConfig{Options: []Option{WithCleanupInterval(0)}, StorageQuotaKB: 8})
+	require.NoError(t, err)
+	defer manager.CloseAll()
+
+	acme, err := manager.OpenTenant("acme")
+	require.NoError(t, err)
+	again, err := manager.OpenTenant("acme")
+	require.NoError(t, err)
+	require.Same(t, acme, again)
+	_, err = manager.OpenTenant("../escape")
+	require.Error(t, err)
+	_, err = manager.OpenTenant("a.b")
+	require.Error(t, err)
+	tenants, err := manager.ListTenants()
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme", "existing"}, tenants)
+
+	existing, err := manager.OpenTenant("existing")
+	require.NoError(t, err)
+	require.Equal(t, "x", existing.Read("k").value.Value.Name)
+	require.NoError(t, existing.Create("k2", TestEntry("y", 2, "")).err)
+
+	// fill the quota from one tenant, the other can't grow either
+	var quotaErr error
+	for i := 0; i < 20 && quotaErr == nil; i++ {
+		quotaErr = acme.Create(fmt.Sprintf("big%d", i), TestEntry(strings.Repeat("x", KB), i, "")).err
+	}
+	require.ErrorContains(t, quotaErr, dbError.NotAvailabeSpace("").(*dbError.DBError).Message)
+	require.ErrorContains(t, existing.Create("k3", TestEntry(strings.Repeat("y", KB), 3, "")).err, "quota")
+	require.NoError(t, acme.Delete("big0").err) // deletes always go through
+
+	stats := manager.Stats()
+	require.Equal(t, 2, stats.Tenants)
+	require.Equal(t, acme.Stats().Entries+2, stats.Entries)
+	require.Equal(t, 8.0, stats.QuotaKB)
+	require.Greater(t, stats.UsedKB, 5.0)
+	require.Contains(t, stats.ByTenant, "existing")
+
+	require.NoError(t, manager.CloseAll())
+	require.ErrorContains(t, acme.Read("k").err, dbError.DBAlreadyClosed("").Error())
+	_, err = manager.OpenTenant("acme")
+	require.Error(t, err)
+
+	// the quota counts the tenants on disk from the start
+	reopened, err := NewManager[TestVal](root, ManagerConfig{StorageQuotaKB: 8})
+	require.NoError(t, err)
+	defer reopened.CloseAll()
+	require.Greater(t, reopened.Stats().UsedKB, 5.0)
+}
+
+func TestManagerQuotaConcurrent(t *testing.T) {
+	manager, err := NewManager[TestVal](t.TempDir(), ManagerConfig{Options: []Option{WithCleanupInterval(0)}, StorageQuotaKB: 8})
+	require.NoError(t, err)
+	defer manager.CloseAll()
+
+	// tenants writing at the same time can't all take the last of the quota
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 16; i++ {
+		tenant, err := manager.OpenTenant(fmt.Sprintf("t%d", i))
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for j := 0; tenant.Create(fmt.Sprintf("k%d", j), TestEntry(strings.Repeat("x", KB), j, "")).err == nil; j++ {
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	storedKB := 0.0
+	tenants, err := manager.ListTenants()
+	require.NoError(t, err)
+	for _, name := range tenants {
+		storedKB += manager.storedKB(name)
+	}
+	// no more entries than the quota has room for were reserved; the files
+	// are a bit bigger than the entries, with their keys and framing
+	entryKB, err := entrySizeKB(TestEntry(strings.Repeat("x", KB), 10, ""), EntrySizeLimitMB*KB)
+	require.NoError(t, err)
+	stats := manager.Stats()
+	require.LessOrEqual(t, stats.Entries, int(8/entryKB))
+	require.InDelta(t, storedKB, stats.UsedKB, 0.001)
+	require.Zero(t, manager.quota.reserved)
+}
+
+func TestBenchCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, runCLI([]string{"bench", "-ops", "50", "-workers", "4", "-dir", t.TempDir()}, &stdout, &stderr), stderr.String())
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, len(benchWorkloads))
+	var result BenchResult
+	require.NoError(t, json.Unmarshal([]byte(lines[3]), &result))
+	require.Equal(t, benchMixed, result.Workload)
+	require.Zero(t, result.Errors)
+	require.Positive(t, result.OpsPerSec)
+	require.Equal(t, 2, runCLI([]string{"bench", "-workload", "nope"}, &stdout, &stderr))
+	require.Equal(t, 2, runCLI([]string{"bench", "-writes", "10", "-value-size", "lots"}, &stdout, &stderr))
+
+	stdout.Reset()
+	require.Equal(t, 0, runCLI([]string{"bench", "--writes", "40", "--readers", "2", "--value-size", "1kb", "-dir", t.TempDir()}, &stdout, &stderr), stderr.String())
+	lines = strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	require.Len(t, lines, 2)
+	var writes, reads BenchResult
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &writes))
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &reads))
+	require.Equal(t, "write", writes.Workload)
+	require.Equal(t, 40, writes.Ops)
+	require.Zero(t, writes.Errors)
+	require.Equal(t, "read", reads.Workload)
+	require.Zero(t, reads.Errors)
+	counted := 0
+	for _, bucket := range writes.Histogram {
+		counted += bucket.Count
+	}
+	require.Equal(t, 40, counted)
+	require.LessOrEqual(t, writes.P99Micros, writes.MaxMicros)
+
+	oplog := filepath.Join(t.TempDir(), "ops.jsonl")
+	db := NewTestDB[TestVal](t, WithOplog(oplog))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Create(benchKey(i), TestEntry("recorded", i, "60")).err)
+	}
+	require.NoError(t, db.Update(benchKey(0), TestEntry("updated", 0, "")).err)
+	require.NoError(t, db.Delete(benchKey(1)).err)
+	stdout.Reset()
+	require.Equal(t, 0, runCLI([]string{"bench", "-replay", oplog, "-workers", "3", "-dir", t.TempDir()}, &stdout, &stderr), stderr.String())
+	var replayed BenchResult
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &replayed))
+	require.Equal(t, "replay", replayed.Workload)
+	require.Equal(t, 12, replayed.Ops)
+	require.Zero(t, replayed.Errors)
+}
+
+func FuzzValidateAndFixJSONFilename(f *testing.F) {
+	for _, seed := range []string{"", "db", "db.json", "aux.json", "../db", "a/b", ".json", "db.bin", " db ", "x\x00y"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, filename string) {
+		fixed, err := ValidateAndFixJSONFilename(filename)
+		if err != nil {
+			return
+		}
+		// an accepted name must stay a plain file name in the target dir
+		require.True(t, strings.HasSuffix(fixed, ".json"), fixed)
+		require.Equal(t, fixed, filepath.Base(fixed))
+		require.NotContains(t, fixed, "..")
+		require.NotContains(t, fixed, "/")
+		require.NotContains(t, fixed, "\\")
+		require.True(t, utf8.ValidString(fixed), fixed)
+		require.Greater(t, len(fixed), len(".json"), fixed)
+		if len(fixed) <= 24 { // the length limit counts the extension added to a bare name
+			again, err := ValidateAndFixJSONFilename(fixed)
+			require.NoError(t, err)
+			require.Equal(t, fixed, again)
+		}
+	})
+}
+
+func FuzzLocalStorageLoad(f *testing.F) {
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+	for _, seed := range []string{
+		"{}", "null", "", "[]", `{"a":1}`, "{}{}", "{} x",
+		`{"k":{"value":{"name":"n","age":1},"ttl":"","created_at":"` + created + `"}}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, content []byte) {
+		dir := t.TempDir()
+		storage, err := NewLocalStorage[TestVal]("fuzz", dir)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dir+"/fuzz.json", content, 0644))
+
+		loaded := make(map[string]DbData[TestVal])
+		if err := storage.Load(&loaded); err != nil {
+			return
+		}
+		// whatever Load accepts is a JSON object (or null) of entries
+		expected := make(map[string]DbData[TestVal])
+		require.NoError(t, json.Unmarshal(content, &expected), "%q", content)
+		require.Equal(t, len(expected), len(loaded))
+	})
+}
+
+// TestConcurrentOpsMatchModel hammers one DB from many goroutines, each owning
+// its own keys and checking every result against a plain map, while other
+// goroutines read foreign keys, scan, compact and let short TTLs expire under
+// the cleanup worker. Run it with -race.
+func TestConcurrentOpsMatchModel(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithCleanupInterval(5*time.Millisecond))
+	require.NoError(t, err)
+
+	const workers = 8
+	const opsPerWorker = 300
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() { // noise on the whole data set
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			db.Read(fmt.Sprintf("w%d-k%d", i%workers, i%10))
+			db.Exists(fmt.Sprintf("ttl-%d", i%20))
+			db.ExpiredKeys()
+			if i%50 == 0 {
+				db.Compact()
+			}
+		}
+	}()
+	background.Add(1)
+	go func() { // entries expiring while everything else runs
+		defer background.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := fmt.Sprintf("ttl-%d", i%20)
+			db.Create(key, DbData[TestVal]{Value: NewTestVal("ttl", i), Ttl: "1", Created_at: time.Now().Add(-999 * time.Millisecond)})
+			res := db.Read(key)
+			if res.err != nil && !strings.Contains(res.err.Error(), dbError.KeyExpired("").Error()) && !strings.Contains(res.err.Error(), dbError.KeyNotFound("").Error()) {
+				t.Errorf("ttl read %s: %v", key, res.err)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			model := make(map[string]TestVal)
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for i := 0; i < opsPerWorker; i++ {
+				key := fmt.Sprintf("w%d-k%d", w, rnd.Intn(10))
+				value := NewTestVal(key, i)
+				_, exists := model[key]
+				switch op := rnd.Intn(7); op {
+				case 0:
+					err := db.Create(key, DbData[TestVal]{Value: value, Created_at: time.Now()}).err
+					if exists {
+						require.ErrorContains(t, err, dbError.EntryAlreadyExists("").Error())
+					} else {
+						require.NoError(t, err)
+						model[key] = value
+					}
+				case 1:
+					err := db.Update(key, DbData[TestVal]{Value: value, Created_at: time.Now()}).err
+					if exists {
+						require.NoError(t, err)
+						model[key] = value
+					} else {
+						require.Error(t, err)
+					}
+				case 2:
+					err := db.Delete(key).err
+					if exists {
+						require.NoError(t, err)
+						delete(model, key)
+					} else {
+						require.Error(t, err)
+					}
+				case 3:
+					res := db.GetAndDelete(key)
+					if exists {
+						require.NoError(t, res.err)
+						require.Equal(t, model[key], res.value.Value)
+						delete(model, key)
+					} else {
+						require.Error(t, res.err)
+					}
+				case 4:
+					require.Equal(t, exists, db.Exists(key))
+				case 5:
+					batch := map[string]DbData[TestVal]{}
+					for j := 0; j < 3; j++ {
+						batchKey := fmt.Sprintf("w%d-b%d-%d", w, i, j)
+						batch[batchKey] = DbData[TestVal]{Value: NewTestVal(batchKey, j), Created_at: time.Now()}
+					}
+					require.NoError(t, db.BatchCreate(batch).err)
+					for batchKey, entry := range batch {
+						model[batchKey] = entry.Value
+					}
+				default:
+					res := db.Read(key)
+					if exists {
+						require.NoError(t, res.err)
+						require.Equal(t, model[key], res.value.Value)
+					} else {
+						require.ErrorContains(t, res.err, dbError.KeyNotFound("").Error())
+					}
+				}
+			}
+			for key, value := range model {
+				res := db.Read(key)
+				require.NoError(t, res.err)
+				require.Equal(t, value, res.value.Value)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+	require.NoError(t, db.Close())
+}
+
+func TestCreateExpiringAt(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("deadline", dir, WithCleanupInterval(0))
+	require.NoError(t, err)
+	deadline := time.Now().Add(300 * time.Millisecond).UTC()
+	require.NoError(t, db.CreateExpiringAt("deadline", NewTestVal("d", 1), deadline).err)
+	require.ErrorContains(t, db.CreateExpiringAt("past", NewTestVal("p", 1), time.Now().Add(-time.Second)).err, dbError.InvalidTTL("").Error())
+	require.NoError(t, db.Close())
+
+	content, err := os.ReadFile(dir + "/deadline.json")
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"expires_at":"`+deadline.Format(time.RFC3339Nano)+`"`)
+
+	db, err = NewDB[TestVal]("deadline", dir, WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	res := db.Read("deadline")
+	require.NoError(t, res.err)
+	require.True(t, deadline.Equal(*res.value.Expires_at))
+	require.Eventually(t, func() bool { return db.IsExpired("deadline") }, time.Second, 20*time.Millisecond)
+
+	// a relative TTL replaces the absolute expiration
+	require.NoError(t, db.CreateExpiringAt("moved", NewTestVal("m", 2), time.Now().Add(time.Hour)).err)
+	require.NoError(t, db.SetTTLBatch([]string{"moved"}, "").err)
+	require.Nil(t, db.Read("moved").value.Expires_at)
+}
+
+func TestSlidingTTL(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	db, err := NewDBWithStorage[TestVal](storage, WithSlidingTTL())
+	require.NoError(t, err)
+	require.NoError(t, db.Create("session", TestEntry("session", 1, "1")).err)
+	for i := 0; i < 8; i++ { // 2s of activity keep a 1s TTL alive
+		time.Sleep(250 * time.Millisecond)
+		res := db.Read("session")
+		require.NoError(t, res.err)
+		require.WithinDuration(t, time.Now().Add(time.Second), *res.value.Expires_at, 100*time.Millisecond)
+	}
+	require.NoError(t, db.Close())
+
+	// the slid expiration was persisted
+	db, err = NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer db.Close()
+	res := db.Read("session")
+	require.NoError(t, res.err)
+	require.NotNil(t, res.value.Expires_at)
+
+	// without the option, only entries marked Sliding slide
+	sliding := TestEntry("marked", 2, "1")
+	sliding.Sliding = true
+	require.NoError(t, db.Create("marked", sliding).err)
+	require.NoError(t, db.Create("fixed", TestEntry("fixed", 3, "1")).err)
+	for i := 0; i < 6; i++ {
+		time.Sleep(250 * time.Millisecond)
+		require.NoError(t, db.Read("marked").err)
+	}
+	require.Error(t, db.Read("fixed").err) // expired, and maybe cleaned up already
+}
+
+func TestMaxEntries(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithMaxEntries(3), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("m1", TestEntry("m1", 1, "")).err)
+	require.NoError(t, db.Create("m2", DbData[TestVal]{Value: NewTestVal("old", 2), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}).err)
+	require.ErrorContains(t, db.BatchCreate(map[string]DbData[TestVal]{
+		"m3": TestEntry("m3", 3, ""),
+		"m4": TestEntry("m4", 4, ""),
+		"m5": TestEntry("m5", 5, ""),
+	}).err, dbError.ErrEntryLimitReached("").Error())
+
+	// the expired entry makes room
+	require.NoError(t, db.BatchCreate(map[string]DbData[TestVal]{
+		"m3": TestEntry("m3", 3, ""),
+		"m4": TestEntry("m4", 4, ""),
+	}).err)
+	require.ErrorContains(t, db.Create("m5", TestEntry("m5", 5, "")).err, dbError.ErrEntryLimitReached("").Error())
+	stats := db.Stats()
+	require.Equal(t, 3, stats.Entries)
+	require.Equal(t, 3, stats.MaxEntries)
+}
+
+func TestEntryBuilder(t *testing.T) {
+	entry, err := NewEntry(NewTestVal("built", 1)).WithTTL(5 * time.Second).WithSliding().Build()
+	require.NoError(t, err)
+	require.Equal(t, "5", entry.Ttl)
+	require.True(t, entry.Sliding)
+	require.WithinDuration(t, time.Now(), entry.Created_at, time.Second)
+
+	deadline := time.Now().Add(time.Hour)
+	entry, err = NewEntry(NewTestVal("deadline", 2)).WithExpiresAt(deadline).Build()
+	require.NoError(t, err)
+	require.Equal(t, deadline, *entry.Expires_at)
+
+	for _, builder := range []*EntryBuilder[TestVal]{
+		NewEntry(NewTestVal("", 0)).WithTTL(1500 * time.Millisecond),
+		NewEntry(NewTestVal("", 0)).WithTTL(-time.Second),
+		NewEntry(NewTestVal("", 0)).WithTTL(time.Second).WithExpiresAt(deadline),
+		NewEntry(NewTestVal("", 0)).WithExpiresAt(time.Now().Add(-time.Second)),
+		NewEntry(NewTestVal("", 0)).WithSliding(),
+	} {
+		_, err := builder.Build()
+		require.ErrorContains(t, err, dbError.InvalidTTL("").Error())
+	}
+
+	// hand-built entries are checked on write too
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	require.ErrorContains(t, db.Create("bad", TestEntry("bad", 1, "5s")).err, dbError.InvalidTTL("").Error())
+	require.NoError(t, db.Create("good", TestEntry("good", 1, "")).err)
+	require.ErrorContains(t, db.Update("good", TestEntry("good", 2, "-1")).err, dbError.InvalidTTL("").Error())
+}
+
+func TestOpenPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a-database-name-well-over-24-characters.json")
+	db, err := OpenPath[TestVal](path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("p1", TestEntry("p1", 1, "")).err)
+	require.NoError(t, db.Close())
+	require.FileExists(t, path)
+
+	_, err = OpenPath[TestVal](filepath.Join(dir, "store.db"))
+	require.ErrorContains(t, err, dbError.InvalidFileName("").Error())
+	db, err = OpenPath[TestVal](filepath.Join(dir, "store.db"), WithAnyExtension())
+	require.NoError(t, err)
+	require.NoError(t, db.Create("p2", TestEntry("p2", 2, "")).err)
+	require.NoError(t, db.Close())
+	report, err := VerifyFile[TestVal](filepath.Join(dir, "store.db"))
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Entries)
+
+	db, err = OpenPath[TestVal](path)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Read("p1").err)
+
+	// a missing directory isn't created
+	missing := filepath.Join(dir, "missing", "nested")
+	_, err = OpenPath[TestVal](filepath.Join(missing, "db.json"))
+	require.ErrorContains(t, err, dbError.DirectoryNotExists("").Error())
+	require.NoDirExists(t, filepath.Join(dir, "missing"))
+}
+
+func TestDirectoryLayout(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("legacy", dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("l1", TestEntry("l1", 1, "")).err)
+	require.NoError(t, db.Close())
+
+	// the legacy file is migrated on open
+	db, err = NewDB[TestVal]("legacy", dir, WithDirectoryLayout())
+	require.NoError(t, err)
+	require.NoError(t, db.Read("l1").err)
+	require.NoError(t, db.Create("l2", TestEntry("l2", 2, "")).err)
+	_, err = NewDB[TestVal]("legacy", dir, WithDirectoryLayout())
+	require.ErrorContains(t, err, dbError.FileIsLockedByAnotherProcess("").Error())
+	require.NoError(t, db.Close())
+
+	dbDir := filepath.Join(dir, "legacy.db")
+	require.NoFileExists(t, filepath.Join(dir, "legacy.json"))
+	require.FileExists(t, filepath.Join(dbDir, "MANIFEST"))
+	require.FileExists(t, filepath.Join(dbDir, "backups", "legacy-legacy.json"))
+	manifest, err := readManifest(filepath.Join(dbDir))
+	require.NoError(t, err)
+	require.Equal(t, []string{"data.json"}, manifest.Segments)
+	require.Equal(t, "backups", manifest.BackupDir)
+	report, err := VerifyFile[TestVal](filepath.Join(dbDir, "data.json"))
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Entries)
+
+	bytesDB, err := NewBytesDB("blobs", dir, WithDirectoryLayout())
+	require.NoError(t, err)
+	require.NoError(t, bytesDB.Create("b1", NewDbData([]byte{0, 1}, "")).err)
+	require.NoError(t, bytesDB.Close())
+	require.FileExists(t, filepath.Join(dir, "blobs.db", "data.bin"))
+	// with nothing to migrate, no empty directory is created
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs.db"))
+	require.NoError(t, err)
+	for _, entry := range entries {
+		require.False(t, entry.IsDir(), entry.Name())
+	}
+	manifest, err = readManifest(filepath.Join(dir, "blobs.db"))
+	require.NoError(t, err)
+	require.Empty(t, manifest.BackupDir)
+}
+
+func TestSetOption(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	expired := DbData[TestVal]{Value: NewTestVal("old", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("expired", expired).err)
+
+	// the paused cleanup worker starts running
+	require.NoError(t, db.SetOption(WithCleanupInterval(10*time.Millisecond)))
+	require.Eventually(t, func() bool { return db.LastCleanup().Removed == 1 }, time.Second, 5*time.Millisecond)
+
+	require.NoError(t, db.SetOption(WithMaxWritesPerSecond(1)))
+	require.NoError(t, db.Create("w1", TestEntry("w1", 1, "")).err)
+	require.ErrorContains(t, db.Create("w2", TestEntry("w2", 2, "")).err, dbError.ErrRateLimited("").Error())
+	require.NoError(t, db.SetOption(WithMaxWritesPerSecond(0)))
+	require.NoError(t, db.Create("w2", TestEntry("w2", 2, "")).err)
+
+	require.ErrorContains(t, db.SetOption(WithMaxEntries(10), WithQueueSizes(1, 1)), dbError.OptionNotReloadable("").Error())
+	require.Equal(t, 0, db.Stats().MaxEntries)
+	require.NoError(t, db.SetOption(WithMaxEntries(10)))
+	require.Equal(t, 10, db.Stats().MaxEntries)
+}
+
+// tornStorage fails every Sync while torn is set, after persisting an empty
+// data set, like a file truncated by an interrupted rewrite.
+type tornStorage[T any] struct {
+	*MemoryStorage[T]
+	torn atomic.Bool
+}
+
+func (ts *tornStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	if ts.torn.Load() {
+		ts.MemoryStorage.Sync(map[string]DbData[T]{})
+		return 0, fmt.Errorf("torn write")
+	}
+	return ts.MemoryStorage.Sync(data)
+}
+
+func TestGroupCommit(t *testing.T) {
+	storage := &tornStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage, WithGroupCommit(20*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+
+	writeAll := func(prefix string) []error {
+		errs := make([]error, 20)
+		var wg sync.WaitGroup
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				key := fmt.Sprintf("%s%d", prefix, i)
+				errs[i] = db.Create(key, TestEntry(key, i, "")).err
+			}()
+		}
+		wg.Wait()
+		return errs
+	}
+	syncs := db.IOStats().Syncs
+	for _, err := range writeAll("ok") {
+		require.NoError(t, err)
+	}
+	require.Less(t, db.IOStats().Syncs-syncs, uint64(5))
+	stored := map[string]DbData[TestVal]{}
+	require.NoError(t, storage.Load(&stored))
+	require.Len(t, stored, 20) // durable once answered
+
+	// the same key twice in a row commits the group in between
+	require.NoError(t, db.Update("ok0", TestEntry("ok0", 100, "")).err)
+	require.NoError(t, db.Delete("ok0").err)
+	require.ErrorContains(t, db.Read("ok0").err, dbError.KeyNotFound("").Error())
+
+	storage.torn.Store(true)
+	for _, err := range writeAll("lost") {
+		require.ErrorContains(t, err, "torn write")
+	}
+	storage.torn.Store(false)
+	for i := range 20 {
+		require.ErrorContains(t, db.Read(fmt.Sprintf("lost%d", i)).err, dbError.KeyNotFound("").Error())
+	}
+	require.Equal(t, 19, db.Stats().Entries)
+}
+
+func TestGroupCommitCoalescing(t *testing.T) {
+	storage := &tornStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage, WithWriteCoalescing(200*time.Millisecond), WithGroupCommit(10*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("hot", TestEntry("hot", 0, "")).err)
+	time.Sleep(250 * time.Millisecond) // not hot anymore
+
+	storage.torn.Store(true)
+	require.ErrorContains(t, db.Update("hot", TestEntry("hot", 1, "")).err, "torn write")
+	storage.torn.Store(false)
+	// the failed group didn't make the key hot: this update syncs
+	require.NoError(t, db.Update("hot", TestEntry("hot", 2, "")).err)
+	stored := map[string]DbData[TestVal]{}
+	require.NoError(t, storage.Load(&stored))
+	require.Equal(t, 2, stored["hot"].Value.Age)
+}
+
+func TestReconcileRepairsTornSync(t *testing.T) {
+	storage := &tornStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("kept", TestEntry("kept", 1, "")).err)
+	require.False(t, db.Checkpoint().Diverged)
+
+	report, err := db.Reconcile()
+	require.NoError(t, err)
+	require.True(t, report.Consistent())
+	require.False(t, report.Repaired)
+
+	storage.torn.Store(true)
+	require.Error(t, db.Create("lost", TestEntry("lost", 2, "")).err)
+	checkpoint := db.Checkpoint()
+	require.True(t, checkpoint.Diverged)
+	require.ErrorContains(t, checkpoint.SyncErr, "torn write")
+	require.Greater(t, checkpoint.Seq, checkpoint.SyncedSeq)
+
+	storage.torn.Store(false)
+	report, err = db.Reconcile()
+	require.NoError(t, err)
+	require.Equal(t, []string{"kept"}, report.Missing)
+	require.True(t, report.Repaired)
+	checkpoint = db.Checkpoint()
+	require.False(t, checkpoint.Diverged)
+	require.Equal(t, checkpoint.Seq, checkpoint.SyncedSeq)
+
+	stored := make(map[string]DbData[TestVal])
+	require.NoError(t, storage.Load(&stored))
+	require.Contains(t, stored, "kept")
+	require.NotContains(t, stored, "lost")
+}
+
+func TestSoftDeleteAndUndelete(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	db, err := NewDBWithStorage[TestVal](storage, WithSoftDelete(time.Hour))
+	require.NoError(t, err)
+	entry := TestEntry("soft", 1, "")
+	require.NoError(t, db.Create("soft", entry).err)
+	require.NoError(t, db.Create("recreated", entry).err)
+	require.NoError(t, db.Delete("soft").err)
+	require.NoError(t, db.Delete("recreated").err)
+
+	require.ErrorContains(t, db.Read("soft").err, dbError.KeyNotFound("").Error())
+	require.False(t, db.Exists("soft"))
+	require.Equal(t, 2, db.Stats().Tombstones)
+	require.NoError(t, db.Create("recreated", TestEntry("new", 2, "")).err)
+	require.ErrorContains(t, db.Undelete("recreated").err, dbError.EntryAlreadyExists("").Error())
+
+	// tombstones survive a restart
+	require.NoError(t, db.Close())
+	db, err = NewDBWithStorage[TestVal](storage, WithSoftDelete(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, 1, db.Stats().Tombstones)
+	res := db.Undelete("soft")
+	require.NoError(t, res.err)
+	require.Equal(t, entry.Value, res.value.Value)
+	require.Nil(t, db.Read("soft").value.Deleted_at)
+	require.ErrorContains(t, db.Undelete("soft").err, dbError.EntryAlreadyExists("").Error())
+	require.Equal(t, 2, db.Read("recreated").value.Value.Age)
+
+	// past the retention, compaction purges them
+	require.NoError(t, db.Close())
+	db, err = NewDBWithStorage[TestVal](storage, WithSoftDelete(0))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Delete("soft").err)
+	require.ErrorContains(t, db.Undelete("soft").err, dbError.KeyNotFound("").Error())
+	require.Equal(t, 1, db.Compact().count)
+	require.Equal(t, 0, db.Stats().Tombstones)
+	report, err := db.Reconcile()
+	require.NoError(t, err)
+	require.True(t, report.Consistent())
+}
+
+func TestHistory(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	oplogPath := t.TempDir() + "/changes.oplog"
+	db, err := NewDBWithStorage[TestVal](storage, WithHistory(3), WithOplog(oplogPath))
+	require.NoError(t, err)
+	require.NoError(t, db.Create("h", TestEntry("v1", 1, "")).err)
+	require.NoError(t, db.Update("h", TestEntry("v2", 2, "")).err)
+	require.NoError(t, db.Update("h", TestEntry("v3", 3, "")).err)
+	require.NoError(t, db.Delete("h").err)
+
+	versions, err := db.History("h")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, uint64(2), versions[0].Version)
+	require.Equal(t, OplogDelete, versions[2].Op)
+	_, err = db.ReadVersion("h", 1)
+	require.ErrorContains(t, err, dbError.VersionNotFound("").Error())
+	_, err = db.ReadVersion("h", 4)
+	require.ErrorContains(t, err, dbError.VersionNotFound("").Error())
+
+	// undo the delete
+	old, err := db.ReadVersion("h", 3)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("h", old).err)
+	require.Equal(t, "v3", db.Read("h").value.Value.Name)
+	require.NoError(t, db.Close())
+
+	// rebuilt from the oplog
+	db, err = NewDBWithStorage[TestVal](storage, WithHistory(3), WithOplog(oplogPath))
+	require.NoError(t, err)
+	defer db.Close()
+	versions, err = db.History("h")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	require.Equal(t, uint64(5), versions[2].Version)
+
+	plain, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.History("h")
+	require.ErrorContains(t, err, dbError.HistoryNotEnabled("").Error())
+}
+
+func TestBatchCreateConflictPolicies(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("old", TestEntry("old", 1, "")).err)
+	expired := DbData[TestVal]{Value: NewTestVal("gone", 1), Ttl: "1", Created_at: time.Now().Add(-time.Hour)}
+	require.NoError(t, db.Create("expired", expired).err)
+	batch := func() map[string]DbData[TestVal] {
+		return map[string]DbData[TestVal]{
+			"old":     TestEntry("new", 2, ""),
+			"expired": TestEntry("new", 2, ""),
+			"fresh":   TestEntry("new", 2, ""),
+		}
+	}
+
+	res := db.BatchCreateWithPolicy(batch(), FailAll)
+	require.ErrorContains(t, res.Err, dbError.EntryAlreadyExists("").Error())
+	require.Equal(t, 0, res.Applied)
+	require.ErrorContains(t, db.Read("fresh").err, dbError.KeyNotFound("").Error())
+
+	res = db.BatchCreateWithPolicy(batch(), SkipExisting)
+	require.NoError(t, res.Err)
+	require.Equal(t, BatchSkipped, res.Entries["old"].Status)
+	require.Equal(t, BatchCreated, res.Entries["expired"].Status)
+	require.Equal(t, BatchCreated, res.Entries["fresh"].Status)
+	require.Equal(t, 1, db.Read("old").value.Value.Age)
+
+	res = db.BatchCreateWithPolicy(batch(), Overwrite)
+	require.NoError(t, res.Err)
+	require.Equal(t, 3, res.Applied)
+	require.Equal(t, BatchOverwritten, res.Entries["old"].Status)
+	require.Equal(t, 2, db.Read("old").value.Value.Age)
+}
+
+func TestBatchResultReportsFailedEntries(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	batch := map[string]DbData[TestVal]{
+		"ok":                                     TestEntry("ok", 1, ""),
+		"a-key-that-is-longer-than-the-32-bytes": TestEntry("long", 2, ""),
+		"bad-ttl":                                TestEntry("ttl", 3, "soon"),
+	}
+
+	res := db.BatchCreateWithPolicy(batch, FailAll)
+	require.Error(t, res.Err)
+	require.Equal(t, []string{"a-key-that-is-longer-than-the-32-bytes", "bad-ttl"}, res.FailedKeys())
+	require.Equal(t, BatchAborted, res.Entries["ok"].Status)
+	require.Equal(t, 1, res.Aborted)
+	require.ErrorContains(t, res.Entries["bad-ttl"].Err, dbError.InvalidTTL("").Error())
+	require.ErrorContains(t, res.Entries["a-key-that-is-longer-than-the-32-bytes"].Err, dbError.KeySizeExceedsLimit(KeySizeLimit, "").Error())
+
+	// the valid entries go through, the rejected ones can be retried
+	res = db.BatchCreateWithPolicy(batch, SkipExisting)
+	require.NoError(t, res.Err)
+	require.Equal(t, 1, res.Applied)
+	require.Equal(t, 2, res.Failed)
+	require.NoError(t, db.Read("ok").err)
+	retry := map[string]DbData[TestVal]{"bad-ttl": TestEntry("ttl", 3, "60")}
+	res = db.BatchCreateWithPolicy(retry, SkipExisting)
+	require.NoError(t, res.Err)
+	require.Equal(t, BatchCreated, res.Entries["bad-ttl"].Status)
+}
+
+func TestCloseCancelsQueuedOps(t *testing.T) {
+	storage := &gatedStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage, WithQueueSizes(1, 1))
+	require.NoError(t, err)
+
+	gate := make(chan struct{})
+	storage.gate.Store(&gate)
+	applied := db.CreateAsync("applied", TestEntry("applied", 1, ""))
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 0 }, time.Second, time.Millisecond)
+	queued := db.CreateAsync("queued", TestEntry("queued", 2, ""))
+	blocked := make(chan error)
+	go func() { blocked <- <-db.CreateAsync("blocked", TestEntry("blocked", 3, "")) }()
+	time.Sleep(20 * time.Millisecond) // waiting for room in the queue
+
+	closed := make(chan error)
+	go func() { closed <- db.Close() }()
+	// the caller waiting for room gives up right away
+	require.ErrorContains(t, <-blocked, dbError.ErrClosed("").Error())
+	storage.gate.Store(nil)
+	close(gate)
+	require.NoError(t, <-closed)
+	require.NoError(t, <-applied)
+	require.ErrorContains(t, <-queued, dbError.ErrClosed("").Error())
+
+	stored := make(map[string]DbData[TestVal])
+	require.NoError(t, storage.Load(&stored))
+	require.Contains(t, stored, "applied")
+	require.NotContains(t, stored, "queued")
+}
+
+func TestTimedOutWriteIsDropped(t *testing.T) {
+	storage := &gatedStorage[TestVal]{MemoryStorage: NewMemoryStorage[TestVal]()}
+	db, err := NewDBWithStorage[TestVal](storage, WithOpTimeout(50*time.Millisecond))
+	require.NoError(t, err)
+	defer db.Close()
+
+	gate := make(chan struct{})
+	storage.gate.Store(&gate)
+	first := make(chan operationResult[TestVal])
+	go func() { first <- db.Create("first", TestEntry("first", 1, "")) }()
+	require.Eventually(t, func() bool { _, writes := db.QueueDepth(); return writes == 0 }, time.Second, time.Millisecond)
+	// queued behind the blocked sync until its deadline
+	require.ErrorContains(t, db.Create("late", TestEntry("late", 2, "")).err, dbError.ErrDBTimeout("").Error())
+	storage.gate.Store(nil)
+	close(gate)
+	<-first
+
+	require.ErrorContains(t, db.Read("late").err, dbError.KeyNotFound("").Error())
+}
+
+func TestWaitFor(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+
+	handoff, handoffErr := make(chan DbData[TestVal], 1), make(chan error, 1)
+	go func() {
+		value, err := db.WaitFor(context.Background(), "job")
+		handoff <- value
+		handoffErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, db.Create("job", TestEntry("job", 7, "")).err)
+	require.NoError(t, <-handoffErr)
+	require.Equal(t, 7, (<-handoff).Value.Age)
+
+	// an existing key is returned right away
+	value, err := db.WaitFor(context.Background(), "job")
+	require.NoError(t, err)
+	require.Equal(t, 7, value.Value.Age)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = db.WaitFor(ctx, "never")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	waiting := make(chan error)
+	go func() {
+		_, err := db.WaitFor(context.Background(), "never")
+		waiting <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, db.Close())
+	require.ErrorContains(t, <-waiting, dbError.DBAlreadyClosed("").Error())
+	require.Empty(t, db.watchers.waiting)
+}
+
+func TestQueue(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	db, err := NewDBWithStorage[TestVal](storage, WithSoftDelete(time.Hour))
+	require.NoError(t, err)
+
+	_, err = NewQueue(db, "has.dot")
+	require.ErrorContains(t, err, dbError.InvalidQueueName("").Error())
+
+	queue, err := NewQueue(db, "jobs")
+	require.NoError(t, err)
+	_, err = queue.Dequeue(time.Second)
+	require.ErrorContains(t, err, dbError.QueueEmpty("").Error())
+
+	first, err := queue.Enqueue(TestVal{Name: "first"})
+	require.NoError(t, err)
+	second, err := queue.Enqueue(TestVal{Name: "second"})
+	require.NoError(t, err)
+
+	peeked, err := queue.Peek()
+	require.NoError(t, err)
+	require.Equal(t, first, peeked.ID)
+	require.Empty(t, peeked.Receipt)
+	_, err = queue.Dequeue(0)
+	require.ErrorContains(t, err, dbError.InvalidTTL("").Error())
+
+	item, err := queue.Dequeue(30 * time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, "first", item.Value.Name)
+	require.False(t, item.EnqueuedAt.IsZero())
+	stale := item
+
+	// the first item is hidden, then handed out again once not acked in time
+	item, err = queue.Dequeue(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "second", item.Value.Name)
+	require.ErrorContains(t, queue.Ack(item.ID, "forged"), dbError.ReceiptInvalid("").Error())
+	require.NoError(t, queue.Ack(item.ID, item.Receipt))
+	time.Sleep(40 * time.Millisecond)
+	item, err = queue.Dequeue(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, first, item.ID)
+	// the receipt of the first consumer doesn't ack it anymore
+	require.ErrorContains(t, queue.Ack(stale.ID, stale.Receipt), dbError.ReceiptInvalid("").Error())
+	require.NoError(t, queue.Ack(item.ID, item.Receipt))
+	require.ErrorContains(t, queue.Ack(item.ID, item.Receipt), dbError.ReceiptInvalid("").Error())
+	_, err = queue.Peek()
+	require.ErrorContains(t, err, dbError.QueueEmpty("").Error())
+	// acked items leave no tombstones behind
+	require.Zero(t, db.Stats().Tombstones)
+
+	// sequence numbers carry on past the items acked, across restarts
+	require.NoError(t, db.Close())
+	db, err = NewDBWithStorage[TestVal](storage)
+	require.NoError(t, err)
+	defer db.Close()
+	other, err := NewQueue(db, "jobs")
+	require.NoError(t, err)
+	id, err := other.Enqueue(TestVal{Name: "third"})
+	require.NoError(t, err)
+	require.Greater(t, id, second)
+}
+
+func TestLease(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	lease, err := db.AcquireLease("compactor", 30*time.Millisecond)
+	require.NoError(t, err)
+	_, err = db.AcquireLease("compactor", time.Second)
+	require.ErrorContains(t, err, dbError.LeaseHeld("").Error())
+
+	require.NoError(t, lease.Renew(30*time.Millisecond))
+	time.Sleep(40 * time.Millisecond)
+
+	// once expired, another holder takes it and the first can't renew it
+	other, err := db.AcquireLease("compactor", time.Second)
+	require.NoError(t, err)
+	require.ErrorContains(t, lease.Renew(time.Second), dbError.LeaseLost("").Error())
+	require.ErrorContains(t, lease.Release(), dbError.LeaseLost("").Error())
+
+	require.NoError(t, other.Release())
+	_, err = db.AcquireLease("compactor", time.Second)
+	require.NoError(t, err)
+
+	_, err = db.AcquireLease("other", 0)
+	require.ErrorContains(t, err, dbError.InvalidTTL("").Error())
+
+	// only the lease ops set an owner: a write can't forge one to release
+	// or renew a lease it doesn't hold
+	forged := TestEntry("forged", 1, "")
+	forged.Owner = "forged-token"
+	require.NoError(t, db.Create(leasePrefix+"forged", forged).err)
+	require.Empty(t, db.Read(leasePrefix+"forged").value.Owner)
+	forgedLease := &Lease[TestVal]{db: db, Name: "forged", Token: "forged-token"}
+	require.ErrorContains(t, forgedLease.Release(), dbError.LeaseLost("").Error())
+}
+
+func TestValidators(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	errNoName := fmt.Errorf("name is required")
+	db.AddValidator(func(key string, value TestVal) error {
+		if value.Name == "" {
+			return errNoName
+		}
+		return nil
+	})
+	db.AddValidator(func(key string, value TestVal) error {
+		if value.Age < 0 || value.Age > 150 {
+			return fmt.Errorf("age %d out of range", value.Age)
+		}
+		return nil
+	})
+
+	err = db.Create("nameless", TestEntry("", 10, "")).err
+	var validationErr *dbError.ValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.ErrorIs(t, err, errNoName)
+
+	require.NoError(t, db.Create("valid", TestEntry("ok", 10, "")).err)
+	require.ErrorContains(t, db.Update("valid", TestEntry("ok", 200, "")).err, "age 200 out of range")
+	require.Equal(t, 10, db.Read("valid").value.Value.Age)
+
+	result := db.BatchCreateWithPolicy(map[string]DbData[TestVal]{
+		"good": TestEntry("good", 1, ""),
+		"bad":  TestEntry("", 1, ""),
+	}, SkipExisting)
+	require.Equal(t, []string{"bad"}, result.FailedKeys())
+	require.ErrorIs(t, result.Entries["bad"].Err, errNoName)
+	require.Equal(t, 1, result.Applied)
+}
+
+func TestMiddleware(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var audit []string
+	db.Use(func(op Operation[TestVal], next Handler[TestVal]) error {
+		err := next(op)
+		audit = append(audit, fmt.Sprintf("%s %s %v", op.Action, op.Key, err == nil))
+		return err
+	})
+	errDenied := fmt.Errorf("denied")
+	db.Use(func(op Operation[TestVal], next Handler[TestVal]) error {
+		if strings.HasPrefix(op.Key, "admin.") {
+			return errDenied
+		}
+		op.Value.Value.Name = strings.ToUpper(op.Value.Value.Name)
+		return next(op)
+	})
+
+	require.NoError(t, db.Create("user", TestEntry("ann", 30, "")).err)
+	require.Equal(t, "ANN", db.Read("user").value.Value.Name)
+	require.ErrorIs(t, db.Create("admin.root", TestEntry("root", 1, "")).err, errDenied)
+	require.ErrorIs(t, <-db.CreateAsync("admin.other", TestEntry("x", 1, "")), errDenied)
+	require.NoError(t, <-db.CreateAsync("async", TestEntry("bob", 1, "")))
+	require.Equal(t, "BOB", db.Read("async").value.Value.Name)
+	require.Equal(t, []string{"create user true", "create admin.root false", "create admin.other false", "create async true"}, audit)
+}
+
+func TestView(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	pair := func(age int) map[string]DbData[TestVal] {
+		return map[string]DbData[TestVal]{"a": TestEntry("a", age, ""), "b": TestEntry("b", age, "")}
+	}
+	require.NoError(t, db.BatchCreate(pair(0)).err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for age := 1; age <= 200; age++ {
+			db.BatchCreateWithPolicy(pair(age), Overwrite)
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.View(func(tx ReadTx[TestVal]) error {
+			a, err := tx.Get("a")
+			require.NoError(t, err)
+			time.Sleep(100 * time.Microsecond)
+			b, err := tx.Get("b")
+			require.NoError(t, err)
+			require.Equal(t, a.Value.Age, b.Value.Age)
+			require.Equal(t, []string{"a", "b"}, tx.Keys())
+			return nil
+		}))
+	}
+	<-done
+
+	errAbort := fmt.Errorf("abort")
+	require.ErrorIs(t, db.View(func(tx ReadTx[TestVal]) error {
+		require.False(t, tx.Has("missing"))
+		return errAbort
+	}), errAbort)
+	// the write worker went on
+	require.NoError(t, db.Create("c", TestEntry("c", 1, "")).err)
+}
+
+func TestFreeze(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+
+	require.NoError(t, db.Create("before", TestEntry("before", 1, "")).err)
+	require.ErrorContains(t, db.Unfreeze(), dbError.DatabaseNotFrozen("").Error())
+	require.NoError(t, db.Freeze())
+	require.True(t, db.Frozen())
+	require.ErrorContains(t, db.Freeze(), dbError.DatabaseFrozen("").Error())
+
+	// reads go on, writes wait for Unfreeze
+	require.NoError(t, db.Read("before").err)
+	pending := db.CreateAsync("during", TestEntry("during", 1, ""))
+	select {
+	case <-pending:
+		t.Fatal("write applied while frozen")
+	case <-time.After(30 * time.Millisecond):
+	}
+	require.NoError(t, db.Unfreeze())
+	require.NoError(t, <-pending)
+	require.False(t, db.Frozen())
+
+	// Close ends a freeze
+	require.NoError(t, db.Freeze())
+	pending = db.CreateAsync("late", TestEntry("late", 1, ""))
+	require.NoError(t, db.Close())
+	require.ErrorContains(t, <-pending, dbError.ErrClosed("").Error())
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithRotation(1, dir), WithChainedReads())
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithRotation(0, dir))
+	require.ErrorContains(t, err, dbError.InvalidRequest("").Error())
+
+	// every entry is about 100 bytes: the 1 KB mark is crossed after ten
+	for i := 0; i < 60; i++ {
+		require.NoError(t, db.Create(fmt.Sprintf("log-%02d", i), TestEntry("line", i, "")).err)
+	}
+	generations := db.Generations()
+	require.NotEmpty(t, generations)
+	for _, path := range generations {
+		require.True(t, strings.HasPrefix(filepath.Base(path), generationPrefix))
+	}
+	require.Greater(t, len(generations), loadedGenerationsSize)
+	require.Less(t, db.Stats().Entries, 60)
+
+	// rotated out entries are still read through the generations, only a
+	// few of which stay loaded
+	for i := 0; i < 60; i++ {
+		result := db.Read(fmt.Sprintf("log-%02d", i))
+		require.NoError(t, result.err)
+		require.Equal(t, i, result.value.Value.Age)
+	}
+	require.Len(t, db.generations.loaded, loadedGenerationsSize)
+	require.ErrorContains(t, db.Read("missing").err, dbError.KeyNotFound("").Error())
+
+	// updates growing past the mark don't rotate the key away
+	require.NoError(t, db.Create("grown", TestEntry("g", 0, "")).err)
+	generations = db.Generations()
+	for i := 1; i <= 20; i++ {
+		require.NoError(t, db.Update("grown", TestEntry(strings.Repeat("g", 100*i), i, "")).err)
+	}
+	require.Equal(t, generations, db.Generations())
+	require.Equal(t, 20, db.Read("grown").value.Value.Age)
+	require.NoError(t, db.Create("next", TestEntry("next", 1, "")).err)
+	require.Len(t, db.Generations(), len(generations)+1)
+
+	// a reopened DB finds the generations again
+	reopened, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithRotation(1, dir))
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Equal(t, db.Generations(), reopened.Generations())
+	require.ErrorContains(t, reopened.Read("log-00").err, dbError.KeyNotFound("").Error())
+}
+
+func TestBlobs(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithBlobDir(dir))
+	require.NoError(t, err)
+	defer db.Close()
+
+	payload := bytes.Repeat([]byte("0123456789"), 100*KB)
+	require.NoError(t, db.CreateFromReader("big", bytes.NewReader(payload)).err)
+	entry := db.Read("big").value
+	require.NotNil(t, entry.Blob)
+	require.Equal(t, int64(len(payload)), entry.Blob.Size)
+
+	var copied bytes.Buffer
+	n, err := db.ReadToWriter("big", &copied)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(payload)), n)
+	require.Equal(t, payload, copied.Bytes())
+
+	// a failed create leaves no file behind
+	require.ErrorContains(t, db.CreateFromReader("big", bytes.NewReader(payload)).err, dbError.EntryAlreadyExists("").Error())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	require.NoError(t, db.Create("inline", TestEntry("inline", 1, "")).err)
+	_, err = db.ReadToWriter("inline", io.Discard)
+	require.ErrorContains(t, err, dbError.NotABlob("").Error())
+
+	// Compact collects the blobs of deleted entries
+	require.NoError(t, db.Delete("big").err)
+	require.NoError(t, db.Compact().err)
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	// a blob reference from the caller is dropped, whatever the write
+	forged := TestEntry("forged", 1, "")
+	forged.Blob = &BlobRef{File: "../../etc/passwd", Size: -MB}
+	require.NoError(t, db.Create("forged", forged).err)
+	require.NoError(t, db.Update("forged", forged).err)
+	require.NoError(t, db.BatchCreate(map[string]DbData[TestVal]{"forged/batch": forged}).err)
+	require.NoError(t, db.BatchWrite([]Op[TestVal]{{Kind: OpPut, Key: "forged/op", Entry: forged}}, nil))
+	for _, key := range []string{"forged", "forged/batch", "forged/op"} {
+		require.Nil(t, db.Read(key).value.Blob, key)
+		_, err = db.ReadToWriter(key, io.Discard)
+		require.ErrorContains(t, err, dbError.NotABlob("").Error())
+	}
+	require.NotNil(t, forged.Blob) // the caller's entry is left alone
+
+	plain, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer plain.Close()
+	require.ErrorContains(t, plain.CreateFromReader("big", bytes.NewReader(payload)).err, dbError.BlobsNotEnabled("").Error())
+}
+
+func TestEntrySizeLimit(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithEntrySizeLimit(2), WithEntrySizeLimitFor("doc.", 8), WithEntrySizeLimitFor("doc.small.", 1))
+	require.NoError(t, err)
+	defer db.Close()
+
+	large := TestEntry(strings.Repeat("x", 4*KB), 1, "")
+	err = db.Create("plain", large).err
+	require.ErrorContains(t, err, dbError.JsonSizeExceedsLimit("").Error())
+	require.ErrorContains(t, err, "the limit is 2 KB")
+	require.NoError(t, db.Create("doc.large", large).err)
+	require.ErrorContains(t, db.Create("doc.small.one", large).err, "the limit is 1 KB")
+	// updates are sized too
+	require.NoError(t, db.Create("doc.small.two", TestEntry("small", 1, "")).err)
+	require.ErrorContains(t, db.Update("doc.small.two", large).err, "the limit is 1 KB")
+	require.Equal(t, "small", db.Read("doc.small.two").value.Value.Name)
+
+	require.NoError(t, db.SetOption(WithEntrySizeLimit(MaxEntrySizeLimitMB*KB*2)))
+	require.NoError(t, db.Create("plain", large).err)
+	require.Equal(t, float64(MaxEntrySizeLimitMB*KB), db.entryLimitKB("plain"))
+}
+
+func TestHealthCheck(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("health", dir)
+	require.NoError(t, err)
+
+	report := db.HealthCheck(context.Background())
+	require.True(t, report.Healthy, "%+v", report)
+	names := make([]string, 0, len(report.Checks))
+	for _, status := range report.Checks {
+		names = append(names, status.Name)
+	}
+	require.Equal(t, []string{"open", "loaded", "lock", "writable", "write_worker", "read_worker", "queues", "disk"}, names)
+
+	// a frozen write worker misses the heartbeat
+	require.NoError(t, db.Freeze())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	report = db.HealthCheck(ctx)
+	cancel()
+	require.False(t, report.Healthy)
+	require.Contains(t, report.Checks[4].Detail, "frozen")
+	require.True(t, report.Checks[5].Healthy)
+	require.NoError(t, db.Unfreeze())
+
+	// so does a lock file removed from under the DB
+	require.NoError(t, os.Remove(filepath.Join(dir, "health.json.lock")))
+	report = db.HealthCheck(context.Background())
+	require.False(t, report.Healthy)
+	require.False(t, report.Checks[2].Healthy)
+
+	require.NoError(t, db.Close())
+	report = db.HealthCheck(context.Background())
+	require.False(t, report.Healthy)
+	require.Len(t, report.Checks, 1)
+}
+
+func TestDiskFull(t *testing.T) {
+	db, err := NewDB[TestVal]("diskFull", t.TempDir())
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("before", TestEntry("before", 1, "")).err)
+
+	realFree := diskFreeBytes
+	defer func() { diskFreeBytes = realFree }()
+	diskFreeBytes = func(dir string) (uint64, error) { return 10, nil }
+
+	err = db.Create("after", TestEntry("after", 1, "")).err
+	require.ErrorContains(t, err, dbError.ErrDiskFull("").Error())
+	require.ErrorContains(t, err, "10 free")
+	require.ErrorContains(t, db.Update("before", TestEntry("changed", 2, "")).err, dbError.ErrDiskFull("").Error())
+	// the data is left as it was
+	require.Equal(t, "before", db.Read("before").value.Value.Name)
+	require.NoError(t, db.Delete("before").err)
+}
+
+func TestOpMetadata(t *testing.T) {
+	db, err := NewDB[TestVal]("opMetadata", t.TempDir(), WithOpMetadata())
+	require.NoError(t, err)
+	defer db.Close()
+
+	result := db.Create("k", TestEntry("k", 1, ""))
+	require.NoError(t, result.err)
+	meta := result.Metadata()
+	require.NotNil(t, meta)
+	require.Equal(t, 1, meta.Syncs)
+	require.Positive(t, meta.SyncDuration)
+	require.GreaterOrEqual(t, meta.Exec, meta.SyncDuration)
+	require.Positive(t, meta.Bytes)
+	require.Equal(t, db.Checkpoint().Seq, meta.Seq)
+
+	read := db.Read("k")
+	require.NotNil(t, read.Metadata())
+	require.Zero(t, read.Metadata().Syncs)
+
+	plain, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer plain.Close()
+	require.Nil(t, plain.Create("k", TestEntry("k", 1, "")).Metadata())
+}
+
+type spanKey struct{}
+
+type recordedSpan struct {
+	name       string
+	parent     string
+	attributes map[string]any
+	err        error
+	ended      bool
+}
+
+// recordingTracer keeps the spans it starts, parented through the context.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (tracer *recordingTracer) Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, Span) {
+	span := &recordedSpan{name: name, attributes: make(map[string]any)}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	for _, attribute := range attributes {
+		span.attributes[attribute.Key] = attribute.Value
+	}
+	tracer.mu.Lock()
+	tracer.spans = append(tracer.spans, span)
+	tracer.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), &recordingSpan{tracer, span}
+}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	span   *recordedSpan
+}
+
+func (s *recordingSpan) SetAttributes(attributes ...Attribute) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	for _, attribute := range attributes {
+		s.span.attributes[attribute.Key] = attribute.Value
+	}
+}
+
+func (s *recordingSpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.span.err = err
+}
+
+func (s *recordingSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.span.ended = true
+}
+
+func TestTracing(t *testing.T) {
+	tracer := &recordingTracer{}
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithTracer(tracer))
+	require.NoError(t, err)
+	require.NoError(t, db.Create("k", TestEntry("k", 1, "")).err)
+	require.Error(t, db.Read("missing").err)
+	require.NoError(t, db.Close())
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	var traced []string
+	for _, span := range tracer.spans {
+		require.True(t, span.ended, span.name)
+		if span.attributes["kv.op"] == "ping" {
+			continue
+		}
+		traced = append(traced, fmt.Sprintf("%s<%s %v %v", span.name, span.parent, span.attributes["kv.op"], span.err != nil))
+	}
+	require.Equal(t, []string{
+		"kv.enqueue< create false",
+		"kv.process<kv.enqueue create false",
+		"kv.sync<kv.process sync false",
+		"kv.enqueue< read false",
+		"kv.process<kv.enqueue read true",
+	}, traced)
+	require.Positive(t, tracer.spans[2].attributes["kv.size"])
+}
+
+func TestDebugHandler(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithMaxEntries(10))
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Create("k", TestEntry("k", 1, "")).err)
+	require.Error(t, db.Create("k", TestEntry("k", 1, "")).err)
+
+	server := httptest.NewServer(db.DebugHandler())
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, "application/json", response.Header.Get("Content-Type"))
+
+	var state struct {
+		Open  bool `json:"open"`
+		Stats struct {
+			Entries int `json:"entries"`
+		} `json:"stats"`
+		Queues struct {
+			WriteCapacity int `json:"write_capacity"`
+		} `json:"queues"`
+		RecentErrors []RecentError `json:"recent_errors"`
+		Config       struct {
+			MaxEntries int `json:"max_entries"`
+		} `json:"config"`
+	}
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&state))
+	require.True(t, state.Open)
+	require.Equal(t, 1, state.Stats.Entries)
+	require.Equal(t, 100, state.Queues.WriteCapacity)
+	require.Equal(t, 10, state.Config.MaxEntries)
+	require.Len(t, state.RecentErrors, 1)
+	require.Equal(t, "create", state.RecentErrors[0].Action)
+	require.Contains(t, state.RecentErrors[0].Err, dbError.EntryAlreadyExists("").Error())
+}
+
+func TestIOStats(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+	a, b := TestEntry("a", 1, ""), TestEntry("b", 2, "")
+	require.NoError(t, db.Create("a", a).err)
+	require.NoError(t, db.Create("b", b).err)
+	require.NoError(t, db.Delete("a").err)
+	require.NoError(t, db.Compact().err)
+
+	stats := db.IOStats()
+	require.GreaterOrEqual(t, stats.Syncs, uint64(3))
+	require.Zero(t, stats.FailedSyncs)
+	require.Equal(t, uint64(1), stats.Rewrites)
+	require.NotZero(t, stats.BytesWritten)
+	// the keys, and the entries as the size checks measured them
+	sizeA, err := entrySizeKB(a, math.MaxFloat64)
+	require.NoError(t, err)
+	sizeB, err := entrySizeKB(b, math.MaxFloat64)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3+int(sizeA*KB)+int(sizeB*KB)), stats.ChangedBytes)
+	require.InDelta(t, float64(stats.BytesWritten)/float64(stats.ChangedBytes), stats.WriteAmplification, 1e-9)
+	require.Equal(t, stats, db.Stats().IO)
+
+	server := httptest.NewServer(db.MetricsHandler())
+	defer server.Close()
+	response, err := http.Get(server.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "# TYPE kv_syncs_total counter\n")
+	require.Contains(t, string(body), "\nkv_entries 1\n")
+	require.Contains(t, string(body), "\nkv_rewrites_total 1\n")
+}
+
+func TestListKeys(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// created in reverse lexical order
+	var all []string
+	for i := 9; i >= 0; i-- {
+		key := fmt.Sprintf("user.%d", i)
+		entry := TestEntry(key, i, "")
+		entry.Created_at = time.Now().Add(time.Duration(-i) * time.Minute)
+		require.NoError(t, db.Create(key, entry).err)
+		all = append([]string{key}, all...)
+	}
+	require.NoError(t, db.Create("other", TestEntry("other", 1, "")).err)
+
+	var listed []string
+	page := ListPage{}
+	for {
+		var err error
+		page, err = db.ListKeys(ListOptions{Prefix: "user.", Limit: 3, After: page.Next})
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page.Keys), 3)
+		listed = append(listed, page.Keys...)
+		if page.Next == "" {
+			break
+		}
+	}
+	require.Equal(t, all, listed)
+
+	page, err = db.ListKeys(ListOptions{Prefix: "user.", Limit: 2, Descending: true})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.9", "user.8"}, page.Keys)
+	// a removed key keeps its token valid
+	require.NoError(t, db.Delete("user.8").err)
+	page, err = db.ListKeys(ListOptions{Prefix: "user.", Limit: 2, Descending: true, After: page.Next})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.7", "user.6"}, page.Keys)
+
+	// user.9 was created first, 9 minutes ago
+	page, err = db.ListKeys(ListOptions{Order: ByCreated, Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.9", "user.7"}, page.Keys)
+	require.NoError(t, db.Update("user.9", TestEntry("user.9", 99, "")).err)
+	page, err = db.ListKeys(ListOptions{Order: ByUpdated, Descending: true, Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user.9"}, page.Keys)
+
+	_, err = db.ListKeys(ListOptions{After: "not a token"})
+	require.ErrorContains(t, err, dbError.InvalidListToken("").Error())
+}
+
+func TestDedup(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithDedup())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Create("a", TestEntry("same", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("same", 1, "")).err)
+	require.NoError(t, db.Create("c", TestEntry("other", 2, "")).err)
+	require.NoError(t, db.Create("d", TestEntry("same", 1, "")).err)
+	groups, err := db.FindDuplicates()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"a", "b", "d"}}, groups)
+
+	require.NoError(t, db.Update("b", TestEntry("other", 2, "")).err)
+	require.NoError(t, db.Delete("d").err)
+	groups, err = db.FindDuplicates()
+	require.NoError(t, err)
+	require.Equal(t, [][]string{{"b", "c"}}, groups)
+
+	unique, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithUniqueValues())
+	require.NoError(t, err)
+	defer unique.Close()
+	require.NoError(t, unique.Create("a", TestEntry("same", 1, "")).err)
+	require.ErrorContains(t, unique.Create("b", TestEntry("same", 1, "")).err, "Value already stored")
+	require.NoError(t, unique.Create("b", TestEntry("other", 2, "")).err)
+	require.ErrorContains(t, unique.Update("b", TestEntry("same", 1, "")).err, "Value already stored")
+	require.NoError(t, unique.Update("a", TestEntry("same", 1, "")).err) // rewriting its own value
+
+	plain, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.FindDuplicates()
+	require.ErrorContains(t, err, "Dedup is not enabled")
+}
+
+func TestPutContent(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer db.Close()
+
+	value := TestEntry("content", 7, "").Value
+	key, err := db.PutContent(value)
+	require.NoError(t, err)
+	require.Len(t, key, KeySizeLimit)
+	expected, err := ContentKey(value)
+	require.NoError(t, err)
+	require.Equal(t, expected, key)
+
+	again, err := db.PutContent(value)
+	require.NoError(t, err)
+	require.Equal(t, key, again)
+	read := db.Read(key)
+	require.NoError(t, read.err)
+	require.Equal(t, value, read.value.Value)
+
+	other, err := db.PutContent(TestEntry("content", 8, "").Value)
+	require.NoError(t, err)
+	require.NotEqual(t, key, other)
+}
+
+func TestMigrate(t *testing.T) {
+	type person struct {
+		FullName string `json:"full_name"`
+		Years    int    `json:"years"`
+	}
+	path := filepath.Join(t.TempDir(), "people.json")
+	db, err := OpenPath[TestVal](path)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("ann", TestEntry("ann", 30, "")).err)
+	require.NoError(t, db.Create("bob", TestEntry("bob", 40, "3600")).err)
+	original := db.Read("bob").value
+	require.NoError(t, db.Close())
+
+	convert := func(old TestVal) person {
+		return person{FullName: strings.ToUpper(old.Name), Years: old.Age}
+	}
+	report, err := MigrateDryRun(path, convert)
+	require.NoError(t, err)
+	require.True(t, report.DryRun)
+	require.Equal(t, 2, report.Converted)
+	db, err = OpenPath[TestVal](path) // untouched
+	require.NoError(t, err)
+	_, err = Migrate(path, convert)
+	require.ErrorContains(t, err, dbError.FileIsLockedByAnotherProcess("").Error())
+	require.NoError(t, db.Close())
+
+	copyPath := filepath.Join(t.TempDir(), "copy.json")
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(copyPath, contents, 0644))
+	report, err = Migrate(copyPath, func(old TestVal) person {
+		if old.Name == "bob" {
+			panic("no bob")
+		}
+		return convert(old)
+	})
+	require.ErrorContains(t, err, "Migration failed")
+	require.Equal(t, []string{"bob"}, report.FailedKeys())
+	after, err := os.ReadFile(copyPath)
+	require.NoError(t, err)
+	require.Equal(t, contents, after)
+
+	report, err = Migrate(copyPath, convert)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Entries)
+	migrated, err := OpenPath[person](copyPath)
+	require.NoError(t, err)
+	defer migrated.Close()
+	bob := migrated.Read("bob")
+	require.NoError(t, bob.err)
+	require.Equal(t, person{FullName: "BOB", Years: 40}, bob.value.Value)
+	require.Equal(t, original.Ttl, bob.value.Ttl)
+	require.True(t, original.Created_at.Round(0).Equal(bob.value.Created_at.Round(0)))
+}
+
+func TestStrictDecode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "drift.json")
+	contents := `{
+		"clean": {"value": {"name": "a", "age": 1}, "ttl": "", "created_at": "2026-01-02T03:04:05Z"},
+		"extra": {"value": {"name": "b", "age": 2, "email": "b@example.com"}, "ttl": "", "created_at": "2026-01-02T03:04:05Z"},
+		"short": {"value": {"name": "c"}, "ttl": "", "created_at": "2026-01-02T03:04:05Z"}
+	}`
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+
+	db, err := OpenPath[TestVal](path, WithStrictDecode())
+	require.NoError(t, err)
+	issues := db.DecodeIssues()
+	require.Len(t, issues, 2)
+	require.Equal(t, "extra", issues[0].Key)
+	require.Contains(t, issues[0].Problem, `unknown field "email"`)
+	require.Equal(t, DecodeIssue{Key: "short", Problem: "value lacks fields [age]"}, issues[1])
+	// loaded anyway, as without the option
+	require.Equal(t, TestVal{Name: "b", Age: 2}, db.Read("extra").value.Value)
+	require.True(t, db.Exists("short"))
+	require.NoError(t, db.Close())
+
+	db, err = OpenPath[TestVal](path)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Nil(t, db.DecodeIssues())
+}
+
+func TestClockChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clock.json")
+	past := time.Now().Add(-time.Minute).Round(0).UTC()
+	future := time.Now().Add(time.Hour).Round(0).UTC()
+	contents := fmt.Sprintf(`{
+		"past": {"value": {"name": "a", "age": 1}, "ttl": "3600", "created_at": %q},
+		"future": {"value": {"name": "b", "age": 2}, "ttl": "60", "created_at": %q}
+	}`, past.Format(time.RFC3339Nano), future.Format(time.RFC3339Nano))
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+
+	db, err := OpenPath[TestVal](path)
+	require.NoError(t, err)
+	loaded := db.Read("past").value.Created_at
+	require.True(t, loaded.Equal(past))
+	// the expiration now runs on the monotonic clock
+	require.NotEqual(t, loaded, loaded.Round(0))
+	require.True(t, db.Read("future").value.Created_at.Equal(future))
+	require.NoError(t, db.Close())
+
+	db, err = OpenPath[TestVal](path, WithClockSafeLoad())
+	require.NoError(t, err)
+	defer db.Close()
+	require.True(t, db.Read("past").value.Created_at.Equal(past))
+	clamped := db.Read("future").value.Created_at
+	require.False(t, clamped.After(time.Now()))
+	require.WithinDuration(t, time.Now(), clamped, time.Minute)
+}
+
+func TestPreviewCleanup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sweep.json")
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	contents := fmt.Sprintf(`{
+		"live": {"value": {"name": "a", "age": 1}, "ttl": "", "created_at": %q},
+		"gone1": {"value": {"name": "b", "age": 2}, "ttl": "60", "created_at": %q},
+		"gone2": {"value": {"name": "c", "age": 3}, "ttl": "60", "created_at": %q}
+	}`, old, old, old)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+
+	db, err := OpenPath[TestVal](path, WithCleanupInterval(0))
+	require.NoError(t, err)
+	preview, err := db.PreviewCleanup()
+	require.NoError(t, err)
+	require.Equal(t, []string{"gone1", "gone2"}, preview.Keys)
+	require.Greater(t, preview.Bytes, int64(0))
+	require.Equal(t, 3, db.Stats().Entries) // nothing removed
+	require.NoError(t, db.Close())
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, runCLI([]string{"cleanup", "-dry-run", path}, &stdout, &stderr), stderr.String())
+	require.Contains(t, stdout.String(), "would remove 2 expired entries")
+	report, err := VerifyFile[TestVal](path)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Entries)
+
+	stdout.Reset()
+	require.Equal(t, 0, runCLI([]string{"cleanup", "-json", path}, &stdout, &stderr), stderr.String())
+	var removed CleanupPreview
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &removed))
+	require.Equal(t, preview, removed)
+	report, err = VerifyFile[TestVal](path)
+	require.NoError(t, err)
+	require.Equal(t, 1, report.Entries)
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plan.json")
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+	contents := fmt.Sprintf(`{
+		"user:1": {"value": {"name": "a", "age": 1}, "ttl": "", "created_at": %q},
+		"user:2": {"value": {"name": "b", "age": 2}, "ttl": "", "created_at": %q},
+		"config": {"value": {"name": "c", "age": 3}, "ttl": "", "created_at": %q},
+		"gone": {"value": {"name": "d", "age": 4}, "ttl": "60", "created_at": %q}
+	}`, old, old, old, old)
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+
+	db, err := OpenPath[TestVal](path, WithCleanupInterval(0))
+	require.NoError(t, err)
+	backup, err := db.Backup(filepath.Join(dir, "backups"))
+	require.NoError(t, err)
+	require.NoError(t, db.Update("user:1", DbData[TestVal]{Value: TestVal{Name: "a2", Age: 1}}).err)
+	require.NoError(t, db.Delete("user:2").err)
+	require.NoError(t, db.Create("new", DbData[TestVal]{Value: TestVal{Name: "e"}, Created_at: time.Now()}).err)
+
+	plan, err := db.PlanRestore(backup)
+	require.NoError(t, err)
+	require.Equal(t, []string{"new"}, plan.Removed)
+	require.Equal(t, []string{"user:2"}, plan.Added)
+	require.Equal(t, []string{"user:1"}, plan.Changed)
+	plan, err = db.PlanCompact()
+	require.NoError(t, err)
+	require.Equal(t, []string{"gone"}, plan.Removed)
+	require.Greater(t, plan.BytesReclaimed, int64(0))
+	plan, err = db.PlanDeleteMatching("user:*")
+	require.NoError(t, err)
+	require.Equal(t, []string{"user:1"}, plan.Removed)
+	require.Equal(t, 4, db.Stats().Entries) // nothing changed
+	require.NoError(t, db.Close())
+
+	run := func(args ...string) ChangePlan {
+		var stdout, stderr bytes.Buffer
+		require.Equal(t, 0, runCLI(append(args[:1:1], append([]string{"-json"}, args[1:]...)...), &stdout, &stderr), stderr.String())
+		var report ChangePlan
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+		return report
+	}
+	entries := func() int {
+		report, err := VerifyFile[TestVal](path)
+		require.NoError(t, err)
+		return report.Entries
+	}
+	require.Equal(t, []string{"gone"}, run("compact", "-dry-run", path).Removed)
+	require.Equal(t, []string{"user:1"}, run("delete", "-dry-run", path, "user:*").Removed)
+	require.Equal(t, []string{"user:2"}, run("restore", "-dry-run", path, backup).Added)
+	require.Equal(t, 4, entries())
+
+	require.Equal(t, []string{"user:1"}, run("delete", path, "user:*").Removed)
+	require.Equal(t, 3, entries())
+	restored := run("restore", path, backup)
+	require.Equal(t, []string{"new"}, restored.Removed)
+	require.Equal(t, []string{"user:1", "user:2"}, restored.Added)
+	require.Equal(t, 4, entries())
+	require.Equal(t, ChangePlan{}, run("restore", "-dry-run", path, backup))
+	require.Equal(t, []string{"gone"}, run("compact", path).Removed)
+	require.Equal(t, 3, entries())
+
+	db, err = OpenPath[TestVal](path, WithCleanupInterval(0))
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, "a", db.Read("user:1").value.Value.Name)
+	require.Equal(t, "b", db.Read("user:2").value.Value.Name)
+	require.ErrorContains(t, db.Read("new").err, dbError.KeyNotFound("").Error())
+}
+
+func TestWriteCoalescing(t *testing.T) {
+	storage := NewMemoryStorage[TestVal]()
+	db, err := NewDBWithStorage[TestVal](storage, WithWriteCoalescing(500*time.Millisecond), WithOpMetadata())
+	require.NoError(t, err)
+	stored := func(key string) TestVal {
+		data := make(map[string]DbData[TestVal])
+		require.NoError(t, storage.Load(&data))
+		return data[key].Value
+	}
+
+	require.NoError(t, db.Create("hot", TestEntry("hot", 0, "")).err)
+	first := db.Update("hot", TestEntry("hot", 1, ""))
+	require.NoError(t, first.err)
+	require.Equal(t, 1, first.Metadata().Syncs)
+	for age := 2; age <= 5; age++ {
+		result := db.Update("hot", TestEntry("hot", age, ""))
+		require.NoError(t, result.err)
+		require.Zero(t, result.Metadata().Syncs)
+	}
+	// read from memory, not persisted yet
+	require.Equal(t, 5, db.Read("hot").value.Value.Age)
+	require.Equal(t, 1, stored("hot").Age)
+	require.Eventually(t, func() bool { return stored("hot").Age == 5 }, 3*time.Second, 20*time.Millisecond)
+
+	require.Zero(t, db.Update("hot", TestEntry("hot", 6, "")).Metadata().Syncs)
+	require.NoError(t, db.Close())
+	require.Equal(t, 6, stored("hot").Age)
+}
+
+func TestStatusFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kv.status")
+	db, err := NewDB[TestVal]("status", dir, WithStatusFile(path, 50*time.Millisecond))
+	require.NoError(t, err)
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+
+	require.Eventually(t, func() bool {
+		status, err := ReadStatusFile(path)
+		return err == nil && status.Entries == 2
+	}, 2*time.Second, 20*time.Millisecond)
+	status, err := ReadStatusFile(path)
+	require.NoError(t, err)
+	require.True(t, status.Running)
+	require.False(t, status.Closed)
+	require.Equal(t, os.Getpid(), status.PID)
+	require.Positive(t, status.SizeKB)
+	require.False(t, status.LastSync.IsZero())
+
+	_, err = NewDB[TestVal]("other", dir, WithStatusFile(path, 0))
+	require.ErrorContains(t, err, dbError.FileIsLockedByAnotherProcess("").Error())
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 0, runCLI([]string{"status", path}, &stdout, &stderr), stderr.String())
+	require.Contains(t, stdout.String(), "entries:    2")
+
+	require.NoError(t, db.Close())
+	status, err = ReadStatusFile(path)
+	require.NoError(t, err)
+	require.False(t, status.Running)
+	require.True(t, status.Closed)
+	stdout.Reset()
+	require.Equal(t, 1, runCLI([]string{"status", path}, &stdout, &stderr))
+	require.Contains(t, stdout.String(), "state:      closed")
+}
+
+func TestHandleSignals(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("signals", dir, WithWriteCoalescing(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, db.Create("k", TestEntry("k", 1, "")).err)
+	require.NoError(t, db.Update("k", TestEntry("k", 2, "")).err)
+	require.NoError(t, db.Update("k", TestEntry("k", 3, "")).err) // deferred
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	closed := db.HandleSignals(ctx)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-closed:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed on SIGTERM")
+	}
+	require.ErrorContains(t, db.Create("late", TestEntry("late", 1, "")).err, dbError.DBAlreadyClosed("").Error())
+
+	// lock released, deferred update flushed
+	db, err = NewDB[TestVal]("signals", dir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 3, db.Read("k").value.Value.Age)
+
+	// a done context stops listening without closing
+	ctx, cancel = context.WithCancel(context.Background())
+	closed = db.HandleSignals(ctx)
+	cancel()
+	_, ok := <-closed
+	require.False(t, ok)
+	require.NoError(t, db.Create("still", TestEntry("still", 1, "")).err)
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	var flushes []FlushStats
+	db.OnFlush(func(stats FlushStats) { flushes = append(flushes, stats) })
+	var closed []string
+	db.OnClose(func() { closed = append(closed, "first") })
+	db.OnClose(func() { closed = append(closed, "second") })
+
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	require.Error(t, db.Create("a", TestEntry("a", 1, "")).err) // no sync
+	require.Len(t, flushes, 2)
+	require.Equal(t, 2, flushes[1].Entries)
+	require.Equal(t, db.Checkpoint().SyncedSeq, flushes[1].Seq)
+	require.Greater(t, flushes[1].Seq, flushes[0].Seq)
+	require.Empty(t, closed)
+
+	require.NoError(t, db.Close())
+	require.Equal(t, []string{"first", "second"}, closed)
+}
+
+func TestHotKeys(t *testing.T) {
+	db, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal](), WithHotKeys())
+	require.NoError(t, err)
+	defer db.Close()
+
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("cold%d", i)
+		require.NoError(t, db.Create(key, TestEntry(key, i, "")).err)
+		require.NoError(t, db.Read(key).err)
+	}
+	for i := 0; i < 50; i++ {
+		require.NoError(t, db.Read("cold7").err)
+		require.NoError(t, db.Read("cold42").err)
+		if i%2 == 0 {
+			require.Error(t, db.Read("missing").err)
+		}
+	}
+	hot, err := db.HotKeys(3)
+	require.NoError(t, err)
+	require.Len(t, hot, 3)
+	require.ElementsMatch(t, []string{"cold7", "cold42"}, []string{hot[0].Key, hot[1].Key})
+	require.GreaterOrEqual(t, hot[0].Count, uint64(51))
+	require.Equal(t, "missing", hot[2].Key)
+
+	stats := db.Stats()
+	require.Equal(t, uint64(300), stats.ReadHits)
+	require.Equal(t, uint64(25), stats.ReadMisses)
+
+	plain, err := NewDBWithStorage[TestVal](NewMemoryStorage[TestVal]())
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = plain.HotKeys(10)
+	require.ErrorContains(t, err, "Hot key tracking is not enabled")
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("seq", dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	require.NoError(t, db.Update("a", TestEntry("a", 3, "")).err)
+	require.Equal(t, uint64(3), db.Read("a").value.Seq)
+	require.Equal(t, uint64(2), db.Read("b").value.Seq)
+	require.Equal(t, uint64(3), db.Checkpoint().Seq)
+
+	changed, err := db.ChangedSince(2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, changed)
+	changed, err = db.ChangedSince(db.Checkpoint().Seq)
+	require.NoError(t, err)
+	require.Empty(t, changed)
+	require.NoError(t, db.Close())
+
+	// numbering resumes after the highest number stored
+	db, err = NewDB[TestVal]("seq", dir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, uint64(3), db.Read("a").value.Seq)
+	require.Equal(t, uint64(3), db.Checkpoint().Seq)
+	require.NoError(t, db.Create("c", TestEntry("c", 4, "")).err)
+	require.Equal(t, uint64(4), db.Read("c").value.Seq)
+}
+
+func TestBatchWrite(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	require.NoError(t, db.Create("from", TestEntry("from", 10, "")).err)
+	from := db.Read("from").value
+
+	transfer := []Op[TestVal]{PutOp("from", TestEntry("from", 7, "")), PutOp("to", TestEntry("to", 3, ""))}
+	require.NoError(t, db.BatchWrite(transfer, []Precondition{VersionEquals("from", from.Seq), KeyAbsent("to")}))
+	require.Equal(t, 7, db.Read("from").value.Value.Age)
+	require.Equal(t, 3, db.Read("to").value.Value.Age)
+
+	// "from" was written since: nothing is applied
+	seq := db.Checkpoint().Seq
+	retry := []Op[TestVal]{PutOp("from", TestEntry("from", 4, "")), DeleteOp[TestVal]("to")}
+	require.ErrorContains(t, db.BatchWrite(retry, []Precondition{VersionEquals("from", from.Seq)}), dbError.PreconditionFailed("").Error())
+	require.ErrorContains(t, db.BatchWrite(retry, []Precondition{KeyExists("missing")}), dbError.PreconditionFailed("").Error())
+	require.Equal(t, seq, db.Checkpoint().Seq)
+	require.Equal(t, 7, db.Read("from").value.Value.Age)
+
+	// an invalid op fails the whole batch
+	invalid := []Op[TestVal]{PutOp("other", TestEntry("other", 1, "")), PutOp("to", TestEntry("to", 1, "-1"))}
+	require.ErrorContains(t, db.BatchWrite(invalid, nil), dbError.InvalidTTL("").Error())
+	require.ErrorContains(t, db.Read("other").err, dbError.KeyNotFound("").Error())
+	require.ErrorContains(t, db.BatchWrite([]Op[TestVal]{DeleteOp[TestVal]("to"), DeleteOp[TestVal]("to")}, nil), dbError.InvalidBatch("").Error())
+
+	require.NoError(t, db.BatchWrite(retry, []Precondition{KeyExists("to")}))
+	require.Equal(t, 4, db.Read("from").value.Value.Age)
+	require.ErrorContains(t, db.Read("to").err, dbError.KeyNotFound("").Error())
+}
+
+func TestBatchWriteEntryLimitPurgesHeldKeys(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	db := NewTestDB[TestVal](t, WithClock(clock), WithMaxEntries(2))
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "1")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	clock.Advance(5 * time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- db.BatchWrite([]Op[TestVal]{PutOp("a", TestEntry("a", 3, "")), PutOp("c", TestEntry("c", 4, ""))}, nil)
+	}()
+	select {
+	case err := <-done:
+		// "a" is purged, "b" and the two puts still make three
+		require.ErrorContains(t, err, dbError.ErrEntryLimitReached("").Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("BatchWrite purging an expired key it holds hung")
+	}
+	require.NoError(t, db.BatchWrite([]Op[TestVal]{PutOp("a", TestEntry("a", 3, ""))}, nil))
+	require.Equal(t, 3, db.Read("a").value.Value.Age)
+}
+
+func TestApply(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	require.NoError(t, db.Create("old", TestEntry("old", 1, "")).err)
+	seq := db.Checkpoint().Seq
+
+	results, err := db.Apply([]Op[TestVal]{
+		PutOp("a", TestEntry("a", 1, "")),
+		DeleteOp[TestVal]("missing"),
+		PutOp("a", TestEntry("a", 2, "")), // sees the first put
+		PutOp("b", TestEntry("b", 1, "-1")),
+		DeleteOp[TestVal]("old"),
+	})
+	require.NoError(t, err)
+	require.Len(t, results, 5)
+	require.NoError(t, results[0].Err)
+	require.ErrorContains(t, results[1].Err, dbError.KeyNotFound("").Error())
+	require.NoError(t, results[2].Err)
+	require.Greater(t, results[2].Seq, results[0].Seq)
+	require.ErrorContains(t, results[3].Err, dbError.InvalidTTL("").Error())
+	require.NoError(t, results[4].Err)
+	require.Greater(t, results[0].Seq, seq)
+
+	require.Equal(t, 2, db.Read("a").value.Value.Age)
+	require.Equal(t, results[2].Seq, db.Read("a").value.Seq)
+	require.ErrorContains(t, db.Read("b").err, dbError.KeyNotFound("").Error())
+	require.ErrorContains(t, db.Read("old").err, dbError.KeyNotFound("").Error())
+
+	results, err = db.Apply(nil)
+	require.NoError(t, err)
+	require.Empty(t, results)
+	db.Close()
+	_, err = db.Apply([]Op[TestVal]{DeleteOp[TestVal]("a")})
+	require.ErrorContains(t, err, dbError.DBAlreadyClosed("").Error())
+}
+
+func TestApplyEntryLimit(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	db := NewTestDB[TestVal](t, WithClock(clock), WithMaxEntries(2))
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "1")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	clock.Advance(5 * time.Second)
+
+	done := make(chan []OpResult)
+	go func() {
+		results, _ := db.Apply([]Op[TestVal]{PutOp("a", TestEntry("a", 3, "")), PutOp("c", TestEntry("c", 4, ""))})
+		done <- results
+	}()
+	select {
+	case results := <-done:
+		// "a" counts until the cleanup worker purges it
+		require.Len(t, results, 2)
+		require.ErrorContains(t, results[1].Err, dbError.ErrEntryLimitReached("").Error())
+		require.ErrorContains(t, db.Read("c").err, dbError.KeyNotFound("").Error())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Apply over the entry limit with an expired key hung")
+	}
+}
+
+func TestSchemaHeader(t *testing.T) {
+	dir := t.TempDir()
+	zoo, err := NewDB[Animals]("zoo", dir)
+	require.NoError(t, err)
+	require.NoError(t, zoo.Create("rex", AnimalEntry("rex", "peru", 3, "")).err)
+	require.NoError(t, zoo.Close())
+
+	_, err = NewDB[TestVal]("zoo", dir)
+	require.ErrorContains(t, err, dbError.ErrTypeMismatch("").Error())
+	require.ErrorContains(t, err, "main.Animals")
+	report, err := VerifyFile[TestVal](filepath.Join(dir, "zoo.json"))
+	require.NoError(t, err)
+	require.Equal(t, CheckSchema, report.Issues[0].Check)
+	require.Equal(t, 1, report.Entries)
+
+	// untyped access keeps the header
+	raw, err := OpenPath[json.RawMessage](filepath.Join(dir, "zoo.json"))
+	require.NoError(t, err)
+	require.NoError(t, raw.Create("kong", DbData[json.RawMessage]{Value: json.RawMessage(`{"name":"kong"}`), Created_at: time.Now()}).err)
+	require.NoError(t, raw.Close())
+	zoo, err = NewDB[Animals]("zoo", dir)
+	require.NoError(t, err)
+	require.Equal(t, "kong", zoo.Read("kong").value.Value.Name)
+	require.NoError(t, zoo.Close())
+
+	// gob files and files written before headers
+	binary, err := NewBinaryLocalStorage[Animals]("zoo", dir)
+	require.NoError(t, err)
+	written, err := binary.Sync(map[string]DbData[Animals]{"rex": AnimalEntry("rex", "peru", 3, "")})
+	require.NoError(t, err)
+	info, err := os.Stat(binary.filePath)
+	require.NoError(t, err)
+	require.Equal(t, info.Size(), written)
+	mistyped := &LocalStorage[TestVal]{filePath: binary.filePath, binary: true}
+	require.ErrorContains(t, mistyped.Load(&map[string]DbData[TestVal]{}), dbError.ErrTypeMismatch("").Error())
+	file, err := os.Create(binary.filePath)
+	require.NoError(t, err)
+	require.NoError(t, gob.NewEncoder(file).Encode(map[string]DbData[TestVal]{"old": TestEntry("old", 1, "")}))
+	require.NoError(t, file.Close())
+	loaded := map[string]DbData[TestVal]{}
+	require.NoError(t, mistyped.Load(&loaded))
+	require.Equal(t, "old", loaded["old"].Value.Name)
+	legacy := `{"old":{"value":{"name":"old","age":1},"ttl":"","created_at":"2024-01-01T00:00:00Z"}}`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "legacy.json"), []byte(legacy), 0644))
+	old, err := NewDB[TestVal]("legacy", dir)
+	require.NoError(t, err)
+	defer old.Close()
+	require.Equal(t, "old", old.Read("old").value.Value.Name)
+}
+
+func TestOpenSet(t *testing.T) {
+	dir := t.TempDir()
+	set, err := OpenSet[TestVal](filepath.Join(dir, "user.json"), filepath.Join(dir, "users.json"), filepath.Join(dir, "orders.bin"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "user", "users"}, set.Buckets())
+
+	require.NoError(t, set.Create("users:1", TestEntry("ann", 30, "")).err)
+	require.NoError(t, set.Create("orders:1", TestEntry("book", 1, "")).err)
+	require.ErrorContains(t, set.Create("carts:1", TestEntry("cart", 1, "")).err, dbError.NoDatabaseForKey("").Error())
+	users, err := set.Bucket("users")
+	require.NoError(t, err)
+	require.Equal(t, "ann", users.Read("users:1").value.Value.Name)
+	require.Equal(t, "book", set.Read("orders:1").value.Value.Name)
+	stats := set.Stats()
+	require.Equal(t, 1, stats["users"].Entries)
+	require.Equal(t, 0, stats["user"].Entries)
+	require.NoError(t, set.Close())
+
+	// a failed open leaves nothing open
+	_, err = OpenSet[TestVal](filepath.Join(dir, "users.json"), filepath.Join(dir, "nested", "users.json"))
+	require.ErrorContains(t, err, dbError.InvalidFileName("").Error())
+	set, err = OpenSet[TestVal](filepath.Join(dir, "users.json"))
+	require.NoError(t, err)
+	require.Equal(t, "ann", set.Read("users:1").value.Value.Name)
+	require.NoError(t, set.Close())
+}
+
+func TestAutoBackup(t *testing.T) {
+	dir := t.TempDir()
+	db := NewTestDB[TestVal](t, WithAutoBackup(10*time.Millisecond, dir, 30*time.Millisecond))
+	require.NoError(t, db.Create("saved", TestEntry("saved", 1, "")).err)
+	require.Eventually(t, func() bool {
+		status := db.Stats().LastBackup
+		return status.Pruned > 0 && status.Err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Contains(t, db.LastBackup().LastPath, dir)
+
+	manual := t.TempDir()
+	path, err := db.Backup(manual)
+	require.NoError(t, err)
+	paths, err := backupPaths(manual)
+	require.NoError(t, err)
+	require.Equal(t, []string{path}, paths)
+	backup, err := OpenPath[TestVal](path)
+	require.NoError(t, err)
+	require.Equal(t, "saved", backup.Read("saved").value.Value.Name)
+	require.NoError(t, backup.Close())
+	require.Equal(t, []string{path}, paths)
+}
+
+func TestBackupManifest(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	db := NewTestDB[TestVal](t, WithAutoBackup(0, dir, 0), WithBackupEncryption(key))
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	path, err := db.Backup(dir)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(path, ".json.enc"))
+
+	backups, err := db.ListBackups()
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	require.Equal(t, path, backups[0].Path)
+	require.True(t, backups[0].Encrypted)
+	require.Equal(t, 2, backups[0].Entries)
+	manifest, err := db.VerifyBackup(path)
+	require.NoError(t, err)
+	require.Equal(t, backupFormatVersion, manifest.FormatVersion)
+
+	restored := t.TempDir()
+	require.NoError(t, db.RestoreBackup(path, "restored", restored))
+	restoredDB, err := NewDB[TestVal]("restored", restored)
+	require.NoError(t, err)
+	require.Equal(t, "b", restoredDB.Read("b").value.Value.Name)
+	require.NoError(t, restoredDB.Close())
+	require.ErrorContains(t, db.RestoreBackup(path, "restored", restored), dbError.RestoreTargetNotEmpty("").Error())
+
+	other := NewTestDB[TestVal](t, WithBackupEncryption(bytes.Repeat([]byte{8}, 32)))
+	_, err = other.VerifyBackup(path)
+	require.ErrorContains(t, err, dbError.InvalidBackupKey("").Error())
+	_, err = NewTestDB[TestVal](t).ListBackups()
+	require.ErrorContains(t, err, dbError.BackupNotEnabled("").Error())
+
+	contents, err := os.ReadFile(path)
+	require.NoError(t, err)
+	contents[len(contents)/2] ^= 1
+	require.NoError(t, os.WriteFile(path, contents, 0644))
+	_, err = db.VerifyBackup(path)
+	require.ErrorContains(t, err, dbError.BackupCorrupted("").Error())
+}
+
+func TestExportSnapshot(t *testing.T) {
+	db := NewTestDB[TestVal](t, WithSoftDelete(time.Hour))
+	require.NoError(t, db.Create("kept", TestEntry("kept", 1, "")).err)
+	require.NoError(t, db.Create("deleted", TestEntry("deleted", 2, "")).err)
+	require.NoError(t, db.Delete("deleted").err)
+	path := filepath.Join(t.TempDir(), "export.json")
+	checksum, err := db.ExportSnapshot(path)
+	require.NoError(t, err)
+	recorded, err := os.ReadFile(path + ".sha256")
+	require.NoError(t, err)
+	require.Equal(t, checksum+"  export.json\n", string(recorded))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0444), info.Mode().Perm())
+
+	reader, err := OpenReadOnly[TestVal](path)
+	require.NoError(t, err)
+	require.Equal(t, "kept", reader.Read("kept").value.Value.Name)
+	stats := reader.Stats()
+	require.Equal(t, 1, stats.Entries)
+	require.Equal(t, 0, stats.Tombstones)
+	require.ErrorContains(t, reader.Create("new", TestEntry("new", 3, "")).err, dbError.ReadOnlyDatabase("").Error())
+	require.NoError(t, reader.Close())
+	report, err := VerifyFile[TestVal](path)
+	require.NoError(t, err)
+	require.True(t, report.OK(), "%+v", report.Issues)
+
+	require.NoError(t, os.Chmod(path, 0644))
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0644))
+	_, err = OpenReadOnly[TestVal](path)
+	require.ErrorContains(t, err, dbError.SnapshotCorrupted("").Error())
+	report, err = VerifyFile[TestVal](path)
+	require.NoError(t, err)
+	require.Len(t, report.Issues, 1)
+	require.Equal(t, CheckChecksum, report.Issues[0].Check)
+}
+
+func TestOplogRecovery(t *testing.T) {
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "test.json")
+	backups := filepath.Join(dir, "backups")
+	opts := []Option{WithOplog(filepath.Join(dir, "changes.oplog")), WithAutoBackup(0, backups, 0)}
+	db, err := NewDB[TestVal]("test", dir, opts...)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("a", TestEntry("a", 1, "")).err)
+	require.NoError(t, db.Create("b", TestEntry("b", 2, "")).err)
+	older, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("c", TestEntry("c", 3, "")).err)
+	require.NoError(t, db.Update("a", TestEntry("a2", 1, "")).err)
+	require.NoError(t, db.Delete("b").err)
+	require.False(t, db.Recovery().Recovered())
+	require.NoError(t, db.Close())
+
+	// the data file rolled back: the oplog brings it up to date
+	require.NoError(t, os.WriteFile(dataPath, older, 0644))
+	db, err = NewDB[TestVal]("test", dir, opts...)
+	require.NoError(t, err)
+	report := db.Stats().Recovery
+	require.Equal(t, 3, report.Replayed)
+	require.Equal(t, 2, report.Skipped)
+	require.Equal(t, "a2", db.Read("a").value.Value.Name)
+	require.Equal(t, "c", db.Read("c").value.Value.Name)
+	require.ErrorContains(t, db.Read("b").err, dbError.KeyNotFound("").Error())
+	require.NoError(t, db.Close())
+
+	// a torn oplog tail is left out, the synced data file needs nothing
+	oplog, err := os.OpenFile(filepath.Join(dir, "changes.oplog"), os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = oplog.WriteString(`{"seq":6,"op":"create","key":"d","va`)
+	require.NoError(t, err)
+	require.NoError(t, oplog.Close())
+	db, err = NewDB[TestVal]("test", dir, opts...)
+	require.NoError(t, err)
+	require.Equal(t, RecoveryReport{CheckpointSeq: 5, Skipped: 5, Corrupt: 1}, db.Recovery())
+
+	// an unreadable data file falls back to the newest backup
+	path, err := db.Backup(backups)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	require.NoError(t, os.WriteFile(dataPath, []byte("{"), 0644))
+	db, err = NewDB[TestVal]("test", dir, opts...)
+	require.NoError(t, err)
+	defer db.Close()
+	report = db.Recovery()
+	require.Equal(t, path, report.Checkpoint)
+	require.Error(t, report.LoadErr)
+	require.Equal(t, "c", db.Read("c").value.Value.Name)
+}
+
+func TestKeyPatterns(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	for _, key := range []string{"session:1", "session:2", "session:10", "sessions", "user:1", "user/a*b"} {
+		require.NoError(t, db.Create(key, TestEntry(key, 1, "")).err)
+	}
+	matches := func(pattern string) []string {
+		entries, err := db.ReadMatching(pattern)
+		require.NoError(t, err)
+		keys := []string{}
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	require.Equal(t, []string{"session:1", "session:10", "session:2"}, matches("session:*"))
+	require.Equal(t, []string{"session:1", "session:2"}, matches("session:?"))
+	require.Equal(t, []string{"user:1"}, matches("[su][!e]*:[1-2]"))
+	require.Equal(t, []string{"user/a*b"}, matches(`user/a\*b`))
+	require.Equal(t, []string{}, matches("nothing*"))
+	_, err := db.ReadMatching("session:[1")
+	require.ErrorContains(t, err, dbError.InvalidPattern("").Error())
+
+	deleted, err := db.DeleteMatching("session:*")
+	require.NoError(t, err)
+	require.Equal(t, 3, deleted)
+	require.Equal(t, []string{"sessions", "user/a*b", "user:1"}, matches("*"))
+	deleted, err = db.DeleteMatching("session:*")
+	require.NoError(t, err)
+	require.Zero(t, deleted)
+
+	for i := 0; i <= MaxMatchResults; i += BatchLimit {
+		batch := make(map[string]DbData[TestVal], BatchLimit)
+		for j := i; j < i+BatchLimit; j++ {
+			batch[fmt.Sprintf("bulk:%04d", j)] = TestEntry("bulk", 1, "")
+		}
+		require.NoError(t, db.BatchCreate(batch).err)
+	}
+	_, err = db.ReadMatching("bulk:*")
+	require.ErrorContains(t, err, dbError.ErrTooManyMatches("").Error())
+	deleted, err = db.DeleteMatching("bulk:*")
+	require.NoError(t, err)
+	require.Equal(t, MaxMatchResults, deleted)
+}
+
+func TestCreatePolicy(t *testing.T) {
+	db := NewTestDB[TestVal](t, WithCreatePolicy(Overwrite))
+	require.NoError(t, db.Create("key", TestEntry("first", 1, "")).err)
+	require.NoError(t, db.Create("key", TestEntry("second", 2, "")).err)
+	require.Equal(t, "second", db.Read("key").value.Value.Name)
+
+	// per call
+	require.ErrorContains(t, db.Create("key", TestEntry("third", 3, ""), FailAll).err, dbError.EntryAlreadyExists("").Error())
+	require.NoError(t, db.Create("key", TestEntry("third", 3, ""), SkipExisting).err)
+	require.Equal(t, "second", db.Read("key").value.Value.Name)
+	require.ErrorContains(t, db.Create("key", TestEntry("bad", 4, "-1"), Overwrite).err, dbError.InvalidTTL("").Error())
+
+	ignoring := NewTestDB[TestVal](t, WithCreatePolicy(SkipExisting))
+	require.NoError(t, ignoring.Create("key", TestEntry("first", 1, "")).err)
+	require.NoError(t, ignoring.BatchCreate(map[string]DbData[TestVal]{
+		"key":   TestEntry("second", 2, ""),
+		"other": TestEntry("other", 3, ""),
+	}).err)
+	require.Equal(t, "first", ignoring.Read("key").value.Value.Name)
+	require.Equal(t, "other", ignoring.Read("other").value.Value.Name)
+}
+
+func TestRename(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	entry := TestEntry("old", 1, "60")
+	entry.Created_at = entry.Created_at.Add(-time.Second)
+	require.NoError(t, db.Create("old", entry).err)
+	before := db.Read("old").value
+
+	require.NoError(t, db.Rename("old", "new").err)
+	require.ErrorContains(t, db.Read("old").err, dbError.KeyNotFound("").Error())
+	renamed := db.Read("new").value
+	require.Equal(t, before.Value, renamed.Value)
+	require.Equal(t, before.Ttl, renamed.Ttl)
+	require.True(t, before.Created_at.Equal(renamed.Created_at))
+	require.Greater(t, renamed.Seq, before.Seq)
+
+	require.NoError(t, db.Create("other", TestEntry("other", 2, "")).err)
+	require.ErrorContains(t, db.RenameNX("new", "other").err, dbError.EntryAlreadyExists("").Error())
+	require.Equal(t, "old", db.Read("new").value.Value.Name)
+	require.NoError(t, db.Rename("new", "other").err)
+	require.Equal(t, "old", db.Read("other").value.Value.Name)
+	require.ErrorContains(t, db.Rename("missing", "other").err, dbError.KeyNotFound("").Error())
+}
+
+func TestPin(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDB[TestVal]("test", dir)
+	require.NoError(t, err)
+	require.NoError(t, db.Create("config:limits", TestEntry("limits", 1, "")).err)
+	require.NoError(t, db.Create("config:cache", TestEntry("cache", 2, "")).err)
+	require.NoError(t, db.Pin("config:limits").err)
+	require.ErrorContains(t, db.Pin("missing").err, dbError.KeyNotFound("").Error())
+
+	// the flag survives updates and reopens
+	require.NoError(t, db.Update("config:limits", TestEntry("limits", 3, "")).err)
+	require.NoError(t, db.Close())
+	db, err = NewDB[TestVal]("test", dir)
+	require.NoError(t, err)
+	defer db.Close()
+	require.True(t, db.Read("config:limits").value.Pinned)
+
+	deleted, err := db.DeleteMatching("config:*")
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	require.NoError(t, db.Read("config:limits").err)
+
+	require.NoError(t, db.Unpin("config:limits").err)
+	deleted, err = db.DeleteMatching("config:*")
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+}
+
+func TestStaleGrace(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	db := NewTestDB[TestVal](t, WithClock(clock), WithStaleGrace(10*time.Second))
+	require.NoError(t, db.Create("cached", TestEntry("cached", 1, "5")).err)
+	require.False(t, db.Read("cached").value.Stale)
+
+	clock.Advance(8 * time.Second)
+	res := db.Read("cached")
+	require.NoError(t, res.err)
+	require.True(t, res.value.Stale)
+	require.Equal(t, "cached", res.value.Value.Name)
+	require.False(t, db.Exists("cached"))
+
+	// refreshing it clears the flag
+	require.NoError(t, db.Create("cached", TestEntry("fresh", 2, "15"), Overwrite).err)
+	res = db.Read("cached")
+	require.False(t, res.value.Stale)
+	require.Equal(t, "fresh", res.value.Value.Name)
+
+	clock.Advance(10 * time.Second)
+	require.True(t, db.Read("cached").value.Stale)
+	require.Eventually(t, func() bool {
+		clock.Advance(time.Second) // past the grace, the cleanup worker removes it
+		return db.Stats().Entries == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	require.ErrorContains(t, db.Read("cached").err, dbError.KeyNotFound("").Error())
+}
+
+func TestImmutableEntry(t *testing.T) {
+	clock := NewManualClock(time.Now())
+	db := NewTestDB[TestVal](t, WithClock(clock))
+	audit := TestEntry("login", 1, "5")
+	audit.Immutable = true
+	require.NoError(t, db.Create("audit:1", audit).err)
+	require.NoError(t, db.Create("audit:2", TestEntry("logout", 2, "")).err)
+
+	immutable := dbError.ErrImmutableEntry("").Error()
+	require.ErrorContains(t, db.Update("audit:1", TestEntry("forged", 3, "")).err, immutable)
+	require.ErrorContains(t, db.Delete("audit:1").err, immutable)
+	require.ErrorContains(t, db.GetAndDelete("audit:1").err, immutable)
+	require.ErrorContains(t, db.SetTTLBatch([]string{"audit:1"}, "").err, immutable)
+	require.ErrorContains(t, db.Rename("audit:1", "audit:3").err, immutable)
+	require.ErrorContains(t, db.Rename("audit:2", "audit:1").err, immutable)
+	require.ErrorContains(t, db.Create("audit:1", TestEntry("forged", 3, ""), Overwrite).err, immutable)
+	require.ErrorContains(t, db.BatchWrite([]Op[TestVal]{{Kind: OpDelete, Key: "audit:1"}}, nil), immutable)
+	deleted, err := db.DeleteMatching("audit:*")
+	require.NoError(t, err)
+	require.Equal(t, 1, deleted)
+	res := db.Read("audit:1")
+	require.NoError(t, res.err)
+	require.Equal(t, "login", res.value.Value.Name)
+
+	// an update can't make an entry immutable
+	require.NoError(t, db.Create("audit:2", TestEntry("logout", 2, "")).err)
+	require.NoError(t, db.Update("audit:2", audit).err)
+	require.NoError(t, db.Delete("audit:2").err)
+
+	// once expired it goes the usual way
+	clock.Advance(6 * time.Second)
+	require.ErrorContains(t, db.Delete("audit:1").err, dbError.KeyExpired("").Error())
+	require.NoError(t, db.Create("audit:1", TestEntry("login", 4, "")).err)
+}
+
+func TestTokenAuthorizer(t *testing.T) {
+	authorizer := NewTokenAuthorizer()
+	authorizer.Grant("alice", Grant{Actions: []string{"read", "debug"}}, Grant{Prefix: "alice:"})
+	authorizer.Grant("ops", Grant{}, Grant{Prefix: "audit:", Actions: []string{"update", "delete"}, Deny: true})
+
+	denied := dbError.AccessDenied("").Error()
+	require.NoError(t, authorizer.Authorize("alice", "read", "bob:1"))
+	require.NoError(t, authorizer.Authorize("alice", "create", "alice:1"))
+	require.ErrorContains(t, authorizer.Authorize("alice", "create", "bob:1"), denied)
+	require.NoError(t, authorizer.Authorize("ops", "create", "audit:1"))
+	require.ErrorContains(t, authorizer.Authorize("ops", "delete", "audit:1"), denied)
+	require.ErrorContains(t, authorizer.Authorize("eve", "read", "alice:1"), dbError.Unauthorized("").Error())
+	authorizer.Revoke("alice")
+	require.ErrorContains(t, authorizer.Authorize("alice", "read", "alice:1"), dbError.Unauthorized("").Error())
+
+	db := NewTestDB[TestVal](t)
+	authorizer.Grant("viewer", Grant{Actions: []string{"debug"}})
+	authorizer.Grant("writer", Grant{Actions: []string{"create"}})
+	server := httptest.NewServer(AuthorizeHTTP(authorizer, "debug", db.DebugHandler()))
+	defer server.Close()
+	for token, status := range map[string]int{"": http.StatusUnauthorized, "ops": http.StatusOK, "viewer": http.StatusOK, "writer": http.StatusForbidden, "nobody": http.StatusUnauthorized} {
+		request, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.NoError(t, err)
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		require.Equal(t, status, response.StatusCode, token)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and
+// its key to dir, returning their paths and a pool trusting it.
+func writeTestCertificate(t *testing.T, dir string) (string, string, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "kv test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return certFile, keyFile, pool
+}
+
+func TestServe(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, pool := writeTestCertificate(t, dir)
+	db, err := NewDB[TestVal]("test", dir)
+	require.NoError(t, err)
+	authorizer := NewTokenAuthorizer()
+	authorizer.Grant("app", Grant{})
+
+	_, err = db.Serve(ServerConfig{Addr: "0.0.0.0:0"})
+	require.ErrorContains(t, err, "AllowInsecure")
+	server, err := db.Serve(ServerConfig{Addr: "127.0.0.1:0", CertFile: certFile, KeyFile: keyFile, Authorizer: authorizer})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(server.URL(), "https://127.0.0.1:"))
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	do := func(method string, path string, token string, body any) (int, []byte) {
+		var reader io.Reader
+		if body != nil {
+			encoded, err := json.Marshal(body)
+			require.NoError(t, err)
+			reader = bytes.NewReader(encoded)
+		}
+		request, err := http.NewRequest(method, server.URL()+path, reader)
+		require.NoError(t, err)
+		request.Header.Set("Authorization", "Bearer "+token)
+		response, err := client.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		contents, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response.StatusCode, contents
+	}
+
+	status, _ := do(http.MethodPost, "/v1/keys/user/1", "app", TestEntry("ann", 1, ""))
+	require.Equal(t, http.StatusCreated, status)
+	status, body := do(http.MethodPost, "/v1/keys/user/1", "app", TestEntry("ann", 1, ""))
+	require.Equal(t, http.StatusConflict, status)
+	require.Contains(t, string(body), `"message":"`+errorMessage(dbError.EntryAlreadyExists(""))+`"`)
+	status, body = do(http.MethodGet, "/v1/keys/user/1", "app", nil)
+	require.Equal(t, http.StatusOK, status)
+	var entry DbData[TestVal]
+	require.NoError(t, json.Unmarshal(body, &entry))
+	require.Equal(t, "ann", entry.Value.Name)
+	status, _ = do(http.MethodGet, "/v1/keys/user/1", "intruder", nil)
+	require.Equal(t, http.StatusUnauthorized, status)
+	status, body = do(http.MethodGet, "/v1/keys?prefix=user/", "app", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"keys":["user/1"],"next":""}`, string(body))
+
+	// a deny under the listed prefix hides its keys, and overwriting needs update
+	authorizer.Grant("lister", Grant{Actions: []string{"list", "create", "batchCreate"}}, Grant{Prefix: "user/", Deny: true})
+	status, _ = do(http.MethodPost, "/v1/keys/public", "app", TestEntry("pub", 1, ""))
+	require.Equal(t, http.StatusCreated, status)
+	status, body = do(http.MethodGet, "/v1/keys?prefix=", "lister", nil)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, `{"keys":["public"],"next":""}`, string(body))
+	status, _ = do(http.MethodPost, "/v1/keys/public?policy=overwrite", "lister", TestEntry("pub", 2, ""))
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = do(http.MethodPost, "/v1/batch?policy=overwrite", "lister", map[string]DbData[TestVal]{"public": TestEntry("pub", 2, "")})
+	require.Equal(t, http.StatusForbidden, status)
+	status, _ = do(http.MethodPost, "/v1/batch?policy=skip", "lister", map[string]DbData[TestVal]{"public": TestEntry("pub", 2, "")})
+	require.Equal(t, http.StatusOK, status)
+	status, _ = do(http.MethodPost, "/v1/keys/public?policy=overwrite", "app", TestEntry("pub", 2, ""))
+	require.Equal(t, http.StatusCreated, status)
+
+	status, _ = do(http.MethodDelete, "/v1/keys/user/1", "app", nil)
+	require.Equal(t, http.StatusNoContent, status)
+	status, _ = do(http.MethodGet, "/v1/keys/user/1", "app", nil)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// Close shuts the server down first
+	require.NoError(t, db.Close())
+	require.NoError(t, server.Err())
+	_, err = client.Get(server.URL() + "/v1/stats")
+	require.Error(t, err)
+}
+
+func TestAPIStatus(t *testing.T) {
+	for err, status := range map[error]int{
+		dbError.InvalidTTL("ttl : x"):   http.StatusBadRequest,
+		dbError.KeyNotFound(""):         http.StatusNotFound,
+		dbError.ErrRateLimited("write"): http.StatusTooManyRequests,
+		dbError.ErrDBTimeout(""):        http.StatusGatewayTimeout,
+		dbError.ErrClosed(""):           http.StatusServiceUnavailable,
+		dbError.NotAvailabeSpace(""):    http.StatusInsufficientStorage,
+		dbError.FailedToGetFileSize(""): http.StatusInternalServerError,
+		fmt.Errorf("torn write"):        http.StatusInternalServerError,
+		context.DeadlineExceeded:        http.StatusServiceUnavailable,
+	} {
+		require.Equal(t, status, apiStatus(err), "%v", err)
+	}
+	recorder := httptest.NewRecorder()
+	writeAPIError(recorder, dbError.ErrRateLimited("write"))
+	require.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	require.Equal(t, "1", recorder.Header().Get("Retry-After"))
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	server := httptest.NewServer(db.HTTPHandler(nil))
+	defer server.Close()
+	create := func(key, idempotencyKey string) *http.Response {
+		body, err := json.Marshal(TestEntry("ann", 1, ""))
+		require.NoError(t, err)
+		request, err := http.NewRequest(http.MethodPost, server.URL+"/v1/keys/"+key, bytes.NewReader(body))
+		require.NoError(t, err)
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Idempotency-Key", idempotencyKey)
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response
+	}
+
+	// a repeat gets the response of the first attempt, not a conflict
+	require.Equal(t, http.StatusCreated, create("user/1", "a").StatusCode)
+	response := create("user/1", "a")
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	require.Equal(t, "true", response.Header.Get("Idempotent-Replayed"))
+	require.Equal(t, http.StatusConflict, create("user/1", "b").StatusCode)
+
+	// a rate limited write isn't remembered, its retry runs it
+	require.NoError(t, db.SetOption(WithMaxWritesPerSecond(1)))
+	require.NoError(t, db.Create("user/2", TestEntry("bob", 2, "")).err)
+	require.Equal(t, http.StatusTooManyRequests, create("user/3", "c").StatusCode)
+	require.NoError(t, db.SetOption(WithMaxWritesPerSecond(0)))
+	response = create("user/3", "c")
+	require.Equal(t, http.StatusCreated, response.StatusCode)
+	require.Empty(t, response.Header.Get("Idempotent-Replayed"))
+	require.NoError(t, db.Read("user/3").err)
+}
+
+func TestAdminHandler(t *testing.T) {
+	db := NewTestDB[TestVal](t)
+	require.NoError(t, db.Create("user/1", TestEntry("ann", 1, "60")).err)
+	authorizer := NewTokenAuthorizer()
+	authorizer.Grant("admin", Grant{})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", db.AdminHandler(nil)))
+	mux.Handle("/secured/", http.StripPrefix("/secured", db.AdminHandler(authorizer)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/admin/")
+	require.NoError(t, err)
+	page, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Contains(t, string(page), `fetch("api/v1/" + path`)
+
+	put := func(path string, name string, header http.Header) int {
+		body := `{"value":{"name":"` + name + `","age":2},"ttl":"60","created_at":"` + time.Now().Format(time.RFC3339Nano) + `"}`
+		request, err := http.NewRequest(http.MethodPut, server.URL+path+"/api/v1/keys/user/1", strings.NewReader(body))
+		require.NoError(t, err)
+		request.Header = header
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		response.Body.Close()
+		return response.StatusCode
+	}
+	jsonHeader := func(pairs ...string) http.Header {
+		header := http.Header{"Content-Type": {"application/json"}}
+		for i := 0; i < len(pairs); i += 2 {
+			header.Set(pairs[i], pairs[i+1])
+		}
+		return header
+	}
+
+	// the page edits the entries through the API it serves under api/
+	require.Equal(t, http.StatusNoContent, put("/admin", "bob", jsonHeader("Sec-Fetch-Site", "same-origin", "Origin", server.URL)))
+	require.Equal(t, "bob", db.Read("user/1").value.Value.Name)
+
+	// writes a page of another site could send are rejected
+	require.Equal(t, http.StatusBadRequest, put("/admin", "form", http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}))
+	require.Equal(t, http.StatusBadRequest, put("/admin", "plain", http.Header{"Content-Type": {"text/plain"}}))
+	require.Equal(t, http.StatusForbidden, put("/admin", "site", jsonHeader("Sec-Fetch-Site", "cross-site")))
+	require.Equal(t, http.StatusForbidden, put("/admin", "origin", jsonHeader("Origin", "https://example.com")))
+	require.Equal(t, "bob", db.Read("user/1").value.Value.Name)
+
+	// with an authorizer, the API needs a token
+	require.Equal(t, http.StatusUnauthorized, put("/secured", "cy", jsonHeader()))
+	require.Equal(t, http.StatusNoContent, put("/secured", "cy", jsonHeader("Authorization", "Bearer admin")))
+	require.Equal(t, "cy", db.Read("user/1").value.Value.Name)
+
+	response, err = http.Get(server.URL + "/admin/api/v1/stats")
+	require.NoError(t, err)
+	defer response.Body.Close()
+	var stats Stats
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&stats))
+	require.Equal(t, 1, stats.Entries)
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "users.csv")
+	require.NoError(t, os.WriteFile(csvPath, []byte("id,name,ttl\n1,ann,60\n,nokey,\n3,cy,soon\n1,again,\n5,too,many,cells\n6,dee,\n"), 0o644))
+	dbPath := filepath.Join(dir, "users.json")
+
+	var stdout, stderr bytes.Buffer
+	require.Equal(t, 1, runCLI([]string{"load", "-file", csvPath, "-key-column", "id", "-ttl-column", "ttl", "-batch", "2", "-json", dbPath}, &stdout, &stderr), stderr.String())
+	var report LoadReport
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &report))
+	require.Equal(t, 6, report.Rows)
+	require.Equal(t, 2, report.Loaded)
+	require.Equal(t, 4, report.Failed)
+	failedRows := []int{}
+	for _, failure := range report.Failures {
+		failedRows = append(failedRows, failure.Row)
+	}
+	require.Equal(t, []int{2, 3, 4, 5}, failedRows)
+	require.Contains(t, report.Failures[1].Err, dbError.InvalidTTL("").Error())
+	require.Contains(t, report.Failures[2].Err, "repeats row 1")
+
+	db, err := OpenPath[json.RawMessage](dbPath)
+	require.NoError(t, err)
+	entry := db.Read("1").value
+	require.JSONEq(t, `{"name":"ann"}`, string(entry.Value))
+	require.Equal(t, "60", entry.Ttl)
+
+	// JSON lines, keys as numbers; the existing keys are skipped
+	loaded, err := Load(db, strings.NewReader(`{"id": 6, "name": "dee"}
+{"id": 7, "name": "eve", "tags": ["a"]}
+[1]`), LoadOptions{Format: "json", KeyColumn: "id"})
+	require.NoError(t, err)
+	require.Equal(t, 3, loaded.Rows)
+	require.Equal(t, 1, loaded.Loaded)
+	require.Equal(t, 1, loaded.Skipped)
+	require.Equal(t, 1, loaded.Failed)
+	require.JSONEq(t, `{"name":"eve","tags":["a"]}`, string(db.Read("7").value.Value))
+
+	loaded, err = Load(db, strings.NewReader(`[{"id": "8"}, {"id": "9"}]`), LoadOptions{Format: "json", KeyColumn: "id"})
+	require.NoError(t, err)
+	require.Equal(t, 2, loaded.Loaded)
+	require.NoError(t, db.Close())
+}
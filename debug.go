@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// recentErrorsSize is how many failed operations DebugHandler shows.
+const recentErrorsSize = 32
+
+// RecentError is a failed operation, as shown by DebugHandler.
+type RecentError struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"op"`
+	Key    string    `json:"key,omitempty"`
+	Err    string    `json:"error"`
+}
+
+// errorLog keeps the last recentErrorsSize errors of the workers.
+type errorLog struct {
+	mu     sync.Mutex
+	errors []RecentError
+	next   int
+}
+
+func (log *errorLog) add(op string, key string, err error) {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	entry := RecentError{Time: time.Now(), Action: op, Key: key, Err: err.Error()}
+	if len(log.errors) < recentErrorsSize {
+		log.errors = append(log.errors, entry)
+		return
+	}
+	log.errors[log.next] = entry
+	log.next = (log.next + 1) % recentErrorsSize
+}
+
+// recent returns the errors kept, newest first.
+func (log *errorLog) recent() []RecentError {
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	recent := make([]RecentError, 0, len(log.errors))
+	for i := len(log.errors) - 1; i >= 0; i-- {
+		recent = append(recent, log.errors[(log.next+i)%len(log.errors)])
+	}
+	return recent
+}
+
+// recordError keeps the error of a failed operation for DebugHandler.
+func (db *DB[T]) recordError(op operation[T], err error) {
+	if err != nil {
+		db.recentErrors.add(op.action, op.key, err)
+	}
+}
+
+// DebugHandler serves the live state of the DB as JSON, to be mounted under
+// something like /debug/kv: its stats, queue lengths, the last failed
+// operations and the options in effect.
+func (db *DB[T]) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(db.debugState())
+	})
+}
+
+func (db *DB[T]) debugState() map[string]any {
+	stats := db.Stats()
+	opts := db.opts()
+	return map[string]any{
+		"open":      !db.closed.Load(),
+		"read_only": db.readOnly.Load(),
+		"frozen":    db.Frozen(),
+		"stats": map[string]any{
+			"entries":     stats.Entries,
+			"max_entries": stats.MaxEntries,
+			"tombstones":  stats.Tombstones,
+			"last_cleanup": map[string]any{
+				"runs":     stats.LastCleanup.Runs,
+				"last_run": stats.LastCleanup.LastRun,
+				"duration": stats.LastCleanup.Duration.String(),
+				"removed":  stats.LastCleanup.Removed,
+				"synced":   stats.LastCleanup.Synced,
+				"error":    errorString(stats.LastCleanup.Err),
+			},
+			"checkpoint": map[string]any{
+				"seq":        stats.Checkpoint.Seq,
+				"synced_seq": stats.Checkpoint.SyncedSeq,
+				"last_sync":  stats.Checkpoint.LastSync,
+				"sync_error": errorString(stats.Checkpoint.SyncErr),
+				"diverged":   stats.Checkpoint.Diverged,
+			},
+			"io": map[string]any{
+				"syncs":               stats.IO.Syncs,
+				"failed_syncs":        stats.IO.FailedSyncs,
+				"rewrites":            stats.IO.Rewrites,
+				"bytes_written":       stats.IO.BytesWritten,
+				"oplog_bytes":         stats.IO.OplogBytes,
+				"oplog_failures":      stats.IO.OplogFailures,
+				"changed_bytes":       stats.IO.ChangedBytes,
+				"write_amplification": stats.IO.WriteAmplification,
+			},
+		},
+		"queues": map[string]any{
+			"reads":          stats.ReadQueue,
+			"writes":         stats.WriteQueue,
+			"admin":          len(db.adminOps),
+			"read_capacity":  cap(db.readOps),
+			"write_capacity": cap(db.writeOps),
+		},
+		"recent_errors": db.recentErrors.recent(),
+		"config": map[string]any{
+			"op_timeout":            opts.opTimeout.String(),
+			"admin_priority":        opts.adminPriority,
+			"copy_on_read":          opts.copyOnRead,
+			"cleanup_interval":      opts.cleanupInterval.String(),
+			"cleanup_batch_size":    opts.cleanupBatchSize,
+			"cleanup_jitter":        opts.cleanupJitter.String(),
+			"follower":              opts.follower,
+			"oplog":                 opts.oplogPath,
+			"history":               opts.historySize,
+			"sliding_ttl":           opts.slidingTTL,
+			"max_entries":           opts.maxEntries,
+			"soft_delete":           opts.softDelete,
+			"soft_delete_retention": opts.softDeleteRetention.String(),
+			"max_ops_per_second":    opts.maxOpsPerSecond,
+			"max_reads_per_second":  opts.maxReadsPerSecond,
+			"max_writes_per_second": opts.maxWritesPerSecond,
+			"entry_size_limit_kb":   opts.entrySizeLimitKB,
+			"entry_size_limits_kb":  opts.entrySizeLimits,
+			"rotate_at_kb":          opts.rotateAtKB,
+			"blob_dir":              opts.blobDir,
+			"op_metadata":           opts.opMetadata,
+			"tracing":               opts.tracer != nil,
+		},
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sort"
+)
+
+// Dedup: with WithDedup or WithUniqueValues, every live entry's value is
+// hashed (SHA-256 of its JSON encoding) into a reverse index from hash to
+// keys, kept with the key index under dataMu. Blob and lease entries aren't
+// indexed: their Value is left zero.
+
+type valueHash [sha256.Size]byte
+
+// valueIndex maps the value hashes to the keys holding them.
+type valueIndex struct {
+	byHash map[valueHash]map[string]bool
+	hashes map[string]valueHash
+}
+
+func newValueIndex() *valueIndex {
+	return &valueIndex{byHash: make(map[valueHash]map[string]bool), hashes: make(map[string]valueHash)}
+}
+
+// hashValue returns the hash of the entry's value, false for the entries not
+// indexed.
+func hashValue[T any](entry DbData[T]) (valueHash, bool) {
+	if entry.Blob != nil || entry.Owner != "" {
+		return valueHash{}, false
+	}
+	hash, err := hashOf(entry.Value)
+	return hash, err == nil
+}
+
+func hashOf[T any](value T) (valueHash, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return valueHash{}, dbError.FailedToConvertMapToJson(err.Error())
+	}
+	return sha256.Sum256(encoded), nil
+}
+
+func (index *valueIndex) put(key string, hash valueHash, indexed bool) {
+	index.remove(key)
+	if !indexed {
+		return
+	}
+	keys := index.byHash[hash]
+	if keys == nil {
+		keys = make(map[string]bool)
+		index.byHash[hash] = keys
+	}
+	keys[key] = true
+	index.hashes[key] = hash
+}
+
+func (index *valueIndex) remove(key string) {
+	hash, exists := index.hashes[key]
+	if !exists {
+		return
+	}
+	delete(index.hashes, key)
+	delete(index.byHash[hash], key)
+	if len(index.byHash[hash]) == 0 {
+		delete(index.byHash, hash)
+	}
+}
+
+// holder returns a key other than key holding a value of that hash.
+func (index *valueIndex) holder(hash valueHash, key string) (string, bool) {
+	for holder := range index.byHash[hash] {
+		if holder != key {
+			return holder, true
+		}
+	}
+	return "", false
+}
+
+// FindDuplicates returns the groups of keys holding the same value, each
+// group and the list sorted. It needs WithDedup or WithUniqueValues.
+func (db *DB[T]) FindDuplicates() ([][]string, error) {
+	if db.values == nil {
+		return nil, dbError.DedupNotEnabled("")
+	}
+	db.dataMu.RLock()
+	defer db.dataMu.RUnlock()
+	var groups [][]string
+	for _, keys := range db.values.byHash {
+		if len(keys) < 2 {
+			continue
+		}
+		group := make([]string, 0, len(keys))
+		for key := range keys {
+			group = append(group, key)
+		}
+		sort.Strings(group)
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups, nil
+}
+
+// checkUnique fails with DuplicateValue, under WithUniqueValues, when another
+// key than key already holds the value of entry. pending holds the hashes of
+// the other entries of the same batch.
+func (db *DB[T]) checkUnique(key string, entry DbData[T], pending map[valueHash]string) error {
+	if !db.opts().uniqueValues {
+		return nil
+	}
+	hash, indexed := hashValue(entry)
+	if !indexed {
+		return nil
+	}
+	holder, taken := db.values.holder(hash, key)
+	if !taken {
+		holder, taken = pending[hash]
+	}
+	if taken {
+		return dbError.DuplicateValue(fmt.Sprintf("key %s holds the same value as %s", key, holder))
+	}
+	if pending != nil {
+		pending[hash] = key
+	}
+	return nil
+}
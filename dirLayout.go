@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Directory layout of a database opened with WithDirectoryLayout, in
+// <dir>/<name>.db/:
+//
+//	MANIFEST          layout description, see dbManifest
+//	LOCK              flock'd while the database is open
+//	data.json         the data segment (data.bin when gob encoded)
+//	backups/          the migrated legacy file, only if there was one
+//
+// The oplog, backups and blobs are wherever WithOplog, WithAutoBackup and
+// WithBlobDir put them.
+const (
+	manifestFileName = "MANIFEST"
+	dirLockFileName  = "LOCK"
+	backupsDirName   = "backups"
+	dirSuffix        = ".db"
+)
+
+// manifestVersion is the version of the layout written by this code.
+const manifestVersion = 1
+
+// dbManifest describes the layout of a database directory.
+type dbManifest struct {
+	Version   int       `json:"version"`
+	Encoding  string    `json:"encoding"`             // "json" or "gob"
+	Segments  []string  `json:"segments"`             // data files, relative to the directory
+	BackupDir string    `json:"backup_dir,omitempty"` // holding the migrated legacy file, if any
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewDirLocalStorage stores the database fileName as a directory in dir
+// instead of a single file (see the layout above). A legacy single-file
+// database of that name found in dir is migrated into it: its data becomes
+// the data segment and a copy is kept in backups/.
+func NewDirLocalStorage[T any](fileName string, dir string, binary bool) (*LocalStorage[T], error) {
+	if len(strings.TrimSpace(dir)) == 0 {
+		curDir, osErr := os.Getwd()
+		if osErr != nil {
+			return nil, osErr
+		}
+		dir = curDir
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, dbError.DirectoryNotExists("")
+	}
+	extension, encoding := ".json", "json"
+	if binary {
+		extension, encoding = ".bin", "gob"
+	}
+	legacyName, err := ValidateAndFixFilename(fileName, extension)
+	if err != nil {
+		return nil, err
+	}
+	dbDir := filepath.Join(dir, strings.TrimSuffix(legacyName, extension)+dirSuffix)
+
+	manifest, err := readManifest(dbDir)
+	if os.IsNotExist(err) {
+		manifest, err = createDirLayout(dbDir, filepath.Join(dir, legacyName), encoding, extension)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Version > manifestVersion {
+		return nil, dbError.FailedToLoadFile(fmt.Sprintf("%s: layout version %d is newer than supported %d", dbDir, manifest.Version, manifestVersion))
+	}
+	if manifest.Encoding != encoding || len(manifest.Segments) != 1 {
+		return nil, dbError.FailedToLoadFile(fmt.Sprintf("%s: %s encoded with %d segments, expected one %s segment", dbDir, manifest.Encoding, len(manifest.Segments), encoding))
+	}
+	localStorage := &LocalStorage[T]{
+		filePath: filepath.Join(dbDir, manifest.Segments[0]),
+		lockPath: filepath.Join(dbDir, dirLockFileName),
+		name:     legacyName,
+		dbDir:    dbDir,
+		binary:   binary,
+	}
+	segmentExists, err := localStorage.fileExists(dbDir)
+	if err != nil {
+		return nil, err
+	}
+	if !segmentExists {
+		if err := localStorage.createFile(); err != nil {
+			return nil, dbError.FailedToCreateFile("")
+		}
+	}
+	return localStorage, nil
+}
+
+func readManifest(dbDir string) (dbManifest, error) {
+	var manifest dbManifest
+	content, err := os.ReadFile(filepath.Join(dbDir, manifestFileName))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return manifest, dbError.FailedToLoadFile(fmt.Sprintf("%s: %s", manifestFileName, err))
+	}
+	return manifest, nil
+}
+
+// createDirLayout creates the database directory, moving the legacy file's
+// data into it if there is one. The manifest is written last: a directory
+// without one is an interrupted creation, which is simply redone.
+func createDirLayout(dbDir string, legacyPath string, encoding string, extension string) (dbManifest, error) {
+	manifest := dbManifest{
+		Version:   manifestVersion,
+		Encoding:  encoding,
+		Segments:  []string{"data" + extension},
+		CreatedAt: time.Now(),
+	}
+	if err := os.MkdirAll(dbDir, os.ModePerm); err != nil {
+		return manifest, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+
+	segmentPath := filepath.Join(dbDir, manifest.Segments[0])
+	if _, err := os.Stat(legacyPath); err == nil {
+		backupDir := filepath.Join(dbDir, backupsDirName)
+		if err := os.MkdirAll(backupDir, os.ModePerm); err != nil {
+			return manifest, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+		}
+		if err := migrateLegacyFile(legacyPath, segmentPath, backupDir); err != nil {
+			return manifest, err
+		}
+		manifest.BackupDir = backupsDirName
+	} else if !os.IsNotExist(err) {
+		return manifest, dbError.FailedToCheckFileExists(fmt.Sprintf("%s", err))
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeFileAtomically(filepath.Join(dbDir, manifestFileName), func(file *os.File) error {
+		_, err := file.Write(encoded)
+		return err
+	}); err != nil {
+		return manifest, dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	return manifest, nil
+}
+
+// migrateLegacyFile copies the legacy file into the data segment and keeps it
+// in backupDir, under its lock so no process is using it meanwhile.
+func migrateLegacyFile(legacyPath string, segmentPath string, backupDir string) error {
+	legacy := &LocalStorage[struct{}]{filePath: legacyPath}
+	if err := legacy.Lock(); err != nil {
+		return dbError.FailedToAcquireLock(fmt.Sprintf("legacy file %s: %s", legacyPath, err))
+	}
+	defer func() {
+		legacy.Unlock()
+		os.Remove(legacy.lockFilePath())
+	}()
+	if err := copyFileAtomically(legacyPath, segmentPath); err != nil {
+		return dbError.FailedToCreateFile(fmt.Sprintf("migrating %s: %s", legacyPath, err))
+	}
+	backupPath := filepath.Join(backupDir, "legacy-"+filepath.Base(legacyPath))
+	if err := os.Rename(legacyPath, backupPath); err != nil {
+		return dbError.FailedToCreateFile(fmt.Sprintf("migrating %s: %s", legacyPath, err))
+	}
+	return nil
+}
+
+func copyFileAtomically(from string, to string) error {
+	source, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	return writeFileAtomically(to, func(file *os.File) error {
+		_, err := io.Copy(file, source)
+		return err
+	})
+}
+
+// writeFileAtomically writes path through a temporary file renamed over it
+// once written and flushed to disk, so readers and crashes never see a
+// partially written file.
+func writeFileAtomically(path string, write func(file *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"maps"
+	"runtime"
+	"slices"
+)
+
+// encodedEntries keeps the JSON of every entry a LocalStorage last synced,
+// as the "key":{...} member of the file, along with the sequence number of
+// the entry. The DB stamps a new sequence number on every write, so an entry
+// with the same number as its encoding hasn't changed since: a sync only
+// encodes the entries written since the previous one and copies the others,
+// which makes its CPU cost proportional to the changes rather than to the
+// data. Entries without a sequence number, loaded from a file written before
+// they existed, are encoded every time until they are written.
+type encodedEntries struct {
+	members map[string]encodedMember
+}
+
+type encodedMember struct {
+	seq  uint64
+	json []byte
+}
+
+func newEncodedEntries() *encodedEntries {
+	return &encodedEntries{members: make(map[string]encodedMember)}
+}
+
+// appendJSONFileIncremental is appendJSONFile reusing the encoding of the entries that
+// didn't change, in key order as well. The encodings of the keys no longer
+// in data are dropped.
+func appendJSONFileIncremental[T any](buffer *encodeBuffer, header schemaHeader, data map[string]DbData[T], cache *encodedEntries) error {
+	if err := appendJSONHeader(buffer, header); err != nil {
+		return err
+	}
+	keys := slices.Sorted(maps.Keys(data))
+	var changed []string
+	for _, key := range keys {
+		entry := data[key]
+		member, cached := cache.members[key]
+		if !cached || member.seq != entry.Seq || entry.Seq == 0 {
+			changed = append(changed, key)
+		}
+	}
+	next := 0
+	err := encodeShards(changed, data, func(shard []byte, ends []int) {
+		shard = slices.Clone(shard) // one allocation the members of the shard share
+		start := 0
+		for _, end := range ends {
+			key := changed[next]
+			cache.members[key] = encodedMember{seq: data[key].Seq, json: shard[start+1 : end : end]} // without the ','
+			start = end
+			next++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		buffer.WriteByte(',')
+		buffer.Write(cache.members[key].json)
+	}
+	if len(cache.members) > len(data) {
+		for key := range cache.members {
+			if _, exists := data[key]; !exists {
+				delete(cache.members, key)
+			}
+		}
+	}
+	buffer.WriteString("}\n")
+	return nil
+}
+
+// parallelEncodeMin is how many entries there must be to encode before
+// encodeShards spreads them over goroutines: below it, a rewrite is quick
+// enough that starting them isn't worth it.
+const parallelEncodeMin = 4096
+
+// encodeShards encodes the ,"key":{...} members of the keys of data, in
+// order, and passes them to use in shards of consecutive keys along with the
+// offsets the members of the shard end at. From parallelEncodeMin keys on,
+// which a checkpoint or compaction of a large DB rewrites all of, the shards
+// are encoded by as many goroutines as GOMAXPROCS at once, each into a pooled
+// buffer; use is still called on the goroutine of the caller, one shard at a
+// time in key order, as soon as the shard and those before it are encoded.
+// A shard is only valid until use returns.
+func encodeShards[T any](keys []string, data map[string]DbData[T], use func(shard []byte, ends []int)) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	shards := 1
+	if len(keys) >= parallelEncodeMin {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	if shards == 1 {
+		buffer := getEncodeBuffer(0)
+		defer putEncodeBuffer(buffer)
+		ends, err := encodeShard(buffer, keys, data)
+		if err != nil {
+			return err
+		}
+		use(buffer.Bytes(), ends)
+		return nil
+	}
+
+	type encodedShard struct {
+		buffer *encodeBuffer
+		ends   []int
+		err    error
+		done   chan struct{}
+	}
+	encoded := make([]encodedShard, shards)
+	for i := range encoded {
+		shard := &encoded[i]
+		shard.buffer = getEncodeBuffer(0)
+		shard.done = make(chan struct{})
+		part := keys[i*len(keys)/shards : (i+1)*len(keys)/shards]
+		go func() {
+			defer close(shard.done)
+			shard.ends, shard.err = encodeShard(shard.buffer, part, data)
+		}()
+	}
+	var err error
+	for i := range encoded {
+		shard := &encoded[i]
+		<-shard.done
+		if err == nil {
+			err = shard.err
+		}
+		if err == nil {
+			use(shard.buffer.Bytes(), shard.ends)
+		}
+		putEncodeBuffer(shard.buffer)
+	}
+	return err
+}
+
+// encodeShard appends the ,"key":{...} members of keys to buffer and returns
+// the offsets they end at.
+func encodeShard[T any](buffer *encodeBuffer, keys []string, data map[string]DbData[T]) ([]int, error) {
+	ends := make([]int, 0, len(keys))
+	for _, key := range keys {
+		buffer.WriteByte(',')
+		if err := buffer.encodeJSON(key); err != nil {
+			return nil, err
+		}
+		buffer.WriteByte(':')
+		if err := buffer.encodeJSON(data[key]); err != nil {
+			return nil, err
+		}
+		ends = append(ends, buffer.Len())
+	}
+	return ends, nil
+}
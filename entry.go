@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"strconv"
+	"time"
+)
+
+// EntryBuilder builds a validated DbData, see NewEntry.
+type EntryBuilder[T any] struct {
+	entry DbData[T]
+	err   error
+}
+
+// NewEntry starts building an entry holding value, without expiration:
+//
+//	entry, err := NewEntry(value).WithTTL(5 * time.Minute).Build()
+//
+// Invalid settings are reported by Build, before anything reaches the DB.
+func NewEntry[T any](value T) *EntryBuilder[T] {
+	return &EntryBuilder[T]{entry: DbData[T]{Value: value}}
+}
+
+// WithTTL makes the entry expire ttl after it is built. The TTL is stored in
+// seconds, so it must be a positive whole number of seconds.
+func (b *EntryBuilder[T]) WithTTL(ttl time.Duration) *EntryBuilder[T] {
+	if ttl <= 0 || ttl%time.Second != 0 {
+		b.fail(dbError.InvalidTTL(fmt.Sprintf("ttl %v is not a positive number of seconds", ttl)))
+		return b
+	}
+	b.entry.Ttl = strconv.FormatInt(int64(ttl/time.Second), 10)
+	return b
+}
+
+// WithExpiresAt makes the entry expire at the given moment, see
+// CreateExpiringAt. It can't be combined with WithTTL.
+func (b *EntryBuilder[T]) WithExpiresAt(expiresAt time.Time) *EntryBuilder[T] {
+	if expiresAt.IsZero() {
+		b.fail(dbError.InvalidTTL("expires at the zero time"))
+		return b
+	}
+	b.entry.Expires_at = &expiresAt
+	return b
+}
+
+// WithSliding makes every read push the expiration by the TTL again, see
+// WithSlidingTTL.
+func (b *EntryBuilder[T]) WithSliding() *EntryBuilder[T] {
+	b.entry.Sliding = true
+	return b
+}
+
+// Build validates the settings and returns the entry, created now.
+func (b *EntryBuilder[T]) Build() (DbData[T], error) {
+	if b.err != nil {
+		return DbData[T]{}, b.err
+	}
+	entry := b.entry
+	entry.Created_at = time.Now()
+	if entry.Ttl != "" && entry.Expires_at != nil {
+		return DbData[T]{}, dbError.InvalidTTL("both a ttl and an expiration time")
+	}
+	if entry.Expires_at != nil && !entry.Expires_at.After(entry.Created_at) {
+		return DbData[T]{}, dbError.InvalidTTL(fmt.Sprintf("expires at %s, which is not in the future", entry.Expires_at.Format(time.RFC3339)))
+	}
+	if entry.Sliding && entry.Ttl == "" {
+		return DbData[T]{}, dbError.InvalidTTL("sliding expiration without a ttl")
+	}
+	return entry, nil
+}
+
+// fail keeps the first error, reported by Build.
+func (b *EntryBuilder[T]) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// validateTTL checks the Ttl string of an entry built by hand, so a bad one
+// is rejected on write instead of silently never expiring.
+func validateTTL[T any](entry DbData[T]) error {
+	if entry.Ttl == "" {
+		return nil
+	}
+	if seconds, err := strconv.Atoi(entry.Ttl); err != nil || seconds < 0 {
+		return dbError.InvalidTTL(fmt.Sprintf("ttl : %q", entry.Ttl))
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+type expiryItem struct {
+	key       string
+	expiresAt time.Time
+	index     int // position in the heap
+}
+
+// expiryHeap implements heap.Interface, earliest expiration first.
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	item := x.(*expiryItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// expiryQueue tracks when every key with a TTL expires, in a min-heap indexed
+// by key so a write can move or drop its key's expiration in place. The
+// cleanup worker sleeps until the earliest expiration and pops only the due
+// keys instead of scanning the whole map.
+type expiryQueue struct {
+	mu    sync.Mutex
+	heap  expiryHeap
+	byKey map[string]*expiryItem
+	wake  chan struct{} // signaled when the earliest expiration moved earlier
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{
+		byKey: make(map[string]*expiryItem),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// set schedules key to expire at expiresAt, replacing its previous schedule.
+func (q *expiryQueue) set(key string, expiresAt time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item, exists := q.byKey[key]; exists {
+		item.expiresAt = expiresAt
+		heap.Fix(&q.heap, item.index)
+	} else {
+		item := &expiryItem{key: key, expiresAt: expiresAt}
+		heap.Push(&q.heap, item)
+		q.byKey[key] = item
+	}
+	if q.heap[0].key == key {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// remove unschedules key, if it was scheduled.
+func (q *expiryQueue) remove(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if item, exists := q.byKey[key]; exists {
+		heap.Remove(&q.heap, item.index)
+		delete(q.byKey, key)
+	}
+}
+
+// next returns the earliest scheduled expiration.
+func (q *expiryQueue) next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.heap) == 0 {
+		return time.Time{}, false
+	}
+	return q.heap[0].expiresAt, true
+}
+
+// popDue unschedules and returns up to limit keys (all when limit is 0) that
+// expire at or before now, earliest first.
+func (q *expiryQueue) popDue(now time.Time, limit int) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var keys []string
+	for len(q.heap) > 0 && !q.heap[0].expiresAt.After(now) {
+		if limit > 0 && len(keys) == limit {
+			break
+		}
+		item := heap.Pop(&q.heap).(*expiryItem)
+		delete(q.byKey, item.key)
+		keys = append(keys, item.key)
+	}
+	return keys
+}
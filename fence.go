@@ -0,0 +1,86 @@
+package main
+
+import "sync"
+
+// writeFence gives reads a read-your-writes guarantee even though reads and
+// writes run on different workers. Every write takes a sequence number when it
+// is queued and releases it once applied (or rejected); a read remembers the
+// last sequence queued for its key and is held back until every write up to
+// it is done.
+type writeFence struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	seq     uint64
+	pending map[string][]uint64 // per key, the sequences not released yet, ascending
+}
+
+func newWriteFence() *writeFence {
+	fence := &writeFence{pending: make(map[string][]uint64)}
+	fence.cond = sync.NewCond(&fence.mu)
+	return fence
+}
+
+// begin registers a write on keys and returns its sequence number.
+func (f *writeFence) begin(keys []string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	for _, key := range keys {
+		f.pending[key] = append(f.pending[key], f.seq)
+	}
+	return f.seq
+}
+
+// end releases the write registered by begin.
+func (f *writeFence) end(keys []string, seq uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		seqs := f.pending[key]
+		for i, pendingSeq := range seqs {
+			if pendingSeq == seq {
+				seqs = append(seqs[:i], seqs[i+1:]...)
+				break
+			}
+		}
+		if len(seqs) == 0 {
+			delete(f.pending, key)
+		} else {
+			f.pending[key] = seqs
+		}
+	}
+	f.cond.Broadcast()
+}
+
+// last returns the sequence of the last write queued on key that isn't done
+// yet, 0 if there is none.
+func (f *writeFence) last(key string) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seqs := f.pending[key]
+	if len(seqs) == 0 {
+		return 0
+	}
+	return seqs[len(seqs)-1]
+}
+
+// isPending reports whether a write on key with a sequence <= upTo is not done.
+func (f *writeFence) isPending(key string, upTo uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.isPendingLocked(key, upTo)
+}
+
+func (f *writeFence) isPendingLocked(key string, upTo uint64) bool {
+	seqs := f.pending[key]
+	return len(seqs) > 0 && seqs[0] <= upTo
+}
+
+// wait blocks until no write on key with a sequence <= upTo is pending.
+func (f *writeFence) wait(key string, upTo uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.isPendingLocked(key, upTo) {
+		f.cond.Wait()
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"time"
+)
+
+// startFollowing starts the follow worker, which reloads the data whenever the
+// storage version changes.
+func (db *DB[T]) startFollowing() {
+	db.stopFollowCh = make(chan struct{})
+	db.followDone = make(chan struct{})
+	go db.followWorker()
+}
+
+func (db *DB[T]) stopFollowing() {
+	close(db.stopFollowCh)
+	<-db.followDone
+	db.followDone = nil
+}
+
+func (db *DB[T]) followWorker() {
+	defer close(db.followDone)
+	versioned, ok := db.storage.(VersionedStorage)
+	if !ok {
+		return
+	}
+	<-db.ready
+	lastVersion := db.loadedVersion
+	ticker := time.NewTicker(db.opts().followInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			version, err := versioned.Version()
+			if err != nil || version == lastVersion {
+				continue
+			}
+			// a reload failing on a half-written file is retried next tick
+			if result := db.submit(db.adminOps, db.reloadOp()); result.err == nil {
+				lastVersion = version
+			}
+		case <-db.stopFollowCh:
+			return
+		case <-db.closeCh:
+			return
+		}
+	}
+}
+
+func (db *DB[T]) reloadOp() operation[T] {
+	return operation[T]{
+		action:   "reload",
+		response: make(chan operationResult[T], 1),
+	}
+}
+
+// reload replaces the in-memory data with what the storage holds now. The
+// current data is kept if the storage can't be loaded.
+func (db *DB[T]) reload() error {
+	loadedData := make(map[string]DbData[T])
+	if err := db.storage.Load(&loadedData); err != nil {
+		return dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	for _, key := range db.data.keys() {
+		if _, exists := loadedData[key]; !exists {
+			unlock := db.lockKey(key)
+			db.removeEntry(key)
+			unlock()
+		}
+	}
+	for key := range db.tombstones {
+		if _, exists := loadedData[key]; !exists {
+			db.removeTombstone(key)
+		}
+	}
+	for key, entry := range loadedData {
+		unlock := db.lockKey(key)
+		db.setLoaded(key, entry)
+		unlock()
+	}
+	db.loaded()
+	return nil
+}
+
+// Promote turns a follower into the writer once the previous writer released
+// the storage lock: it takes the lock, reloads the latest data, and from then
+// on accepts writes and runs the cleanup worker. It fails with
+// FailedToAcquireLock while another process still holds the lock.
+func (db *DB[T]) Promote() error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	if !db.readOnly.Load() {
+		return nil
+	}
+	if err := db.storage.Lock(); err != nil {
+		return dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
+	}
+	db.stopFollowing()
+	if result := db.submit(db.adminOps, db.reloadOp()); result.err != nil {
+		db.storage.Unlock()
+		db.startFollowing()
+		return result.err
+	}
+	db.readOnly.Store(false)
+	db.cleanupWG.Add(1)
+	go db.startCleanupWorker()
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "local-key-value-DB/dbError"
+
+// Freeze waits until every write queued before it is applied, then holds the
+// write worker until Unfreeze, so that external tooling can copy, rotate or
+// verify the storage file while the process stays alive. Reads keep being
+// served; writes and maintenance (cleanup runs, compaction) queue up
+// meanwhile, and fail once their op timeout is over. Close ends a freeze.
+func (db *DB[T]) Freeze() error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	db.freezeMu.Lock()
+	defer db.freezeMu.Unlock()
+	if db.freezeRelease != nil {
+		return dbError.DatabaseFrozen("already frozen")
+	}
+	op := operation[T]{
+		action:   "freeze",
+		response: make(chan operationResult[T], 1),
+		release:  make(chan struct{}),
+	}
+	deadline, timeout, stop := db.opDeadline()
+	defer stop()
+	op.deadline = deadline
+	err := db.enqueue(db.writeOps, op, timeout)
+	if err == nil {
+		result, _ := db.await(op, timeout)
+		err = result.err
+	}
+	if err != nil {
+		close(op.release) // frees the worker if it paused after we gave up
+		return err
+	}
+	db.freezeRelease = op.release
+	return nil
+}
+
+// Unfreeze lets the write worker go on after Freeze.
+func (db *DB[T]) Unfreeze() error {
+	db.freezeMu.Lock()
+	defer db.freezeMu.Unlock()
+	if db.freezeRelease == nil {
+		return dbError.DatabaseNotFrozen("")
+	}
+	close(db.freezeRelease)
+	db.freezeRelease = nil
+	return nil
+}
+
+// Frozen reports whether the DB is between Freeze and Unfreeze.
+func (db *DB[T]) Frozen() bool {
+	db.freezeMu.Lock()
+	defer db.freezeMu.Unlock()
+	return db.freezeRelease != nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "local-key-value-DB/dbError"
+
+// GetOrDefault returns the value stored under key, or def if the key is
+// missing, expired or can't be read.
+func (db *DB[T]) GetOrDefault(key string, def T) T {
+	result := db.Read(key)
+	if result.err != nil {
+		return def
+	}
+	return result.value.Value
+}
+
+// Exists reports whether key holds an entry that is not expired. Unlike Read
+// it never copies the value.
+func (db *DB[T]) Exists(key string) bool {
+	if db.closed.Load() {
+		return false
+	}
+	op := operation[T]{
+		action:   "exists",
+		key:      key,
+		response: make(chan operationResult[T], 1),
+		fenceSeq: db.fence.last(key),
+	}
+	return db.submit(db.readOps, op).exists
+}
+
+// GetAndDelete removes the entry stored under key and returns it, as a
+// single write: no other operation on key can run in between.
+func (db *DB[T]) GetAndDelete(key string) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:   "getAndDelete",
+		key:      key,
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op)
+}
+
+func (db *DB[T]) exists(key string) bool {
+	exists := db.data.has(key)
+	return exists && !db.isExpired(key)
+}
+
+func (db *DB[T]) getAndDelete(key string) (DbData[T], error) {
+	if db.isExpired(key) {
+		db.expireEntry(key)
+		return DbData[T]{}, dbError.KeyExpired("")
+	}
+	value, err := db.read(key)
+	if err != nil {
+		return DbData[T]{}, err
+	}
+	if err := db.checkMutable(key); err != nil {
+		return DbData[T]{}, err
+	}
+	if err := db.deleteEntry(key, OplogDelete); err != nil {
+		return DbData[T]{}, err
+	}
+	return value, nil
+}
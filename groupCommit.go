@@ -0,0 +1,112 @@
+package main
+
+import "time"
+
+// commitGroup is the writes applied since the last sync that wait for the
+// next one, see WithGroupCommit. A grouped write keeps its keys locked and
+// its fence up until the group is committed, so reads of its key don't see
+// it before the sync; ListKeys, ReadMatching and Stats, which don't take the
+// key locks, may. A key is in one write of the group at most, the next write
+// of it committing the group first.
+type commitGroup[T any] struct {
+	writes  []groupedWrite[T]
+	undo    *writeUndo[T]    // What the keys held before the group, to roll it back
+	records []OplogRecord[T] // Logged once synced
+	dirty   bool             // A write synced, or would have without the group
+	timer   *time.Timer      // Fires when the group is due
+}
+
+// groupedWrite is a write of a group, waiting for its answer. The result is
+// stamped already, with the checkpoint the write reached.
+type groupedWrite[T any] struct {
+	op     operation[T]
+	result operationResult[T]
+	unlock func()
+	span   Span
+}
+
+// groupable reports whether op can join a group commit. With WithRotation
+// writes don't group, as a rotation after any of them needs it synced.
+func (db *DB[T]) groupable(op operation[T]) bool {
+	if db.opts().groupCommit <= 0 || db.generations != nil {
+		return false
+	}
+	switch op.action {
+	case "create", "update", "delete":
+		return true
+	}
+	return false
+}
+
+// due returns the channel the write worker waits on for the commit, nil
+// without a group.
+func (group *commitGroup[T]) due() <-chan time.Time {
+	if group == nil {
+		return nil
+	}
+	return group.timer.C
+}
+
+// admits reports whether a write of key can join the group.
+func (group *commitGroup[T]) admits(key string) bool {
+	return !group.undo.keys[key] && len(group.writes) < BatchLimit
+}
+
+// joinGroup adds a write of key to the group, starting one if there is
+// none, before it changes anything.
+func (db *DB[T]) joinGroup(key string) {
+	if db.group == nil {
+		db.group = &commitGroup[T]{
+			undo:  newWriteUndo[T](1),
+			timer: time.NewTimer(db.opts().groupCommit),
+		}
+	}
+	db.group.undo.save(db, key)
+}
+
+// hold keeps write until the group is committed.
+func (group *commitGroup[T]) hold(write groupedWrite[T]) {
+	group.writes = append(group.writes, write)
+}
+
+// commitGroup syncs the writes of the group and answers them. If the sync
+// fails, the group is rolled back and every write that succeeded fails with
+// the error.
+func (db *DB[T]) commitGroup() {
+	group := db.group
+	if group == nil {
+		return
+	}
+	db.group = nil
+	group.timer.Stop()
+	var err error
+	db.syncMeter = syncMeter{}
+	if group.dirty {
+		err = db.sync()
+	}
+	shared := db.syncMeter
+	if err != nil {
+		db.rollback(group.undo)
+	} else {
+		db.logOps(group.records...)
+	}
+	if err == nil && group.dirty {
+		now := time.Now()
+		for key := range group.undo.keys {
+			db.coalescer.synced(key, now)
+		}
+	}
+	for _, write := range group.writes {
+		result := write.result
+		if err != nil && result.err == nil {
+			result.err = err
+		}
+		if meta := result.meta; meta != nil { // the sync counts for every write
+			meta.Exec += shared.duration
+			meta.SyncDuration += shared.duration
+			meta.Syncs += shared.syncs
+			meta.Bytes = shared.bytes
+		}
+		db.finishWrite(write.op, result, write.unlock, opMeter{}, write.span)
+	}
+}
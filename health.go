@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// healthQueueThreshold is the share of a queue's capacity above which
+// HealthCheck reports it as backed up.
+const healthQueueThreshold = 0.8
+
+// HealthReporter is implemented by backends able to check themselves for
+// HealthCheck; the checks are skipped for the others.
+type HealthReporter interface {
+	// LockHeld reports whether the lock taken by Lock is still held.
+	LockHeld() bool
+	// CheckWritable fails if the backend can't write anymore.
+	CheckWritable() error
+	// Dir returns the directory holding the data, "" if it isn't on disk.
+	Dir() string
+}
+
+// HealthStatus is the outcome of one check of HealthCheck.
+type HealthStatus struct {
+	Name    string `json:"name"` // "open", "loaded", "lock", "writable", "oplog", "write_worker", "read_worker", "queues" or "disk"
+	Healthy bool   `json:"healthy"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// HealthReport is the result of HealthCheck, ready to be served as JSON.
+type HealthReport struct {
+	Healthy   bool           `json:"healthy"`
+	Checks    []HealthStatus `json:"checks"`
+	CheckedAt time.Time      `json:"checked_at"`
+}
+
+// HealthCheck checks deeply that the DB can serve: it is open and loaded,
+// the storage lock is still held and the storage writable, both workers
+// answer a heartbeat within ctx, the queues aren't backed up, and the disk
+// has room for the data file to be rewritten plus one entry, the replica's
+// too with WithReplica. With WithOplog, it fails while the last append to
+// the oplog did. A follower skips the lock and write checks.
+func (db *DB[T]) HealthCheck(ctx context.Context) HealthReport {
+	report := HealthReport{Healthy: true, CheckedAt: time.Now()}
+	check := func(name string, err error) {
+		status := HealthStatus{Name: name, Healthy: err == nil}
+		if err != nil {
+			status.Detail = err.Error()
+			report.Healthy = false
+		}
+		report.Checks = append(report.Checks, status)
+	}
+
+	if db.closed.Load() {
+		check("open", dbError.DBAlreadyClosed(""))
+		return report
+	}
+	check("open", nil)
+	select {
+	case <-db.ready:
+		check("loaded", db.loadErr)
+	default:
+		check("loaded", fmt.Errorf("still loading"))
+	}
+
+	reporter, _ := db.storage.(HealthReporter)
+	if reporter != nil && !db.readOnly.Load() {
+		if reporter.LockHeld() {
+			check("lock", nil)
+		} else {
+			check("lock", fmt.Errorf("the storage lock is not held anymore"))
+		}
+		check("writable", reporter.CheckWritable())
+	}
+	if db.oplog != nil {
+		check("oplog", db.oplog.err())
+	}
+
+	// concurrently, so a stuck worker doesn't eat the other's time
+	readPing := make(chan error, 1)
+	go func() { readPing <- db.ping(ctx, db.readOps) }()
+	check("write_worker", db.ping(ctx, db.writeOps))
+	check("read_worker", <-readPing)
+
+	reads, writes := db.QueueDepth()
+	if float64(reads) > healthQueueThreshold*float64(cap(db.readOps)) || float64(writes) > healthQueueThreshold*float64(cap(db.writeOps)) {
+		check("queues", fmt.Errorf("%d reads and %d writes queued, capacity %d and %d", reads, writes, cap(db.readOps), cap(db.writeOps)))
+	} else {
+		check("queues", nil)
+	}
+
+	if dirs := storageDirs(db.storage); len(dirs) > 0 {
+		sizeKB, err := db.storage.Size()
+		for _, dir := range dirs {
+			if err == nil {
+				err = checkDiskSpace(dir, sizeKB+float64(db.opts().entrySizeLimitKB))
+			}
+		}
+		check("disk", err)
+	}
+	return report
+}
+
+// storageDirs returns the directories the data file is rewritten in on each
+// sync: the storage's own and, with WithReplica, the replica's.
+func storageDirs(storage any) []string {
+	var dirs []string
+	if reporter, ok := storage.(HealthReporter); ok && reporter.Dir() != "" {
+		dirs = append(dirs, reporter.Dir())
+	}
+	if replicated, ok := storage.(interface{ replicaDir() string }); ok {
+		dirs = append(dirs, replicated.replicaDir())
+	}
+	return dirs
+}
+
+// ping sends a no-op through a worker's queue and waits for its answer.
+func (db *DB[T]) ping(ctx context.Context, queue chan operation[T]) error {
+	op := operation[T]{
+		action:   "ping",
+		response: make(chan operationResult[T], 1),
+	}
+	err := func() error {
+		db.closeMu.RLock()
+		defer db.closeMu.RUnlock()
+		if db.closed.Load() {
+			return dbError.DBAlreadyClosed("")
+		}
+		select {
+		case queue <- op:
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("heartbeat not queued: %w", ctx.Err())
+		case <-db.closeCh:
+			return dbError.ErrClosed(op.action)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	select {
+	case result := <-op.response:
+		return result.err
+	case <-ctx.Done():
+		if db.Frozen() && queue == db.writeOps {
+			return fmt.Errorf("no heartbeat, the database is frozen: %w", ctx.Err())
+		}
+		return fmt.Errorf("no heartbeat: %w", ctx.Err())
+	}
+}
+
+// checkDiskSpace fails with ErrDiskFull when the disk holding dir has less
+// than neededKB free.
+func checkDiskSpace(dir string, neededKB float64) error {
+	free, err := diskFreeBytes(dir)
+	if err != nil {
+		return err
+	}
+	needed := uint64(neededKB * KB)
+	if free < needed {
+		return dbError.ErrDiskFull(fmt.Sprintf("%d bytes needed, %d free in %s", needed, free, dir))
+	}
+	return nil
+}
+
+// diskFreeBytes returns the space available to the process on the disk
+// holding dir; tests replace it.
+var diskFreeBytes = func(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
+
+func (ls *LocalStorage[T]) LockHeld() bool {
+	if ls.lockFile == nil {
+		return false
+	}
+	// the lock is lost along with the file if it was removed or replaced
+	held, err := ls.lockFile.Stat()
+	if err != nil {
+		return false
+	}
+	onDisk, err := os.Stat(ls.lockFilePath())
+	return err == nil && os.SameFile(held, onDisk)
+}
+
+func (ls *LocalStorage[T]) CheckWritable() error {
+	probe, err := os.CreateTemp(ls.Dir(), ".health-*")
+	if err != nil {
+		return dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+func (ls *LocalStorage[T]) Dir() string {
+	return filepath.Dir(ls.filePath)
+}
+
+func (ms *MemoryStorage[T]) LockHeld() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.locked
+}
+
+func (ms *MemoryStorage[T]) CheckWritable() error {
+	return nil
+}
+
+func (ms *MemoryStorage[T]) Dir() string {
+	return ""
+}
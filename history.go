@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sync"
+	"time"
+)
+
+// Version is one state of a key kept by WithHistory.
+type Version[T any] struct {
+	Version   uint64     `json:"version"`         // Per key, from 1 on, one per mutation of the key
+	Op        string     `json:"op"`              // Oplog operation that produced it
+	Value     *DbData[T] `json:"value,omitempty"` // The entry, nil for delete and expire
+	Timestamp time.Time  `json:"ts"`
+}
+
+// keyHistory keeps the last versions of every key. The write worker records
+// the mutations it applied; History and ReadVersion read it from any
+// goroutine.
+type keyHistory[T any] struct {
+	mu       sync.Mutex
+	limit    int
+	versions map[string][]Version[T] // Oldest first
+}
+
+func newKeyHistory[T any](limit int) *keyHistory[T] {
+	return &keyHistory[T]{limit: limit, versions: make(map[string][]Version[T])}
+}
+
+func (h *keyHistory[T]) record(records []OplogRecord[T]) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, record := range records {
+		versions := h.versions[record.Key]
+		number := uint64(1)
+		if len(versions) > 0 {
+			number = versions[len(versions)-1].Version + 1
+		}
+		versions = append(versions, Version[T]{Version: number, Op: record.Op, Value: record.Value, Timestamp: record.Timestamp})
+		if len(versions) > h.limit {
+			versions = append(versions[:0:0], versions[len(versions)-h.limit:]...)
+		}
+		h.versions[record.Key] = versions
+	}
+}
+
+func (h *keyHistory[T]) get(key string) []Version[T] {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Version[T](nil), h.versions[key]...)
+}
+
+// History returns the versions of key still retained (see WithHistory),
+// oldest first. A key never written has none.
+func (db *DB[T]) History(key string) ([]Version[T], error) {
+	if db.history == nil {
+		return nil, dbError.HistoryNotEnabled("")
+	}
+	versions := db.history.get(key)
+	for i, version := range versions {
+		if version.Value == nil {
+			continue
+		}
+		value, err := db.ownCopy(*version.Value)
+		if err != nil {
+			return nil, err
+		}
+		versions[i].Value = &value
+	}
+	return versions, nil
+}
+
+// ReadVersion returns the entry key held at version, which must still be
+// retained and not be a delete or an expiration. Restore an old version with
+// Update (or Create, once deleted).
+func (db *DB[T]) ReadVersion(key string, version uint64) (DbData[T], error) {
+	versions, err := db.History(key)
+	if err != nil {
+		return DbData[T]{}, err
+	}
+	for _, kept := range versions {
+		if kept.Version != version {
+			continue
+		}
+		if kept.Value == nil {
+			return DbData[T]{}, dbError.VersionNotFound(fmt.Sprintf("key : %s, version %d is a %s", key, version, kept.Op))
+		}
+		return *kept.Value, nil
+	}
+	return DbData[T]{}, dbError.VersionNotFound(fmt.Sprintf("key : %s, version %d", key, version))
+}
@@ -0,0 +1,52 @@
+package main
+
+import "time"
+
+// FlushStats describes a sync that reached the storage, see OnFlush.
+type FlushStats struct {
+	Seq      uint64        // Checkpoint sequence number the storage matches now
+	Entries  int           // Live entries persisted
+	Duration time.Duration // How long the sync took
+	At       time.Time     // When it completed
+}
+
+// OnClose registers hook to run by Close once the workers stopped and the
+// last updates are flushed, before the storage lock is released. Hooks run
+// in the order they were registered.
+func (db *DB[T]) OnClose(hook func()) {
+	db.hooksMu.Lock()
+	defer db.hooksMu.Unlock()
+	db.closeHooks = append(db.closeHooks, hook)
+}
+
+// OnFlush registers hook to run after every successful sync, for state that
+// must be persisted alongside the data, such as a consumer's cursor. It runs
+// on the write worker, which waits for it: it must be quick and must not
+// call the DB.
+func (db *DB[T]) OnFlush(hook func(stats FlushStats)) {
+	db.hooksMu.Lock()
+	defer db.hooksMu.Unlock()
+	db.flushHooks = append(db.flushHooks, hook)
+}
+
+func (db *DB[T]) runFlushHooks(seq uint64, started time.Time, at time.Time) {
+	db.hooksMu.Lock()
+	hooks := db.flushHooks
+	db.hooksMu.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+	stats := FlushStats{Seq: seq, Entries: db.data.len(), Duration: at.Sub(started), At: at}
+	for _, hook := range hooks {
+		hook(stats)
+	}
+}
+
+func (db *DB[T]) runCloseHooks() {
+	db.hooksMu.Lock()
+	hooks := db.closeHooks
+	db.hooksMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
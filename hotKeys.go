@@ -0,0 +1,92 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+	"sort"
+	"sync"
+)
+
+// hotKeyCounters is how many keys each bucket of the hot key sketch tracks,
+// 2048 over all buckets.
+const hotKeyCounters = 32
+
+// KeyAccess is a key and how many reads it got, see HotKeys. Count may be
+// overestimated by up to Error.
+type KeyAccess struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+	Error uint64 `json:"error"`
+}
+
+// hotKeySketch counts the reads of the most read keys with the Space-Saving
+// algorithm: a bounded set of counters where a key not tracked takes over
+// the smallest one. Any key read more than 1/hotKeyCounters of its bucket's
+// reads is sure to be tracked. Split into buckets like the data map, so the
+// read workers rarely wait on each other.
+type hotKeySketch struct {
+	shards [dataShards]hotKeyShard
+}
+
+type hotKeyShard struct {
+	mu       sync.Mutex
+	counters map[string]*KeyAccess
+}
+
+func newHotKeySketch() *hotKeySketch {
+	sketch := &hotKeySketch{}
+	for i := range sketch.shards {
+		sketch.shards[i].counters = make(map[string]*KeyAccess, hotKeyCounters)
+	}
+	return sketch
+}
+
+func (sketch *hotKeySketch) add(key string) {
+	shard := &sketch.shards[shardOf(key)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if counter, ok := shard.counters[key]; ok {
+		counter.Count++
+		return
+	}
+	if len(shard.counters) < hotKeyCounters {
+		shard.counters[key] = &KeyAccess{Key: key, Count: 1}
+		return
+	}
+	var smallest *KeyAccess
+	for _, counter := range shard.counters {
+		if smallest == nil || counter.Count < smallest.Count {
+			smallest = counter
+		}
+	}
+	delete(shard.counters, smallest.Key)
+	shard.counters[key] = &KeyAccess{Key: key, Count: smallest.Count + 1, Error: smallest.Count}
+}
+
+// top returns the n keys with the highest counts, highest first.
+func (sketch *hotKeySketch) top(n int) []KeyAccess {
+	var all []KeyAccess
+	for i := range sketch.shards {
+		shard := &sketch.shards[i]
+		shard.mu.Lock()
+		for _, counter := range shard.counters {
+			all = append(all, *counter)
+		}
+		shard.mu.Unlock()
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Count != all[j].Count {
+			return all[i].Count > all[j].Count
+		}
+		return all[i].Key < all[j].Key
+	})
+	return all[:min(n, len(all))]
+}
+
+// HotKeys returns the n most read keys since the DB was opened, most read
+// first, to spot a skewed workload. It needs WithHotKeys.
+func (db *DB[T]) HotKeys(n int) ([]KeyAccess, error) {
+	if db.hotKeys == nil {
+		return nil, dbError.HotKeysNotEnabled("")
+	}
+	return db.hotKeys.top(n), nil
+}
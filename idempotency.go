@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyTTL is how long HTTPHandler remembers the response to a write
+// carrying an Idempotency-Key, to answer the retries of a client with it.
+const idempotencyTTL = 10 * time.Minute
+
+// maxIdempotencyKeys caps the responses remembered; the oldest go first.
+const maxIdempotencyKeys = 10000
+
+// idempotentResponse is the response to the first request with a key. done
+// is closed once it is recorded, so a retry racing the first attempt waits
+// for it instead of applying the write again.
+type idempotentResponse struct {
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+	at          time.Time
+}
+
+// idempotencyCache remembers the responses to the writes by key, in the
+// order they came in, which is also the order they expire in.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	responses map[string]*idempotentResponse
+	order     []idempotencyKey
+}
+
+type idempotencyKey struct {
+	key      string
+	response *idempotentResponse
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{responses: make(map[string]*idempotentResponse)}
+}
+
+// claim returns the response recorded under key and false, or a new one to
+// record and true if the request is the first with it.
+func (cache *idempotencyCache) claim(key string, now time.Time) (*idempotentResponse, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	for len(cache.order) > 0 {
+		oldest := cache.order[0]
+		if len(cache.order) < maxIdempotencyKeys && now.Sub(oldest.response.at) < idempotencyTTL {
+			break
+		}
+		if cache.responses[oldest.key] == oldest.response { // not forgotten and claimed again
+			delete(cache.responses, oldest.key)
+		}
+		cache.order = cache.order[1:]
+	}
+	if response, exists := cache.responses[key]; exists {
+		return response, false
+	}
+	response := &idempotentResponse{done: make(chan struct{}), at: now}
+	cache.responses[key] = response
+	cache.order = append(cache.order, idempotencyKey{key: key, response: response})
+	return response, true
+}
+
+// forget drops the response under key, for a failure worth retrying.
+func (cache *idempotencyCache) forget(key string, response *idempotentResponse) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.responses[key] == response {
+		delete(cache.responses, key)
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (recorder *responseRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *responseRecorder) Write(contents []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	recorder.body.Write(contents)
+	return recorder.ResponseWriter.Write(contents)
+}
+
+// idempotent wraps the handler of a write so that the requests repeating the
+// Idempotency-Key of an earlier one, from the same caller to the same URL,
+// get its response instead of applying the write again. Failures worth
+// retrying (5xx and 429) aren't remembered, so the retry runs the write.
+func (api *httpAPI[T]) idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		key = bearerToken(r) + "\x00" + r.Method + " " + r.URL.RequestURI() + "\x00" + key
+		response, first := api.idempotency.claim(key, time.Now())
+		if !first {
+			select {
+			case <-response.done:
+			case <-r.Context().Done():
+				return
+			}
+			if response.status != 0 {
+				w.Header().Set("Content-Type", response.contentType)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(response.status)
+				w.Write(response.body)
+				return
+			}
+			// the first attempt failed in a way worth retrying, run it again
+			handler(w, r)
+			return
+		}
+		recorder := &responseRecorder{ResponseWriter: w}
+		defer close(response.done)
+		handler(recorder, r)
+		if recorder.status >= 500 || recorder.status == http.StatusTooManyRequests {
+			api.idempotency.forget(key, response)
+			return
+		}
+		response.status = recorder.status
+		response.contentType = w.Header().Get("Content-Type")
+		response.body = recorder.body.Bytes()
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+)
+
+// Immutable entries: an entry created with Immutable set is write-once.
+// Update, Delete, GetAndDelete, SetTTLBatch, Rename (of it or onto it),
+// overwriting creates and batch ops on it fail with ErrImmutableEntry, and
+// DeleteMatching leaves it alone, until its TTL expires and it goes the usual
+// way. Its TTL doesn't slide either. The flag can only be set by a create;
+// Update keeps it unset.
+
+// checkMutable fails with ErrImmutableEntry if key holds a live immutable
+// entry. Expired entries are left to the caller.
+func (db *DB[T]) checkMutable(key string) error {
+	entry, exists := db.data.get(key)
+	if !exists || !entry.Immutable || db.isExpired(key) {
+		return nil
+	}
+	return dbError.ErrImmutableEntry(fmt.Sprintf("key : %s", key))
+}
+
+// protected reports whether DeleteMatching must leave the entry alone.
+func (entry DbData[T]) protected() bool {
+	return entry.Pinned || entry.Immutable
+}
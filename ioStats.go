@@ -0,0 +1,63 @@
+package main
+
+import "sync/atomic"
+
+// IOStats sums up what the DB wrote since it was opened, to weigh the bytes
+// that reached the storage against the data that changed. Every sync
+// rewrites the storage whole, so WriteAmplification is about the size of the
+// data over the size of a write; write coalescing and batching bring it down
+// by making a sync cover more changes.
+type IOStats struct {
+	Syncs              uint64  // Syncs of the storage, the failed ones included
+	FailedSyncs        uint64  // Syncs that failed, and were rolled back
+	Rewrites           uint64  // Compact runs, which rewrite the storage even when nothing changed
+	BytesWritten       uint64  // Written by the syncs that succeeded, which write the storage whole
+	OplogBytes         uint64  // Appended to the oplog, see WithOplog
+	OplogFailures      uint64  // Oplog records lost to an encode or write error; their mutations were applied
+	ChangedBytes       uint64  // Size of the keys changed, and of the entries created or updated as the size checks measured it
+	WriteAmplification float64 // (BytesWritten + OplogBytes) / ChangedBytes, 0 before anything changed
+}
+
+// ioCounters counts what IOStats reports.
+type ioCounters struct {
+	syncs        atomic.Uint64
+	failedSyncs  atomic.Uint64
+	rewrites     atomic.Uint64
+	bytesWritten atomic.Uint64
+	changedBytes atomic.Uint64
+}
+
+// IOStats returns what the DB wrote since it was opened.
+func (db *DB[T]) IOStats() IOStats {
+	stats := IOStats{
+		Syncs:        db.io.syncs.Load(),
+		FailedSyncs:  db.io.failedSyncs.Load(),
+		Rewrites:     db.io.rewrites.Load(),
+		BytesWritten: db.io.bytesWritten.Load(),
+		ChangedBytes: db.io.changedBytes.Load(),
+	}
+	if db.oplog != nil {
+		stats.OplogBytes = db.oplog.written.Load()
+		stats.OplogFailures = db.oplog.failed.Load()
+	}
+	if stats.ChangedBytes > 0 {
+		stats.WriteAmplification = float64(stats.BytesWritten+stats.OplogBytes) / float64(stats.ChangedBytes)
+	}
+	return stats
+}
+
+// countSync counts a sync that wrote written bytes, or failed with err.
+func (db *DB[T]) countSync(written int64, err error) {
+	db.io.syncs.Add(1)
+	if err != nil {
+		db.io.failedSyncs.Add(1)
+		return
+	}
+	db.io.bytesWritten.Add(uint64(written))
+}
+
+// countChange counts the bytes a mutation changed: its key, and the size
+// the checks measured of the entry it wrote, if they did.
+func (db *DB[T]) countChange(record OplogRecord[T]) {
+	db.io.changedBytes.Add(uint64(len(record.Key) + record.size))
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ListOrder is the order ListKeys returns keys in.
+type ListOrder int
+
+const (
+	ByKey     ListOrder = iota // Lexical order of the keys
+	ByCreated                  // Created_at of the entries, then key
+	ByUpdated                  // Time the entries were last written, then key; Created_at for those not written since the DB was opened
+)
+
+// DefaultListLimit is the page size of ListKeys when none is given; pages are
+// capped to MaxListLimit keys.
+const (
+	DefaultListLimit = 100
+	MaxListLimit     = 1000
+)
+
+// ListOptions selects the keys ListKeys returns.
+type ListOptions struct {
+	Prefix     string    // Only the keys starting with it
+	Limit      int       // Keys per page, DefaultListLimit when 0
+	Order      ListOrder // ByKey by default
+	Descending bool
+	After      string // Continuation token of the previous page, "" for the first one
+}
+
+// ListPage is a page of keys; Next is the continuation token of the next page,
+// "" after the last one.
+type ListPage struct {
+	Keys []string
+	Next string
+}
+
+// ListKeys lists the keys of the live entries page by page, from indexes
+// kept in order as entries are written, so a page costs its size rather than
+// a sort of every key. Only ByKey narrows a prefix down by search; the time
+// orders filter on it. A continuation token stays valid across writes: the
+// next page starts right after the position of the last key returned, even
+// if that key was removed since.
+func (db *DB[T]) ListKeys(opts ListOptions) (ListPage, error) {
+	if db.closed.Load() {
+		return ListPage{}, dbError.DBAlreadyClosed("")
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+	var after *indexedKey
+	if opts.After != "" {
+		position, err := decodeListToken(opts.After)
+		if err != nil {
+			return ListPage{}, err
+		}
+		after = &position
+	}
+
+	<-db.ready // like the queued operations, wait for the data to be loaded
+	db.dataMu.RLock()
+	defer db.dataMu.RUnlock()
+	keys := db.keyIndex.ordered(opts.Order)
+	var node *skipNode
+	switch {
+	case after != nil && opts.Descending:
+		if node = keys.search(*after); node != nil {
+			node = node.prev
+		} else {
+			node = keys.last()
+		}
+	case after != nil:
+		if node = keys.search(*after); node != nil && node.item == *after {
+			node = node.next[0]
+		}
+	case opts.Descending:
+		node = keys.last()
+	case opts.Order == ByKey:
+		node = keys.search(indexedKey{key: opts.Prefix})
+	default:
+		node = keys.first()
+	}
+	step := func(node *skipNode) *skipNode {
+		if opts.Descending {
+			return node.prev
+		}
+		return node.next[0]
+	}
+
+	page := ListPage{Keys: []string{}}
+	var last indexedKey
+	for ; node != nil; node = step(node) {
+		item := node.item
+		if !strings.HasPrefix(item.key, opts.Prefix) {
+			if opts.Order == ByKey && (item.key > opts.Prefix) == !opts.Descending {
+				break // past the keys with the prefix
+			}
+			continue
+		}
+		if db.isExpired(item.key) {
+			continue
+		}
+		if len(page.Keys) == limit {
+			page.Next = encodeListToken(last)
+			break
+		}
+		page.Keys = append(page.Keys, item.key)
+		last = item
+	}
+	return page, nil
+}
+
+// indexedKey is a key at its position in an order: at is 0 for ByKey and a
+// Unix time in nanoseconds otherwise.
+type indexedKey struct {
+	at  int64
+	key string
+}
+
+func (a indexedKey) less(b indexedKey) bool {
+	if a.at != b.at {
+		return a.at < b.at
+	}
+	return a.key < b.key
+}
+
+// orderedKeys is a skip list of indexedKeys, so that writes keep it in
+// order in O(log n). The first level is doubly linked for descending scans.
+type orderedKeys struct {
+	head  skipNode // sentinel, its item is unused
+	tail  *skipNode
+	level int
+}
+
+type skipNode struct {
+	item indexedKey
+	next []*skipNode
+	prev *skipNode // nil for the first node
+}
+
+const skipMaxLevel = 32
+
+func newOrderedKeys() *orderedKeys {
+	return &orderedKeys{head: skipNode{next: make([]*skipNode, skipMaxLevel)}, level: 1}
+}
+
+// seek returns, on every level, the last node before item.
+func (keys *orderedKeys) seek(item indexedKey) [skipMaxLevel]*skipNode {
+	var before [skipMaxLevel]*skipNode
+	node := &keys.head
+	for level := keys.level - 1; level >= 0; level-- {
+		for node.next[level] != nil && node.next[level].item.less(item) {
+			node = node.next[level]
+		}
+		before[level] = node
+	}
+	return before
+}
+
+// search returns the first node not less than item, nil if there is none.
+func (keys *orderedKeys) search(item indexedKey) *skipNode {
+	return keys.seek(item)[0].next[0]
+}
+
+// first and last return nil when empty.
+func (keys *orderedKeys) first() *skipNode { return keys.head.next[0] }
+func (keys *orderedKeys) last() *skipNode  { return keys.tail }
+
+func (keys *orderedKeys) insert(item indexedKey) {
+	before := keys.seek(item)
+	level := 1
+	for level < skipMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	for ; keys.level < level; keys.level++ {
+		before[keys.level] = &keys.head
+	}
+	node := &skipNode{item: item, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = before[i].next[i]
+		before[i].next[i] = node
+	}
+	if before[0] != &keys.head {
+		node.prev = before[0]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node
+	} else {
+		keys.tail = node
+	}
+}
+
+func (keys *orderedKeys) remove(item indexedKey) {
+	before := keys.seek(item)
+	node := before[0].next[0]
+	if node == nil || node.item != item {
+		return
+	}
+	for i := range node.next {
+		before[i].next[i] = node.next[i]
+	}
+	if node.next[0] != nil {
+		node.next[0].prev = node.prev
+	} else {
+		keys.tail = node.prev
+	}
+}
+
+// keyIndex keeps the live keys in each ListOrder. It is changed along with
+// db.data, under dataMu.
+type keyIndex struct {
+	byKey     *orderedKeys
+	byCreated *orderedKeys
+	byUpdated *orderedKeys
+	times     map[string][2]int64 // created and updated time of every key
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		byKey:     newOrderedKeys(),
+		byCreated: newOrderedKeys(),
+		byUpdated: newOrderedKeys(),
+		times:     make(map[string][2]int64),
+	}
+}
+
+// put indexes key, or moves it to its new times. Only the lists whose order
+// changes are touched: updating a key keeps it in byKey, and usually in
+// byCreated, without allocating nodes for them again.
+func (index *keyIndex) put(key string, created time.Time, updated time.Time) {
+	times := [2]int64{created.UnixNano(), updated.UnixNano()}
+	previous, exists := index.times[key]
+	index.times[key] = times
+	if !exists {
+		index.byKey.insert(indexedKey{key: key})
+	}
+	if !exists || previous[0] != times[0] {
+		if exists {
+			index.byCreated.remove(indexedKey{at: previous[0], key: key})
+		}
+		index.byCreated.insert(indexedKey{at: times[0], key: key})
+	}
+	if !exists || previous[1] != times[1] {
+		if exists {
+			index.byUpdated.remove(indexedKey{at: previous[1], key: key})
+		}
+		index.byUpdated.insert(indexedKey{at: times[1], key: key})
+	}
+}
+
+func (index *keyIndex) remove(key string) {
+	times, exists := index.times[key]
+	if !exists {
+		return
+	}
+	delete(index.times, key)
+	index.byKey.remove(indexedKey{key: key})
+	index.byCreated.remove(indexedKey{at: times[0], key: key})
+	index.byUpdated.remove(indexedKey{at: times[1], key: key})
+}
+
+func (index *keyIndex) ordered(order ListOrder) *orderedKeys {
+	switch order {
+	case ByCreated:
+		return index.byCreated
+	case ByUpdated:
+		return index.byUpdated
+	default:
+		return index.byKey
+	}
+}
+
+func encodeListToken(position indexedKey) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(position.at, 10) + ":" + position.key))
+}
+
+func decodeListToken(token string) (indexedKey, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err == nil {
+		at, key, found := strings.Cut(string(decoded), ":")
+		if nanos, parseErr := strconv.ParseInt(at, 10, 64); found && parseErr == nil {
+			return indexedKey{at: nanos, key: key}, nil
+		}
+	}
+	return indexedKey{}, dbError.InvalidListToken(fmt.Sprintf("%q", token))
+}
@@ -0,0 +1,422 @@
+// Package kvclient talks to a DB exposed by Serve (or HTTPHandler) over
+// HTTP. Its Client mirrors the DB API, with the same entry type, conflict
+// policies and dbErrors, so an application can move from the embedded DB to
+// a networked one by swapping the handle.
+package kvclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds every call but WaitFor, retries included, when
+// WithTimeout isn't given.
+const DefaultTimeout = 30 * time.Second
+
+// DefaultMaxConns is how many connections to the server a Client keeps
+// open without WithConnPool.
+const DefaultMaxConns = 16
+
+// idempotencyHeader carries the key of a write, the same for every attempt.
+const idempotencyHeader = "Idempotency-Key"
+
+// DbData is an entry as the server stores it, the same as the DB's.
+type DbData[T any] struct {
+	Value      T          `json:"value"`
+	Ttl        string     `json:"ttl"` // seconds from Created_at, "" for no expiration (unless Expires_at is set)
+	Created_at time.Time  `json:"created_at"`
+	Expires_at *time.Time `json:"expires_at,omitempty"`
+	Sliding    bool       `json:"sliding,omitempty"`
+	Seq        uint64     `json:"seq,omitempty"` // set by the server
+	Pinned     bool       `json:"pinned,omitempty"`
+	Immutable  bool       `json:"immutable,omitempty"`
+}
+
+// ConflictPolicy says what a create does with the keys that already hold a
+// live entry, as the DB's does.
+type ConflictPolicy int
+
+const (
+	FailAll ConflictPolicy = iota
+	SkipExisting
+	Overwrite
+)
+
+func (policy ConflictPolicy) String() string {
+	switch policy {
+	case SkipExisting:
+		return "skip"
+	case Overwrite:
+		return "overwrite"
+	default:
+		return "fail"
+	}
+}
+
+// Per-key outcomes of a batch create.
+const (
+	BatchCreated     = "created"
+	BatchSkipped     = "skipped"
+	BatchOverwritten = "overwritten"
+	BatchFailed      = "failed"
+	BatchAborted     = "aborted"
+)
+
+// BatchEntryResult is what a batch create did with one key.
+type BatchEntryResult struct {
+	Status string
+	Err    error // Why the entry was rejected, with BatchFailed
+}
+
+// BatchResult reports a batch create key by key.
+type BatchResult struct {
+	Entries map[string]BatchEntryResult
+	Applied int
+	Skipped int
+	Failed  int
+	Aborted int
+}
+
+// ListOptions selects a page of keys, see ListKeys.
+type ListOptions struct {
+	Prefix string
+	Limit  int    // Keys per page, the server's default when 0
+	After  string // Continuation token of the previous page, "" for the first one
+}
+
+// ListPage is a page of keys; Next is the continuation token of the next
+// page, "" after the last one.
+type ListPage struct {
+	Keys []string `json:"keys"`
+	Next string   `json:"next"`
+}
+
+type config struct {
+	token      string
+	httpClient *http.Client
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	retry      RetryPolicy
+	maxConns   int
+	idleConns  time.Duration
+}
+
+// Option configures a Client.
+type Option func(*config)
+
+// WithToken sends token as the bearer token of every request, for a server
+// with an Authorizer.
+func WithToken(token string) Option {
+	return func(c *config) { c.token = token }
+}
+
+// WithHTTPClient makes the Client send its requests through httpClient.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *config) { c.httpClient = httpClient }
+}
+
+// WithTLSConfig sets the TLS settings of the connections, the CA of a
+// self-signed server certificate for instance. It is ignored along with
+// WithHTTPClient.
+func WithTLSConfig(tlsConfig *tls.Config) Option {
+	return func(c *config) { c.tlsConfig = tlsConfig }
+}
+
+// WithConnPool sizes the pool of connections to the server: at most
+// maxConns are open at once, all of them kept for reuse until idle for
+// idleTimeout (0 for the default of net/http). It is ignored along with
+// WithHTTPClient.
+func WithConnPool(maxConns int, idleTimeout time.Duration) Option {
+	return func(c *config) {
+		c.maxConns = maxConns
+		c.idleConns = idleTimeout
+	}
+}
+
+// WithTimeout bounds every call but WaitFor, retries included,
+// DefaultTimeout otherwise.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *config) { c.timeout = timeout }
+}
+
+// Client is a handle on a remote DB of T entries. It is safe for concurrent
+// use.
+type Client[T any] struct {
+	baseURL string
+	config  config
+}
+
+// New returns a Client for the server at baseURL, such as the URL of the
+// Server returned by Serve.
+func New[T any](baseURL string, opts ...Option) (*Client[T], error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, dbError.ErrDBConnectionFailed(fmt.Sprintf("invalid server URL %q", baseURL))
+	}
+	c := config{timeout: DefaultTimeout, retry: DefaultRetryPolicy, maxConns: DefaultMaxConns}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.retry.MaxAttempts = max(c.retry.MaxAttempts, 1)
+	if c.httpClient == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.tlsConfig
+		// every connection kept for reuse, where net/http keeps 2 per host
+		transport.MaxConnsPerHost = c.maxConns
+		transport.MaxIdleConnsPerHost = c.maxConns
+		if c.idleConns > 0 {
+			transport.IdleConnTimeout = c.idleConns
+		}
+		c.httpClient = &http.Client{Transport: transport}
+	}
+	return &Client[T]{baseURL: strings.TrimSuffix(baseURL, "/"), config: c}, nil
+}
+
+// Close releases the idle connections of the Client.
+func (client *Client[T]) Close() error {
+	client.config.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// Create stores value under key; policy says what happens if key holds a
+// live entry already, the server's create policy if none is passed.
+func (client *Client[T]) Create(key string, value DbData[T], policy ...ConflictPolicy) error {
+	return client.call(http.MethodPost, keyPath(key)+policyQuery(policy), value, nil)
+}
+
+// Read returns the entry stored under key.
+func (client *Client[T]) Read(key string) (DbData[T], error) {
+	var entry DbData[T]
+	err := client.call(http.MethodGet, keyPath(key), nil, &entry)
+	return entry, err
+}
+
+// Update replaces the entry stored under key.
+func (client *Client[T]) Update(key string, value DbData[T]) error {
+	return client.call(http.MethodPut, keyPath(key), value, nil)
+}
+
+// Delete removes the entry stored under key.
+func (client *Client[T]) Delete(key string) error {
+	return client.call(http.MethodDelete, keyPath(key), nil, nil)
+}
+
+// BatchCreate creates the entries of batchData at once, under the server's
+// create policy.
+func (client *Client[T]) BatchCreate(batchData map[string]DbData[T]) error {
+	_, err := client.batchCreate(batchData, "")
+	return err
+}
+
+// BatchCreateWithPolicy creates the entries of batchData at once under
+// policy and reports the outcome of every key. The error is set when the
+// batch as a whole failed.
+func (client *Client[T]) BatchCreateWithPolicy(batchData map[string]DbData[T], policy ConflictPolicy) (BatchResult, error) {
+	return client.batchCreate(batchData, policyQuery([]ConflictPolicy{policy}))
+}
+
+func (client *Client[T]) batchCreate(batchData map[string]DbData[T], query string) (BatchResult, error) {
+	var response struct {
+		Entries map[string]struct {
+			Status string    `json:"status"`
+			Err    *apiError `json:"error"`
+		} `json:"entries"`
+		Applied int `json:"applied"`
+		Skipped int `json:"skipped"`
+		Failed  int `json:"failed"`
+		Aborted int `json:"aborted"`
+	}
+	if err := client.call(http.MethodPost, "/v1/batch"+query, batchData, &response); err != nil {
+		return BatchResult{}, err
+	}
+	result := BatchResult{
+		Entries: make(map[string]BatchEntryResult, len(response.Entries)),
+		Applied: response.Applied,
+		Skipped: response.Skipped,
+		Failed:  response.Failed,
+		Aborted: response.Aborted,
+	}
+	for key, entry := range response.Entries {
+		result.Entries[key] = BatchEntryResult{Status: entry.Status, Err: entry.Err.toError()}
+	}
+	return result, nil
+}
+
+// ListKeys lists the keys of the live entries page by page.
+func (client *Client[T]) ListKeys(opts ListOptions) (ListPage, error) {
+	query := url.Values{}
+	if opts.Prefix != "" {
+		query.Set("prefix", opts.Prefix)
+	}
+	if opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+	if opts.After != "" {
+		query.Set("after", opts.After)
+	}
+	path := "/v1/keys"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var page ListPage
+	err := client.call(http.MethodGet, path, nil, &page)
+	return page, err
+}
+
+// Stats returns the stats of the server's DB, as its Stats encodes them.
+func (client *Client[T]) Stats() (map[string]any, error) {
+	var stats map[string]any
+	err := client.call(http.MethodGet, "/v1/stats", nil, &stats)
+	return stats, err
+}
+
+// WaitFor returns the entry stored under key, waiting until it is created or
+// updated if there is none, like the DB's WaitFor. It fails with ctx's
+// error once ctx is done.
+func (client *Client[T]) WaitFor(ctx context.Context, key string) (DbData[T], error) {
+	var entry DbData[T]
+	err := client.do(ctx, http.MethodGet, keyPath(key)+"?wait=true", nil, &entry)
+	if err != nil && ctx.Err() != nil {
+		return DbData[T]{}, ctx.Err()
+	}
+	return entry, err
+}
+
+// call runs a request bounded by the timeout of the Client.
+func (client *Client[T]) call(method string, path string, body any, out any) error {
+	ctx, cancel := context.WithTimeout(context.Background(), client.config.timeout)
+	defer cancel()
+	return client.do(ctx, method, path, body, out)
+}
+
+// do sends the request, retrying it as the RetryPolicy says, and decodes
+// the response into out, or the error the server answered with.
+func (client *Client[T]) do(ctx context.Context, method string, path string, body any, out any) error {
+	var encoded []byte
+	if body != nil {
+		var err error
+		if encoded, err = json.Marshal(body); err != nil {
+			return dbError.InvalidRequest(fmt.Sprintf("%s", err))
+		}
+	}
+	idempotencyKey := ""
+	if method != http.MethodGet {
+		idempotencyKey = newIdempotencyKey()
+	}
+	policy := client.config.retry
+	for attempt := 1; ; attempt++ {
+		response, err := client.send(ctx, method, path, encoded, idempotencyKey)
+		retryable := err != nil && ctx.Err() == nil
+		if err == nil {
+			retryable = retryableStatus(response.StatusCode)
+		}
+		if !retryable || attempt == policy.MaxAttempts {
+			if err != nil {
+				return err
+			}
+			defer response.Body.Close()
+			return decodeResponse(response, out)
+		}
+		wait := policy.backoff(attempt, response)
+		if response != nil {
+			io.Copy(io.Discard, response.Body) // so the connection is reused
+			response.Body.Close()
+		}
+		if sleep(ctx, wait) != nil {
+			if err != nil {
+				return err
+			}
+			return dbError.ErrDBConnectionFailed(fmt.Sprintf("%s, retry cut short: %s", response.Status, ctx.Err()))
+		}
+	}
+}
+
+// send makes one attempt of a request.
+func (client *Client[T]) send(ctx context.Context, method string, path string, body []byte, idempotencyKey string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, client.baseURL+path, reader)
+	if err != nil {
+		return nil, dbError.ErrDBConnectionFailed(fmt.Sprintf("%s", err))
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if client.config.token != "" {
+		request.Header.Set("Authorization", "Bearer "+client.config.token)
+	}
+	if idempotencyKey != "" {
+		request.Header.Set(idempotencyHeader, idempotencyKey)
+	}
+	response, err := client.config.httpClient.Do(request)
+	if err != nil {
+		return nil, dbError.ErrDBConnectionFailed(fmt.Sprintf("%s", err))
+	}
+	return response, nil
+}
+
+// decodeResponse decodes a successful response into out, or returns the
+// error of a failed one.
+func decodeResponse(response *http.Response, out any) error {
+	if response.StatusCode >= 300 {
+		return responseError(response)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+		return dbError.ErrDBConnectionFailed(fmt.Sprintf("decoding the response: %s", err))
+	}
+	return nil
+}
+
+// apiError is how the server sends a dbError.
+type apiError struct {
+	Message string `json:"message"`
+	Info    string `json:"info"`
+}
+
+func (e *apiError) toError() error {
+	if e == nil {
+		return nil
+	}
+	return dbError.NewDBError(e.Message, e.Info)
+}
+
+// responseError rebuilds the dbError of a failed response, so that it reads
+// as the embedded DB's would.
+func responseError(response *http.Response) error {
+	contents, _ := io.ReadAll(io.LimitReader(response.Body, 64*1024))
+	var decoded apiError
+	if err := json.Unmarshal(contents, &decoded); err != nil || decoded.Message == "" {
+		return dbError.ErrDBConnectionFailed(fmt.Sprintf("%s: %s", response.Status, bytes.TrimSpace(contents)))
+	}
+	return decoded.toError()
+}
+
+func keyPath(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return "/v1/keys/" + strings.Join(segments, "/")
+}
+
+func policyQuery(policy []ConflictPolicy) string {
+	if len(policy) == 0 {
+		return ""
+	}
+	return "?policy=" + policy[0].String()
+}
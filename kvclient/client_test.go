@@ -0,0 +1,349 @@
+package kvclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"local-key-value-DB/dbError"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testVal struct {
+	Name string `json:"name"`
+	Age  int    `json:"age"`
+}
+
+// fakeServer serves the /v1 API of Serve from a map, with the response to
+// every Idempotency-Key remembered as the real one does.
+type fakeServer struct {
+	mu       sync.Mutex
+	entries  map[string]DbData[testVal]
+	replies  map[string]*httptest.ResponseRecorder
+	requests []*http.Request
+	// fail answers the next requests with it instead of serving them, after
+	// applying the writes when apply is set, as a dropped response would
+	fail  []int
+	apply bool
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *httptest.Server) {
+	fake := &fakeServer{entries: make(map[string]DbData[testVal]), replies: make(map[string]*httptest.ResponseRecorder)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (fake *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fake.mu.Lock()
+	fake.requests = append(fake.requests, r)
+	if len(fake.fail) > 0 {
+		status := fake.fail[0]
+		fake.fail = fake.fail[1:]
+		if fake.apply {
+			fake.serve(httptest.NewRecorder(), r)
+		}
+		fake.mu.Unlock()
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		writeTestJSON(w, status, apiError{Message: http.StatusText(status)})
+		return
+	}
+	defer fake.mu.Unlock()
+	fake.serve(w, r)
+}
+
+// serve answers r, replaying the response to a repeated Idempotency-Key.
+func (fake *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(idempotencyHeader)
+	if reply, ok := fake.replies[key]; ok && key != "" {
+		w.WriteHeader(reply.Code)
+		w.Write(reply.Body.Bytes())
+		return
+	}
+	recorder := httptest.NewRecorder()
+	fake.route(recorder, r)
+	if key != "" {
+		fake.replies[key] = recorder
+	}
+	w.WriteHeader(recorder.Code)
+	w.Write(recorder.Body.Bytes())
+}
+
+func (fake *fakeServer) route(w http.ResponseWriter, r *http.Request) {
+	key, isKey := strings.CutPrefix(r.URL.Path, "/v1/keys/")
+	switch {
+	case r.URL.Path == "/v1/keys" && r.Method == http.MethodGet:
+		page := ListPage{Keys: []string{}}
+		for key := range fake.entries {
+			if strings.HasPrefix(key, r.URL.Query().Get("prefix")) {
+				page.Keys = append(page.Keys, key)
+			}
+		}
+		slices.Sort(page.Keys)
+		writeTestJSON(w, http.StatusOK, page)
+	case r.URL.Path == "/v1/batch" && r.Method == http.MethodPost:
+		var batch map[string]DbData[testVal]
+		json.NewDecoder(r.Body).Decode(&batch)
+		type entryResult struct {
+			Status string `json:"status"`
+		}
+		response := struct {
+			Entries map[string]entryResult `json:"entries"`
+			Applied int                    `json:"applied"`
+			Skipped int                    `json:"skipped"`
+		}{Entries: make(map[string]entryResult)}
+		for key, entry := range batch {
+			if _, exists := fake.entries[key]; exists && r.URL.Query().Get("policy") == "skip" {
+				response.Entries[key] = entryResult{Status: BatchSkipped}
+				response.Skipped++
+				continue
+			}
+			fake.entries[key] = entry
+			response.Entries[key] = entryResult{Status: BatchCreated}
+			response.Applied++
+		}
+		writeTestJSON(w, http.StatusOK, response)
+	case !isKey:
+		writeTestJSON(w, http.StatusNotFound, apiError{Message: "not found"})
+	case r.Method == http.MethodGet:
+		entry, exists := fake.entries[key]
+		if !exists && r.URL.Query().Get("wait") == "true" {
+			fake.mu.Unlock()
+			for !exists && r.Context().Err() == nil {
+				time.Sleep(5 * time.Millisecond)
+				fake.mu.Lock()
+				entry, exists = fake.entries[key]
+				fake.mu.Unlock()
+			}
+			fake.mu.Lock()
+		}
+		if !exists {
+			writeTestJSON(w, http.StatusNotFound, toTestError(dbError.KeyNotFound(key)))
+			return
+		}
+		writeTestJSON(w, http.StatusOK, entry)
+	case r.Method == http.MethodPost, r.Method == http.MethodPut:
+		_, exists := fake.entries[key]
+		if r.Method == http.MethodPost && exists {
+			if r.URL.Query().Get("policy") != "skip" {
+				writeTestJSON(w, http.StatusConflict, toTestError(dbError.EntryAlreadyExists(key)))
+			}
+			return
+		}
+		if r.Method == http.MethodPut && !exists {
+			writeTestJSON(w, http.StatusNotFound, toTestError(dbError.KeyNotFound(key)))
+			return
+		}
+		var entry DbData[testVal]
+		json.NewDecoder(r.Body).Decode(&entry)
+		fake.entries[key] = entry
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case r.Method == http.MethodDelete:
+		if _, exists := fake.entries[key]; !exists {
+			writeTestJSON(w, http.StatusNotFound, toTestError(dbError.KeyNotFound(key)))
+			return
+		}
+		delete(fake.entries, key)
+	}
+}
+
+func (fake *fakeServer) put(key string, entry DbData[testVal]) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.entries[key] = entry
+}
+
+// failNext answers the next requests with statuses, after applying them if
+// apply is set.
+func (fake *fakeServer) failNext(apply bool, statuses ...int) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.fail = statuses
+	fake.apply = apply
+	fake.requests = nil
+}
+
+func (fake *fakeServer) sent() []*http.Request {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return slices.Clone(fake.requests)
+}
+
+func toTestError(err error) apiError {
+	var dbErr *dbError.DBError
+	errors.As(err, &dbErr)
+	return apiError{Message: dbErr.Message, Info: dbErr.AdditionalInfo}
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"", "localhost:8080", "ftp://host", "http://"} {
+		_, err := New[testVal](baseURL)
+		require.ErrorContains(t, err, dbError.ErrDBConnectionFailed("").(*dbError.DBError).Message, baseURL)
+	}
+	client, err := New[testVal]("http://localhost:8080/")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8080", client.baseURL)
+}
+
+func TestClient(t *testing.T) {
+	fake, server := newFakeServer(t)
+	client, err := New[testVal](server.URL, WithToken("secret"))
+	require.NoError(t, err)
+	defer client.Close()
+
+	entry := DbData[testVal]{Value: testVal{Name: "ann", Age: 1}, Created_at: time.Now()}
+	require.NoError(t, client.Create("user/1", entry))
+	// the errors read as the embedded DB's
+	require.EqualError(t, client.Create("user/1", entry), dbError.EntryAlreadyExists("user/1").Error())
+	require.NoError(t, client.Create("user/1", entry, SkipExisting))
+	require.Equal(t, "/v1/keys/user/1?policy=skip", fake.sent()[2].URL.RequestURI())
+	require.Equal(t, "Bearer secret", fake.sent()[2].Header.Get("Authorization"))
+	read, err := client.Read("user/1")
+	require.NoError(t, err)
+	require.Equal(t, "ann", read.Value.Name)
+	entry.Value.Name = "bob"
+	require.NoError(t, client.Update("user/1", entry))
+	read, err = client.Read("user/1")
+	require.NoError(t, err)
+	require.Equal(t, "bob", read.Value.Name)
+	require.EqualError(t, client.Update("user/9", entry), dbError.KeyNotFound("user/9").Error())
+
+	result, err := client.BatchCreateWithPolicy(map[string]DbData[testVal]{
+		"user/1": entry,
+		"user/2": entry,
+	}, SkipExisting)
+	require.NoError(t, err)
+	require.Equal(t, BatchSkipped, result.Entries["user/1"].Status)
+	require.Equal(t, BatchCreated, result.Entries["user/2"].Status)
+	require.Equal(t, 1, result.Applied)
+	page, err := client.ListKeys(ListOptions{Prefix: "user/"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user/1", "user/2"}, page.Keys)
+
+	require.NoError(t, client.Delete("user/2"))
+	_, err = client.Read("user/2")
+	require.ErrorContains(t, err, dbError.KeyNotFound("").Error())
+
+	// the segments of a key are escaped, its slashes kept
+	require.NoError(t, client.Create("a b/c?d", entry))
+	require.Equal(t, "/v1/keys/a%20b/c%3Fd", fake.sent()[len(fake.sent())-1].URL.EscapedPath())
+
+	waited := make(chan DbData[testVal], 1)
+	go func() {
+		entry, err := client.WaitFor(context.Background(), "user/3")
+		if err == nil {
+			waited <- entry
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	fake.put("user/3", DbData[testVal]{Value: testVal{Name: "cy"}})
+	select {
+	case entry := <-waited:
+		require.Equal(t, "cy", entry.Value.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("WaitFor didn't return")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = client.WaitFor(ctx, "user/4")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestClientRetry(t *testing.T) {
+	fake, server := newFakeServer(t)
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond}
+	client, err := New[testVal](server.URL, WithRetry(policy), WithConnPool(4, time.Minute))
+	require.NoError(t, err)
+	defer client.Close()
+	entry := DbData[testVal]{Value: testVal{Name: "ann"}, Created_at: time.Now()}
+
+	// the retry gets the response of the create applied by the first attempt,
+	// sending the same idempotency key
+	fake.failNext(true, http.StatusServiceUnavailable)
+	require.NoError(t, client.Create("key", entry))
+	sent := fake.sent()
+	require.Len(t, sent, 2)
+	require.NotEmpty(t, sent[0].Header.Get(idempotencyHeader))
+	require.Equal(t, sent[0].Header.Get(idempotencyHeader), sent[1].Header.Get(idempotencyHeader))
+
+	// a new write is a new key
+	require.ErrorContains(t, client.Create("key", entry), dbError.EntryAlreadyExists("").Error())
+
+	// 429, 502 and 504 are retried too, reads without an idempotency key
+	fake.failNext(false, http.StatusTooManyRequests, http.StatusBadGateway)
+	read, err := client.Read("key")
+	require.NoError(t, err)
+	require.Equal(t, "ann", read.Value.Name)
+	require.Len(t, fake.sent(), 3)
+	require.Empty(t, fake.sent()[0].Header.Get(idempotencyHeader))
+	fake.failNext(false, http.StatusGatewayTimeout, http.StatusGatewayTimeout, http.StatusGatewayTimeout)
+	_, err = client.Read("key")
+	require.ErrorContains(t, err, http.StatusText(http.StatusGatewayTimeout))
+	require.Len(t, fake.sent(), 3)
+
+	// the other failures aren't
+	fake.failNext(false, http.StatusInternalServerError)
+	_, err = client.Read("key")
+	require.Error(t, err)
+	require.Len(t, fake.sent(), 1)
+
+	noRetry, err := New[testVal](server.URL, WithRetry(RetryPolicy{MaxAttempts: 1}))
+	require.NoError(t, err)
+	fake.failNext(false, http.StatusServiceUnavailable)
+	_, err = noRetry.Read("key")
+	require.ErrorContains(t, err, http.StatusText(http.StatusServiceUnavailable))
+	_, err = noRetry.Read("key")
+	require.NoError(t, err)
+}
+
+func TestClientRetryCutShort(t *testing.T) {
+	var attempts atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	// a Retry-After within the cap is waited, so the timeout ends the retries
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Millisecond, MaxBackoff: time.Minute}
+	client, err := New[testVal](server.URL, WithRetry(policy), WithTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	_, err = client.Read("key")
+	require.ErrorContains(t, err, "retry cut short")
+	require.Equal(t, int32(1), attempts.Load())
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for retry, limit := range []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		if retry == 0 {
+			continue
+		}
+		wait := policy.backoff(retry, nil)
+		require.LessOrEqual(t, wait, limit)
+		require.GreaterOrEqual(t, wait, limit/2)
+	}
+	response := &http.Response{Header: http.Header{"Retry-After": {"1"}}}
+	require.Equal(t, time.Second, policy.backoff(1, response))
+	// past the cap, the backoff of the policy is kept
+	response.Header.Set("Retry-After", "120")
+	require.LessOrEqual(t, policy.backoff(1, response), 100*time.Millisecond)
+}
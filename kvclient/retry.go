@@ -0,0 +1,76 @@
+package kvclient
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy says how a Client retries the requests that failed for a
+// transient reason: the server unreachable or the connection dropped, or a
+// 429, 502, 503 or 504 answer. Writes are retried as well, safely: they
+// carry an idempotency key the server answers a repeat of with the response
+// of the first attempt, rather than applying it twice.
+type RetryPolicy struct {
+	MaxAttempts    int           // Attempts in total, 1 for no retry
+	InitialBackoff time.Duration // Wait before the first retry
+	MaxBackoff     time.Duration // Cap of the wait, which doubles after every retry
+}
+
+// DefaultRetryPolicy is the policy of a Client without WithRetry.
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 3, InitialBackoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second}
+
+// WithRetry sets the retry policy of the Client; RetryPolicy{MaxAttempts: 1}
+// turns retries off.
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *config) { c.retry = policy }
+}
+
+// backoff returns the wait before retry number retry (from 1): the initial
+// backoff doubled every time up to the cap, less a random jitter of up to
+// half of it so that clients failing together don't retry together. A
+// Retry-After of the response is honored if it is within the cap.
+func (policy RetryPolicy) backoff(retry int, response *http.Response) time.Duration {
+	if response != nil {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+			if wait := time.Duration(seconds) * time.Second; wait <= policy.MaxBackoff {
+				return wait
+			}
+		}
+	}
+	wait := float64(policy.InitialBackoff) * math.Pow(2, float64(retry-1))
+	wait = min(wait, float64(policy.MaxBackoff))
+	return time.Duration(wait/2 + mrand.Float64()*wait/2)
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// newIdempotencyKey returns a random key for the attempts of one write.
+func newIdempotencyKey() string {
+	key := make([]byte, 16)
+	rand.Read(key)
+	return hex.EncodeToString(key)
+}
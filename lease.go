@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"time"
+)
+
+// leasePrefix marks the keys holding leases.
+const leasePrefix = "lease."
+
+// Lease is a named lock held until it expires or is released, so that the
+// processes sharing a database can coordinate work through it. It is stored
+// as the entry "lease.<name>", expiring with the lease and owned by a random
+// token; Renew and Release only apply while the entry still holds that token
+// (compare-and-set through the write worker), so a holder whose lease expired
+// and was acquired by another can't take it back.
+type Lease[T any] struct {
+	db        *DB[T]
+	Name      string
+	Token     string
+	ExpiresAt time.Time
+}
+
+// AcquireLease takes the lease name for ttl. It fails with LeaseHeld while
+// another holder's lease hasn't expired.
+func (db *DB[T]) AcquireLease(name string, ttl time.Duration) (*Lease[T], error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	lease := &Lease[T]{db: db, Name: name, Token: token}
+	if err := lease.submit("acquireLease", ttl); err != nil {
+		return nil, err
+	}
+	return lease, nil
+}
+
+// Renew pushes the expiration of the lease to ttl from now. It fails with
+// LeaseLost if the lease expired or was released meanwhile.
+func (lease *Lease[T]) Renew(ttl time.Duration) error {
+	return lease.submit("renewLease", ttl)
+}
+
+// Release gives the lease up before it expires. It fails with LeaseLost if
+// the lease isn't held anymore.
+func (lease *Lease[T]) Release() error {
+	return lease.submit("releaseLease", 0)
+}
+
+func (lease *Lease[T]) submit(action string, ttl time.Duration) error {
+	db := lease.db
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	entry := DbData[T]{Owner: lease.Token, Created_at: time.Now()}
+	if action != "releaseLease" {
+		if ttl <= 0 {
+			return dbError.InvalidTTL(fmt.Sprintf("lease ttl %v is not positive", ttl))
+		}
+		expiresAt := entry.Created_at.Add(ttl)
+		entry.Expires_at = &expiresAt
+	}
+	op := operation[T]{
+		action:   action,
+		key:      leasePrefix + lease.Name,
+		value:    entry,
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submitWrite(op)
+	if result.err == nil && entry.Expires_at != nil {
+		lease.ExpiresAt = *entry.Expires_at
+	}
+	return result.err
+}
+
+// randomToken returns 32 random hex digits, unique across processes.
+func randomToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", dbError.NewDBError("Failed to generate random token", err.Error())
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// holdsLease reports whether key holds an unexpired lease owned by token.
+func (db *DB[T]) holdsLease(key string, token string) bool {
+	entry, exists := db.data.get(key)
+	return exists && entry.Owner == token && !db.isExpired(key)
+}
+
+// acquireLease stores the lease entry unless an unexpired lease is held by
+// someone else; an expired one not purged yet is replaced.
+func (db *DB[T]) acquireLease(key string, entry DbData[T]) error {
+	if current, exists := db.data.get(key); exists && !db.isExpired(key) {
+		if current.Owner == "" {
+			return dbError.EntryAlreadyExists(fmt.Sprintf("key %s is not a lease", key))
+		}
+		return dbError.LeaseHeld(fmt.Sprintf("key : %s", key))
+	}
+	entrySize, err := db.validateEntry(key, entry)
+	if err != nil {
+		return err
+	}
+	isSpaceAvailable, _, spaceErr := db.checkAvailableSpace(entrySize)
+	if spaceErr != nil {
+		return spaceErr
+	}
+	if !isSpaceAvailable {
+		return dbError.NotAvailabeSpace("")
+	}
+	return db.putLease(key, entry, OplogCreate)
+}
+
+func (db *DB[T]) renewLease(key string, entry DbData[T]) error {
+	if !db.holdsLease(key, entry.Owner) {
+		return dbError.LeaseLost(fmt.Sprintf("key : %s", key))
+	}
+	renewed := db.data.entry(key)
+	renewed.Expires_at = entry.Expires_at
+	return db.putLease(key, renewed, OplogTTL)
+}
+
+// releaseLease drops the lease entry, never as a tombstone: a released lease
+// is free to acquire again.
+func (db *DB[T]) releaseLease(key string, token string) error {
+	if !db.holdsLease(key, token) {
+		return dbError.LeaseLost(fmt.Sprintf("key : %s", key))
+	}
+	previous := db.data.entry(key)
+	db.removeEntry(key)
+	if err := db.sync(); err != nil {
+		db.setEntry(key, previous) // rollback
+		return err
+	}
+	db.logOps(OplogRecord[T]{Op: OplogDelete, Key: key})
+	return nil
+}
+
+func (db *DB[T]) putLease(key string, entry DbData[T], op string) error {
+	previous, existed := db.data.get(key)
+	db.setEntry(key, entry)
+	if err := db.sync(); err != nil {
+		// rollback
+		if existed {
+			db.setEntry(key, previous)
+		} else {
+			db.removeEntry(key)
+		}
+		return err
+	}
+	db.logOps(entryRecord(op, key, entry))
+	return nil
+}
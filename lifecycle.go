@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// HandleSignals closes the DB on SIGINT or SIGTERM, so that a simple program
+// built on it doesn't leave a stale lock or unsynced updates behind when
+// stopped. Close stops accepting operations, lets the write worker finish
+// the one it is on, flushes what WithWriteCoalescing deferred and releases
+// the lock. The returned channel gets Close's error once the DB is closed
+// that way, then is closed; it is closed without a value if ctx is done
+// first, in which case the signals are handled as before the call.
+func (db *DB[T]) HandleSignals(ctx context.Context) <-chan error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	closed := make(chan error, 1)
+	go func() {
+		defer close(closed)
+		defer signal.Stop(signals)
+		select {
+		case <-signals:
+			closed <- db.Close()
+		case <-ctx.Done():
+		}
+	}()
+	return closed
+}
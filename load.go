@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"strconv"
+	"time"
+)
+
+// LoadOptions configures Load.
+type LoadOptions struct {
+	Format    string         // "csv" or "json": a JSON array of objects or one object per line
+	KeyColumn string         // Column, or field, holding the key of each row
+	TTLColumn string         // Column holding the TTL in seconds, "" for none; empty cells mean no expiration
+	BatchSize int            // Rows per BatchCreate, 100 when 0, BatchLimit at most
+	Policy    ConflictPolicy // SkipExisting or Overwrite; FailAll counts as SkipExisting
+	Progress  func(LoadReport)
+}
+
+// LoadFailure is a row Load couldn't store.
+type LoadFailure struct {
+	Row int    `json:"row"` // From 1, the header of a CSV file not counted
+	Key string `json:"key,omitempty"`
+	Err string `json:"error"`
+}
+
+// LoadReport sums up a Load, or its progress so far.
+type LoadReport struct {
+	Rows      int           `json:"rows"`
+	Loaded    int           `json:"loaded"`
+	Skipped   int           `json:"skipped"` // Keys that existed, with SkipExisting
+	Failed    int           `json:"failed"`
+	BytesRead int64         `json:"bytes_read"`
+	Elapsed   time.Duration `json:"elapsed_ns"`
+	Failures  []LoadFailure `json:"failures"`
+}
+
+// loadRow is a row ready to store: its value is the row as a JSON object,
+// without the key and TTL columns.
+type loadRow struct {
+	row   int
+	key   string
+	entry DbData[json.RawMessage]
+}
+
+// Load streams the rows of r into db, BatchSize rows per BatchCreate, as
+// JSON objects. Every row is checked on its own: a row without a key, with an
+// invalid TTL, repeating the key of an earlier row or rejected by the DB is
+// reported in Failures while the others are stored. Progress, if set, is
+// called after every batch. The error is only set when the input can't be
+// read any further or the DB fails as a whole.
+func Load(db *DB[json.RawMessage], r io.Reader, opts LoadOptions) (LoadReport, error) {
+	started := time.Now()
+	counter := &countingReader{reader: r}
+	var next func() (map[string]any, error)
+	switch opts.Format {
+	case "csv":
+		next = csvRows(counter)
+	case "json":
+		next = jsonRows(counter)
+	default:
+		return LoadReport{}, dbError.InvalidRequest(fmt.Sprintf("format %q is neither csv nor json", opts.Format))
+	}
+	if opts.KeyColumn == "" {
+		return LoadReport{}, dbError.InvalidRequest("no key column")
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+	batchSize = min(batchSize, BatchLimit)
+	policy := opts.Policy
+	if policy == FailAll {
+		policy = SkipExisting // one failing row must not fail its whole batch
+	}
+
+	var report LoadReport
+	seen := make(map[string]int) // row of every key, to report duplicates
+	batch := make([]loadRow, 0, batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		entries := make(map[string]DbData[json.RawMessage], len(batch))
+		for _, row := range batch {
+			entries[row.key] = row.entry
+		}
+		result := db.BatchCreateWithPolicy(entries, policy)
+		if result.Err != nil && db.closed.Load() {
+			return result.Err
+		}
+		for _, row := range batch {
+			outcome := result.Entries[row.key]
+			switch {
+			case result.Err != nil:
+				report.fail(row.row, row.key, result.Err)
+			case outcome.Status == BatchCreated || outcome.Status == BatchOverwritten:
+				report.Loaded++
+			case outcome.Status == BatchSkipped:
+				report.Skipped++
+			default:
+				report.fail(row.row, row.key, outcome.Err)
+			}
+		}
+		batch = batch[:0]
+		report.BytesRead = counter.read
+		report.Elapsed = time.Since(started)
+		if opts.Progress != nil {
+			opts.Progress(report)
+		}
+		return nil
+	}
+
+	for {
+		fields, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var rowErr *loadRowError
+		if err != nil && !errors.As(err, &rowErr) {
+			// the input can't be read any further
+			if flushErr := flush(); flushErr != nil {
+				return report, flushErr
+			}
+			return report, dbError.InvalidRequest(fmt.Sprintf("after row %d: %s", report.Rows, err))
+		}
+		report.Rows++
+		if err != nil {
+			report.fail(report.Rows, "", rowErr.err)
+			continue
+		}
+		row, err := toLoadRow(report.Rows, fields, opts)
+		if err == nil {
+			if first, duplicate := seen[row.key]; duplicate {
+				err = dbError.EntryAlreadyExists(fmt.Sprintf("key %s repeats row %d", row.key, first))
+			}
+		}
+		if err != nil {
+			report.fail(report.Rows, row.key, err)
+			continue
+		}
+		seen[row.key] = row.row
+		batch = append(batch, row)
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+	report.BytesRead = counter.read
+	report.Elapsed = time.Since(started)
+	return report, nil
+}
+
+func (report *LoadReport) fail(row int, key string, err error) {
+	report.Failed++
+	report.Failures = append(report.Failures, LoadFailure{Row: row, Key: key, Err: err.Error()})
+}
+
+// toLoadRow takes the key and TTL out of the fields of a row.
+func toLoadRow(number int, fields map[string]any, opts LoadOptions) (loadRow, error) {
+	row := loadRow{row: number}
+	key, err := cellString(fields[opts.KeyColumn])
+	if err != nil || key == "" {
+		return row, dbError.InvalidRequest(fmt.Sprintf("no key in column %q", opts.KeyColumn))
+	}
+	row.key = key
+	delete(fields, opts.KeyColumn)
+	row.entry.Created_at = time.Now()
+	if opts.TTLColumn != "" {
+		ttl, err := cellString(fields[opts.TTLColumn])
+		if err != nil {
+			return row, dbError.InvalidTTL(fmt.Sprintf("ttl : %v", fields[opts.TTLColumn]))
+		}
+		if ttl != "" {
+			if seconds, err := strconv.Atoi(ttl); err != nil || seconds <= 0 {
+				return row, dbError.InvalidTTL(fmt.Sprintf("ttl : %q", ttl))
+			}
+		}
+		row.entry.Ttl = ttl
+		delete(fields, opts.TTLColumn)
+	}
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return row, dbError.InvalidRequest(fmt.Sprintf("%s", err))
+	}
+	row.entry.Value = value
+	return row, nil
+}
+
+// cellString returns a key or TTL cell as a string: CSV cells are strings
+// already, JSON ones may be numbers.
+func cellString(cell any) (string, error) {
+	switch cell := cell.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return cell, nil
+	case json.Number:
+		return cell.String(), nil
+	default:
+		return "", fmt.Errorf("not a string or a number: %v", cell)
+	}
+}
+
+// loadRowError is a row that can't be parsed, after which the next rows
+// still can.
+type loadRowError struct {
+	err error
+}
+
+func (e *loadRowError) Error() string {
+	return e.err.Error()
+}
+
+// csvRows returns the rows of a CSV file with a header, one at a time, as
+// column name to cell maps.
+func csvRows(r io.Reader) func() (map[string]any, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	var header []string
+	return func() (map[string]any, error) {
+		if header == nil {
+			record, err := reader.Read()
+			if err != nil {
+				return nil, err
+			}
+			header = append([]string(nil), record...)
+		}
+		record, err := reader.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+				return nil, &loadRowError{dbError.InvalidRequest(parseErr.Error())}
+			}
+			return nil, err
+		}
+		fields := make(map[string]any, len(header))
+		for i, column := range header {
+			fields[column] = record[i]
+		}
+		return fields, nil
+	}
+}
+
+// jsonRows returns the objects of a JSON array, or of a stream of objects
+// such as one per line, one at a time.
+func jsonRows(r io.Reader) func() (map[string]any, error) {
+	buffered := bufio.NewReader(r)
+	decoder := json.NewDecoder(buffered)
+	decoder.UseNumber()
+	started, inArray := false, false
+	return func() (map[string]any, error) {
+		if !started {
+			started = true
+			first, err := firstNonSpace(buffered)
+			if err != nil {
+				return nil, err
+			}
+			if first == '[' {
+				inArray = true
+				decoder.Token()
+			}
+		}
+		if inArray && !decoder.More() {
+			if _, err := decoder.Token(); err != nil { // closing ']'
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		fields, ok := value.(map[string]any)
+		if !ok {
+			return nil, &loadRowError{dbError.InvalidRequest(fmt.Sprintf("row is not an object: %v", value))}
+		}
+		return fields, nil
+	}
+}
+
+// firstNonSpace peeks at the first byte of r that isn't white space.
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// countingReader counts the bytes read through it, for the progress.
+type countingReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (counter *countingReader) Read(p []byte) (int, error) {
+	n, err := counter.reader.Read(p)
+	counter.read += int64(n)
+	return n, err
+}
@@ -3,19 +3,45 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"local-key-value-DB/dbError"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 )
 
+// LocalStorage persists the data as a single JSON file guarded by a flock'd
+// ".lock" file next to it. NewBinaryLocalStorage uses a gob encoded ".bin"
+// file instead, which stores []byte values raw rather than base64.
+// NewDirLocalStorage keeps the file, its lock and the database's other files
+// in a directory of their own.
 type LocalStorage[T any] struct {
 	filePath string
+	lockPath string // "" for filePath+".lock"
+	name     string // file name replicas use, "" for the base of filePath
+	dbDir    string // database directory, "" for the single-file layout
 	lockFile *os.File
+	binary   bool
+	header   *schemaHeader // Of the file when loaded, nil if it had none
+	seq      uint64        // Checkpoint sequence number to write in the header, set by the DB
+
+	syncMu   sync.Mutex      // Protects file, lastSize and encoded
+	file     *os.File        // Kept open from one Sync to the next, closed by Unlock
+	lastSize int             // Of the file last synced, to size the next buffer
+	encoded  *encodedEntries // JSON of the entries last synced, nil until the first sync
+}
+
+func NewLocalStorage[T any](fileName string, dir string) (*LocalStorage[T], error) {
+	return newLocalStorage[T](fileName, dir, false)
 }
 
-func NewLocalStorage[T any](fileName string, dir string, dataToLoad *map[string]DbData[T]) (*LocalStorage[T], error) {
+func NewBinaryLocalStorage[T any](fileName string, dir string) (*LocalStorage[T], error) {
+	return newLocalStorage[T](fileName, dir, true)
+}
+
+func newLocalStorage[T any](fileName string, dir string, binary bool) (*LocalStorage[T], error) {
 	if len(strings.TrimSpace(dir)) == 0 {
 		curDir, osErr := os.Getwd()
 		if osErr != nil {
@@ -23,16 +49,35 @@ func NewLocalStorage[T any](fileName string, dir string, dataToLoad *map[string]
 		}
 		dir = curDir
 	}
-	fileName, fileErr := ValidateAndFixJSONFilename(fileName)
+	extension := ".json"
+	if binary {
+		extension = ".bin"
+	}
+	fileName, fileErr := ValidateAndFixFilename(fileName, extension)
 	if fileErr != nil {
 		return nil, fileErr
 	}
-	filePath := filepath.Join(dir, fileName)
+	return openLocalStorage[T](filepath.Join(dir, fileName), binary)
+}
+
+// NewLocalStorageAtPath uses the file at path as is, in any directory and
+// with any name. A ".bin" file is gob encoded, anything else is JSON. The
+// directory must exist, it fails with DirectoryNotExists otherwise; the file
+// is created if missing.
+func NewLocalStorageAtPath[T any](path string) (*LocalStorage[T], error) {
+	if len(strings.TrimSpace(path)) == 0 {
+		return nil, dbError.InvalidFileName("empty path")
+	}
+	return openLocalStorage[T](path, filepath.Ext(path) == ".bin")
+}
+
+func openLocalStorage[T any](filePath string, binary bool) (*LocalStorage[T], error) {
 	localStorage := &LocalStorage[T]{
 		filePath: filePath,
+		binary:   binary,
 	}
 
-	fileExists, err := localStorage.fileExists(dir)
+	fileExists, err := localStorage.fileExists(filepath.Dir(filePath))
 	if err != nil {
 		return nil, err
 	}
@@ -40,32 +85,13 @@ func NewLocalStorage[T any](fileName string, dir string, dataToLoad *map[string]
 		if err := localStorage.createFile(); err != nil {
 			return nil, dbError.FailedToCreateFile("")
 		}
-		if err := localStorage.acquireLock(); err != nil {
-			return nil, dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
-		}
-	} else {
-		if err := localStorage.acquireLock(); err != nil {
-			return nil, dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
-		}
-		if err := localStorage.Load(dataToLoad); err != nil {
-			return nil, dbError.FailedToLoadFile("")
-		}
 	}
 	return localStorage, nil
 }
 
+// createFile creates the file in its directory, which fileExists checked
+// exists: no directory is ever created for it.
 func (ls *LocalStorage[T]) createFile() error {
-	dir := filepath.Dir(ls.filePath)
-
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err := os.MkdirAll(dir, os.ModePerm)
-		if err != nil {
-			return dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
-		}
-	} else if err != nil {
-		return dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
-	}
-
 	// fmt.Println("Creating file at:", ls.filePath)
 	file, err := os.Create(ls.filePath)
 	if err != nil {
@@ -74,7 +100,8 @@ func (ls *LocalStorage[T]) createFile() error {
 	defer file.Close()
 
 	// Initialize the file with an empty map
-	return ls.Sync(make(map[string]DbData[T]))
+	_, err = ls.Sync(make(map[string]DbData[T]))
+	return err
 }
 func (ls *LocalStorage[T]) fileExists(dir string) (bool, error) {
 
@@ -96,32 +123,243 @@ func (ls *LocalStorage[T]) fileExists(dir string) (bool, error) {
 	return false, dbError.FailedToCheckFileExists(fmt.Sprintf("%s", err))
 }
 
-func (ls *LocalStorage[T]) Sync(data map[string]DbData[T]) error {
-	// fmt.Printf("Sync data %+v\n ", data)
-	file, err := os.Create(ls.filePath)
+// Sync encodes data into a pooled buffer, sized after the previous sync,
+// reusing the JSON of the entries that didn't change (see encodedEntries), and
+// writes it over the file, through a handle kept open from one sync to the
+// next, then fsyncs it: once Sync returns, the data survives a crash. The
+// file is left as it was if data can't be encoded.
+func (ls *LocalStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	ls.syncMu.Lock()
+	defer ls.syncMu.Unlock()
+	buffer := getEncodeBuffer(ls.lastSize)
+	defer putEncodeBuffer(buffer)
+	if ls.binary {
+		if err := ls.encodeInto(buffer, data); err != nil {
+			return 0, err
+		}
+	} else {
+		if ls.encoded == nil {
+			ls.encoded = newEncodedEntries()
+		}
+		if err := appendJSONFileIncremental(buffer, ls.schemaHeader(), data, ls.encoded); err != nil {
+			return 0, err
+		}
+	}
+	ls.lastSize = buffer.Len()
+	written := int64(buffer.Len())
+	if ls.dbDir != "" {
+		return written, writeFileAtomically(ls.filePath, func(file *os.File) error {
+			_, err := file.Write(buffer.Bytes())
+			return err
+		})
+	}
+	file, err := ls.syncFile()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := file.WriteAt(buffer.Bytes(), 0); err != nil {
+		return 0, err
+	}
+	if err := file.Truncate(written); err != nil {
+		return 0, err
+	}
+	return written, file.Sync()
+}
+
+// syncFile returns the handle Sync writes through, opening it again if the
+// file was replaced or removed since.
+func (ls *LocalStorage[T]) syncFile() (*os.File, error) {
+	if ls.file != nil {
+		current, err := os.Stat(ls.filePath)
+		opened, openedErr := ls.file.Stat()
+		if err == nil && openedErr == nil && os.SameFile(current, opened) {
+			return ls.file, nil
+		}
+		ls.file.Close()
+		ls.file = nil
+	}
+	file, err := os.OpenFile(ls.filePath, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
+		return nil, err
+	}
+	ls.file = file
+	return file, nil
+}
+
+// encode writes data, after the schema header of T. A T matching any file
+// keeps the header the file was loaded with.
+func (ls *LocalStorage[T]) encode(file io.Writer, data map[string]DbData[T]) error {
+	buffer := getEncodeBuffer(0)
+	defer putEncodeBuffer(buffer)
+	if err := ls.encodeInto(buffer, data); err != nil {
 		return err
 	}
-	defer file.Close()
+	_, err := file.Write(buffer.Bytes())
+	return err
+}
+
+func (ls *LocalStorage[T]) encodeInto(buffer *encodeBuffer, data map[string]DbData[T]) error {
+	if ls.binary {
+		return encodeGobFile(buffer, ls.schemaHeader(), data)
+	}
+	return appendJSONFile(buffer, ls.schemaHeader(), data)
+}
+
+func (ls *LocalStorage[T]) schemaHeader() schemaHeader {
+	header := schemaOf[T]()
+	if header.Fingerprint == "" && ls.header != nil {
+		header = *ls.header
+	}
+	header.Seq = ls.seq
+	return header
+}
 
-	encoder := json.NewEncoder(file)
-	return encoder.Encode(data)
+// Version changes whenever the file is rewritten: it combines the file's
+// modification time and size.
+func (ls *LocalStorage[T]) Version() (string, error) {
+	fileInfo, err := os.Stat(ls.filePath)
+	if err != nil {
+		return "", dbError.FailedToGetFileInfo(fmt.Sprintf("%s", err))
+	}
+	return fmt.Sprintf("%d-%d", fileInfo.ModTime().UnixNano(), fileInfo.Size()), nil
 }
 
 func (ls *LocalStorage[T]) Load(dataToLoad *map[string]DbData[T]) error {
+	return ls.LoadWithProgress(dataToLoad, nil)
+}
+
+// loadProgressEvery is how many decoded entries go by between two progress
+// callbacks.
+const loadProgressEvery = 1000
+
+// LoadWithProgress decodes the file entry by entry instead of as one value,
+// reporting the decoded byte offset to progress along the way.
+func (ls *LocalStorage[T]) LoadWithProgress(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) error {
+	return ls.load(dataToLoad, progress, nil)
+}
+
+// LoadStrict loads as LoadWithProgress does, reporting the entries that
+// don't match T. Gob files can't tell, their issues are always empty.
+func (ls *LocalStorage[T]) LoadStrict(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) ([]DecodeIssue, error) {
+	issues := []DecodeIssue{}
+	err := ls.load(dataToLoad, progress, &issues)
+	sortDecodeIssues(issues)
+	return issues, err
+}
+
+// load decodes the file; with issues, the entries are checked against T.
+func (ls *LocalStorage[T]) load(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64), issues *[]DecodeIssue) error {
 	file, err := os.Open(ls.filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return dbError.FailedToGetFileInfo(fmt.Sprintf("%s", err))
+	}
+	totalBytes := fileInfo.Size()
+
+	if ls.binary {
+		header, err := decodeGobFile(file, dataToLoad)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			if err := header.check(schemaOf[T]()); err != nil {
+				return err
+			}
+			ls.header = header
+		}
+		if progress != nil {
+			progress(totalBytes, totalBytes)
+		}
+		return nil
+	}
+
 	decoder := json.NewDecoder(file)
-	return decoder.Decode(&dataToLoad)
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil { // "null" file
+		return expectEOF(decoder)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("expected a JSON object, got %v", token)
+	}
+	if *dataToLoad == nil {
+		*dataToLoad = make(map[string]DbData[T])
+	}
+	decoded := 0
+	for decoder.More() {
+		keyToken, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		if keyToken == schemaHeaderKey {
+			var header schemaHeader
+			if err := decoder.Decode(&header); err != nil {
+				return err
+			}
+			if err := header.check(schemaOf[T]()); err != nil {
+				return err
+			}
+			ls.header = &header
+			continue
+		}
+		var entry DbData[T]
+		if issues == nil {
+			if err := decoder.Decode(&entry); err != nil {
+				return err
+			}
+		} else {
+			var raw json.RawMessage
+			if err := decoder.Decode(&raw); err != nil {
+				return err
+			}
+			problem, err := decodeStrict(raw, &entry)
+			if err != nil {
+				return err
+			}
+			if problem != "" {
+				*issues = append(*issues, DecodeIssue{Key: keyToken.(string), Problem: problem})
+			}
+		}
+		(*dataToLoad)[keyToken.(string)] = entry
+		decoded++
+		if progress != nil && decoded%loadProgressEvery == 0 {
+			progress(decoder.InputOffset(), totalBytes)
+		}
+	}
+	if _, err := decoder.Token(); err != nil { // closing '}'
+		return err
+	}
+	if err := expectEOF(decoder); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(totalBytes, totalBytes)
+	}
+	return nil
+}
+
+// expectEOF fails if anything but whitespace follows the decoded value, as
+// json.Unmarshal does: a truncated rewrite could leave such garbage behind.
+func expectEOF(decoder *json.Decoder) error {
+	if _, err := decoder.Token(); err != io.EOF {
+		if err == nil {
+			return fmt.Errorf("unexpected data after the JSON object at offset %d", decoder.InputOffset())
+		}
+		return err
+	}
+	return nil
 }
 
-func (ls *LocalStorage[T]) acquireLock() error {
+func (ls *LocalStorage[T]) Lock() error {
 	var err error
-	ls.lockFile, err = os.OpenFile(ls.filePath+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	ls.lockFile, err = os.OpenFile(ls.lockFilePath(), os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return err
 	}
@@ -139,7 +377,28 @@ func (ls *LocalStorage[T]) acquireLock() error {
 	return nil
 }
 
-func (ls *LocalStorage[T]) releaseLock() error {
+func (ls *LocalStorage[T]) lockFilePath() string {
+	if ls.lockPath != "" {
+		return ls.lockPath
+	}
+	return ls.filePath + ".lock"
+}
+
+// fileName is the name replicas of this database are stored under.
+func (ls *LocalStorage[T]) fileName() string {
+	if ls.name != "" {
+		return ls.name
+	}
+	return filepath.Base(ls.filePath)
+}
+
+func (ls *LocalStorage[T]) Unlock() error {
+	ls.syncMu.Lock()
+	if ls.file != nil {
+		ls.file.Close()
+		ls.file = nil
+	}
+	ls.syncMu.Unlock()
 	if ls.lockFile == nil {
 		return nil
 	}
@@ -158,7 +417,7 @@ func (ls *LocalStorage[T]) releaseLock() error {
 	return nil
 }
 
-func (ls *LocalStorage[T]) getFileSizeInKB() (float64, error) {
+func (ls *LocalStorage[T]) Size() (float64, error) {
 	fileInfo, err := os.Stat(ls.filePath)
 	if err != nil {
 		return 0, dbError.FailedToGetFileInfo(fmt.Sprintf("%s", err))
@@ -1,5 +1,7 @@
 package main
 
+import "os"
+
 type Animals struct {
 	Name    string `json:"name"`
 	Country string `json:"country"`
@@ -19,6 +21,9 @@ func AnimalEntry(name string, country string, age int, ttlSeconds string) DbData
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+	}
 	// dir, _ := os.UserHomeDir()
 	// dbsIns, err := NewDB[Animals]("animals", dir)
 
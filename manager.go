@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Manager keeps the databases of many tenants under one root directory,
+// each a database named after its tenant, as NewDB names them, opened on
+// demand with the same options. The storage of all the tenants together can
+// be capped: once the quota is used up, the writes making any tenant's file
+// grow fail with NotAvailabeSpace.
+type Manager[T any] struct {
+	root  string
+	opts  []Option
+	quota *storageQuota // nil without a quota
+
+	mu      sync.Mutex // Protects tenants and closed
+	tenants map[string]*DB[T]
+	closed  bool
+}
+
+// ManagerConfig configures a Manager.
+type ManagerConfig struct {
+	Options        []Option // Shared by the tenants; options taking a path would have them share it
+	StorageQuotaKB float64  // Storage of all the tenants' files together, 0 for no quota
+}
+
+// NewManager manages the tenants under root, created if missing. The
+// tenants already there count against the quota from the start.
+func NewManager[T any](root string, config ManagerConfig) (*Manager[T], error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+	manager := &Manager[T]{root: root, opts: config.Options, tenants: make(map[string]*DB[T])}
+	if config.StorageQuotaKB > 0 {
+		manager.quota = &storageQuota{limitKB: config.StorageQuotaKB, usedKB: make(map[string]float64), reservedKB: make(map[string]float64)}
+		names, err := manager.ListTenants()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			manager.quota.allow(name, manager.storedKB(name), 0)
+		}
+	}
+	return manager, nil
+}
+
+// OpenTenant returns the database of tenant name, opening it, and creating
+// it if new, unless it is open already. The name follows the file name rules
+// of NewDB, without an extension.
+func (manager *Manager[T]) OpenTenant(name string) (*DB[T], error) {
+	if fixed, err := ValidateAndFixJSONFilename(name); err != nil {
+		return nil, err
+	} else if fixed != name+".json" {
+		return nil, dbError.InvalidFileName(fmt.Sprintf("tenant %q", name))
+	}
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	if manager.closed {
+		return nil, dbError.DBAlreadyClosed("the manager is closed")
+	}
+	if db, open := manager.tenants[name]; open && !db.closed.Load() {
+		return db, nil
+	}
+	opts := manager.opts
+	if manager.quota != nil {
+		opts = append(slices.Clip(opts), withStorageQuota(manager.quota, name))
+	}
+	db, err := NewDB[T](name, manager.root, opts...)
+	if err != nil {
+		return nil, err
+	}
+	manager.tenants[name] = db
+	return db, nil
+}
+
+// ListTenants returns the names of the tenants under the root directory,
+// open or not, sorted.
+func (manager *Manager[T]) ListTenants() ([]string, error) {
+	files, err := os.ReadDir(manager.root)
+	if err != nil {
+		return nil, dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
+	}
+	var names []string
+	for _, file := range files {
+		for _, suffix := range []string{".json", ".bin", dirSuffix} {
+			if name, found := strings.CutSuffix(file.Name(), suffix); found && name != "" && file.IsDir() == (suffix == dirSuffix) {
+				names = append(names, name)
+			}
+		}
+	}
+	manager.mu.Lock()
+	for name := range manager.tenants {
+		names = append(names, name) // not synced yet
+	}
+	manager.mu.Unlock()
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+// ManagerStats sums up the stats of the open tenants.
+type ManagerStats struct {
+	Tenants    int // Open
+	Entries    int
+	Tombstones int
+	ReadHits   uint64
+	ReadMisses uint64
+	UsedKB     float64 // Storage of all the tenants, open or not, as last seen; 0 without a quota
+	QuotaKB    float64 // 0 without a quota
+	ByTenant   map[string]Stats
+}
+
+// Stats returns the stats of every open tenant and their totals.
+func (manager *Manager[T]) Stats() ManagerStats {
+	manager.mu.Lock()
+	tenants := make(map[string]*DB[T], len(manager.tenants))
+	for name, db := range manager.tenants {
+		if !db.closed.Load() {
+			tenants[name] = db
+		}
+	}
+	manager.mu.Unlock()
+	stats := ManagerStats{Tenants: len(tenants), ByTenant: make(map[string]Stats, len(tenants))}
+	for name, db := range tenants {
+		tenant := db.Stats()
+		stats.ByTenant[name] = tenant
+		stats.Entries += tenant.Entries
+		stats.Tombstones += tenant.Tombstones
+		stats.ReadHits += tenant.ReadHits
+		stats.ReadMisses += tenant.ReadMisses
+	}
+	if manager.quota != nil {
+		stats.UsedKB, stats.QuotaKB = manager.quota.used(), manager.quota.limitKB
+	}
+	return stats
+}
+
+// CloseAll closes every open tenant, even if some fail, and returns the
+// first error. The manager can't open tenants anymore.
+func (manager *Manager[T]) CloseAll() error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	manager.closed = true
+	var firstErr error
+	for name, db := range manager.tenants {
+		delete(manager.tenants, name)
+		if db.closed.Load() { // by its owner
+			continue
+		}
+		if err := db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// storedKB returns the size of the data file of a tenant that isn't open,
+// 0 if it can't be found.
+func (manager *Manager[T]) storedKB(name string) float64 {
+	for _, path := range []string{name + ".json", name + ".bin", name + dirSuffix + "/data.json", name + dirSuffix + "/data.bin"} {
+		if info, err := os.Stat(filepath.Join(manager.root, path)); err == nil {
+			return BytesToKB(int(info.Size()))
+		}
+	}
+	return 0
+}
+
+// storageQuota caps the storage of the tenants of a Manager together. It
+// knows the size of each tenant as of its last write or sync, and the growth
+// reserved by the writes allowed since its last sync, so that tenants
+// writing at the same time can't all take the last of the quota.
+type storageQuota struct {
+	limitKB    float64
+	mu         sync.Mutex // Protects the fields below
+	usedKB     map[string]float64
+	totalKB    float64
+	reservedKB map[string]float64 // By the writes of each tenant not synced yet
+	reserved   float64
+}
+
+// allow records that the file of tenant is sizeKB now and, if it can grow
+// by entryKB within the quota, reserves that until its next sync settles it.
+func (quota *storageQuota) allow(tenant string, sizeKB float64, entryKB float64) bool {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	quota.record(tenant, sizeKB)
+	if quota.totalKB+quota.reserved+entryKB > quota.limitKB {
+		return false
+	}
+	quota.reservedKB[tenant] += entryKB
+	quota.reserved += entryKB
+	return true
+}
+
+// settle releases the reservations of tenant once a sync wrote them, or
+// failed to, and records the size of its file as size reports it.
+func (quota *storageQuota) settle(tenant string, size func() (float64, error)) {
+	sizeKB, err := size()
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	if err == nil {
+		quota.record(tenant, sizeKB)
+	}
+	quota.reserved -= quota.reservedKB[tenant]
+	delete(quota.reservedKB, tenant)
+}
+
+func (quota *storageQuota) record(tenant string, sizeKB float64) {
+	quota.totalKB += sizeKB - quota.usedKB[tenant]
+	quota.usedKB[tenant] = sizeKB
+}
+
+func (quota *storageQuota) used() float64 {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	return quota.totalKB
+}
+
+// withStorageQuota makes the DB the tenant of a Manager sharing quota.
+func withStorageQuota(quota *storageQuota, tenant string) Option {
+	return func(o *dbOptions) {
+		o.quota = quota
+		o.quotaTenant = tenant
+	}
+}
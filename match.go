@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxMatchResults caps the entries ReadMatching returns and DeleteMatching
+// removes in one call.
+const MaxMatchResults = 1000
+
+// keyPattern is a compiled glob: * matches any run of characters, ? a single
+// one, [abc] and [a-z] one of a class, [!abc] one outside it, and \ escapes
+// the next character. Unlike path.Match, * also matches '/'.
+type keyPattern struct {
+	prefix string // Literal start, to narrow the scan down
+	re     *regexp.Regexp
+}
+
+func compileKeyPattern(pattern string) (keyPattern, error) {
+	var expr strings.Builder
+	expr.WriteString(`(?s)^`)
+	prefix, literal := strings.Builder{}, true
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+			literal = false
+		case '?':
+			expr.WriteString(".")
+			literal = false
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return keyPattern{}, dbError.InvalidPattern(fmt.Sprintf("%q: unterminated [", pattern))
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+			literal = false
+		case '\\':
+			if i+1 == len(pattern) {
+				return keyPattern{}, dbError.InvalidPattern(fmt.Sprintf("%q: trailing \\", pattern))
+			}
+			i++
+			c = pattern[i]
+			fallthrough
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+			if literal {
+				prefix.WriteByte(c)
+			}
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return keyPattern{}, dbError.InvalidPattern(fmt.Sprintf("%q: %s", pattern, err))
+	}
+	return keyPattern{prefix: prefix.String(), re: re}, nil
+}
+
+// matchingKeys returns, in key order, up to limit live keys matching
+// pattern, and whether more match. Pinned and immutable entries are left
+// out unless withProtected.
+func (db *DB[T]) matchingKeys(pattern keyPattern, limit int, withProtected bool) ([]string, bool) {
+	db.dataMu.RLock()
+	defer db.dataMu.RUnlock()
+	keys := []string{}
+	for node := db.keyIndex.byKey.search(indexedKey{key: pattern.prefix}); node != nil; node = node.next[0] {
+		key := node.item.key
+		if !strings.HasPrefix(key, pattern.prefix) {
+			break
+		}
+		if !pattern.re.MatchString(key) || db.isExpired(key) || (!withProtected && db.data.entry(key).protected()) {
+			continue
+		}
+		if len(keys) == limit {
+			return keys, true
+		}
+		keys = append(keys, key)
+	}
+	return keys, false
+}
+
+// ReadMatching returns the live entries whose key matches the glob pattern
+// (see keyPattern), such as "session:*". It fails with ErrTooManyMatches if
+// more than MaxMatchResults do; page through them with ListKeys instead. It
+// runs on a read worker: the entries are each read as they are at the time,
+// not as one snapshot.
+func (db *DB[T]) ReadMatching(pattern string) (map[string]DbData[T], error) {
+	if db.closed.Load() {
+		return nil, dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "readMatching",
+		key:      pattern,
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submit(db.readOps, op)
+	return result.entries, result.err
+}
+
+func (db *DB[T]) readMatching(pattern string) (map[string]DbData[T], error) {
+	compiled, err := compileKeyPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	keys, more := db.matchingKeys(compiled, MaxMatchResults, true)
+	if more {
+		return nil, dbError.ErrTooManyMatches(fmt.Sprintf("%q matches more than %d keys", pattern, MaxMatchResults))
+	}
+	entries := make(map[string]DbData[T], len(keys))
+	for _, key := range keys {
+		if entry, err := db.read(key); err == nil { // unless removed meanwhile
+			entries[key] = entry
+		}
+	}
+	return entries, nil
+}
+
+// DeleteMatching deletes the live entries whose key matches the glob
+// pattern, as Delete does, with a single sync, and returns how many it
+// deleted. Pinned and immutable entries are kept, see Pin. It deletes
+// MaxMatchResults of them at most, so as not to hold the write worker for
+// long: call it again until it returns 0.
+func (db *DB[T]) DeleteMatching(pattern string) (int, error) {
+	if db.closed.Load() {
+		return 0, dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "deleteMatching",
+		key:      pattern,
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submitWrite(op)
+	return result.count, result.err
+}
+
+func (db *DB[T]) deleteMatching(pattern string) (int, error) {
+	compiled, err := compileKeyPattern(pattern)
+	if err != nil {
+		return 0, err
+	}
+	keys, _ := db.matchingKeys(compiled, MaxMatchResults, false)
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	unlock := db.lockKeys(keys)
+	defer unlock()
+	removed := make(map[string]DbData[T], len(keys))
+	records := make([]OplogRecord[T], 0, len(keys))
+	for _, key := range keys {
+		entry := db.data.entry(key)
+		removed[key] = entry
+		db.removeEntry(key)
+		if db.opts().softDelete { // a live key has no tombstone to replace
+			deletedAt := time.Now()
+			entry.Deleted_at = &deletedAt
+			db.setTombstone(key, entry)
+		}
+		records = append(records, OplogRecord[T]{Op: OplogDelete, Key: key})
+	}
+	if err := db.sync(); err != nil {
+		for key, entry := range removed { // rollback
+			db.removeTombstone(key)
+			db.setEntry(key, entry)
+		}
+		return 0, err
+	}
+	db.logOps(records...)
+	return len(keys), nil
+}
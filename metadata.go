@@ -0,0 +1,83 @@
+package main
+
+import "time"
+
+// OpMetadata describes how an operation was executed, to diagnose tail
+// latency. Results carry it with WithOpMetadata.
+type OpMetadata struct {
+	QueueWait    time.Duration // From queueing to the worker picking the op up
+	Exec         time.Duration // Spent by the worker on the op, syncs included
+	SyncDuration time.Duration // Spent syncing the storage, 0 for reads
+	Syncs        int           // Syncs the op made, rollbacks included
+	Bytes        int64         // Size of the data persisted by the last sync
+	Seq          uint64        // Checkpoint sequence number reached once applied, see Checkpoint
+}
+
+// syncMeter sums up the syncs of the write being processed; only the write
+// worker touches it.
+type syncMeter struct {
+	duration time.Duration
+	syncs    int
+	bytes    int64
+}
+
+// opMeter measures an op on its worker, from metered to stamp. It is zero
+// without WithOpMetadata.
+type opMeter struct {
+	start    time.Time
+	queuedAt time.Time
+	write    bool
+}
+
+// metered starts measuring op on its worker. It returns a value rather than
+// a func stamping the result, which would be allocated for every op even
+// without WithOpMetadata.
+func (db *DB[T]) metered(op operation[T]) opMeter {
+	if !db.opts().opMetadata {
+		return opMeter{}
+	}
+	meter := opMeter{start: time.Now(), queuedAt: op.queuedAt, write: !readActions[op.action]}
+	if meter.write {
+		db.syncMeter = syncMeter{}
+	}
+	return meter
+}
+
+// stamp sets the metadata of the result of the op meter measured, if any.
+func (db *DB[T]) stamp(meter opMeter, result *operationResult[T]) {
+	if meter.start.IsZero() {
+		return
+	}
+	meta := &OpMetadata{Exec: time.Since(meter.start), Seq: db.Checkpoint().Seq}
+	if !meter.queuedAt.IsZero() {
+		meta.QueueWait = meter.start.Sub(meter.queuedAt)
+	}
+	if meter.write {
+		meta.SyncDuration = db.syncMeter.duration
+		meta.Syncs = db.syncMeter.syncs
+		meta.Bytes = db.syncMeter.bytes
+	}
+	result.meta = meta
+}
+
+// readActions run on the read workers.
+var readActions = map[string]bool{"read": true, "exists": true, "expiredKeys": true, "ping": true}
+
+// meterSync records a sync of the write being processed, which wrote
+// written bytes.
+func (db *DB[T]) meterSync(started time.Time, written int64, err error) {
+	if !db.opts().opMetadata {
+		return
+	}
+	db.syncMeter.duration += time.Since(started)
+	db.syncMeter.syncs++
+	if err == nil {
+		db.syncMeter.bytes = written
+	}
+}
+
+// Metadata returns how the operation was executed, nil without
+// WithOpMetadata.
+func (result operationResult[T]) Metadata() *OpMetadata {
+	return result.meta
+}
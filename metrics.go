@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// MetricsHandler serves Stats in the Prometheus text format, for a scraper:
+//
+//	mux.Handle("/metrics", db.MetricsHandler())
+//
+// Counters end with _total and count from when the DB was opened.
+func (db *DB[T]) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, db.Stats())
+	})
+}
+
+// metric is one line of the metrics, with its help and type.
+type metric struct {
+	name  string
+	kind  string // "gauge" or "counter"
+	help  string
+	value float64
+}
+
+func writeMetrics(w io.Writer, stats Stats) {
+	metrics := []metric{
+		{"kv_entries", "gauge", "Entries stored, expired ones not removed yet included.", float64(stats.Entries)},
+		{"kv_tombstones", "gauge", "Soft deleted entries kept for Undelete.", float64(stats.Tombstones)},
+		{"kv_read_queue", "gauge", "Reads waiting in the queue.", float64(stats.ReadQueue)},
+		{"kv_write_queue", "gauge", "Writes waiting in the queue.", float64(stats.WriteQueue)},
+		{"kv_read_hits_total", "counter", "Reads that found a live entry.", float64(stats.ReadHits)},
+		{"kv_read_misses_total", "counter", "Reads of a missing or expired key.", float64(stats.ReadMisses)},
+		{"kv_syncs_total", "counter", "Syncs of the storage, the failed ones included.", float64(stats.IO.Syncs)},
+		{"kv_failed_syncs_total", "counter", "Syncs of the storage that failed.", float64(stats.IO.FailedSyncs)},
+		{"kv_rewrites_total", "counter", "Compact runs, which rewrite the storage.", float64(stats.IO.Rewrites)},
+		{"kv_bytes_written_total", "counter", "Bytes the syncs wrote to the storage.", float64(stats.IO.BytesWritten)},
+		{"kv_oplog_bytes_total", "counter", "Bytes appended to the oplog.", float64(stats.IO.OplogBytes)},
+		{"kv_oplog_failures_total", "counter", "Oplog records lost to an encode or write error.", float64(stats.IO.OplogFailures)},
+		{"kv_changed_bytes_total", "counter", "Bytes of the entries written and the keys removed.", float64(stats.IO.ChangedBytes)},
+		{"kv_write_amplification", "gauge", "Bytes written to disk per byte changed.", stats.IO.WriteAmplification},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
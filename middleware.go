@@ -0,0 +1,62 @@
+package main
+
+// Operation is the view of a write given to middleware. Middleware may pass
+// next a changed copy, rewriting the key or the value for instance; changes
+// to Action are ignored.
+type Operation[T any] struct {
+	Action string               // "create", "update", "delete", "batchCreate", ...
+	Key    string               // Empty for batch operations
+	Value  DbData[T]            // Value written by create and update
+	Batch  map[string]DbData[T] // Entries of batchCreate
+	Keys   []string             // Keys of multi-key operations such as SetTTLBatch
+}
+
+// Handler runs the rest of the chain for an operation.
+type Handler[T any] func(op Operation[T]) error
+
+// Middleware intercepts every write: it can inspect or change the operation,
+// reject it by returning an error without calling next, or wrap next to
+// measure or audit it. It runs on the caller's goroutine, before the write is
+// queued. For the sync writes next returns once the write is applied, with
+// its error; for the async ones (CreateAsync, ...) next only queues it.
+type Middleware[T any] func(op Operation[T], next Handler[T]) error
+
+// Use appends middleware to the chain; the first registered is the outermost.
+func (db *DB[T]) Use(middleware Middleware[T]) {
+	db.middlewareMu.Lock()
+	defer db.middlewareMu.Unlock()
+	db.middleware = append(db.middleware, middleware)
+}
+
+// intercept runs op through the middleware chain, apply being the innermost
+// handler.
+func (db *DB[T]) intercept(op operation[T], apply func(op operation[T]) error) error {
+	db.middlewareMu.Lock()
+	middleware := db.middleware
+	db.middlewareMu.Unlock()
+	if len(middleware) == 0 {
+		return apply(op)
+	}
+	handler := Handler[T](func(view Operation[T]) error {
+		return apply(op.with(view))
+	})
+	for i := len(middleware) - 1; i >= 0; i-- {
+		current, next := middleware[i], handler
+		handler = func(view Operation[T]) error {
+			return current(view, next)
+		}
+	}
+	return handler(op.view())
+}
+
+func (op operation[T]) view() Operation[T] {
+	return Operation[T]{Action: op.action, Key: op.key, Value: op.value, Batch: op.batchData, Keys: op.batchKeys}
+}
+
+func (op operation[T]) with(view Operation[T]) operation[T] {
+	op.key = view.Key
+	op.value = view.Value
+	op.batchData = view.Batch
+	op.batchKeys = view.Keys
+	return op
+}
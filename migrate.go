@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"sort"
+)
+
+// MigrationReport tells what Migrate did, or would do on a dry run.
+type MigrationReport struct {
+	Path      string
+	DryRun    bool
+	Entries   int               // entries in the file, tombstones included
+	Converted int               // values converted
+	Kept      int               // blob and lease entries, whose Value is unused and left zero
+	Failed    map[string]string // keys whose conversion panicked or whose new value doesn't encode
+}
+
+// FailedKeys returns the keys that failed to convert, sorted.
+func (r MigrationReport) FailedKeys() []string {
+	keys := make([]string, 0, len(r.Failed))
+	for key := range r.Failed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Migrate rewrites the database file at path, holding TOld values, into one
+// holding the TNew values convert returns. Everything else of the entries,
+// TTL, created_at, expiration and tombstones, is kept as is. The database
+// must be closed: Migrate takes its lock. The file is rewritten atomically
+// and only if every entry converted; otherwise it is left untouched and the
+// failures are in the report.
+func Migrate[TOld any, TNew any](path string, convert func(TOld) TNew) (MigrationReport, error) {
+	return migrate(path, convert, false)
+}
+
+// MigrateDryRun converts every entry as Migrate would and reports it, without
+// writing anything.
+func MigrateDryRun[TOld any, TNew any](path string, convert func(TOld) TNew) (MigrationReport, error) {
+	return migrate(path, convert, true)
+}
+
+func migrate[TOld any, TNew any](path string, convert func(TOld) TNew, dryRun bool) (MigrationReport, error) {
+	report := MigrationReport{Path: path, DryRun: dryRun, Failed: make(map[string]string)}
+	if _, err := os.Stat(path); err != nil {
+		return report, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	source, err := NewLocalStorageAtPath[TOld](path)
+	if err != nil {
+		return report, err
+	}
+	if err := source.Lock(); err != nil {
+		return report, err
+	}
+	defer source.Unlock()
+
+	entries := make(map[string]DbData[TOld])
+	if err := source.Load(&entries); err != nil {
+		return report, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	converted := make(map[string]DbData[TNew], len(entries))
+	for key, entry := range entries {
+		report.Entries++
+		migrated := DbData[TNew]{
+			Ttl:        entry.Ttl,
+			Created_at: entry.Created_at,
+			Expires_at: entry.Expires_at,
+			Sliding:    entry.Sliding,
+			Deleted_at: entry.Deleted_at,
+			Owner:      entry.Owner,
+			Blob:       entry.Blob,
+			Seq:        entry.Seq,
+		}
+		if entry.Blob != nil || entry.Owner != "" {
+			report.Kept++
+			converted[key] = migrated
+			continue
+		}
+		value, err := convertValue(entry.Value, convert)
+		if err != nil {
+			report.Failed[key] = err.Error()
+			continue
+		}
+		migrated.Value = value
+		converted[key] = migrated
+		report.Converted++
+	}
+	if len(report.Failed) > 0 {
+		return report, dbError.MigrationFailed(fmt.Sprintf("%d of %d entries failed to convert", len(report.Failed), report.Entries))
+	}
+	if dryRun {
+		return report, nil
+	}
+	target := &LocalStorage[TNew]{filePath: path, binary: source.binary}
+	return report, writeFileAtomically(path, func(file *os.File) error {
+		return target.encode(file, converted)
+	})
+}
+
+// convertValue runs convert on value, turning a panic into an error, and
+// checks that the result encodes.
+func convertValue[TOld any, TNew any](value TOld, convert func(TOld) TNew) (result TNew, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("convert panicked: %v", recovered)
+		}
+	}()
+	result = convert(value)
+	if _, err := json.Marshal(result); err != nil {
+		return result, err
+	}
+	return result, nil
+}
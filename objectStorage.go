@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sync"
+	"time"
+)
+
+// ObjectClient is the minimal object-storage API ObjectStorage needs.
+// S3Client implements it for S3-compatible services.
+type ObjectClient interface {
+	PutObject(ctx context.Context, key string, body []byte) error
+	// GetObject returns found=false (and no error) when the object doesn't exist.
+	GetObject(ctx context.Context, key string) (body []byte, found bool, err error)
+}
+
+// ObjectStorage keeps a local backend as the source of truth and uploads a
+// snapshot of it to object storage every interval. When the local backend is
+// empty on Load, it bootstraps from the last uploaded snapshot, so an
+// ephemeral container can pick up where the previous one left off.
+type ObjectStorage[T any] struct {
+	local     Storage[T]
+	client    ObjectClient
+	objectKey string
+	interval  time.Duration
+
+	mu       sync.Mutex
+	snapshot []byte // latest synced data, encoded
+	dirty    bool   // snapshot not uploaded yet
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func NewObjectStorage[T any](local Storage[T], client ObjectClient, objectKey string, interval time.Duration) *ObjectStorage[T] {
+	return &ObjectStorage[T]{
+		local:     local,
+		client:    client,
+		objectKey: objectKey,
+		interval:  interval,
+	}
+}
+
+func (obs *ObjectStorage[T]) Load(dataToLoad *map[string]DbData[T]) error {
+	if err := obs.local.Load(dataToLoad); err != nil {
+		return err
+	}
+	if len(*dataToLoad) > 0 {
+		return nil
+	}
+	body, found, err := obs.client.GetObject(context.Background(), obs.objectKey)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return nil
+	}
+	if err := json.Unmarshal(body, dataToLoad); err != nil {
+		return err
+	}
+	// persist the bootstrapped data locally, the bucket already has it
+	_, err = obs.local.Sync(*dataToLoad)
+	return err
+}
+
+// Sync writes data to the local backend, returning the bytes written there;
+// the bucket gets it on the next upload.
+func (obs *ObjectStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	written, err := obs.local.Sync(data)
+	if err != nil {
+		return 0, err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	obs.mu.Lock()
+	obs.snapshot = encoded
+	obs.dirty = true
+	obs.mu.Unlock()
+	return written, nil
+}
+
+func (obs *ObjectStorage[T]) Size() (float64, error) {
+	return obs.local.Size()
+}
+
+// LockHeld, CheckWritable, Dir and Version are those of the local backend;
+// the checks pass when it can't check itself.
+func (obs *ObjectStorage[T]) LockHeld() bool {
+	reporter, ok := obs.local.(HealthReporter)
+	return !ok || reporter.LockHeld()
+}
+
+func (obs *ObjectStorage[T]) CheckWritable() error {
+	if reporter, ok := obs.local.(HealthReporter); ok {
+		return reporter.CheckWritable()
+	}
+	return nil
+}
+
+func (obs *ObjectStorage[T]) Dir() string {
+	if reporter, ok := obs.local.(HealthReporter); ok {
+		return reporter.Dir()
+	}
+	return ""
+}
+
+func (obs *ObjectStorage[T]) Version() (string, error) {
+	if versioned, ok := obs.local.(VersionedStorage); ok {
+		return versioned.Version()
+	}
+	return "", nil
+}
+
+func (obs *ObjectStorage[T]) Lock() error {
+	if err := obs.local.Lock(); err != nil {
+		return err
+	}
+	obs.stopCh = make(chan struct{})
+	obs.doneCh = make(chan struct{})
+	go obs.uploadWorker()
+	return nil
+}
+
+// Unlock stops the upload worker, uploads any pending snapshot and releases
+// the local backend.
+func (obs *ObjectStorage[T]) Unlock() error {
+	if obs.stopCh != nil {
+		close(obs.stopCh)
+		<-obs.doneCh
+		obs.stopCh = nil
+	}
+	uploadErr := obs.Upload(context.Background())
+	if err := obs.local.Unlock(); err != nil {
+		return err
+	}
+	return uploadErr
+}
+
+// Upload pushes the latest snapshot to object storage if it changed since the
+// previous upload.
+func (obs *ObjectStorage[T]) Upload(ctx context.Context) error {
+	obs.mu.Lock()
+	if !obs.dirty {
+		obs.mu.Unlock()
+		return nil
+	}
+	snapshot := obs.snapshot
+	obs.dirty = false
+	obs.mu.Unlock()
+
+	if err := obs.client.PutObject(ctx, obs.objectKey, snapshot); err != nil {
+		obs.mu.Lock()
+		obs.dirty = true // retry on the next tick
+		obs.mu.Unlock()
+		return dbError.FailedToUploadSnapshot(fmt.Sprintf("%s", err))
+	}
+	return nil
+}
+
+func (obs *ObjectStorage[T]) uploadWorker() {
+	defer close(obs.doneCh)
+	ticker := time.NewTicker(obs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			obs.Upload(context.Background())
+		case <-obs.stopCh:
+			return
+		}
+	}
+}
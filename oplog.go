@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"local-key-value-DB/dbError"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Oplog record operations.
+const (
+	OplogCreate = "create"
+	OplogUpdate = "update"
+	OplogDelete = "delete"
+	OplogExpire = "expire"
+	OplogTTL    = "ttl"
+)
+
+// OplogRecord is one applied mutation, one JSON line of the oplog file.
+type OplogRecord[T any] struct {
+	Seq       uint64     `json:"seq"`
+	Op        string     `json:"op"`
+	Key       string     `json:"key"`
+	Value     *DbData[T] `json:"value,omitempty"` // the new entry, for create, update and ttl
+	Timestamp time.Time  `json:"ts"`
+	Change    uint64     `json:"change,omitempty"` // checkpoint sequence number of the mutation, see SyncCheckpoint
+	CRC       uint32     `json:"crc,omitempty"`    // CRC-32 of the line up to this member
+	size      int        // encoded size of Value the checks measured, for IOStats; 0 if they didn't
+}
+
+// oplog appends the mutations applied to the DB, after they were synced, to a
+// JSON Lines file. Sequence numbers continue from the last record of an
+// existing file.
+type oplog[T any] struct {
+	mu      sync.Mutex
+	path    string
+	seq     uint64
+	lastErr error         // error of the last append, nil once one succeeds; the mutations themselves were applied
+	corrupt int           // lines cut off the end of the file when opened, see readVerifiedOplog
+	written atomic.Uint64 // bytes appended since opened
+	failed  atomic.Uint64 // records lost since opened, not encoded or not written
+}
+
+// openOplog also returns the records already in the file. The lines from
+// the first one failing its checksum on are cut off, unless readOnly, so
+// that new records follow the last good one.
+func openOplog[T any](path string, readOnly bool) (*oplog[T], []OplogRecord[T], error) {
+	records, corrupt, size, err := readVerifiedOplog[T](path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	log := &oplog[T]{path: path, corrupt: corrupt}
+	if corrupt > 0 && !readOnly {
+		if err := os.Truncate(path, size); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(records) > 0 {
+		log.seq = records[len(records)-1].Seq
+	}
+	return log, records, nil
+}
+
+// append assigns sequence numbers to records and writes them. A record that
+// doesn't encode gets no sequence number, so the file has no gap; the
+// error returned covers it and a failed write.
+func (l *oplog[T]) append(records []OplogRecord[T]) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return l.fail(len(records), err)
+	}
+	defer file.Close()
+	writer := bufio.NewWriter(file)
+	var encodeErrs []error
+	buffered := 0
+	for i := range records {
+		records[i].Seq = l.seq + 1
+		line, err := json.Marshal(records[i])
+		if err != nil {
+			records[i].Seq = 0
+			encodeErrs = append(encodeErrs, fmt.Errorf("record of key %s: %w", records[i].Key, err))
+			continue
+		}
+		l.seq++
+		records[i].CRC = crc32.ChecksumIEEE(line)
+		line = fmt.Appendf(line[:len(line)-1], `,"crc":%d}`, records[i].CRC)
+		writer.Write(append(line, '\n'))
+		buffered += len(line) + 1
+	}
+	if err := writer.Flush(); err != nil {
+		return l.fail(len(records), err)
+	}
+	l.written.Add(uint64(buffered))
+	if len(encodeErrs) > 0 {
+		return l.fail(len(encodeErrs), errors.Join(encodeErrs...))
+	}
+	l.lastErr = nil
+	return nil
+}
+
+// fail records the loss of lost records to err, under l.mu.
+func (l *oplog[T]) fail(lost int, err error) error {
+	l.failed.Add(uint64(lost))
+	l.lastErr = dbError.OplogAppendFailed(fmt.Sprintf("%d records lost: %s", lost, err))
+	return l.lastErr
+}
+
+// err returns the error of the last append, nil if it succeeded.
+func (l *oplog[T]) err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastErr
+}
+
+// ReadOplog returns the records of an oplog file with a sequence number of at
+// least fromSeq, in order.
+func ReadOplog[T any](path string, fromSeq uint64) ([]OplogRecord[T], error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []OplogRecord[T]
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*KB), (MaxEntrySizeLimitMB+1)*MB)
+	for scanner.Scan() {
+		var record OplogRecord[T]
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return records, err
+		}
+		if record.Seq >= fromSeq {
+			records = append(records, record)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// readVerifiedOplog is ReadOplog checking the CRC of every record written
+// with one. It stops at the first record that doesn't pass, typically the
+// torn last line of a crash, and returns how many lines it left out and the
+// size of the file up to there.
+func readVerifiedOplog[T any](path string) ([]OplogRecord[T], int, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer file.Close()
+
+	var records []OplogRecord[T]
+	corrupt := 0
+	size := int64(0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*KB), (MaxEntrySizeLimitMB+1)*MB)
+	for scanner.Scan() {
+		if corrupt > 0 {
+			corrupt++
+			continue
+		}
+		line := scanner.Bytes()
+		record, ok := decodeOplogLine[T](line)
+		if !ok {
+			corrupt++
+			continue
+		}
+		records = append(records, record)
+		size += int64(len(line)) + 1
+	}
+	return records, corrupt, size, scanner.Err()
+}
+
+// decodeOplogLine decodes a line of an oplog file, checking its CRC if it
+// was written with one.
+func decodeOplogLine[T any](line []byte) (OplogRecord[T], bool) {
+	var record OplogRecord[T]
+	if err := json.Unmarshal(line, &record); err != nil {
+		return record, false
+	}
+	if record.CRC != 0 {
+		signed := bytes.LastIndex(line, []byte(`,"crc":`))
+		if signed < 0 || crc32.ChecksumIEEE(append(line[:signed:signed], '}')) != record.CRC {
+			return record, false
+		}
+	}
+	return record, true
+}
+
+// TailOplog returns the records appended to the DB's oplog from fromSeq on;
+// pass the last seen Seq+1 to poll for new mutations.
+func (db *DB[T]) TailOplog(fromSeq uint64) ([]OplogRecord[T], error) {
+	if db.oplog == nil {
+		return nil, nil
+	}
+	records, err := ReadOplog[T](db.oplog.path, fromSeq)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return records, err
+}
+
+// logOps records mutations that were just synced, in the oplog and the
+// history, and wakes the WaitFor callers of the keys written. Within a group
+// commit they wait for its sync.
+func (db *DB[T]) logOps(records ...OplogRecord[T]) {
+	if db.group != nil {
+		db.group.records = append(db.group.records, records...) // logged once synced
+		return
+	}
+	for _, record := range records {
+		if record.Value != nil {
+			db.watchers.wake(record.Key)
+		}
+		db.countChange(record)
+	}
+	if len(records) == 0 || (db.oplog == nil && db.history == nil) {
+		return
+	}
+	now := time.Now()
+	seq := db.Checkpoint().Seq // the last change of the write, which synced them all
+	for i := range records {
+		records[i].Timestamp = now
+		records[i].Change = seq
+	}
+	if db.oplog != nil {
+		if err := db.oplog.append(records); err != nil {
+			db.recordError(operation[T]{action: "oplog"}, err)
+		}
+	}
+	if db.history != nil {
+		db.history.record(records)
+	}
+}
+
+// entryRecord builds the record of a mutation setting key to entry.
+func entryRecord[T any](op string, key string, entry DbData[T]) OplogRecord[T] {
+	return OplogRecord[T]{Op: op, Key: key, Value: &entry}
+}
+
+// sizedRecord is entryRecord for an entry of sizeKB, as the checks measured
+// it.
+func sizedRecord[T any](op string, key string, entry DbData[T], sizeKB float64) OplogRecord[T] {
+	record := entryRecord(op, key, entry)
+	record.size = int(sizeKB * KB)
+	return record
+}
+
+// RestoreTo rebuilds the data as it was at the given moment by replaying the
+// oplog, and writes it to the new database file fileName in dir. The live
+// database is left untouched. The oplog must have been enabled since the
+// database was created, otherwise earlier entries are missing.
+func (db *DB[T]) RestoreTo(at time.Time, fileName string, dir string) error {
+	return db.restore(func(record OplogRecord[T]) bool {
+		return !record.Timestamp.After(at)
+	}, fileName, dir)
+}
+
+// RestoreToSeq is RestoreTo up to and including the record with sequence
+// number seq.
+func (db *DB[T]) RestoreToSeq(seq uint64, fileName string, dir string) error {
+	return db.restore(func(record OplogRecord[T]) bool {
+		return record.Seq <= seq
+	}, fileName, dir)
+}
+
+func (db *DB[T]) restore(include func(OplogRecord[T]) bool, fileName string, dir string) error {
+	if db.oplog == nil {
+		return dbError.OplogNotEnabled("")
+	}
+	records, err := db.TailOplog(0)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]DbData[T])
+	for _, record := range records {
+		if !include(record) {
+			break // records are in seq, hence time, order
+		}
+		applyOplogRecord(data, record)
+	}
+	return restoreInto(data, fileName, dir)
+}
+
+// restoreInto writes data to the new database file fileName in dir, which
+// must not hold any yet.
+func restoreInto[T any](data map[string]DbData[T], fileName string, dir string) error {
+	storage, err := NewLocalStorage[T](fileName, dir)
+	if err != nil {
+		return err
+	}
+	if err := storage.Lock(); err != nil {
+		return dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
+	}
+	defer storage.Unlock()
+	existing := make(map[string]DbData[T])
+	if err := storage.Load(&existing); err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return dbError.RestoreTargetNotEmpty(fmt.Sprintf("file : %s", storage.filePath))
+	}
+	_, err = storage.Sync(data)
+	return err
+}
+
+// applyOplogRecord replays one record onto data.
+func applyOplogRecord[T any](data map[string]DbData[T], record OplogRecord[T]) {
+	switch record.Op {
+	case OplogCreate, OplogUpdate, OplogTTL:
+		if record.Value != nil {
+			data[record.Key] = *record.Value
+		}
+	case OplogDelete, OplogExpire:
+		delete(data, record.Key)
+	}
+}
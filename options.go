@@ -0,0 +1,524 @@
+package main
+
+import (
+	"runtime"
+	"time"
+)
+
+type dbOptions struct {
+	lazyLoad         bool
+	loadProgress     func(loadedBytes int64, totalBytes int64)
+	readQueueSize    int
+	writeQueueSize   int
+	readWorkers      int
+	validationShards int
+	opTimeout        time.Duration
+	adminPriority    bool
+	copyOnRead       bool
+
+	cleanupInterval  time.Duration
+	cleanupBatchSize int
+	cleanupJitter    time.Duration
+
+	expiredArchivePath string
+
+	follower       bool
+	followInterval time.Duration
+
+	replicaDir string
+
+	oplogPath   string
+	historySize int
+
+	slidingTTL bool
+
+	coalesceWindow time.Duration
+	groupCommit    time.Duration
+
+	maxEntries int
+
+	softDelete          bool
+	softDeleteRetention time.Duration
+
+	anyExtension    bool
+	directoryLayout bool
+
+	rotateAtKB   float64
+	rotationDir  string
+	chainedReads bool
+
+	blobDir string
+
+	opMetadata bool
+	hotKeys    bool
+
+	statusPath     string
+	statusInterval time.Duration
+
+	backupDir       string
+	backupInterval  time.Duration
+	backupRetention time.Duration
+	backupKey       []byte
+
+	createPolicy ConflictPolicy
+	staleGrace   time.Duration
+
+	clock         Clock
+	strictDecode  bool
+	clockSafeLoad bool
+
+	dedup        bool
+	uniqueValues bool
+	tracer       Tracer
+
+	entrySizeLimitKB int
+	entrySizeLimits  map[string]int // Per key prefix, in KB
+
+	maxOpsPerSecond    int
+	maxReadsPerSecond  int
+	maxWritesPerSecond int
+
+	quota       *storageQuota // Shared with the other tenants of a Manager
+	quotaTenant string
+}
+
+// Option configures a DB at open time.
+type Option func(*dbOptions)
+
+func defaultOptions() dbOptions {
+	return dbOptions{
+		readQueueSize:    100,
+		writeQueueSize:   100,
+		readWorkers:      runtime.GOMAXPROCS(0),
+		cleanupInterval:  cleanpInterval,
+		followInterval:   time.Second,
+		clock:            wallClock{},
+		entrySizeLimitKB: EntrySizeLimitMB * KB,
+	}
+}
+
+// WithLazyLoad makes NewDB return as soon as the storage is locked and load
+// the data in the background. Operations issued meanwhile are queued and
+// processed once loading finishes; use WaitLoaded to block until then.
+func WithLazyLoad() Option {
+	return func(o *dbOptions) {
+		o.lazyLoad = true
+	}
+}
+
+// WithLoadProgress registers a callback invoked while the data is loaded, for
+// backends that can report progress (LocalStorage does). It runs on the
+// loading goroutine, so it should return quickly.
+func WithLoadProgress(progress func(loadedBytes int64, totalBytes int64)) Option {
+	return func(o *dbOptions) {
+		o.loadProgress = progress
+	}
+}
+
+// WithQueueSizes sets the buffer size of the read and write queues (100 each
+// by default). Once a queue is full, new operations wait for a free slot.
+func WithQueueSizes(readQueueSize int, writeQueueSize int) Option {
+	return func(o *dbOptions) {
+		o.readQueueSize = readQueueSize
+		o.writeQueueSize = writeQueueSize
+	}
+}
+
+// WithReadWorkers sets how many goroutines serve the read queue (one per
+// CPU by default). Writes go through a single worker, see
+// WithParallelValidation.
+func WithReadWorkers(n int) Option {
+	return func(o *dbOptions) {
+		o.readWorkers = max(n, 1)
+	}
+}
+
+// WithParallelValidation validates the creates and updates of a single key
+// on n goroutines, by key hash, ahead of the write worker: they run the
+// checks of the entries that don't depend on the data (TTL, size,
+// validators, WithCopyOnRead copy) concurrently, and the write worker still
+// applies and syncs every write one at a time. The writes on a key are
+// applied in the order they were queued, but writes on different keys may be
+// applied in another order; the writes on several keys, or none, wait for
+// every write queued before them and hold back those queued after. Every
+// goroutine has a queue of the size of the write queue. 0 or 1, the
+// default, validates on the write worker and keeps every write in queue
+// order.
+func WithParallelValidation(n int) Option {
+	return func(o *dbOptions) {
+		o.validationShards = max(n, 0)
+	}
+}
+
+// WithOpTimeout bounds how long an operation may wait to be queued and
+// processed; past it the call returns ErrDBTimeout. An operation still queued
+// then is dropped, never applied; one already being applied completes.
+func WithOpTimeout(timeout time.Duration) Option {
+	return func(o *dbOptions) {
+		o.opTimeout = timeout
+	}
+}
+
+// WithAdminPriority lets queued admin operations (Compact) jump ahead of the
+// queued writes. By default both lanes are served fairly.
+func WithAdminPriority() Option {
+	return func(o *dbOptions) {
+		o.adminPriority = true
+	}
+}
+
+// WithCopyOnRead makes the DB keep its own deep copy of every value written
+// and hand out deep copies on read, so callers can't mutate the stored state
+// through pointers, slices or maps in T. It costs an encode/decode per value.
+func WithCopyOnRead() Option {
+	return func(o *dbOptions) {
+		o.copyOnRead = true
+	}
+}
+
+// WithCleanupInterval sets how often the cleanup worker removes expired
+// entries (every minute by default). 0 disables the worker: expired entries
+// are then only removed on access or by PurgeExpired/Compact.
+func WithCleanupInterval(interval time.Duration) Option {
+	return func(o *dbOptions) {
+		o.cleanupInterval = interval
+	}
+}
+
+// WithCleanupBatchSize caps how many expired entries one cleanup run removes,
+// bounding the time a run takes; the rest waits for the next runs. 0, the
+// default, removes all of them.
+func WithCleanupBatchSize(batchSize int) Option {
+	return func(o *dbOptions) {
+		o.cleanupBatchSize = batchSize
+	}
+}
+
+// WithCleanupJitter adds a random delay in [0, jitter) to every cleanup
+// interval.
+func WithCleanupJitter(jitter time.Duration) Option {
+	return func(o *dbOptions) {
+		o.cleanupJitter = jitter
+	}
+}
+
+// WithExpiredArchive appends every expired entry to the JSON Lines file at
+// path before removing it, so expired data can be audited or recovered (see
+// ReadExpiredArchive). An entry that can't be archived is not removed.
+func WithExpiredArchive(path string) Option {
+	return func(o *dbOptions) {
+		o.expiredArchivePath = path
+	}
+}
+
+// WithFollower opens the database read-only without taking the storage lock,
+// next to the one process that holds it and writes. The follower polls the
+// storage for changes and reloads its in-memory view, giving one writer and
+// many reader processes on the same machine. Writes return ReadOnlyDatabase
+// until Promote succeeds.
+func WithFollower() Option {
+	return func(o *dbOptions) {
+		o.follower = true
+	}
+}
+
+// WithFollowInterval sets how often a follower checks the storage for changes
+// (every second by default).
+func WithFollowInterval(interval time.Duration) Option {
+	return func(o *dbOptions) {
+		o.followInterval = interval
+	}
+}
+
+// WithReplica mirrors every sync, asynchronously, to a copy of the database
+// file in dir, ideally on another disk. Use PromoteReplica to open it if the
+// primary is lost.
+func WithReplica(dir string) Option {
+	return func(o *dbOptions) {
+		o.replicaDir = dir
+	}
+}
+
+// WithOplog appends every applied mutation (op, key, new value, timestamp,
+// sequence number) to the JSON Lines file at path, typically next to the data
+// file, so external processes can follow the changes (see TailOplog).
+func WithOplog(path string) Option {
+	return func(o *dbOptions) {
+		o.oplogPath = path
+	}
+}
+
+// WithHistory keeps the last n versions of every key, deletes included, for
+// History and ReadVersion. With WithOplog the history is rebuilt from the
+// oplog on open, so it survives restarts; otherwise it starts empty.
+func WithHistory(n int) Option {
+	return func(o *dbOptions) {
+		o.historySize = n
+	}
+}
+
+// WithMaxOpsPerSecond caps the rate of all operations together; above it they
+// fail right away with ErrRateLimited instead of being queued. Bursts of up
+// to n operations are allowed. 0, the default, is unlimited.
+func WithMaxOpsPerSecond(n int) Option {
+	return func(o *dbOptions) {
+		o.maxOpsPerSecond = n
+	}
+}
+
+// WithMaxReadsPerSecond is WithMaxOpsPerSecond for reads only.
+func WithMaxReadsPerSecond(n int) Option {
+	return func(o *dbOptions) {
+		o.maxReadsPerSecond = n
+	}
+}
+
+// WithMaxWritesPerSecond is WithMaxOpsPerSecond for writes only, to protect
+// the disk from a runaway writer.
+func WithMaxWritesPerSecond(n int) Option {
+	return func(o *dbOptions) {
+		o.maxWritesPerSecond = n
+	}
+}
+
+// WithSlidingTTL makes every successful read of an entry with a Ttl push its
+// expiration to Ttl seconds from the read, as session stores need; the new
+// expiration is persisted. Set DbData.Sliding instead to do it for some
+// entries only. Entries created with CreateExpiringAt keep their deadline.
+func WithSlidingTTL() Option {
+	return func(o *dbOptions) {
+		o.slidingTTL = true
+	}
+}
+
+// WithMaxEntries caps the number of entries; creates going over it fail with
+// ErrEntryLimitReached. 0, the default, is unlimited. See Stats for the
+// current count.
+func WithMaxEntries(n int) Option {
+	return func(o *dbOptions) {
+		o.maxEntries = n
+	}
+}
+
+// WithAnyExtension lets OpenPath open a file whatever its extension, or
+// without one, as JSON. NewDB always validates its name.
+func WithAnyExtension() Option {
+	return func(o *dbOptions) {
+		o.anyExtension = true
+	}
+}
+
+// WithDirectoryLayout makes NewDB and NewBytesDB store the database as a
+// directory, <name>.db, holding a manifest, the data segment, the lock, a
+// wal/ and a backups/ directory. An existing single-file database of the same
+// name is migrated into it on open.
+func WithDirectoryLayout() Option {
+	return func(o *dbOptions) {
+		o.directoryLayout = true
+	}
+}
+
+// WithRotation suits log-like workloads: once a create or an enqueue brings
+// the storage to sizeKB, the data set is archived as a timestamped
+// generation file in dir and starts over from an empty one. The removal of
+// every key rotated out is logged to the oplog. sizeKB must be above 0 and
+// is capped to the storage limit.
+func WithRotation(sizeKB float64, dir string) Option {
+	return func(o *dbOptions) {
+		o.rotateAtKB = min(sizeKB, StorageLimitMB*KB)
+		o.rotationDir = dir
+	}
+}
+
+// WithChainedReads makes a read of a key missing from the data fall back to
+// the generations archived by WithRotation, newest first. Each generation is
+// loaded in memory the first time a read reaches it.
+func WithChainedReads() Option {
+	return func(o *dbOptions) {
+		o.chainedReads = true
+	}
+}
+
+// WithEntrySizeLimit sets the limit of an encoded entry, in KB, instead of
+// EntrySizeLimitMB. It is kept between 1 KB and MaxEntrySizeLimitMB.
+func WithEntrySizeLimit(limitKB int) Option {
+	return func(o *dbOptions) {
+		o.entrySizeLimitKB = clampEntrySizeLimit(limitKB)
+	}
+}
+
+// WithEntrySizeLimitFor overrides the entry size limit for the keys starting
+// with prefix, a bucket of related keys; the longest matching prefix wins.
+func WithEntrySizeLimitFor(prefix string, limitKB int) Option {
+	return func(o *dbOptions) {
+		limits := make(map[string]int, len(o.entrySizeLimits)+1)
+		for bucket, limit := range o.entrySizeLimits {
+			limits[bucket] = limit
+		}
+		limits[prefix] = clampEntrySizeLimit(limitKB)
+		o.entrySizeLimits = limits
+	}
+}
+
+func clampEntrySizeLimit(limitKB int) int {
+	return min(max(limitKB, 1), MaxEntrySizeLimitMB*KB)
+}
+
+// WithOpMetadata makes every result carry how its operation was executed:
+// queue wait, execution and sync time, bytes persisted and the checkpoint
+// sequence number reached. See operationResult.Metadata.
+func WithOpMetadata() Option {
+	return func(o *dbOptions) {
+		o.opMetadata = true
+	}
+}
+
+// WithClock makes the DB read the time from clock rather than the wall
+// clock when checking expiration, and wake the cleanup worker with its
+// tickers. Entries keep the creation time they were given.
+func WithClock(clock Clock) Option {
+	return func(o *dbOptions) {
+		o.clock = clock
+	}
+}
+
+// WithClockSafeLoad moves to the load time the creation time of the loaded
+// entries created in the future, as happens after the wall clock was set
+// back, so that their TTL can't outlive the change.
+func WithClockSafeLoad() Option {
+	return func(o *dbOptions) {
+		o.clockSafeLoad = true
+	}
+}
+
+// WithStrictDecode checks every entry against T while loading and reports
+// through DecodeIssues the ones with unknown or missing fields, which a plain
+// load drops and zero-fills silently. Only JSON files written by
+// LocalStorage can be checked.
+func WithStrictDecode() Option {
+	return func(o *dbOptions) {
+		o.strictDecode = true
+	}
+}
+
+// WithWriteCoalescing lets updates of hot keys share a sync: an update of a
+// key whose last update was synced less than window ago is kept in memory,
+// where reads see it, and persisted along with the others by one sync window
+// later (or by any sync before that, or by Close). A crash within window
+// loses those updates, although their callers were told they succeeded.
+func WithWriteCoalescing(window time.Duration) Option {
+	return func(o *dbOptions) {
+		o.coalesceWindow = window
+	}
+}
+
+// WithGroupCommit lets concurrent writers share a sync, a group commit: the
+// creates, updates and deletes queued within window of each other are
+// applied in memory and synced together, window after the first of them, and
+// their callers are answered once the sync is done. A write is then as
+// durable when it returns as without the option: LocalStorage fsyncs every
+// sync, so the group shares one fsync. Until then Read and Exists of their
+// keys wait, as they do for any write, but ListKeys, ReadMatching and Stats
+// may already count them. A failed sync rolls back and fails the whole
+// group. Each write waits up to window longer, for much better throughput
+// under concurrent writers.
+func WithGroupCommit(window time.Duration) Option {
+	return func(o *dbOptions) {
+		o.groupCommit = window
+	}
+}
+
+// WithStatusFile keeps a small JSON status file at path, rewritten every
+// interval (5s when 0): entry count, size, last sync and pid, so that
+// external tools can show the state of a running instance. See
+// ReadStatusFile and "kvcli status".
+func WithStatusFile(path string, interval time.Duration) Option {
+	return func(o *dbOptions) {
+		o.statusPath = path
+		o.statusInterval = interval
+	}
+}
+
+// WithAutoBackup writes a backup of the data to dir every interval (see
+// Backup) and removes the backups taken more than retention ago, the newest
+// one excepted; 0 keeps them all. LastBackup and Stats report how the last
+// run went. A zero interval only sets the directory ListBackups lists.
+func WithAutoBackup(interval time.Duration, dir string, retention time.Duration) Option {
+	return func(o *dbOptions) {
+		o.backupInterval = interval
+		o.backupDir = dir
+		o.backupRetention = retention
+	}
+}
+
+// WithStaleGrace keeps expired entries readable for grace: a Read within it
+// returns the entry flagged Stale, so that one caller can refresh it while
+// the others keep being served. The cleanup worker removes the entry once
+// the grace is over; Exists, writes and full scans treat it as expired
+// right away.
+func WithStaleGrace(grace time.Duration) Option {
+	return func(o *dbOptions) {
+		o.staleGrace = grace
+	}
+}
+
+// WithCreatePolicy sets what Create and BatchCreate do with a key holding a
+// live entry: fail with EntryAlreadyExists (FailAll, the default), keep it
+// (SkipExisting) or replace it (Overwrite). Create can override it per call.
+func WithCreatePolicy(policy ConflictPolicy) Option {
+	return func(o *dbOptions) {
+		o.createPolicy = policy
+	}
+}
+
+// WithBackupEncryption encrypts the backups with AES-GCM under key, which
+// must be 16, 24 or 32 bytes long. The same key is needed to verify or
+// restore them.
+func WithBackupEncryption(key []byte) Option {
+	return func(o *dbOptions) {
+		o.backupKey = key
+	}
+}
+
+// WithHotKeys counts the reads of the most read keys, for HotKeys.
+func WithHotKeys() Option {
+	return func(o *dbOptions) {
+		o.hotKeys = true
+	}
+}
+
+// WithDedup indexes the entries by a hash of their value, for
+// FindDuplicates.
+func WithDedup() Option {
+	return func(o *dbOptions) {
+		o.dedup = true
+	}
+}
+
+// WithUniqueValues is WithDedup that also refuses, with DuplicateValue, a
+// create or update writing a value another key already holds, as a content
+// addressed cache wants.
+func WithUniqueValues() Option {
+	return func(o *dbOptions) {
+		o.dedup = true
+		o.uniqueValues = true
+	}
+}
+
+// WithBlobDir keeps the values streamed in by CreateFromReader as files of
+// their own in dir, see CreateFromReader.
+func WithBlobDir(dir string) Option {
+	return func(o *dbOptions) {
+		o.blobDir = dir
+	}
+}
+
+// WithSoftDelete makes Delete and GetAndDelete keep a tombstone of the entry
+// for retention, during which Undelete can restore it. Compact purges the
+// tombstones older than that. Expired entries are still removed for good.
+func WithSoftDelete(retention time.Duration) Option {
+	return func(o *dbOptions) {
+		o.softDelete = true
+		o.softDeleteRetention = retention
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+)
+
+// Pin marks the entry of key as pinned: DeleteMatching and any eviction
+// leave it alone. The flag is stored with the entry and kept by Update,
+// overwriting creates and Rename. Delete still removes a pinned entry, and
+// its TTL still applies.
+func (db *DB[T]) Pin(key string) operationResult[T] {
+	return db.submitPin(key, "pin")
+}
+
+// Unpin clears the flag set by Pin.
+func (db *DB[T]) Unpin(key string) operationResult[T] {
+	return db.submitPin(key, "unpin")
+}
+
+func (db *DB[T]) submitPin(key string, action string) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:   action,
+		key:      key,
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op)
+}
+
+func (db *DB[T]) setPinned(key string, pinned bool) error {
+	entry, exists := db.data.get(key)
+	if !exists {
+		return dbError.KeyNotFound(fmt.Sprintf("key : %s", key))
+	}
+	if db.isExpired(key) {
+		db.expireEntry(key)
+		return dbError.KeyExpired(fmt.Sprintf("key : %s", key))
+	}
+	if entry.Pinned == pinned {
+		return nil
+	}
+	updated := entry
+	updated.Pinned = pinned
+	db.setEntry(key, updated)
+	if err := db.sync(); err != nil {
+		// rollback
+		db.setEntry(key, entry)
+		return err
+	}
+	db.logOps(entryRecord(OplogUpdate, key, db.data.entry(key)))
+	return nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"maps"
+	"slices"
+	"time"
+)
+
+// ChangePlan is what a destructive operation would change if it ran now,
+// worked out without changing anything, for a dry run. Tombstones count as
+// entries of their own.
+type ChangePlan struct {
+	Removed        []string `json:"removed"` // sorted, as are the others
+	Added          []string `json:"added"`
+	Changed        []string `json:"changed"`         // replaced by another version
+	BytesReclaimed int64    `json:"bytes_reclaimed"` // JSON size of the entries, which the file shrinks by; negative if it grows
+}
+
+// Keys returns how many keys the plan affects.
+func (plan ChangePlan) Keys() int {
+	return len(plan.Removed) + len(plan.Added) + len(plan.Changed)
+}
+
+// PlanDeleteMatching returns the keys DeleteMatching would delete, all of
+// them rather than MaxMatchResults at most. With WithSoftDelete they turn into
+// tombstones, which take a few bytes more.
+func (db *DB[T]) PlanDeleteMatching(pattern string) (ChangePlan, error) {
+	if err := db.planReady(); err != nil {
+		return ChangePlan{}, err
+	}
+	compiled, err := compileKeyPattern(pattern)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+	keys, _ := db.matchingKeys(compiled, -1, false)
+	plan := ChangePlan{Removed: keys}
+	softDelete := db.opts().softDelete
+	now := time.Now()
+	for _, key := range keys {
+		entry := db.data.entry(key)
+		size, err := entrySize(entry)
+		if err != nil {
+			return ChangePlan{}, err
+		}
+		plan.BytesReclaimed += size
+		if softDelete {
+			entry.Deleted_at = &now
+			if size, err = entrySize(entry); err != nil {
+				return ChangePlan{}, err
+			}
+			plan.BytesReclaimed -= size
+		}
+	}
+	return plan, nil
+}
+
+// PlanCompact returns the expired entries and the tombstones past their
+// retention Compact would drop.
+func (db *DB[T]) PlanCompact() (ChangePlan, error) {
+	if err := db.planReady(); err != nil {
+		return ChangePlan{}, err
+	}
+	dropped := make(map[string]DbData[T])
+	for _, key := range db.expiredKeys() {
+		dropped[key] = db.data.entry(key)
+	}
+	now := time.Now()
+	db.dataMu.RLock()
+	for key, tombstone := range db.tombstones {
+		if db.tombstoneExpired(tombstone, now) {
+			dropped[key] = tombstone
+		}
+	}
+	db.dataMu.RUnlock()
+	plan := ChangePlan{Removed: slices.Sorted(maps.Keys(dropped))}
+	for _, entry := range dropped {
+		size, err := entrySize(entry)
+		if err != nil {
+			return ChangePlan{}, err
+		}
+		plan.BytesReclaimed += size
+	}
+	return plan, nil
+}
+
+// PlanRestore verifies the backup at path, as VerifyBackup does, and returns
+// what RestoreInPlace would change: the keys it would remove, add, and set
+// to the version of the backup.
+func (db *DB[T]) PlanRestore(path string) (ChangePlan, error) {
+	if err := db.planReady(); err != nil {
+		return ChangePlan{}, err
+	}
+	_, restored, err := db.readBackup(path)
+	if err != nil {
+		return ChangePlan{}, err
+	}
+	current := db.data.snapshot()
+	db.dataMu.RLock()
+	maps.Copy(current, db.tombstones)
+	db.dataMu.RUnlock()
+
+	var plan ChangePlan
+	for key, entry := range current {
+		size, err := entrySize(entry)
+		if err != nil {
+			return ChangePlan{}, err
+		}
+		backedUp, kept := restored[key]
+		if !kept {
+			plan.Removed = append(plan.Removed, key)
+			plan.BytesReclaimed += size
+			continue
+		}
+		if !sameData(entry, backedUp) {
+			plan.Changed = append(plan.Changed, key)
+			plan.BytesReclaimed += size
+		}
+	}
+	for key, entry := range restored {
+		if previous, exists := current[key]; exists {
+			if sameData(previous, entry) {
+				continue
+			}
+		} else {
+			plan.Added = append(plan.Added, key)
+		}
+		size, err := entrySize(entry)
+		if err != nil {
+			return ChangePlan{}, err
+		}
+		plan.BytesReclaimed -= size
+	}
+	slices.Sort(plan.Removed)
+	slices.Sort(plan.Added)
+	slices.Sort(plan.Changed)
+	return plan, nil
+}
+
+// planReady fails if the DB can't be planned on: closed, or not loaded.
+func (db *DB[T]) planReady() error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	<-db.ready
+	return db.loadErr
+}
+
+// entrySize returns the size of the entry in a JSON file.
+func entrySize[T any](entry DbData[T]) (int64, error) {
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return 0, dbError.FailedToConvertMapToJson(fmt.Sprintf("%s", err))
+	}
+	return int64(len(encoded)), nil
+}
+
+// sameData reports whether two versions of an entry hold the same data,
+// whatever write stored them.
+func sameData[T any](a DbData[T], b DbData[T]) bool {
+	a.Seq, b.Seq = 0, 0
+	return sameEntry(a, b)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// queueNameLimit keeps the item keys, "q.<name>.<16 hex digits>", within
+// KeySizeLimit.
+const queueNameLimit = KeySizeLimit - len("q..") - 16
+
+// Queue is a FIFO job queue stored in a DB: every item is an entry of its
+// own, keyed by the queue name and an increasing sequence number. Dequeue
+// hides the item it returns for a visibility timeout instead of removing it,
+// and hands out a receipt with it; Ack removes the item with that receipt
+// once processed, otherwise it is handed out again, with a new receipt,
+// after the timeout. Since which items are hidden is only kept in memory,
+// every item not acked is visible again after a restart. A pinned marker
+// entry keyed by the queue prefix, "q.<name>.", holds the last sequence
+// number handed out, so IDs aren't reused once every item is acked. Dequeue
+// and Peek scan the queue's keys, which suits small local queues.
+type Queue[T any] struct {
+	db     *DB[T]
+	name   string
+	prefix string
+}
+
+// QueueItem is an item handed out by Dequeue or Peek.
+type QueueItem[T any] struct {
+	ID         string // Key of the item in the DB
+	Receipt    string // Set by Dequeue only, to Ack the item
+	Value      T
+	EnqueuedAt time.Time
+}
+
+// queueState is what the write worker knows of a queue besides its entries.
+type queueState struct {
+	nextSeq uint64
+	hidden  map[string]hiddenItem // Dequeued items
+}
+
+// hiddenItem is a dequeued item: until when it is hidden, and the receipt
+// acking it.
+type hiddenItem struct {
+	until   time.Time
+	receipt string
+}
+
+// NewQueue returns the queue name of db, holding the items already enqueued
+// under that name. Names are up to 13 characters, without dots.
+func NewQueue[T any](db *DB[T], name string) (*Queue[T], error) {
+	if name == "" || len(name) > queueNameLimit || strings.Contains(name, ".") {
+		return nil, dbError.InvalidQueueName(fmt.Sprintf("%q: 1 to %d characters, no dots", name, queueNameLimit))
+	}
+	return &Queue[T]{db: db, name: name, prefix: "q." + name + "."}, nil
+}
+
+// Enqueue appends value to the queue and returns its ID.
+func (q *Queue[T]) Enqueue(value T) (string, error) {
+	result := q.submit(operation[T]{action: "enqueue", key: q.prefix, value: DbData[T]{Value: value}})
+	if result.err != nil {
+		return "", result.err
+	}
+	return result.keys[0], nil
+}
+
+// Dequeue hands out the oldest visible item and hides it for visibility,
+// which must be positive. It fails with QueueEmpty when every item is hidden
+// or there is none.
+func (q *Queue[T]) Dequeue(visibility time.Duration) (QueueItem[T], error) {
+	if visibility <= 0 {
+		return QueueItem[T]{}, dbError.InvalidTTL(fmt.Sprintf("visibility %v is not positive", visibility))
+	}
+	return q.item(q.submit(operation[T]{action: "dequeue", key: q.prefix, visibility: visibility}))
+}
+
+// Peek returns the item Dequeue would hand out, without hiding it.
+func (q *Queue[T]) Peek() (QueueItem[T], error) {
+	return q.item(q.submit(operation[T]{action: "queuePeek", key: q.prefix}))
+}
+
+// Ack removes an item once processed, given the receipt Dequeue handed out
+// with it. It fails with ReceiptInvalid once the visibility timeout passed,
+// as the item may have been handed out again. The item is dropped, never
+// kept as a tombstone by WithSoftDelete.
+func (q *Queue[T]) Ack(id string, receipt string) error {
+	if _, ok := queueSeq(q.prefix, id); !ok || len(id) != len(q.prefix)+16 {
+		return dbError.KeyNotFound(fmt.Sprintf("%s is not an item of queue %s", id, q.name))
+	}
+	return q.submit(operation[T]{action: "queueAck", key: id, receipt: receipt}).err
+}
+
+func (q *Queue[T]) submit(op operation[T]) operationResult[T] {
+	if q.db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op.response = make(chan operationResult[T], 1)
+	return q.db.submitWrite(op)
+}
+
+func (q *Queue[T]) item(result operationResult[T]) (QueueItem[T], error) {
+	if result.err != nil {
+		return QueueItem[T]{}, result.err
+	}
+	return QueueItem[T]{ID: result.keys[0], Receipt: result.keys[1], Value: result.value.Value, EnqueuedAt: result.value.Created_at}, nil
+}
+
+// queue returns the state of the queue with prefix, taking the last sequence
+// number from its marker and its entries the first time.
+func (db *DB[T]) queue(prefix string) *queueState {
+	if state, ok := db.queues[prefix]; ok {
+		return state
+	}
+	state := &queueState{nextSeq: 1, hidden: make(map[string]hiddenItem)}
+	if marker, ok := db.data.get(prefix); ok {
+		state.nextSeq = marker.QueueSeq + 1
+	}
+	for _, key := range db.data.keys() {
+		if seq, ok := queueSeq(prefix, key); ok && seq >= state.nextSeq {
+			state.nextSeq = seq + 1
+		}
+	}
+	db.queues[prefix] = state
+	return state
+}
+
+func queueSeq(prefix string, key string) (uint64, bool) {
+	if !strings.HasPrefix(key, prefix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(key[len(prefix):], 16, 64)
+	return seq, err == nil
+}
+
+// enqueueItem stores value as the next item, along with the queue's marker
+// in the same sync. The caller holds the lock of prefix, the marker's key.
+func (db *DB[T]) enqueueItem(prefix string, value T) (string, error) {
+	state := db.queue(prefix)
+	key := fmt.Sprintf("%s%016x", prefix, state.nextSeq)
+	unlock := db.lockKey(key)
+	defer unlock()
+	previous, existed := db.data.get(prefix)
+	marker := DbData[T]{Created_at: time.Now(), Pinned: true, QueueSeq: state.nextSeq}
+	db.setEntry(prefix, marker)
+	if err := db.create(key, DbData[T]{Value: value, Created_at: time.Now()}); err != nil {
+		// rollback
+		if existed {
+			db.setEntry(prefix, previous)
+		} else {
+			db.removeEntry(prefix)
+		}
+		return "", err
+	}
+	state.nextSeq++
+	db.logOps(entryRecord(OplogUpdate, prefix, marker))
+	return key, nil
+}
+
+// nextItem finds the oldest visible item of the queue; with hide, it is
+// hidden until visibility from now, under a new receipt.
+func (db *DB[T]) nextItem(prefix string, hide bool, visibility time.Duration) (string, string, DbData[T], error) {
+	state := db.queue(prefix)
+	now := time.Now()
+	next := ""
+	for _, key := range db.data.keys() {
+		if _, ok := queueSeq(prefix, key); !ok || (next != "" && key > next) || db.isExpired(key) {
+			continue
+		}
+		if item, hidden := state.hidden[key]; hidden && now.Before(item.until) {
+			continue
+		}
+		next = key // fixed width sequence numbers sort as strings
+	}
+	for key, item := range state.hidden {
+		if exists := db.data.has(key); !exists || !now.Before(item.until) {
+			delete(state.hidden, key) // acked or visible again
+		}
+	}
+	if next == "" {
+		return "", "", DbData[T]{}, dbError.QueueEmpty(prefix)
+	}
+	receipt := ""
+	if hide {
+		var err error
+		if receipt, err = randomToken(); err != nil {
+			return "", "", DbData[T]{}, err
+		}
+		state.hidden[next] = hiddenItem{until: now.Add(visibility), receipt: receipt}
+	}
+	entry, err := db.ownCopy(db.data.entry(next))
+	return next, receipt, entry, err
+}
+
+// ackItem drops the item key, still hidden under receipt, as releaseLease
+// drops a lease: never as a tombstone.
+func (db *DB[T]) ackItem(key string, receipt string) error {
+	state := db.queue(key[:len(key)-16])
+	item, hidden := state.hidden[key]
+	if !hidden || item.receipt != receipt || !time.Now().Before(item.until) || !db.data.has(key) {
+		return dbError.ReceiptInvalid(fmt.Sprintf("key : %s", key))
+	}
+	previous := db.data.entry(key)
+	db.removeEntry(key)
+	if err := db.sync(); err != nil {
+		db.setEntry(key, previous) // rollback
+		return err
+	}
+	delete(state.hidden, key)
+	db.logOps(OplogRecord[T]{Op: OplogDelete, Key: key})
+	return nil
+}
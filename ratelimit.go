@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sync"
+	"time"
+)
+
+// Operation kinds the rate limits apply to.
+const (
+	readKind  = "read"
+	writeKind = "write"
+	adminKind = "admin"
+)
+
+// tokenBucket allows rate operations per second on average, with bursts of up
+// to one second's worth.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+}
+
+// rateLimiter enforces WithMaxOpsPerSecond and the per-kind limits. A nil
+// bucket is unlimited.
+type rateLimiter struct {
+	mu    sync.Mutex
+	total *tokenBucket
+	kinds map[string]*tokenBucket
+}
+
+func newRateLimiter(options dbOptions) *rateLimiter {
+	limiter := &rateLimiter{
+		total: newTokenBucket(options.maxOpsPerSecond),
+		kinds: map[string]*tokenBucket{
+			readKind:  newTokenBucket(options.maxReadsPerSecond),
+			writeKind: newTokenBucket(options.maxWritesPerSecond),
+		},
+	}
+	if limiter.total == nil && limiter.kinds[readKind] == nil && limiter.kinds[writeKind] == nil {
+		return nil
+	}
+	return limiter
+}
+
+// allow takes a token from every bucket the kind is subject to, only if all
+// of them have one.
+func (l *rateLimiter) allow(kind string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	buckets := []*tokenBucket{l.total, l.kinds[kind]}
+	for _, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			return false
+		}
+	}
+	for _, bucket := range buckets {
+		if bucket != nil {
+			bucket.tokens--
+		}
+	}
+	return true
+}
+
+// throttle rejects op if it goes over the configured rates. Internal
+// operations (follower reloads, cleanup runs) are never limited.
+func (db *DB[T]) throttle(kind string, op operation[T]) error {
+	limiter := db.limiter.Load()
+	if limiter == nil || op.action == "reload" || op.action == "cleanup" {
+		return nil
+	}
+	if !limiter.allow(kind) {
+		return dbError.ErrRateLimited(fmt.Sprintf("%s over the %s rate limit", op.action, kind))
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sort"
+	"time"
+)
+
+// SyncCheckpoint tracks how far the storage is known to match the in-memory
+// data. Every change applied in memory, rollbacks included, takes the next
+// sequence number; a successful sync writes the whole data set and so
+// checkpoints the sequence reached.
+type SyncCheckpoint struct {
+	Seq       uint64    // Last change applied in memory
+	SyncedSeq uint64    // Seq at the last successful sync
+	LastSync  time.Time // Time of the last successful sync, zero before the first one
+	SyncErr   error     // Error of the last failed sync, nil once a sync succeeded again
+	// Diverged is set when a sync failed after SyncedSeq: the rollback
+	// restored memory, but the storage may hold a partial write until the
+	// next successful sync or Reconcile.
+	Diverged bool
+}
+
+// ReconcileReport is the result of Reconcile. The key lists are sorted.
+type ReconcileReport struct {
+	Entries  int      // Entries in memory, tombstones not included
+	Missing  []string // In memory (tombstones included), not in the storage
+	Extra    []string // In the storage, not in memory
+	Changed  []string // In both, with different contents
+	LoadErr  error    // Why the storage couldn't be read back, if it couldn't
+	Repaired bool     // Whether the storage was rewritten from memory
+}
+
+// Consistent reports whether the storage matched memory.
+func (report ReconcileReport) Consistent() bool {
+	return report.LoadErr == nil && len(report.Missing) == 0 && len(report.Extra) == 0 && len(report.Changed) == 0
+}
+
+// Checkpoint returns the current sync checkpoint.
+func (db *DB[T]) Checkpoint() SyncCheckpoint {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	return db.checkpoint
+}
+
+// ChangedSince lists, sorted, the keys written after the change with
+// sequence number seq, such as Checkpoint().Seq read earlier: their entries
+// (or tombstones, see WithSoftDelete) carry a higher Seq. Keys deleted for
+// good are not listed, but Checkpoint().Seq moving past seq still tells that
+// something changed.
+func (db *DB[T]) ChangedSince(seq uint64) ([]string, error) {
+	if db.closed.Load() {
+		return nil, dbError.DBAlreadyClosed("")
+	}
+	changed := []string{}
+	for key, entry := range db.data.snapshot() {
+		if entry.Seq > seq {
+			changed = append(changed, key)
+		}
+	}
+	db.dataMu.RLock()
+	for key, tombstone := range db.tombstones {
+		if tombstone.Seq > seq {
+			changed = append(changed, key)
+		}
+	}
+	db.dataMu.RUnlock()
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Reconcile reads the storage back and compares it with the in-memory data,
+// which is authoritative: only the write worker changes it and it is rolled
+// back when a sync fails. Any divergence, an unreadable storage or a
+// checkpoint left diverged by a failed sync is repaired by rewriting the
+// storage from memory. It goes through the admin lane, so no write runs
+// meanwhile. The error is only set when the repair fails.
+func (db *DB[T]) Reconcile() (ReconcileReport, error) {
+	if db.closed.Load() {
+		return ReconcileReport{}, dbError.DBAlreadyClosed("")
+	}
+	if db.readOnly.Load() {
+		return ReconcileReport{}, dbError.ReadOnlyDatabase("")
+	}
+	op := operation[T]{
+		action:   "reconcile",
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submit(db.adminOps, op)
+	if result.reconcile == nil {
+		return ReconcileReport{}, result.err
+	}
+	return *result.reconcile, result.err
+}
+
+func (db *DB[T]) reconcile() (ReconcileReport, error) {
+	report := ReconcileReport{Entries: db.data.len()}
+	expected := db.persisted()
+	stored := make(map[string]DbData[T])
+	if err := db.storage.Load(&stored); err != nil {
+		report.LoadErr = err
+	} else {
+		for key, entry := range expected {
+			storedEntry, exists := stored[key]
+			if !exists {
+				report.Missing = append(report.Missing, key)
+			} else if !sameEntry(entry, storedEntry) {
+				report.Changed = append(report.Changed, key)
+			}
+		}
+		for key := range stored {
+			if _, exists := expected[key]; !exists {
+				report.Extra = append(report.Extra, key)
+			}
+		}
+		sort.Strings(report.Missing)
+		sort.Strings(report.Extra)
+		sort.Strings(report.Changed)
+	}
+
+	if report.Consistent() && !db.Checkpoint().Diverged {
+		return report, nil
+	}
+	if err := db.sync(); err != nil {
+		return report, err
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// sameEntry compares entries as they are persisted: times read back from
+// the storage lose their monotonic reading and location.
+func sameEntry[T any](a DbData[T], b DbData[T]) bool {
+	encodedA, errA := json.Marshal(a)
+	encodedB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// sync writes the whole data set to the storage and moves the checkpoint.
+// Every write path syncs through it. Within a group commit it only marks
+// the group for commitGroup to sync.
+func (db *DB[T]) sync() error {
+	if db.group != nil {
+		db.group.dirty = true // commitGroup syncs
+		return nil
+	}
+	started := time.Now()
+	tracing := db.opts().tracer != nil
+	var span Span = noopSpan{}
+	if tracing {
+		_, span = db.startSpan(db.writeTraceCtx, "kv.sync", operation[T]{action: "sync"})
+	}
+	if local, ok := db.localStorage(); ok {
+		local.seq = db.Checkpoint().Seq
+	}
+	written, err := db.storage.Sync(db.persisted())
+	if quota := db.opts().quota; quota != nil {
+		quota.settle(db.opts().quotaTenant, db.storage.Size)
+	}
+	db.meterSync(started, written, err)
+	db.countSync(written, err)
+	if err == nil && tracing {
+		span.SetAttributes(Attribute{Key: "kv.size", Value: written})
+	}
+	endSpan(span, err)
+	db.checkpointMu.Lock()
+	if err != nil {
+		db.checkpoint.SyncErr = fmt.Errorf("sync after change %d: %w", db.checkpoint.Seq, err)
+		db.checkpoint.Diverged = true
+		db.checkpointMu.Unlock()
+		return err
+	}
+	db.checkpoint.SyncedSeq = db.checkpoint.Seq
+	db.checkpoint.LastSync = time.Now()
+	db.checkpoint.SyncErr = nil
+	db.checkpoint.Diverged = false
+	seq, at := db.checkpoint.SyncedSeq, db.checkpoint.LastSync
+	db.checkpointMu.Unlock()
+	db.coalescer.synced("", at)
+	db.runFlushHooks(seq, started, at)
+	return nil
+}
+
+// changed takes the next checkpoint sequence number for a change to db.data
+// and returns it.
+func (db *DB[T]) changed() uint64 {
+	db.checkpointMu.Lock()
+	defer db.checkpointMu.Unlock()
+	db.checkpoint.Seq++
+	return db.checkpoint.Seq
+}
+
+// seenSeq moves the checkpoint sequence number up to seq, the number of an
+// entry read from the storage, so that numbering resumes after the highest
+// one stored rather than from 0 on every open.
+func (db *DB[T]) seenSeq(seq uint64) {
+	db.checkpointMu.Lock()
+	db.checkpoint.Seq = max(db.checkpoint.Seq, seq)
+	db.checkpointMu.Unlock()
+}
+
+// loaded checkpoints data just read from the storage, which it matches.
+func (db *DB[T]) loaded() {
+	db.checkpointMu.Lock()
+	db.checkpoint.SyncedSeq = db.checkpoint.Seq
+	db.checkpoint.Diverged = false
+	db.checkpointMu.Unlock()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Recovery: with WithOplog, opening a DB stored in a local file checks the
+// data against the tail of the oplog. The data file is the checkpoint: it
+// holds every change up to the sequence number in its header (see
+// schemaHeader). The oplog records of later changes, left out by a data file
+// rolled back or replaced by an older copy, are replayed on top and the
+// result synced. If the data file can't be loaded at all and WithAutoBackup
+// sets a backup directory, the newest backup passing VerifyBackup is the
+// checkpoint instead.
+
+// RecoveryReport tells what opening the DB recovered, see Recovery.
+type RecoveryReport struct {
+	Checkpoint    string // Path of the backup the data was loaded from, "" for the storage
+	CheckpointSeq uint64 // Sequence number of the last change the checkpoint holds
+	LoadErr       error  // Why the storage couldn't be loaded, when a backup was used
+	Replayed      int    // Oplog records applied on top of the checkpoint
+	Skipped       int    // Oplog records the checkpoint already holds
+	Corrupt       int    // Oplog lines from the first one failing its checksum on, cut off
+}
+
+// Recovered reports whether anything had to be recovered.
+func (report RecoveryReport) Recovered() bool {
+	return report.Replayed > 0 || report.Checkpoint != ""
+}
+
+// Recovery returns the report of the recovery run when the DB was opened,
+// the zero report without WithOplog or while WithLazyLoad is still loading.
+func (db *DB[T]) Recovery() RecoveryReport {
+	select {
+	case <-db.ready:
+		return db.recovery
+	default:
+		return RecoveryReport{}
+	}
+}
+
+// recoverCheckpoint loads into data the newest backup passing VerifyBackup,
+// in place of the storage, which failed to load with loadErr.
+func (db *DB[T]) recoverCheckpoint(data *map[string]DbData[T], loadErr error) bool {
+	dir := db.opts().backupDir
+	if dir == "" {
+		return false
+	}
+	paths, err := backupPaths(dir)
+	if err != nil {
+		return false
+	}
+	for i := len(paths) - 1; i >= 0; i-- {
+		if manifest, backup, err := db.readBackup(paths[i]); err == nil {
+			*data = backup
+			db.recovery.Checkpoint = paths[i]
+			db.recovery.CheckpointSeq = manifest.Seq
+			db.recovery.LoadErr = loadErr
+			return true
+		}
+	}
+	return false
+}
+
+// replayOplog applies to data, the checkpoint, the oplog records of the
+// changes it doesn't hold.
+func (db *DB[T]) replayOplog(data map[string]DbData[T]) error {
+	for _, entry := range data { // files written before the header had a Seq
+		db.recovery.CheckpointSeq = max(db.recovery.CheckpointSeq, entry.Seq)
+	}
+	records, err := db.TailOplog(0) // cut to the last good record by openOplog
+	if err != nil {
+		return fmt.Errorf("oplog: %w", err)
+	}
+	db.recovery.Corrupt = db.oplog.corrupt
+	for _, record := range records {
+		if record.Change <= db.recovery.CheckpointSeq { // records written before Change existed included
+			db.recovery.Skipped++
+			continue
+		}
+		if record.Value != nil {
+			entry := *record.Value
+			entry.Seq = record.Change
+			record.Value = &entry
+		}
+		applyOplogRecord(data, record)
+		db.seenSeq(record.Change) // deletes included
+		db.recovery.Replayed++
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"time"
+)
+
+// Rename moves the entry of oldKey to newKey, replacing any entry there, as
+// a single write with a single sync: TTL, creation time, metadata and last
+// write time are kept, and no other operation on either key runs in
+// between. It fails with KeyNotFound or KeyExpired if oldKey holds no live
+// entry.
+func (db *DB[T]) Rename(oldKey string, newKey string) operationResult[T] {
+	return db.submitRename(oldKey, newKey, Overwrite)
+}
+
+// RenameNX is Rename failing with EntryAlreadyExists if newKey holds a live
+// entry.
+func (db *DB[T]) RenameNX(oldKey string, newKey string) operationResult[T] {
+	return db.submitRename(oldKey, newKey, FailAll)
+}
+
+func (db *DB[T]) submitRename(oldKey string, newKey string, policy ConflictPolicy) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:    "rename",
+		key:       oldKey,
+		batchKeys: []string{oldKey, newKey},
+		policy:    policy,
+		response:  make(chan operationResult[T], 1),
+	}
+	if oldKey == newKey {
+		op.batchKeys = op.batchKeys[:1]
+	}
+	return db.submitWrite(op)
+}
+
+// rename moves oldKey to newKey; policy is FailAll for RenameNX and
+// Overwrite for Rename. The caller holds the locks of both keys.
+func (db *DB[T]) rename(oldKey string, newKey string, policy ConflictPolicy) error {
+	entry, exists := db.data.get(oldKey)
+	if !exists {
+		return dbError.KeyNotFound(fmt.Sprintf("key : %s", oldKey))
+	}
+	if db.isExpired(oldKey) {
+		db.expireEntry(oldKey)
+		return dbError.KeyExpired(fmt.Sprintf("key : %s", oldKey))
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	if err := db.checkMutable(oldKey); err != nil {
+		return err
+	}
+	target, targetExists := db.data.get(newKey)
+	if targetExists && db.isExpired(newKey) {
+		if err := db.expireEntry(newKey); err != nil {
+			return err
+		}
+		targetExists = false
+	}
+	if targetExists && policy == FailAll {
+		return dbError.EntryAlreadyExists(fmt.Sprintf("key : %s", newKey))
+	}
+	if err := db.checkMutable(newKey); err != nil {
+		return err
+	}
+	sizeKB, err := db.validateEntry(newKey, entry)
+	if err != nil {
+		return err
+	}
+	if err := db.validate(newKey, entry.Value); err != nil {
+		return err
+	}
+
+	updated := time.Now()
+	if times, indexed := db.keyIndex.times[oldKey]; indexed {
+		updated = time.Unix(0, times[1])
+	}
+	tombstone, hadTombstone := db.tombstones[newKey]
+	db.removeTombstone(newKey)
+	db.removeEntry(oldKey)
+	db.setEntryAt(newKey, entry, updated)
+	if err := db.sync(); err != nil {
+		// rollback
+		db.removeEntry(newKey)
+		if targetExists {
+			db.setEntry(newKey, target)
+		}
+		if hadTombstone {
+			db.setTombstone(newKey, tombstone)
+		}
+		db.setEntryAt(oldKey, entry, updated)
+		return err
+	}
+	record := sizedRecord(OplogCreate, newKey, db.data.entry(newKey), sizeKB)
+	if targetExists {
+		record.Op = OplogUpdate
+	}
+	db.logOps(OplogRecord[T]{Op: OplogDelete, Key: oldKey}, record)
+	return nil
+}
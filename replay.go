@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"strings"
+	"time"
+)
+
+// ReplayFilter selects the oplog records ReplayOplog applies, by key and
+// time of the record.
+type ReplayFilter func(key string, at time.Time) bool
+
+// ReplayKeyPrefix keeps the records of the keys starting with prefix.
+func ReplayKeyPrefix(prefix string) ReplayFilter {
+	return func(key string, at time.Time) bool {
+		return strings.HasPrefix(key, prefix)
+	}
+}
+
+// ReplayTimeRange keeps the records from from on, included, up to to,
+// excluded. A zero bound leaves that side open.
+func ReplayTimeRange(from time.Time, to time.Time) ReplayFilter {
+	return func(key string, at time.Time) bool {
+		return !at.Before(from) && (to.IsZero() || at.Before(to))
+	}
+}
+
+// ReplayFailure is an oplog record ReplayOplog couldn't apply.
+type ReplayFailure struct {
+	Seq uint64 `json:"seq"`
+	Key string `json:"key"`
+	Err string `json:"error"`
+}
+
+// ReplayReport sums up a ReplayOplog.
+type ReplayReport struct {
+	Records  int             `json:"records"` // Read, the filtered out ones included
+	Applied  int             `json:"applied"`
+	Filtered int             `json:"filtered"` // Left out by a filter
+	Failed   int             `json:"failed"`
+	Failures []ReplayFailure `json:"failures"`
+}
+
+// ReplayOplog re-applies the records of an oplog, as written by WithOplog, to
+// target, typically a fresh database: one at a time, in order, so the same
+// oplog always gives the same data. Creates, updates and TTL changes store
+// the recorded entry, with its recorded times; deletes and expirations
+// remove the key, which counts as applied if it is gone already. The records
+// left out by any of the filters are skipped. A record the target rejects is
+// reported in Failures and the replay goes on; it stops with OplogCorrupted
+// at the first line that can't be decoded or fails its checksum.
+func ReplayOplog[T any](r io.Reader, target *DB[T], filters ...ReplayFilter) (ReplayReport, error) {
+	var report ReplayReport
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*KB), (MaxEntrySizeLimitMB+1)*MB)
+	for line := 1; scanner.Scan(); line++ {
+		record, ok := decodeOplogLine[T](scanner.Bytes())
+		if !ok {
+			return report, dbError.OplogCorrupted(fmt.Sprintf("line %d", line))
+		}
+		report.Records++
+		if !replayed(record, filters) {
+			report.Filtered++
+			continue
+		}
+		if err := replayRecord(target, record, 0); err != nil {
+			if target.closed.Load() {
+				return report, err
+			}
+			report.Failed++
+			report.Failures = append(report.Failures, ReplayFailure{Seq: record.Seq, Key: record.Key, Err: err.Error()})
+			continue
+		}
+		report.Applied++
+	}
+	if err := scanner.Err(); err != nil {
+		return report, dbError.OplogCorrupted(fmt.Sprintf("after record %d: %s", report.Records, err))
+	}
+	return report, nil
+}
+
+func replayed[T any](record OplogRecord[T], filters []ReplayFilter) bool {
+	for _, filter := range filters {
+		if !filter(record.Key, record.Timestamp) {
+			return false
+		}
+	}
+	return true
+}
+
+// replayRecord applies one oplog record to db, its times moved by shift.
+func replayRecord[T any](db *DB[T], record OplogRecord[T], shift time.Duration) error {
+	switch record.Op {
+	case OplogCreate, OplogUpdate, OplogTTL:
+		if record.Value == nil {
+			return nil
+		}
+		entry := *record.Value
+		entry.Seq = 0
+		entry.Created_at = entry.Created_at.Add(shift)
+		if entry.Expires_at != nil {
+			expiresAt := entry.Expires_at.Add(shift)
+			entry.Expires_at = &expiresAt
+		}
+		return db.Create(record.Key, entry, Overwrite).err
+	case OplogDelete, OplogExpire:
+		err := db.Delete(record.Key).err
+		var dbErr *dbError.DBError
+		if errors.As(err, &dbErr) && (dbErr.Message == errorMessage(dbError.KeyNotFound("")) || dbErr.Message == errorMessage(dbError.KeyExpired(""))) {
+			return nil // gone already
+		}
+		return err
+	default:
+		return dbError.InvalidRequest(fmt.Sprintf("unknown oplog operation %q", record.Op))
+	}
+}
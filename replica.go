@@ -0,0 +1,210 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"sync"
+)
+
+// replicatedStorage mirrors every sync of the primary storage to a replica
+// LocalStorage in another directory (another disk, a network mount). The
+// replica is written asynchronously by its own goroutine; when syncs come
+// faster than the replica can be written, only the latest state is written.
+type replicatedStorage[T any] struct {
+	Storage[T] // the primary
+	replica    *LocalStorage[T]
+
+	mu      sync.Mutex
+	pending map[string]DbData[T] // latest state not mirrored yet, nil if none
+	lastErr error                // last replica write error
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newReplicatedStorage[T any](primary Storage[T], replicaDir string) (*replicatedStorage[T], error) {
+	var replica *LocalStorage[T]
+	var err error
+	if local, ok := primary.(*LocalStorage[T]); ok {
+		// same file name, which OpenPath may have taken from any path
+		replica, err = openLocalStorage[T](filepath.Join(replicaDir, local.fileName()), local.binary)
+	} else {
+		replica, err = newLocalStorage[T]("replica", replicaDir, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &replicatedStorage[T]{
+		Storage: primary,
+		replica: replica,
+		wake:    make(chan struct{}, 1),
+	}, nil
+}
+
+func (rs *replicatedStorage[T]) Load(dataToLoad *map[string]DbData[T]) error {
+	if err := rs.Storage.Load(dataToLoad); err != nil {
+		return err
+	}
+	rs.schedule(*dataToLoad) // bring a stale replica up to date
+	return nil
+}
+
+func (rs *replicatedStorage[T]) LoadWithProgress(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) error {
+	progressLoader, ok := rs.Storage.(ProgressLoader[T])
+	if !ok {
+		return rs.Load(dataToLoad)
+	}
+	if err := progressLoader.LoadWithProgress(dataToLoad, progress); err != nil {
+		return err
+	}
+	rs.schedule(*dataToLoad)
+	return nil
+}
+
+func (rs *replicatedStorage[T]) LoadStrict(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) ([]DecodeIssue, error) {
+	strictLoader, ok := rs.Storage.(StrictLoader[T])
+	if !ok {
+		return nil, rs.LoadWithProgress(dataToLoad, progress)
+	}
+	issues, err := strictLoader.LoadStrict(dataToLoad, progress)
+	if err != nil {
+		return issues, err
+	}
+	rs.schedule(*dataToLoad)
+	return issues, nil
+}
+
+// Sync returns the bytes written to the primary; the replica gets them in
+// the background.
+func (rs *replicatedStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	written, err := rs.Storage.Sync(data)
+	if err != nil {
+		return 0, err
+	}
+	rs.schedule(data)
+	return written, nil
+}
+
+// schedule queues a copy of data for the replica; the map itself keeps
+// changing once Sync returns.
+func (rs *replicatedStorage[T]) schedule(data map[string]DbData[T]) {
+	rs.mu.Lock()
+	rs.pending = maps.Clone(data)
+	if rs.pending == nil {
+		rs.pending = make(map[string]DbData[T])
+	}
+	rs.mu.Unlock()
+	select {
+	case rs.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Lock locks the primary and the replica, so a replica can't be promoted
+// while its primary is still running.
+func (rs *replicatedStorage[T]) Lock() error {
+	if err := rs.Storage.Lock(); err != nil {
+		return err
+	}
+	if err := rs.replica.Lock(); err != nil {
+		rs.Storage.Unlock()
+		return err
+	}
+	rs.stop = make(chan struct{})
+	rs.done = make(chan struct{})
+	go rs.replicateWorker()
+	return nil
+}
+
+// Unlock writes any pending state to the replica, then releases both. It
+// returns the last replica write error, if the replica couldn't be written.
+func (rs *replicatedStorage[T]) Unlock() error {
+	if rs.stop != nil {
+		close(rs.stop)
+		<-rs.done
+		rs.stop = nil
+	}
+	rs.flush()
+	replicaErr := rs.replica.Unlock()
+	if err := rs.Storage.Unlock(); err != nil {
+		return err
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.lastErr != nil {
+		return rs.lastErr
+	}
+	return replicaErr
+}
+
+func (rs *replicatedStorage[T]) replicateWorker() {
+	defer close(rs.done)
+	for {
+		select {
+		case <-rs.wake:
+			rs.flush()
+		case <-rs.stop:
+			return
+		}
+	}
+}
+
+func (rs *replicatedStorage[T]) flush() {
+	rs.mu.Lock()
+	pending := rs.pending
+	rs.pending = nil
+	rs.mu.Unlock()
+	if pending == nil {
+		return
+	}
+	_, err := rs.replica.Sync(pending)
+	rs.mu.Lock()
+	rs.lastErr = err
+	rs.mu.Unlock()
+}
+
+// LockHeld reports whether the primary and the replica are both still
+// locked.
+func (rs *replicatedStorage[T]) LockHeld() bool {
+	if reporter, ok := rs.Storage.(HealthReporter); ok && !reporter.LockHeld() {
+		return false
+	}
+	return rs.replica.LockHeld()
+}
+
+// CheckWritable fails if either the primary or the replica can't be written.
+func (rs *replicatedStorage[T]) CheckWritable() error {
+	if reporter, ok := rs.Storage.(HealthReporter); ok {
+		if err := reporter.CheckWritable(); err != nil {
+			return err
+		}
+	}
+	return rs.replica.CheckWritable()
+}
+
+// Dir returns the primary's directory; see replicaDir for the replica's.
+func (rs *replicatedStorage[T]) Dir() string {
+	if reporter, ok := rs.Storage.(HealthReporter); ok {
+		return reporter.Dir()
+	}
+	return ""
+}
+
+func (rs *replicatedStorage[T]) replicaDir() string {
+	return rs.replica.Dir()
+}
+
+// Version is the primary's version, "" (never changing) if it has none.
+func (rs *replicatedStorage[T]) Version() (string, error) {
+	if versioned, ok := rs.Storage.(VersionedStorage); ok {
+		return versioned.Version()
+	}
+	return "", nil
+}
+
+// PromoteReplica opens the replica kept in replicaDir by WithReplica as the
+// database, for when the primary is lost. It fails with FailedToAcquireLock
+// while the primary is still running.
+func PromoteReplica[T any](fileName string, replicaDir string, opts ...Option) (*DB[T], error) {
+	return NewDB[T](fileName, replicaDir, opts...)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rotation: with WithRotation, once a write growing the data brings the
+// storage to the size given, the whole data set is archived as a new
+// generation file in the rotation directory, "gen-<UTC time>.json", and the
+// data starts over empty. With WithChainedReads a read missing in the live
+// data falls back to the generations, newest first.
+
+const generationPrefix = "gen-"
+
+// generationTimeFormat sorts the generation files chronologically.
+const generationTimeFormat = "20060102T150405.000000000Z"
+
+// loadedGenerationsSize is how many generations chained reads keep decoded.
+const loadedGenerationsSize = 4
+
+// generations lists the archived generation files, oldest first, and keeps
+// the last loadedGenerationsSize loaded by chained reads; they never change
+// once written.
+type generations[T any] struct {
+	mu        sync.Mutex
+	dir       string
+	paths     []string
+	loaded    map[string]map[string]DbData[T]
+	loadedLRU []string // paths in loaded, least recently used first
+}
+
+func openGenerations[T any](dir string) (*generations[T], error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, dbError.FailedToCreateDirectory(fmt.Sprintf("%s", err))
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, generationPrefix+"*.json"))
+	if err != nil {
+		return nil, dbError.FailedToCheckDir(fmt.Sprintf("%s", err))
+	}
+	sort.Strings(paths)
+	return &generations[T]{dir: dir, paths: paths, loaded: make(map[string]map[string]DbData[T])}, nil
+}
+
+// Generations lists the generation files archived by rotation, oldest
+// first.
+func (db *DB[T]) Generations() []string {
+	if db.generations == nil {
+		return nil
+	}
+	db.generations.mu.Lock()
+	defer db.generations.mu.Unlock()
+	return append([]string(nil), db.generations.paths...)
+}
+
+// archive writes data as the next generation file.
+func (gens *generations[T]) archive(data map[string]DbData[T], at time.Time) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", dbError.FailedToConvertMapToJson(fmt.Sprintf("%s", err))
+	}
+	path := filepath.Join(gens.dir, generationPrefix+at.UTC().Format(generationTimeFormat)+".json")
+	err = writeFileAtomically(path, func(file *os.File) error {
+		_, err := file.Write(encoded)
+		return err
+	})
+	if err != nil {
+		return "", dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	gens.mu.Lock()
+	gens.paths = append(gens.paths, path)
+	gens.mu.Unlock()
+	return path, nil
+}
+
+// forget drops a generation whose rotation was rolled back.
+func (gens *generations[T]) forget(path string) {
+	gens.mu.Lock()
+	defer gens.mu.Unlock()
+	gens.paths = gens.paths[:len(gens.paths)-1]
+	os.Remove(path)
+}
+
+// lookup finds key in the newest generation holding it, skipping expired
+// entries.
+func (gens *generations[T]) lookup(key string) (DbData[T], bool, error) {
+	gens.mu.Lock()
+	defer gens.mu.Unlock()
+	for i := len(gens.paths) - 1; i >= 0; i-- {
+		data, err := gens.load(gens.paths[i])
+		if err != nil {
+			return DbData[T]{}, false, err
+		}
+		entry, exists := data[key]
+		if !exists {
+			continue
+		}
+		if expiresAt, ok := entry.expiresAt(); ok && time.Now().After(expiresAt) {
+			return DbData[T]{}, false, nil
+		}
+		return entry, true, nil
+	}
+	return DbData[T]{}, false, nil
+}
+
+// blobs adds the blob files referenced by the generations to referenced.
+func (gens *generations[T]) blobs(referenced map[string]bool) error {
+	gens.mu.Lock()
+	defer gens.mu.Unlock()
+	for _, path := range gens.paths {
+		data, err := gens.load(path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range data {
+			if entry.Blob != nil {
+				referenced[entry.Blob.File] = true
+			}
+		}
+	}
+	return nil
+}
+
+func (gens *generations[T]) load(path string) (map[string]DbData[T], error) {
+	if data, ok := gens.loaded[path]; ok {
+		gens.used(path)
+		return data, nil
+	}
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	data := make(map[string]DbData[T])
+	if err := json.Unmarshal(encoded, &data); err != nil {
+		return nil, dbError.FailedToLoadFile(fmt.Sprintf("%s: %s", filepath.Base(path), err))
+	}
+	for key, entry := range data {
+		if entry.Deleted_at != nil {
+			delete(data, key) // tombstones are archived too, they don't chain
+		}
+	}
+	if len(gens.loadedLRU) == loadedGenerationsSize {
+		delete(gens.loaded, gens.loadedLRU[0])
+		gens.loadedLRU = gens.loadedLRU[1:]
+	}
+	gens.loaded[path] = data
+	gens.loadedLRU = append(gens.loadedLRU, path)
+	return data, nil
+}
+
+// used moves a loaded path to the most recently used end.
+func (gens *generations[T]) used(path string) {
+	i := slices.Index(gens.loadedLRU, path)
+	gens.loadedLRU = append(slices.Delete(gens.loadedLRU, i, i+1), path)
+}
+
+// growingActions are the writes checked for rotation once they applied.
+// An update doesn't rotate: it rewrites a key it would then move out of
+// reach.
+var growingActions = map[string]bool{"create": true, "batchCreate": true, "enqueue": true}
+
+// rotateIfDue rotates after op applied, when the storage reached the
+// rotation size. A failed rotation is recorded and left for the next write
+// to retry; op itself succeeded.
+func (db *DB[T]) rotateIfDue(op operation[T]) {
+	if db.generations == nil || !growingActions[op.action] {
+		return
+	}
+	sizeKB, err := db.storage.Size()
+	if err == nil && sizeKB < db.opts().rotateAtKB {
+		return
+	}
+	if err == nil {
+		err = db.rotate()
+	} else {
+		err = dbError.FailedToGetFileSize("")
+	}
+	db.recordError(operation[T]{action: "rotate"}, err)
+}
+
+// rotate archives the data set, tombstones included, as a generation and
+// empties it, logging the removal of every key.
+func (db *DB[T]) rotate() error {
+	data := db.persisted()
+	path, err := db.generations.archive(data, time.Now())
+	if err != nil {
+		return err
+	}
+	entries, tombstones := db.data.snapshot(), db.tombstones
+	keys := db.data.keys()
+	sort.Strings(keys)
+	unlock := db.lockKeys(keys)
+	defer unlock()
+	index, values := db.keyIndex, db.values
+	db.data.replace(nil)
+	db.dataMu.Lock()
+	db.tombstones = make(map[string]DbData[T])
+	db.keyIndex = newKeyIndex()
+	if values != nil {
+		db.values = newValueIndex()
+	}
+	db.dataMu.Unlock()
+	db.changed()
+	for _, key := range keys {
+		db.expiries.remove(key)
+	}
+	if err := db.sync(); err != nil {
+		// rollback
+		db.data.replace(entries)
+		db.dataMu.Lock()
+		db.tombstones, db.keyIndex, db.values = tombstones, index, values
+		db.dataMu.Unlock()
+		db.changed()
+		for key, entry := range entries {
+			if expiresAt, ok := entry.expiresAt(); ok {
+				db.expiries.set(key, expiresAt.Add(db.opts().staleGrace))
+			}
+		}
+		db.generations.forget(path)
+		return err
+	}
+	records := make([]OplogRecord[T], 0, len(keys))
+	for _, key := range keys {
+		records = append(records, OplogRecord[T]{Op: OplogDelete, Key: key})
+	}
+	db.logOps(records...)
+	return nil
+}
+
+// chainedRead looks a key missing from the live data up in the generations.
+func (db *DB[T]) chainedRead(key string) (DbData[T], error) {
+	entry, found, err := db.generations.lookup(key)
+	if err != nil {
+		return DbData[T]{}, err
+	}
+	if !found {
+		return DbData[T]{}, dbError.KeyNotFound("")
+	}
+	return db.ownCopy(entry)
+}
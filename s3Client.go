@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3Client is a small ObjectClient for S3-compatible services (AWS S3, MinIO,
+// R2, ...). It signs requests with AWS Signature V4 and uses path-style URLs:
+// {Endpoint}/{Bucket}/{key}.
+type S3Client struct {
+	Endpoint        string // e.g. https://s3.eu-west-1.amazonaws.com
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	HTTPClient      *http.Client
+}
+
+func NewS3Client(endpoint string, bucket string, region string, accessKeyID string, secretAccessKey string) *S3Client {
+	return &S3Client{
+		Endpoint:        strings.TrimSuffix(endpoint, "/"),
+		Bucket:          bucket,
+		Region:          region,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		HTTPClient:      http.DefaultClient,
+	}
+}
+
+func (c *S3Client) PutObject(ctx context.Context, key string, body []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return c.responseError(resp)
+	}
+	return nil
+}
+
+func (c *S3Client) GetObject(ctx context.Context, key string) ([]byte, bool, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, false, c.responseError(resp)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, dbError.ObjectStorageRequestFailed(fmt.Sprintf("%s", err))
+	}
+	return body, true, nil
+}
+
+func (c *S3Client) do(ctx context.Context, method string, key string, body []byte) (*http.Response, error) {
+	path := "/" + s3URIEncode(c.Bucket) + "/" + s3URIEncode(key)
+	req, err := http.NewRequestWithContext(ctx, method, c.Endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, dbError.ObjectStorageRequestFailed(fmt.Sprintf("%s", err))
+	}
+	c.sign(req, path, body, time.Now().UTC())
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, dbError.ObjectStorageRequestFailed(fmt.Sprintf("%s", err))
+	}
+	return resp, nil
+}
+
+func (c *S3Client) responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return dbError.ObjectStorageRequestFailed(fmt.Sprintf("status %d: %s", resp.StatusCode, msg))
+}
+
+// sign adds the AWS Signature V4 headers to req.
+func (c *S3Client) sign(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		"", // no query string
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, c.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3URIEncode encodes everything except the unreserved characters and '/',
+// as required for the canonical URI of a signed request.
+func s3URIEncode(s string) string {
+	var result strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if (ch >= 'A' && ch <= 'Z') || (ch >= 'a' && ch <= 'z') || (ch >= '0' && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			result.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&result, "%%%02X", ch)
+		}
+	}
+	return result.String()
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// schemaHeaderKey is the member of a JSON database file that holds its
+// schemaHeader. It is longer than KeySizeLimit, so no key can take it.
+const schemaHeaderKey = "__local-key-value-DB.schema_header__"
+
+// schemaHeader identifies the type of value a database file was written
+// with. LocalStorage writes it in every file and fails to load a file whose
+// header doesn't match T; files written before headers existed load as is.
+// The header also records how far the data goes, see SyncCheckpoint.
+// Gob files start with it, JSON files hold it under schemaHeaderKey.
+type schemaHeader struct {
+	Type        string `json:"type"`          // T as reflect prints it, for error messages
+	Fingerprint string `json:"fingerprint"`   // Hash of the structure of T, see schemaOf
+	Seq         uint64 `json:"seq,omitempty"` // Checkpoint sequence number the file was written at
+}
+
+// schemaOf returns the header of files holding values of type T. The
+// fingerprint covers what the encoding depends on: field names (or their
+// JSON names) and types, recursively. Two types with the same structure
+// share it whatever their names. Types that take any value, such as
+// json.RawMessage the CLI opens files with, have no fingerprint: they match
+// any file.
+func schemaOf[T any]() schemaHeader {
+	t := reflect.TypeFor[T]()
+	if t == reflect.TypeFor[json.RawMessage]() || t.Kind() == reflect.Interface {
+		return schemaHeader{Type: t.String()}
+	}
+	hash := sha256.Sum256([]byte(describeType(t, map[reflect.Type]bool{})))
+	return schemaHeader{Type: t.String(), Fingerprint: hex.EncodeToString(hash[:8])}
+}
+
+// check fails with ErrTypeMismatch if the file's header doesn't match
+// expected.
+func (header schemaHeader) check(expected schemaHeader) error {
+	if header.Fingerprint == expected.Fingerprint || header.Fingerprint == "" || expected.Fingerprint == "" {
+		return nil
+	}
+	return dbError.ErrTypeMismatch(fmt.Sprintf("file written for %s (schema %s), opened as %s (schema %s)", header.Type, header.Fingerprint, expected.Type, expected.Fingerprint))
+}
+
+var (
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// describeType spells out the structure of t. Types encoding themselves,
+// such as time.Time, are described by name since their fields don't tell.
+func describeType(t reflect.Type, seen map[reflect.Type]bool) string {
+	if t.Implements(jsonMarshalerType) || t.Implements(textMarshalerType) ||
+		reflect.PointerTo(t).Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType) {
+		return t.String()
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return "*" + describeType(t.Elem(), seen)
+	case reflect.Slice:
+		return "[]" + describeType(t.Elem(), seen)
+	case reflect.Array:
+		return fmt.Sprintf("[%d]%s", t.Len(), describeType(t.Elem(), seen))
+	case reflect.Map:
+		return "map[" + describeType(t.Key(), seen) + "]" + describeType(t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] { // recursive type
+			return t.String()
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		var description strings.Builder
+		description.WriteString("struct{")
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name := field.Name
+			if tag, _, _ := strings.Cut(field.Tag.Get("json"), ","); tag == "-" {
+				continue
+			} else if tag != "" {
+				name = tag
+			}
+			fmt.Fprintf(&description, "%s %s;", name, describeType(field.Type, seen))
+		}
+		description.WriteString("}")
+		return description.String()
+	default:
+		return t.Kind().String()
+	}
+}
+
+// encodeGobFile writes header, then data.
+func encodeGobFile[T any](w io.Writer, header schemaHeader, data map[string]DbData[T]) error {
+	encoder := gob.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	return encoder.Encode(data)
+}
+
+// decodeGobFile reads a file written by encodeGobFile, or a headerless one
+// written before, in which case the header is nil.
+func decodeGobFile[T any](r io.ReadSeeker, data *map[string]DbData[T]) (*schemaHeader, error) {
+	decoder := gob.NewDecoder(r)
+	var header schemaHeader
+	if err := decoder.Decode(&header); err != nil {
+		// no header: the file starts with the data
+		if _, seekErr := r.Seek(0, io.SeekStart); seekErr != nil {
+			return nil, seekErr
+		}
+		return nil, gob.NewDecoder(r).Decode(data)
+	}
+	return &header, decoder.Decode(data)
+}
+
+// appendJSONFile appends data as a JSON object with header as its first
+// member, encoding the data right after the header rather than into a copy
+// first. Large data is encoded in parallel shards, see encodeShards.
+func appendJSONFile[T any](buffer *encodeBuffer, header schemaHeader, data map[string]DbData[T]) error {
+	if err := appendJSONHeader(buffer, header); err != nil {
+		return err
+	}
+	start := buffer.Len()
+	if len(data) == 0 {
+		buffer.WriteString("}\n")
+		return nil
+	}
+	if len(data) >= parallelEncodeMin {
+		err := encodeShards(slices.Sorted(maps.Keys(data)), data, func(shard []byte, _ []int) {
+			buffer.Write(shard)
+		})
+		buffer.WriteString("}\n")
+		return err
+	}
+	if err := buffer.encoder.Encode(data); err != nil {
+		return err
+	}
+	buffer.Bytes()[start] = ',' // the data's opening brace, ending with "}\n"
+	return nil
+}
+
+// appendJSONHeader opens the JSON object of a file with its header member.
+func appendJSONHeader(buffer *encodeBuffer, header schemaHeader) error {
+	fmt.Fprintf(buffer, "{%q:", schemaHeaderKey)
+	return buffer.encodeJSON(header)
+}
+
+// decodeJSONFile reads a JSON object written by appendJSONFile, or by a
+// version without the header, in which case the header is nil.
+func decodeJSONFile[T any](r io.Reader, data *map[string]DbData[T]) (*schemaHeader, error) {
+	var members map[string]json.RawMessage
+	if err := json.NewDecoder(r).Decode(&members); err != nil {
+		return nil, err
+	}
+	var header *schemaHeader
+	if encodedHeader, exists := members[schemaHeaderKey]; exists {
+		header = &schemaHeader{}
+		if err := json.Unmarshal(encodedHeader, header); err != nil {
+			return nil, err
+		}
+		delete(members, schemaHeaderKey)
+	}
+	*data = make(map[string]DbData[T], len(members))
+	for key, encoded := range members {
+		var entry DbData[T]
+		if err := json.Unmarshal(encoded, &entry); err != nil {
+			return nil, fmt.Errorf("key %s: %w", key, err)
+		}
+		(*data)[key] = entry
+	}
+	return header, nil
+}
@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultServerAddr is where Serve listens when ServerConfig.Addr is empty.
+const DefaultServerAddr = "127.0.0.1:7380"
+
+// maxRequestBytes caps the body of the requests HTTPHandler reads.
+const maxRequestBytes = 64 * MB
+
+// defaultShutdownTimeout is how long Close waits for the requests in flight
+// when ServerConfig.ShutdownTimeout is 0.
+const defaultShutdownTimeout = 5 * time.Second
+
+// ServerConfig configures the HTTP server started by Serve.
+type ServerConfig struct {
+	Addr              string        // Listen address, DefaultServerAddr when empty
+	Listener          net.Listener  // Listener to serve on instead of Addr, a unix socket for instance
+	CertFile          string        // PEM certificate, with KeyFile: serve HTTPS
+	KeyFile           string        // PEM private key of CertFile
+	TLSConfig         *tls.Config   // Base TLS settings, client certificates for instance; HTTPS if it has certificates
+	AllowInsecure     bool          // Allow plain HTTP on an address that isn't loopback
+	Authorizer        Authorizer    // Checks the bearer token of every request, nil to let them all through
+	ReadHeaderTimeout time.Duration // 10s when 0
+	ShutdownTimeout   time.Duration // How long Close waits for the requests in flight, 5s when 0
+}
+
+// Server is an HTTP server started by Serve. Close shuts it down.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+	tls      bool
+	timeout  time.Duration
+	done     chan struct{} // closed once Serve returned
+	err      error         // why Serve returned, nil after a shutdown
+}
+
+// Addr returns the address the server listens on, with the port picked by
+// the system when the config asked for port 0.
+func (server *Server) Addr() net.Addr {
+	return server.listener.Addr()
+}
+
+// URL returns the base URL of the server, "https://..." with TLS.
+func (server *Server) URL() string {
+	if server.tls {
+		return "https://" + server.Addr().String()
+	}
+	return "http://" + server.Addr().String()
+}
+
+// Shutdown stops the server gracefully: it stops accepting connections and
+// waits for the requests in flight until ctx is done.
+func (server *Server) Shutdown(ctx context.Context) error {
+	err := server.server.Shutdown(ctx)
+	<-server.done
+	return err
+}
+
+// Err returns why the server stopped on its own, nil while it runs and
+// after a shutdown.
+func (server *Server) Err() error {
+	select {
+	case <-server.done:
+		return server.err
+	default:
+		return nil
+	}
+}
+
+// Serve exposes the DB over HTTP, see HTTPHandler, until Close, which first
+// shuts the server down gracefully so the requests in flight complete. It
+// refuses plain HTTP on an address that isn't loopback unless
+// AllowInsecure is set.
+func (db *DB[T]) Serve(config ServerConfig) (*Server, error) {
+	if db.closed.Load() {
+		return nil, dbError.DBAlreadyClosed("")
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	listener := config.Listener
+	if listener == nil {
+		addr := config.Addr
+		if addr == "" {
+			addr = DefaultServerAddr
+		}
+		if listener, err = net.Listen("tcp", addr); err != nil {
+			return nil, dbError.ServerFailed(fmt.Sprintf("%s", err))
+		}
+	}
+	if tlsConfig == nil && !config.AllowInsecure && !isLoopback(listener.Addr()) {
+		listener.Close()
+		return nil, dbError.ServerFailed(fmt.Sprintf("plain HTTP on %s, configure TLS or set AllowInsecure", listener.Addr()))
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	readHeaderTimeout := config.ReadHeaderTimeout
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = 10 * time.Second
+	}
+	// cancelled by Shutdown, so the requests waiting on a key don't hold it up
+	baseCtx, cancel := context.WithCancel(context.Background())
+	httpServer := &http.Server{
+		Handler:           db.HTTPHandler(config.Authorizer),
+		ReadHeaderTimeout: readHeaderTimeout,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+	}
+	httpServer.RegisterOnShutdown(cancel)
+	server := &Server{
+		server:   httpServer,
+		listener: listener,
+		tls:      tlsConfig != nil,
+		timeout:  config.ShutdownTimeout,
+		done:     make(chan struct{}),
+	}
+	if server.timeout == 0 {
+		server.timeout = defaultShutdownTimeout
+	}
+	db.serversMu.Lock()
+	if db.closed.Load() {
+		db.serversMu.Unlock()
+		listener.Close()
+		return nil, dbError.DBAlreadyClosed("")
+	}
+	db.servers = append(db.servers, server)
+	db.serversMu.Unlock()
+	go func() {
+		defer close(server.done)
+		if err := server.server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			server.err = err
+		}
+	}()
+	return server, nil
+}
+
+// tlsConfig returns the TLS settings of the config, nil for plain HTTP.
+func (config ServerConfig) tlsConfig() (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, dbError.ServerFailed(fmt.Sprintf("loading the certificate: %s", err))
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, certificate)
+	}
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetCertificate == nil) {
+		return nil, nil
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+	return tlsConfig, nil
+}
+
+func isLoopback(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true // unix sockets and the like don't leave the machine
+	}
+	return tcp.IP.IsLoopback()
+}
+
+// stopServers shuts the servers started by Serve down, each waiting for its
+// requests in flight at most its ShutdownTimeout.
+func (db *DB[T]) stopServers() {
+	db.serversMu.Lock()
+	servers := db.servers
+	db.servers = nil
+	db.serversMu.Unlock()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), server.timeout)
+			defer cancel()
+			if server.Shutdown(ctx) != nil {
+				server.server.Close() // the timeout passed, drop the rest
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// HTTPHandler serves the DB as a JSON API, the one Serve exposes, to be
+// mounted in an application's own server as well:
+//
+//	GET    /v1/keys/{key}[?wait=true]     read the entry, waiting for it with wait, see WaitFor
+//	POST   /v1/keys/{key}[?policy=...]    create it, policy being fail, skip or overwrite
+//	PUT    /v1/keys/{key}                 update it
+//	DELETE /v1/keys/{key}                 delete it
+//	GET    /v1/keys?prefix=&limit=&after= list the keys, see ListKeys
+//	POST   /v1/batch[?policy=...]         create the entries of a JSON object at once
+//	GET    /v1/stats                      Stats
+//	GET    /v1/metrics                    Stats in the Prometheus text format, see MetricsHandler
+//
+// Entries are DbData in JSON. Errors come as {"message", "info"}, the fields
+// of the dbError, with a status that matches them (404 for a missing key,
+// 409 for a conflict, 429 when rate limited, 500 for a failed sync, ...). With an authorizer, every request needs an
+// "Authorization: Bearer <token>" header the authorizer allows the action
+// ("read", "create", "update", "delete", "list", "batchCreate", "stats") for,
+// on the key, on the prefix for "list" and on every key for "batchCreate";
+// the metrics take "stats" as well. A list only returns the keys the caller
+// may "list" too, and a create with the overwrite policy needs "update" on
+// its keys as well.
+// A write with an "Idempotency-Key" header repeating the one of a write
+// answered in the last 10 minutes, from the same caller to the same URL,
+// gets the same response without being applied again, so clients can retry
+// writes safely.
+func (db *DB[T]) HTTPHandler(authorizer Authorizer) http.Handler {
+	api := &httpAPI[T]{db: db, authorizer: authorizer, idempotency: newIdempotencyCache()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/keys/{key...}", api.read)
+	mux.HandleFunc("POST /v1/keys/{key...}", api.idempotent(api.create))
+	mux.HandleFunc("PUT /v1/keys/{key...}", api.idempotent(api.update))
+	mux.HandleFunc("DELETE /v1/keys/{key...}", api.idempotent(api.delete))
+	mux.HandleFunc("GET /v1/keys", api.list)
+	mux.HandleFunc("POST /v1/batch", api.idempotent(api.batch))
+	mux.HandleFunc("GET /v1/stats", api.stats)
+	mux.HandleFunc("GET /v1/metrics", api.metrics)
+	return mux
+}
+
+type httpAPI[T any] struct {
+	db          *DB[T]
+	authorizer  Authorizer
+	idempotency *idempotencyCache // Responses to the writes with an Idempotency-Key
+}
+
+// apiError is how the API sends a dbError.
+type apiError struct {
+	Message string `json:"message"`
+	Info    string `json:"info,omitempty"`
+}
+
+// apiBatchEntry is what the API reports of one key of a batch.
+type apiBatchEntry struct {
+	Status string    `json:"status"`
+	Err    *apiError `json:"error,omitempty"`
+}
+
+type apiBatchResult struct {
+	Entries map[string]apiBatchEntry `json:"entries"`
+	Applied int                      `json:"applied"`
+	Skipped int                      `json:"skipped"`
+	Failed  int                      `json:"failed"`
+	Aborted int                      `json:"aborted"`
+}
+
+// allowed checks the request against the authorizer for action on every
+// key, writing the error response if it isn't.
+func (api *httpAPI[T]) allowed(w http.ResponseWriter, r *http.Request, action string, keys ...string) bool {
+	if api.authorizer == nil {
+		return true
+	}
+	token := bearerToken(r)
+	for _, key := range keys {
+		if err := api.authorizer.Authorize(token, action, key); err != nil {
+			writeAPIError(w, err)
+			return false
+		}
+	}
+	return true
+}
+
+// overwriteAllowed is allowed for "update" as well when policy replaces the
+// existing entries, which a caller only allowed to create mustn't.
+func (api *httpAPI[T]) overwriteAllowed(w http.ResponseWriter, r *http.Request, policy ConflictPolicy, keys ...string) bool {
+	return policy != Overwrite || api.allowed(w, r, "update", keys...)
+}
+
+// authorizedKeys drops the keys the caller isn't allowed action on, which a
+// deny under the prefix it was allowed on hides.
+func (api *httpAPI[T]) authorizedKeys(r *http.Request, action string, keys []string) []string {
+	if api.authorizer == nil {
+		return keys
+	}
+	token := bearerToken(r)
+	allowed := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if api.authorizer.Authorize(token, action, key) == nil {
+			allowed = append(allowed, key)
+		}
+	}
+	return allowed
+}
+
+func (api *httpAPI[T]) read(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !api.allowed(w, r, "read", key) {
+		return
+	}
+	if r.URL.Query().Get("wait") == "true" {
+		entry, err := api.db.WaitFor(r.Context(), key)
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+	result := api.db.Read(key)
+	if result.err != nil {
+		writeAPIError(w, result.err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result.value)
+}
+
+func (api *httpAPI[T]) create(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	policy, ok := api.policy(w, r)
+	if !ok || !api.allowed(w, r, "create", key) || !api.overwriteAllowed(w, r, policy, key) {
+		return
+	}
+	var entry DbData[T]
+	if !readJSON(w, r, &entry) {
+		return
+	}
+	if err := api.db.Create(key, entry, policy).err; err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (api *httpAPI[T]) update(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !api.allowed(w, r, "update", key) {
+		return
+	}
+	var entry DbData[T]
+	if !readJSON(w, r, &entry) {
+		return
+	}
+	if err := api.db.Update(key, entry).err; err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI[T]) delete(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if !api.allowed(w, r, "delete", key) {
+		return
+	}
+	if err := api.db.Delete(key).err; err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (api *httpAPI[T]) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if !api.allowed(w, r, "list", query.Get("prefix")) {
+		return
+	}
+	opts := ListOptions{Prefix: query.Get("prefix"), After: query.Get("after")}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if opts.Limit, err = strconv.Atoi(limit); err != nil {
+			writeAPIError(w, dbError.InvalidRequest(fmt.Sprintf("limit : %q", limit)))
+			return
+		}
+	}
+	page, err := api.db.ListKeys(opts)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": api.authorizedKeys(r, "list", page.Keys), "next": page.Next})
+}
+
+func (api *httpAPI[T]) batch(w http.ResponseWriter, r *http.Request) {
+	policy, ok := api.policy(w, r)
+	if !ok {
+		return
+	}
+	var entries map[string]DbData[T]
+	if !readJSON(w, r, &entries) {
+		return
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	if !api.allowed(w, r, "batchCreate", keys...) || !api.overwriteAllowed(w, r, policy, keys...) {
+		return
+	}
+	result := api.db.BatchCreateWithPolicy(entries, policy)
+	if result.Err != nil {
+		writeAPIError(w, result.Err)
+		return
+	}
+	response := apiBatchResult{
+		Entries: make(map[string]apiBatchEntry, len(result.Entries)),
+		Applied: result.Applied,
+		Skipped: result.Skipped,
+		Failed:  result.Failed,
+		Aborted: result.Aborted,
+	}
+	for key, entry := range result.Entries {
+		response.Entries[key] = apiBatchEntry{Status: entry.Status, Err: toAPIError(entry.Err)}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (api *httpAPI[T]) stats(w http.ResponseWriter, r *http.Request) {
+	if !api.allowed(w, r, "stats", "") {
+		return
+	}
+	writeJSON(w, http.StatusOK, api.db.Stats())
+}
+
+func (api *httpAPI[T]) metrics(w http.ResponseWriter, r *http.Request) {
+	if !api.allowed(w, r, "stats", "") {
+		return
+	}
+	api.db.MetricsHandler().ServeHTTP(w, r)
+}
+
+// policy reads the policy query parameter, the DB's create policy if there
+// is none.
+func (api *httpAPI[T]) policy(w http.ResponseWriter, r *http.Request) (ConflictPolicy, bool) {
+	switch name := r.URL.Query().Get("policy"); name {
+	case "":
+		return api.db.opts().createPolicy, true
+	case "fail":
+		return FailAll, true
+	case "skip":
+		return SkipExisting, true
+	case "overwrite":
+		return Overwrite, true
+	default:
+		writeAPIError(w, dbError.InvalidRequest(fmt.Sprintf("policy : %q", name)))
+		return 0, false
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(value); err != nil {
+		writeAPIError(w, dbError.InvalidRequest(fmt.Sprintf("body: %s", err)))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := apiStatus(err)
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1") // the rate limits refill every second
+	}
+	writeJSON(w, status, toAPIError(err))
+}
+
+func toAPIError(err error) *apiError {
+	if err == nil {
+		return nil
+	}
+	var dbErr *dbError.DBError
+	if errors.As(err, &dbErr) {
+		return &apiError{Message: dbErr.Message, Info: dbErr.AdditionalInfo}
+	}
+	return &apiError{Message: err.Error()}
+}
+
+// apiStatuses maps the message of the dbErrors to their HTTP status: the
+// ones not listed are about the request, 400 Bad Request.
+var apiStatuses = map[string]int{
+	errorMessage(dbError.KeyNotFound("")):          http.StatusNotFound,
+	errorMessage(dbError.EntryNotExists("")):       http.StatusNotFound,
+	errorMessage(dbError.KeyExpired("")):           http.StatusNotFound,
+	errorMessage(dbError.EntryExpired("")):         http.StatusNotFound,
+	errorMessage(dbError.VersionNotFound("")):      http.StatusNotFound,
+	errorMessage(dbError.EntryAlreadyExists("")):   http.StatusConflict,
+	errorMessage(dbError.ErrImmutableEntry("")):    http.StatusConflict,
+	errorMessage(dbError.DuplicateValue("")):       http.StatusConflict,
+	errorMessage(dbError.ReceiptInvalid("")):       http.StatusConflict,
+	errorMessage(dbError.LeaseHeld("")):            http.StatusConflict,
+	errorMessage(dbError.LeaseLost("")):            http.StatusConflict,
+	errorMessage(dbError.ReadOnlyDatabase("")):     http.StatusConflict,
+	errorMessage(dbError.PreconditionFailed("")):   http.StatusPreconditionFailed,
+	errorMessage(dbError.Unauthorized("")):         http.StatusUnauthorized,
+	errorMessage(dbError.AccessDenied("")):         http.StatusForbidden,
+	errorMessage(dbError.ErrRateLimited("")):       http.StatusTooManyRequests,
+	errorMessage(dbError.ErrDBTimeout("")):         http.StatusGatewayTimeout,
+	errorMessage(dbError.DBAlreadyClosed("")):      http.StatusServiceUnavailable,
+	errorMessage(dbError.DatabaseAlreadyClose("")): http.StatusServiceUnavailable,
+	errorMessage(dbError.ErrClosed("")):            http.StatusServiceUnavailable,
+	errorMessage(dbError.DatabaseFrozen("")):       http.StatusServiceUnavailable,
+	errorMessage(dbError.ErrDiskFull("")):          http.StatusInsufficientStorage,
+	errorMessage(dbError.NotAvailabeSpace("")):     http.StatusInsufficientStorage,
+	errorMessage(dbError.ErrEntryLimitReached("")): http.StatusInsufficientStorage,
+	// failures of the DB or its storage
+	errorMessage(dbError.ErrDBConnectionFailed("")):        http.StatusInternalServerError,
+	errorMessage(dbError.ReadOperationFailed("")):          http.StatusInternalServerError,
+	errorMessage(dbError.WriteOperationFailed("")):         http.StatusInternalServerError,
+	errorMessage(dbError.DeleteOperationFailed("")):        http.StatusInternalServerError,
+	errorMessage(dbError.UnkownOperation("")):              http.StatusInternalServerError,
+	errorMessage(dbError.FailedToAcquireLock("")):          http.StatusInternalServerError,
+	errorMessage(dbError.FailedToReleaseLock("")):          http.StatusInternalServerError,
+	errorMessage(dbError.FailedToCheckFileExists("")):      http.StatusInternalServerError,
+	errorMessage(dbError.FailedToCreateDirectory("")):      http.StatusInternalServerError,
+	errorMessage(dbError.FailedToCreateFile("")):           http.StatusInternalServerError,
+	errorMessage(dbError.FailedToGetFileSize("")):          http.StatusInternalServerError,
+	errorMessage(dbError.FailedToCheckDir("")):             http.StatusInternalServerError,
+	errorMessage(dbError.FileIsLockedByAnotherProcess("")): http.StatusInternalServerError,
+	errorMessage(dbError.FailedToCloseLockedFile("")):      http.StatusInternalServerError,
+	errorMessage(dbError.FailedToGetFileInfo("")):          http.StatusInternalServerError,
+	errorMessage(dbError.FailedToLoadFile("")):             http.StatusInternalServerError,
+	errorMessage(dbError.FailedToDeleteFile("")):           http.StatusInternalServerError,
+	errorMessage(dbError.FailedToArchiveEntry("")):         http.StatusInternalServerError,
+	errorMessage(dbError.FailedToUploadSnapshot("")):       http.StatusInternalServerError,
+	errorMessage(dbError.ObjectStorageRequestFailed("")):   http.StatusInternalServerError,
+	errorMessage(dbError.OplogCorrupted("")):               http.StatusInternalServerError,
+	errorMessage(dbError.OplogAppendFailed("")):            http.StatusInternalServerError,
+	errorMessage(dbError.ServerFailed("")):                 http.StatusInternalServerError,
+}
+
+func errorMessage(err error) string {
+	return err.(*dbError.DBError).Message
+}
+
+func apiStatus(err error) int {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable // a wait cut short by the shutdown
+	}
+	var dbErr *dbError.DBError
+	if !errors.As(err, &dbErr) {
+		return http.StatusInternalServerError // a failed sync, for one
+	}
+	if status, ok := apiStatuses[dbErr.Message]; ok {
+		return status
+	}
+	return http.StatusBadRequest
+}
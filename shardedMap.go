@@ -0,0 +1,131 @@
+package main
+
+import (
+	"maps"
+	"sync"
+)
+
+// dataShards is how many buckets the data map and the per-key locks are
+// split into. Every bucket has its own lock, so reads of different keys
+// rarely wait on each other.
+const dataShards = 64
+
+// shardedMap is the data map, split by key hash into buckets that each have
+// their own RWMutex. Only the write worker changes it; readers lock the
+// bucket of the key they read, never the whole map.
+type shardedMap[T any] struct {
+	shards [dataShards]dataShard[T]
+}
+
+type dataShard[T any] struct {
+	mu      sync.RWMutex
+	entries map[string]DbData[T]
+}
+
+func newShardedMap[T any]() *shardedMap[T] {
+	m := &shardedMap[T]{}
+	for i := range m.shards {
+		m.shards[i].entries = make(map[string]DbData[T])
+	}
+	return m
+}
+
+// shardOf returns the bucket of key, by its FNV-1a hash.
+func shardOf(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % dataShards)
+}
+
+// get returns the entry of key; it is the zero entry when ok is false.
+func (m *shardedMap[T]) get(key string) (DbData[T], bool) {
+	shard := &m.shards[shardOf(key)]
+	shard.mu.RLock()
+	entry, ok := shard.entries[key]
+	shard.mu.RUnlock()
+	return entry, ok
+}
+
+// entry returns the entry of key, the zero entry if there is none.
+func (m *shardedMap[T]) entry(key string) DbData[T] {
+	entry, _ := m.get(key)
+	return entry
+}
+
+// has reports whether key has an entry, expired or not.
+func (m *shardedMap[T]) has(key string) bool {
+	_, ok := m.get(key)
+	return ok
+}
+
+func (m *shardedMap[T]) set(key string, entry DbData[T]) {
+	shard := &m.shards[shardOf(key)]
+	shard.mu.Lock()
+	shard.entries[key] = entry
+	shard.mu.Unlock()
+}
+
+func (m *shardedMap[T]) delete(key string) {
+	shard := &m.shards[shardOf(key)]
+	shard.mu.Lock()
+	delete(shard.entries, key)
+	shard.mu.Unlock()
+}
+
+func (m *shardedMap[T]) len() int {
+	total := 0
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		total += len(shard.entries)
+		shard.mu.RUnlock()
+	}
+	return total
+}
+
+// keys returns every key, in no particular order. Outside the write worker,
+// the result is only consistent bucket by bucket.
+func (m *shardedMap[T]) keys() []string {
+	keys := make([]string, 0, m.len())
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		for key := range shard.entries {
+			keys = append(keys, key)
+		}
+		shard.mu.RUnlock()
+	}
+	return keys
+}
+
+// snapshot copies every entry into a single map, as the storage takes it.
+func (m *shardedMap[T]) snapshot() map[string]DbData[T] {
+	all := make(map[string]DbData[T], m.len())
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.RLock()
+		maps.Copy(all, shard.entries)
+		shard.mu.RUnlock()
+	}
+	return all
+}
+
+// replace swaps the contents for entries, bucket by bucket.
+func (m *shardedMap[T]) replace(entries map[string]DbData[T]) {
+	split := make([]map[string]DbData[T], dataShards)
+	for i := range split {
+		split[i] = make(map[string]DbData[T])
+	}
+	for key, entry := range entries {
+		split[shardOf(key)][key] = entry
+	}
+	for i := range m.shards {
+		shard := &m.shards[i]
+		shard.mu.Lock()
+		shard.entries = split[i]
+		shard.mu.Unlock()
+	}
+}
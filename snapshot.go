@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Snapshots are compacted copies of the data for other processes to read:
+// only the live entries, no tombstone nor expired entry, in the format the
+// extension of their path picks (".bin" for gob, JSON otherwise). The file is
+// made read-only and its SHA-256 is written next to it, in "<path>.sha256",
+// in the format of sha256sum. Entries holding a blob keep referencing the
+// blob directory.
+
+const checksumExtension = ".sha256"
+
+// ExportSnapshot writes a snapshot of the data to path, replacing any
+// previous one, and returns its checksum. It goes through the admin lane, so
+// the snapshot is consistent. Open it with OpenReadOnly.
+func (db *DB[T]) ExportSnapshot(path string) (string, error) {
+	if db.closed.Load() {
+		return "", dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "exportSnapshot",
+		key:      path,
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submit(db.adminOps, op)
+	if result.err != nil {
+		return "", result.err
+	}
+	return result.keys[0], nil
+}
+
+func (db *DB[T]) exportSnapshot(path string) (string, error) {
+	live := db.data.snapshot()
+	for key := range live {
+		if db.isExpired(key) {
+			delete(live, key)
+		}
+	}
+	target := &LocalStorage[T]{binary: filepath.Ext(path) == ".bin"}
+	if local, ok := db.localStorage(); ok {
+		target.header = local.header
+	}
+	var encoded bytes.Buffer
+	if err := target.encode(&encoded, live); err != nil {
+		return "", dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	hash := sha256.Sum256(encoded.Bytes())
+	checksum := hex.EncodeToString(hash[:])
+	if err := writeFileAtomically(path, func(file *os.File) error {
+		if _, err := file.Write(encoded.Bytes()); err != nil {
+			return err
+		}
+		return file.Chmod(0444) // read-only before it replaces the previous one
+	}); err != nil {
+		return "", dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	if err := writeBytesAtomically(path+checksumExtension, []byte(checksum+"  "+filepath.Base(path)+"\n")); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// OpenReadOnly opens the snapshot at path, written by ExportSnapshot, after
+// checking it against its checksum; it fails with SnapshotCorrupted if they
+// differ. The DB is a follower (see WithFollower): it takes no lock, rejects
+// writes with ReadOnlyDatabase and picks up a snapshot exported again to the
+// same path. A file without checksum is opened unchecked.
+func OpenReadOnly[T any](path string, opts ...Option) (*DB[T], error) {
+	if err := verifySnapshot(path); err != nil {
+		return nil, err
+	}
+	return OpenPath[T](path, append(opts, WithFollower())...)
+}
+
+// verifySnapshot checks the file at path against its checksum file, if any.
+func verifySnapshot(path string) error {
+	expected, found, err := recordedChecksum(path)
+	if err != nil || !found {
+		return err
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	hash := sha256.Sum256(contents)
+	if hex.EncodeToString(hash[:]) != expected {
+		return dbError.SnapshotCorrupted(fmt.Sprintf("%s does not match %s", path, path+checksumExtension))
+	}
+	return nil
+}
+
+// recordedChecksum reads the checksum recorded for the file at path in
+// "<path>.sha256"; found is false if there is none.
+func recordedChecksum(path string) (checksum string, found bool, err error) {
+	recorded, err := os.ReadFile(path + checksumExtension)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	checksum, _, _ = strings.Cut(string(recorded), " ")
+	return checksum, true, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+	"maps"
+	"time"
+)
+
+// Tombstones: with WithSoftDelete, Delete moves the entry out of db.data into
+// db.tombstones, stamped with Deleted_at, instead of dropping it. Tombstones
+// are invisible to every operation but Undelete and are persisted along with
+// the live entries (Deleted_at tells them apart on load). Compact purges the
+// ones older than the retention period.
+
+// Undelete restores an entry removed by Delete under WithSoftDelete, as it
+// was when deleted, as long as its tombstone is within the retention period
+// and the key wasn't created again since. It fails with KeyNotFound
+// otherwise.
+func (db *DB[T]) Undelete(key string) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:   "undelete",
+		key:      key,
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op)
+}
+
+func (db *DB[T]) undelete(key string) (DbData[T], error) {
+	if db.data.has(key) {
+		return DbData[T]{}, dbError.EntryAlreadyExists(fmt.Sprintf("key : %s", key))
+	}
+	tombstone, exists := db.tombstones[key]
+	if !exists || db.tombstoneExpired(tombstone, time.Now()) {
+		return DbData[T]{}, dbError.KeyNotFound(fmt.Sprintf("no tombstone for key : %s", key))
+	}
+	entry := tombstone
+	entry.Deleted_at = nil
+	db.removeTombstone(key)
+	db.setEntry(key, entry)
+	if err := db.sync(); err != nil {
+		// rollback
+		db.removeEntry(key)
+		db.setTombstone(key, tombstone)
+		return DbData[T]{}, err
+	}
+	db.logOps(entryRecord(OplogCreate, key, entry))
+	return db.ownCopy(entry)
+}
+
+// softDeleteEntry replaces key's entry with a tombstone and syncs.
+func (db *DB[T]) softDeleteEntry(key string) error {
+	entry := db.data.entry(key)
+	deletedAt := time.Now()
+	tombstone := entry
+	tombstone.Deleted_at = &deletedAt
+	db.removeEntry(key)
+	db.setTombstone(key, tombstone)
+	if err := db.sync(); err != nil {
+		// rollback
+		db.removeTombstone(key)
+		db.setEntry(key, entry)
+		return err
+	}
+	db.logOps(OplogRecord[T]{Op: OplogDelete, Key: key})
+	return nil
+}
+
+// tombstoneExpired reports whether the tombstone is past the retention
+// period, due to be purged.
+func (db *DB[T]) tombstoneExpired(tombstone DbData[T], now time.Time) bool {
+	return !now.Before(tombstone.Deleted_at.Add(db.opts().softDeleteRetention))
+}
+
+// purgeTombstones drops the tombstones past the retention period without
+// syncing; the caller syncs and, if that fails, puts the returned ones back.
+func (db *DB[T]) purgeTombstones() map[string]DbData[T] {
+	now := time.Now()
+	purged := make(map[string]DbData[T])
+	for key, tombstone := range db.tombstones {
+		if db.tombstoneExpired(tombstone, now) {
+			purged[key] = tombstone
+			db.removeTombstone(key)
+		}
+	}
+	return purged
+}
+
+// persisted is what the storage holds: the live entries plus the tombstones.
+// Keys are never in both.
+func (db *DB[T]) persisted() map[string]DbData[T] {
+	merged := db.data.snapshot()
+	maps.Copy(merged, db.tombstones)
+	return merged
+}
+
+// setLoaded stores an entry read from the storage, as a tombstone if it is
+// one. Both keep the sequence number they were stored with.
+func (db *DB[T]) setLoaded(key string, entry DbData[T]) {
+	db.seenSeq(entry.Seq)
+	if entry.Deleted_at != nil {
+		db.removeEntry(key)
+		db.putTombstone(key, entry)
+		return
+	}
+	db.removeTombstone(key)
+	if db.opts().clockSafeLoad {
+		entry = clampFuture(entry, time.Now())
+	}
+	// not written since it was loaded
+	db.putEntry(key, entry, entry.Created_at)
+}
+
+func (db *DB[T]) setTombstone(key string, tombstone DbData[T]) {
+	tombstone.Seq = db.changed()
+	db.putTombstone(key, tombstone)
+}
+
+func (db *DB[T]) putTombstone(key string, tombstone DbData[T]) {
+	db.dataMu.Lock()
+	db.tombstones[key] = tombstone
+	db.dataMu.Unlock()
+}
+
+func (db *DB[T]) removeTombstone(key string) {
+	if _, exists := db.tombstones[key]; !exists {
+		return
+	}
+	db.dataMu.Lock()
+	delete(db.tombstones, key)
+	db.dataMu.Unlock()
+	db.changed()
+}
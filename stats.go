@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+)
+
+// Stats is a snapshot of the DB's size and activity.
+type Stats struct {
+	Entries     int          // Entries stored, expired ones not removed yet included
+	MaxEntries  int          // WithMaxEntries limit, 0 when unlimited
+	Tombstones  int          // Soft deleted entries kept for Undelete, see WithSoftDelete
+	ReadQueue   int          // Reads waiting in the queue
+	WriteQueue  int          // Writes waiting in the queue
+	ReadHits    uint64       // Reads that found a live entry, since the DB was opened
+	ReadMisses  uint64       // Reads of a missing or expired key
+	LastCleanup CleanupStats // Last run of the cleanup worker
+	LastBackup  BackupStatus // Automatic backups, see WithAutoBackup
+	Checkpoint  SyncCheckpoint
+	Recovery    RecoveryReport // What opening the DB recovered, see WithOplog
+	IO          IOStats
+}
+
+// Stats returns the current stats.
+func (db *DB[T]) Stats() Stats {
+	entries := db.data.len()
+	db.dataMu.RLock()
+	tombstones := len(db.tombstones)
+	db.dataMu.RUnlock()
+	reads, writes := db.QueueDepth()
+	return Stats{
+		Entries:     entries,
+		MaxEntries:  db.opts().maxEntries,
+		Tombstones:  tombstones,
+		ReadQueue:   reads,
+		WriteQueue:  writes,
+		ReadHits:    db.readHits.Load(),
+		ReadMisses:  db.readMisses.Load(),
+		LastCleanup: db.LastCleanup(),
+		LastBackup:  db.LastBackup(),
+		Checkpoint:  db.Checkpoint(),
+		Recovery:    db.Recovery(),
+		IO:          db.IOStats(),
+	}
+}
+
+// checkEntryLimit fails with ErrEntryLimitReached if adding count entries
+// goes over WithMaxEntries. Expired entries are purged first rather than
+// counted against the limit; held reports the keys whose locks the caller
+// holds already, which the purge doesn't take again.
+func (db *DB[T]) checkEntryLimit(count int, held func(key string) bool) error {
+	limit := db.opts().maxEntries
+	if limit <= 0 || db.data.len()+count <= limit {
+		return nil
+	}
+	if _, err := db.cleanupExpiredKeys(0, held); err != nil {
+		return err
+	}
+	return db.entryLimitReached(count)
+}
+
+// entryLimitReached is checkEntryLimit without purging the expired entries,
+// which syncs.
+func (db *DB[T]) entryLimitReached(count int) error {
+	limit := db.opts().maxEntries
+	if limit > 0 && db.data.len()+count > limit {
+		return dbError.ErrEntryLimitReached(fmt.Sprintf("%d entries stored, limit %d", db.data.len(), limit))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"os"
+	"syscall"
+	"time"
+)
+
+// defaultStatusInterval is how often the status file is rewritten when
+// WithStatusFile is given no interval.
+const defaultStatusInterval = 5 * time.Second
+
+// InstanceStatus is what WithStatusFile writes for external tools, and what
+// ReadStatusFile returns.
+type InstanceStatus struct {
+	PID        int       `json:"pid"`
+	Entries    int       `json:"entries"`
+	Tombstones int       `json:"tombstones"`
+	SizeKB     float64   `json:"size_kb"`
+	LastSync   time.Time `json:"last_sync"`
+	SyncErr    string    `json:"sync_err,omitempty"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	Closed     bool      `json:"closed"` // Set by the last write, on Close
+	// Running is set by ReadStatusFile: whether the instance still holds the
+	// status lock. It is false after a crash even though Closed is too.
+	Running bool `json:"-"`
+}
+
+// statusFile rewrites the status file every interval while the DB is open.
+// The instance holds an exclusive flock on "<path>.lock" meanwhile, which
+// tells readers whether it is still running.
+type statusFile struct {
+	path     string
+	interval time.Duration
+	lock     *os.File
+	done     chan struct{} // Closed once the writing goroutine returned
+}
+
+func openStatusFile(path string, interval time.Duration) (*statusFile, error) {
+	lock, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, dbError.FailedToCreateFile(fmt.Sprintf("%s", err))
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, dbError.FileIsLockedByAnotherProcess(path + ".lock")
+		}
+		return nil, dbError.FailedToAcquireLock(fmt.Sprintf("%s", err))
+	}
+	if interval <= 0 {
+		interval = defaultStatusInterval
+	}
+	return &statusFile{path: path, interval: interval, lock: lock, done: make(chan struct{})}, nil
+}
+
+// writeStatus writes the current status, atomically: readers never see a
+// partial file.
+func (db *DB[T]) writeStatus(closed bool) error {
+	stats := db.Stats()
+	status := InstanceStatus{
+		PID:        os.Getpid(),
+		Entries:    stats.Entries,
+		Tombstones: stats.Tombstones,
+		LastSync:   stats.Checkpoint.LastSync,
+		UpdatedAt:  time.Now(),
+		Closed:     closed,
+	}
+	if stats.Checkpoint.SyncErr != nil {
+		status.SyncErr = stats.Checkpoint.SyncErr.Error()
+	}
+	if sizeKB, err := db.storage.Size(); err == nil {
+		status.SizeKB = sizeKB
+	}
+	return writeFileAtomically(db.status.path, func(file *os.File) error {
+		return json.NewEncoder(file).Encode(status)
+	})
+}
+
+// runStatusFile keeps the status file current until the DB closes.
+func (db *DB[T]) runStatusFile() {
+	defer close(db.status.done)
+	ticker := time.NewTicker(db.status.interval)
+	defer ticker.Stop()
+	for {
+		if err := db.writeStatus(false); err != nil {
+			db.recordError(operation[T]{action: "status"}, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-db.closeCh:
+			return
+		}
+	}
+}
+
+// closeStatusFile writes the final status once everything is synced and
+// releases the status lock.
+func (db *DB[T]) closeStatusFile() {
+	if db.status == nil {
+		return
+	}
+	<-db.status.done
+	db.writeStatus(true)
+	syscall.Flock(int(db.status.lock.Fd()), syscall.LOCK_UN)
+	db.status.lock.Close()
+}
+
+// ReadStatusFile reads the status file written by an instance opened with
+// WithStatusFile, and whether that instance is still running.
+func ReadStatusFile(path string) (InstanceStatus, error) {
+	var status InstanceStatus
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return status, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	if err := json.Unmarshal(contents, &status); err != nil {
+		return status, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	lock, err := os.Open(path + ".lock")
+	if err != nil {
+		return status, nil // never locked
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		status.Running = true
+	} else if err == nil {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	}
+	return status, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"local-key-value-DB/dbError"
+	"strconv"
+	"sync"
+)
+
+// Storage is the persistence backend used by DB. LocalStorage is the default
+// implementation; any other backend (in-memory, object storage, embedded
+// engines) can be plugged in through NewDBWithStorage.
+type Storage[T any] interface {
+	// Load decodes the persisted entries into dataToLoad.
+	Load(dataToLoad *map[string]DbData[T]) error
+	// Sync persists the full data set, replacing the previous contents, and
+	// returns the bytes it wrote.
+	Sync(data map[string]DbData[T]) (int64, error)
+	// Size returns the persisted size in KB, used for the storage limit checks.
+	Size() (float64, error)
+	// Lock acquires exclusive access to the backend for one DB instance.
+	Lock() error
+	// Unlock releases the access acquired by Lock.
+	Unlock() error
+}
+
+// ProgressLoader is implemented by backends able to report how far a Load
+// has progressed, in bytes.
+type ProgressLoader[T any] interface {
+	LoadWithProgress(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) error
+}
+
+// StrictLoader is implemented by backends able to tell, while loading, which
+// entries didn't decode cleanly into T; see WithStrictDecode.
+type StrictLoader[T any] interface {
+	LoadStrict(dataToLoad *map[string]DbData[T], progress func(loadedBytes int64, totalBytes int64)) ([]DecodeIssue, error)
+}
+
+// VersionedStorage is implemented by backends able to tell cheaply whether
+// the persisted data changed; followers poll it (see WithFollower).
+type VersionedStorage interface {
+	// Version returns a value that changes whenever the persisted data does.
+	Version() (string, error)
+}
+
+// MemoryStorage keeps the encoded data in memory. Nothing survives the
+// process, which makes it handy for tests and throwaway caches.
+type MemoryStorage[T any] struct {
+	mu      sync.Mutex
+	data    []byte
+	locked  bool
+	version int
+}
+
+func NewMemoryStorage[T any]() *MemoryStorage[T] {
+	return &MemoryStorage[T]{}
+}
+
+func (ms *MemoryStorage[T]) Load(dataToLoad *map[string]DbData[T]) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if len(ms.data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(ms.data, dataToLoad)
+}
+
+func (ms *MemoryStorage[T]) Sync(data map[string]DbData[T]) (int64, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.data = encoded
+	ms.version++
+	return int64(len(encoded)), nil
+}
+
+func (ms *MemoryStorage[T]) Version() (string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return strconv.Itoa(ms.version), nil
+}
+
+func (ms *MemoryStorage[T]) Size() (float64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return BytesToKB(len(ms.data)), nil
+}
+
+func (ms *MemoryStorage[T]) Lock() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.locked {
+		return dbError.FileIsLockedByAnotherProcess("memory storage")
+	}
+	ms.locked = true
+	return nil
+}
+
+func (ms *MemoryStorage[T]) Unlock() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.locked = false
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// DecodeIssue is an entry that didn't decode cleanly into T under
+// WithStrictDecode: its value has fields T doesn't know, which were dropped,
+// or lacks fields of T, which were left zero. The entry is loaded anyway.
+type DecodeIssue struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+}
+
+// DecodeIssues returns what WithStrictDecode found while loading, sorted by
+// key; nil without the option or when every entry matched T.
+func (db *DB[T]) DecodeIssues() []DecodeIssue {
+	<-db.ready
+	return db.decodeIssues
+}
+
+// decodeStrict decodes one encoded entry, leniently as a plain load does,
+// and tells what a strict decode would have complained about.
+func decodeStrict[T any](raw json.RawMessage, entry *DbData[T]) (string, error) {
+	if err := json.Unmarshal(raw, entry); err != nil {
+		return "", err
+	}
+	strict := json.NewDecoder(bytes.NewReader(raw))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(new(DbData[T])); err != nil {
+		return err.Error(), nil
+	}
+	if missing := missingFields(raw, entry.Value); len(missing) > 0 {
+		return fmt.Sprintf("value lacks fields %v", missing), nil
+	}
+	return "", nil
+}
+
+// missingFields returns the fields value encodes that the stored value
+// doesn't have, when both are JSON objects. Zero omitempty fields encode to
+// nothing, so they never count as missing.
+func missingFields[T any](raw json.RawMessage, value T) []string {
+	var stored struct {
+		Value map[string]json.RawMessage `json:"value"`
+	}
+	if json.Unmarshal(raw, &stored) != nil || stored.Value == nil {
+		return nil
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(encoded, &fields) != nil {
+		return nil
+	}
+	var missing []string
+	for field := range fields {
+		if _, ok := stored.Value[field]; !ok {
+			missing = append(missing, field)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func sortDecodeIssues(issues []DecodeIssue) {
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Key < issues[j].Key })
+}
@@ -0,0 +1,67 @@
+package main
+
+import "context"
+
+// Tracing: with WithTracer, every operation produces a "kv.enqueue" span on
+// the caller's side, a "kv.process" span child of it on the worker and, for
+// writes, a "kv.sync" span per storage sync. Tracer and Span follow the shape
+// of OpenTelemetry's, so an adapter of a few lines plugs an OpenTelemetry
+// tracer in without the package depending on it.
+
+// Attribute is a key/value pair set on a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Tracer starts spans, as an OpenTelemetry trace.Tracer does.
+type Tracer interface {
+	Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, Span)
+}
+
+// Span is a started span, as an OpenTelemetry trace.Span.
+type Span interface {
+	SetAttributes(attributes ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// WithTracer traces every operation with tracer.
+func WithTracer(tracer Tracer) Option {
+	return func(o *dbOptions) {
+		o.tracer = tracer
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+// startSpan starts a span of op under ctx, a no-op without WithTracer.
+func (db *DB[T]) startSpan(ctx context.Context, name string, op operation[T]) (context.Context, Span) {
+	tracer := db.opts().tracer
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	attributes := []Attribute{{Key: "kv.op", Value: op.action}}
+	if op.key != "" {
+		attributes = append(attributes, Attribute{Key: "kv.key", Value: op.key})
+	}
+	if keys := len(op.batchData) + len(op.batchKeys); keys > 0 {
+		attributes = append(attributes, Attribute{Key: "kv.keys", Value: keys})
+	}
+	return tracer.Start(ctx, name, attributes...)
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"local-key-value-DB/dbError"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SetTTLBatch makes every key expire ttlSeconds from now ("" removes the
+// expiration) with a single sync. It is all-or-nothing: if a key is missing
+// or already expired nothing is changed.
+func (db *DB[T]) SetTTLBatch(keys []string, ttlSeconds string) operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	if len(keys) > BatchLimit {
+		return operationResult[T]{err: dbError.BatchLimitCountExceeds("")}
+	}
+	op := operation[T]{
+		action:    "setTTLBatch",
+		batchKeys: keys,
+		ttl:       ttlSeconds,
+		response:  make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op)
+}
+
+// CreateExpiringAt creates an entry expiring at the given moment rather than
+// after a TTL, for records whose lifetime is tied to an external deadline.
+// The expiration is stored as an RFC 3339 time.
+func (db *DB[T]) CreateExpiringAt(key string, value T, expiresAt time.Time) operationResult[T] {
+	if expiresAt.IsZero() || !expiresAt.After(db.now()) {
+		return operationResult[T]{err: dbError.InvalidTTL(fmt.Sprintf("expires at %s, which is not in the future", expiresAt.Format(time.RFC3339)))}
+	}
+	entry := NewDbData(value, "")
+	entry.Expires_at = &expiresAt
+	return db.Create(key, entry)
+}
+
+// ExpiredKeys lists, sorted, the keys that are expired but not removed yet.
+func (db *DB[T]) ExpiredKeys() operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:   "expiredKeys",
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submit(db.readOps, op)
+}
+
+// CleanupPreview is what a cleanup run would remove right now.
+type CleanupPreview struct {
+	Keys  []string `json:"keys"`  // expired keys, sorted
+	Bytes int64    `json:"bytes"` // JSON size of their entries, which the file shrinks by
+}
+
+// PreviewCleanup returns the keys PurgeExpired would remove now, and the
+// space that would free, without removing anything.
+func (db *DB[T]) PreviewCleanup() (CleanupPreview, error) {
+	if db.closed.Load() {
+		return CleanupPreview{}, dbError.DBAlreadyClosed("")
+	}
+	<-db.ready
+	if db.loadErr != nil {
+		return CleanupPreview{}, db.loadErr
+	}
+	preview := CleanupPreview{Keys: db.expiredKeys()}
+	for _, key := range preview.Keys {
+		encoded, err := json.Marshal(db.data.entry(key))
+		if err != nil {
+			return CleanupPreview{}, dbError.FailedToConvertMapToJson(fmt.Sprintf("%s", err))
+		}
+		preview.Bytes += int64(len(encoded))
+	}
+	return preview, nil
+}
+
+// PurgeExpired removes every expired entry right away instead of waiting for
+// the cleanup worker. The result count is the number of entries removed.
+func (db *DB[T]) PurgeExpired() operationResult[T] {
+	if db.closed.Load() {
+		return operationResult[T]{err: dbError.DBAlreadyClosed("")}
+	}
+	op := operation[T]{
+		action:   "purgeExpired",
+		response: make(chan operationResult[T], 1),
+	}
+	return db.submitWrite(op)
+}
+
+func (db *DB[T]) setTTLBatch(keys []string, ttlSeconds string) error {
+	ttl := 0
+	if ttlSeconds != "" {
+		var err error
+		ttl, err = strconv.Atoi(ttlSeconds)
+		if err != nil || ttl < 0 {
+			return dbError.InvalidTTL(fmt.Sprintf("ttl : %q", ttlSeconds))
+		}
+	}
+	for _, key := range keys {
+		if !db.data.has(key) {
+			return dbError.KeyNotFound(fmt.Sprintf("key : %s", key))
+		}
+		if db.isExpired(key) {
+			return dbError.KeyExpired(fmt.Sprintf("key : %s", key))
+		}
+		if err := db.checkMutable(key); err != nil {
+			return err
+		}
+	}
+	previous := make(map[string]DbData[T], len(keys))
+	for _, key := range keys {
+		entry := db.data.entry(key)
+		previous[key] = entry
+		if ttlSeconds == "" {
+			entry.Ttl = ""
+		} else {
+			// the TTL counts from Created_at, which is kept as is
+			elapsed := int(time.Since(entry.Created_at).Seconds())
+			entry.Ttl = strconv.Itoa(elapsed + ttl)
+		}
+		entry.Expires_at = nil // replaced by the new TTL
+		db.setEntry(key, entry)
+	}
+	err := db.sync()
+	if err != nil {
+		for key, entry := range previous { // rollback
+			db.setEntry(key, entry)
+		}
+		return err
+	}
+	for _, key := range keys {
+		db.logOps(entryRecord(OplogTTL, key, db.data.entry(key)))
+	}
+	return nil
+}
+
+// withMonotonic gives the times of entry that have none a monotonic clock
+// reading, taken as of now, so that expiring them no longer depends on the
+// wall clock: Go compares two times holding such readings with them. Times
+// taken with time.Now in this process already hold one; loaded or parsed ones
+// don't. A wall clock change after that is ignored until the next restart.
+func withMonotonic[T any](entry DbData[T], now time.Time) DbData[T] {
+	entry.Created_at = monotonicTime(entry.Created_at, now)
+	if entry.Expires_at != nil {
+		expiresAt := monotonicTime(*entry.Expires_at, now)
+		entry.Expires_at = &expiresAt
+	}
+	return entry
+}
+
+// monotonicTime returns t with the monotonic reading it would have had if it
+// had been taken with time.Now. t keeps its wall time but takes the location
+// of now.
+func monotonicTime(t time.Time, now time.Time) time.Time {
+	if t.IsZero() || t != t.Round(0) { // no time, or it has a reading already
+		return t
+	}
+	return now.Add(t.Sub(now))
+}
+
+// clampFuture moves the creation time of an entry created after now, which
+// only a wall clock set back since it was written explains, to now: its TTL
+// then runs from the load instead of outliving the clock change. See
+// WithClockSafeLoad.
+func clampFuture[T any](entry DbData[T], now time.Time) DbData[T] {
+	if entry.Created_at.After(now) {
+		entry.Created_at = now
+	}
+	return entry
+}
+
+// expiresAt returns when the entry expires; ok is false for entries without
+// a (valid) TTL, which never expire.
+func (entry DbData[T]) expiresAt() (time.Time, bool) {
+	if entry.Expires_at != nil {
+		return *entry.Expires_at, true
+	}
+	if entry.Ttl == "" {
+		return time.Time{}, false
+	}
+	seconds, err := strconv.Atoi(entry.Ttl)
+	if err != nil {
+		return time.Time{}, false // todo : handle
+	}
+	return entry.Created_at.Add(time.Duration(seconds) * time.Second), true
+}
+
+// staleRead returns the entry of key flagged Stale if it expired less than
+// WithStaleGrace ago.
+func (db *DB[T]) staleRead(key string) (DbData[T], bool) {
+	grace := db.opts().staleGrace
+	entry, exists := db.data.get(key)
+	if grace <= 0 || !exists {
+		return DbData[T]{}, false
+	}
+	expiresAt, ok := entry.expiresAt()
+	if !ok || db.now().After(expiresAt.Add(grace)) {
+		return DbData[T]{}, false
+	}
+	entry, err := db.ownCopy(entry)
+	entry.Stale = true
+	return entry, err == nil
+}
+
+func (db *DB[T]) expiredKeys() []string {
+	keys := []string{}
+	for _, key := range db.data.keys() {
+		if db.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *DB[T]) purgeExpired() (int, error) {
+	return db.cleanupExpiredKeys(0, nil)
+}
+
+// slidExpiry returns the expiration a read moves entry to when its TTL
+// slides (WithSlidingTTL or entry.Sliding): Ttl seconds from now. It is nil
+// if the TTL doesn't slide (never for an immutable entry), or would move by less than a tenth of it (a
+// second at most), which spares a sync to reads in quick succession.
+func (db *DB[T]) slidExpiry(entry DbData[T]) *time.Time {
+	if entry.Ttl == "" || entry.Immutable || !(db.opts().slidingTTL || entry.Sliding) {
+		return nil
+	}
+	seconds, err := strconv.Atoi(entry.Ttl)
+	if err != nil {
+		return nil
+	}
+	ttl := time.Duration(seconds) * time.Second
+	next := db.now().Add(ttl)
+	if current, ok := entry.expiresAt(); ok && next.Sub(current) < min(time.Second, ttl/10) {
+		return nil
+	}
+	return &next
+}
+
+// queueTouch asks the write worker to move key's expiration to expiresAt.
+func (db *DB[T]) queueTouch(key string, expiresAt time.Time) {
+	db.queueFromRead(operation[T]{
+		action:   "touch",
+		key:      key,
+		value:    DbData[T]{Expires_at: &expiresAt},
+		response: make(chan operationResult[T], 1),
+	})
+}
+
+// touch persists a slid expiration, unless the entry expired or was given a
+// later one meanwhile.
+func (db *DB[T]) touch(key string, expiresAt time.Time) error {
+	entry, exists := db.data.get(key)
+	if !exists || db.isExpired(key) {
+		return nil
+	}
+	if current, ok := entry.expiresAt(); !ok || !expiresAt.After(current) {
+		return nil
+	}
+	previous := entry
+	entry.Expires_at = &expiresAt
+	db.setEntry(key, entry)
+	if err := db.sync(); err != nil {
+		db.setEntry(key, previous) // rollback
+		return err
+	}
+	db.logOps(entryRecord(OplogTTL, key, entry))
+	return nil
+}
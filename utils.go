@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"local-key-value-DB/dbError"
 	"path/filepath"
 	"regexp"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -15,11 +17,24 @@ const (
 )
 
 type DbData[T any] struct {
-	Value      T         `json:"value"`
-	Ttl        string    `json:"ttl"` // if string empty means no expiration time
-	Created_at time.Time `json:"created_at"`
+	Value      T          `json:"value"`
+	Ttl        string     `json:"ttl"` // if string empty means no expiration time (unless Expires_at is set)
+	Created_at time.Time  `json:"created_at"`
+	Expires_at *time.Time `json:"expires_at,omitempty"` // absolute expiration, takes precedence over Ttl
+	Sliding    bool       `json:"sliding,omitempty"`    // every read pushes the expiration Ttl from then, see WithSlidingTTL
+	Deleted_at *time.Time `json:"deleted_at,omitempty"` // set on tombstones only, see WithSoftDelete
+	Owner      string     `json:"owner,omitempty"`      // token of the holder, set by the lease ops only, see AcquireLease
+	Blob       *BlobRef   `json:"blob,omitempty"`       // value stored in a blob file instead, set by CreateFromReader only
+	Seq        uint64     `json:"seq,omitempty"`        // checkpoint sequence number of the write that stored it, set by the DB
+	Pinned     bool       `json:"pinned,omitempty"`     // exempt from DeleteMatching and eviction, see Pin
+	Immutable  bool       `json:"immutable,omitempty"`  // write-once until it expires, set at create time only, see checkMutable
+	QueueSeq   uint64     `json:"queue_seq,omitempty"`  // last sequence number a queue handed out, on its marker entry only, see Queue
+	Stale      bool       `json:"-"`                    // set on reads of an expired entry only, see WithStaleGrace
 }
 
+// NewDbData builds an entry expiring ttlSeconds after now ("" for never).
+//
+// Deprecated: use NewEntry, which takes a time.Duration and validates it.
 func NewDbData[T any](value T, ttlSeconds string) DbData[T] {
 	return DbData[T]{
 		Value:      value,
@@ -74,21 +89,43 @@ func GenerateRandomKey() string {
 	return result.String()
 }
 
+// deepCopy returns a copy of value sharing no memory with it. It round-trips
+// through JSON, the same encoding the storage uses, so the copy holds exactly
+// what would be read back from disk.
+func deepCopy[T any](value T) (T, error) {
+	if raw, ok := any(value).([]byte); ok {
+		return any(append([]byte(nil), raw...)).(T), nil
+	}
+	var copied T
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return copied, err
+	}
+	err = json.Unmarshal(encoded, &copied)
+	return copied, err
+}
+
 func BytesToKB(sizeInBytes int) float64 {
 	return float64(sizeInBytes) / float64(KB)
 }
 
 func ValidateAndFixJSONFilename(filename string) (string, error) {
+	return ValidateAndFixFilename(filename, ".json")
+}
+
+// ValidateAndFixFilename is ValidateAndFixJSONFilename for any extension
+// (with its dot, e.g. ".bin").
+func ValidateAndFixFilename(filename string, extension string) (string, error) {
 	filename = strings.TrimSpace(filename)
 
 	if len(filename) == 0 {
-		return "default_file.json", nil
+		return "default_file" + extension, nil
 	} else if len(filename) > 24 {
 		return "", dbError.InvalidFileName("file name exceeds max limit of 24 characters")
 	}
 
 	invalidCharPattern := regexp.MustCompile(`[<>:"/\\|?*\x00-\x1F]`)
-	if invalidCharPattern.MatchString(filename) {
+	if invalidCharPattern.MatchString(filename) || !utf8.ValidString(filename) {
 		return "", dbError.InvalidFileName("contains invalid characters")
 	}
 
@@ -102,15 +139,18 @@ func ValidateAndFixJSONFilename(filename string) (string, error) {
 	}
 
 	ext := filepath.Ext(filename)
-	if ext == ".json" {
+	if ext == extension {
 		nameWithoutExt := strings.TrimSuffix(filename, ext)
+		if len(strings.TrimSpace(nameWithoutExt)) == 0 {
+			return "", dbError.InvalidFileName("missing name before the extension")
+		}
 		if strings.Contains(nameWithoutExt, ".") {
 			return "", dbError.InvalidFileName("contains extra dot")
 		}
 		return filename, nil
 	}
 
-	if ext != "" && ext != ".json" {
+	if ext != "" && ext != extension {
 		return "", dbError.InvalidFileName("no file extension or wrong extension.")
 	}
 
@@ -119,5 +159,5 @@ func ValidateAndFixJSONFilename(filename string) (string, error) {
 		return "", dbError.InvalidFileName("contains extra dot")
 	}
 
-	return filename + ".json", nil
+	return filename + extension, nil
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// validationShards validates the writes in parallel ahead of the write
+// worker, see WithParallelValidation. It applies nothing: the single write
+// worker still applies and syncs every write, it only skips the checks done
+// here. A dispatcher takes the ops from db.writeOps in queue order and hands
+// each op on a single key to the worker of its shard, by key hash, which
+// checks its entry and passes it on to the apply queue, the one the write
+// worker takes from. A shard keeps the order of its ops, so the ops on a key
+// keep theirs, while a shard busy with an expensive entry doesn't hold the
+// others back. An op on several keys, or none, goes through every shard as a
+// writeBarrier: it reaches the apply queue after every op queued before it
+// and before every op queued after it.
+type validationShards[T any] struct {
+	queues  []chan shardedWrite[T]
+	applied chan operation[T]
+	workers sync.WaitGroup
+}
+
+// shardedWrite is an op for a shard worker, or a barrier to go through.
+type shardedWrite[T any] struct {
+	op      operation[T]
+	barrier *writeBarrier[T]
+}
+
+// writeBarrier is an op on several keys, or none, on its way through the
+// shards. The last shard to reach it queues the op; the others wait for it
+// to be queued before going on.
+type writeBarrier[T any] struct {
+	op        operation[T]
+	remaining atomic.Int32
+	queued    chan struct{}
+}
+
+// startValidationShards starts the dispatcher and n shard workers, with queues
+// of queueSize ops.
+func (db *DB[T]) startValidationShards(n int, queueSize int) {
+	shards := &validationShards[T]{
+		queues:  make([]chan shardedWrite[T], n),
+		applied: make(chan operation[T], queueSize),
+	}
+	for i := range shards.queues {
+		shards.queues[i] = make(chan shardedWrite[T], queueSize)
+	}
+	db.shards = shards
+	shards.workers.Add(n)
+	for _, queue := range shards.queues {
+		go db.shardWorker(queue)
+	}
+	db.wg.Add(1)
+	go db.dispatchWrites()
+}
+
+// dispatchWrites hands the queued ops to the shards until Close closes the
+// write queue, then closes the shard queues and, once the shard workers are
+// done with them, the apply queue.
+func (db *DB[T]) dispatchWrites() {
+	defer db.wg.Done()
+	shards := db.shards
+	for op := range db.writeOps {
+		if keys := op.keys(); len(keys) == 1 {
+			shards.queues[shardOf(keys[0])%len(shards.queues)] <- shardedWrite[T]{op: op}
+			continue
+		}
+		barrier := &writeBarrier[T]{op: op, queued: make(chan struct{})}
+		barrier.remaining.Store(int32(len(shards.queues)))
+		for _, queue := range shards.queues {
+			queue <- shardedWrite[T]{barrier: barrier}
+		}
+	}
+	for _, queue := range shards.queues {
+		close(queue)
+	}
+	shards.workers.Wait()
+	close(shards.applied)
+}
+
+func (db *DB[T]) shardWorker(queue chan shardedWrite[T]) {
+	defer db.shards.workers.Done()
+	for write := range queue {
+		if barrier := write.barrier; barrier != nil {
+			if barrier.remaining.Add(-1) == 0 {
+				db.shards.applied <- barrier.op
+				close(barrier.queued)
+			} else {
+				<-barrier.queued
+			}
+			continue
+		}
+		db.prepareWrite(&write.op)
+		db.shards.applied <- write.op
+	}
+}
+
+// prepareWrite runs the checks of the entry of op that don't depend on the
+// data, validators included, for the write worker to skip.
+func (db *DB[T]) prepareWrite(op *operation[T]) {
+	switch op.action {
+	case "create", "update":
+		checked := db.checkEntry(op.key, op.value)
+		op.checked = &checked
+	}
+}
+
+// queued returns how many ops are on their way through the shards, 0
+// without them.
+func (shards *validationShards[T]) queued() int {
+	if shards == nil {
+		return 0
+	}
+	total := len(shards.applied)
+	for _, queue := range shards.queues {
+		total += len(queue)
+	}
+	return total
+}
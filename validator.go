@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"local-key-value-DB/dbError"
+)
+
+// Validator enforces application rules on the values written, such as a
+// non-empty name or an age range. It runs before every create (batches
+// included) and update, on the write worker, so it must not call the DB.
+// With WithParallelValidation, the creates and updates of a single key are
+// validated on its goroutines instead, several at once: the validator must
+// then be safe for concurrent use too.
+type Validator[T any] func(key string, value T) error
+
+// AddValidator registers a validator checked by every later write, after the
+// ones already registered. A rejected entry fails with a ValidationError
+// wrapping the validator's error; in a batch only that entry fails, as
+// decided by the conflict policy.
+func (db *DB[T]) AddValidator(validator Validator[T]) {
+	db.validatorsMu.Lock()
+	defer db.validatorsMu.Unlock()
+	db.validators = append(db.validators, validator)
+}
+
+// validate runs the validators on an entry about to be written.
+func (db *DB[T]) validate(key string, value T) error {
+	db.validatorsMu.Lock()
+	validators := db.validators
+	db.validatorsMu.Unlock()
+	for _, validator := range validators {
+		if err := validator(key, value); err != nil {
+			return dbError.ValidationFailed(fmt.Sprintf("key : %s", key), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"local-key-value-DB/dbError"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Checks reported by Verify.
+const (
+	CheckJSON      = "json"       // the file or an entry can't be decoded
+	CheckDuplicate = "duplicate"  // a key appears more than once in the file
+	CheckKeySize   = "key_size"   // a key is longer than KeySizeLimit
+	CheckEntrySize = "entry_size" // an entry is larger than EntrySizeLimitMB
+	CheckTTL       = "ttl"        // the TTL or creation time makes no sense
+	CheckSchema    = "schema"     // the file was written for another type than T
+	CheckChecksum  = "checksum"   // the file doesn't match the checksum recorded next to it
+)
+
+// maxClockSkew is how far in the future a Created_at may be before Verify
+// reports it.
+const maxClockSkew = time.Minute
+
+// VerifyIssue is one problem found by Verify.
+type VerifyIssue struct {
+	Check   string `json:"check"`
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// VerifyReport is the result of an integrity check. Path, Checksum and
+// SizeBytes are only set when the data lives in a local file.
+type VerifyReport struct {
+	Path      string        `json:"path,omitempty"`
+	Checksum  string        `json:"checksum,omitempty"` // SHA-256 of the file, checked against "<path>.sha256" if there is one
+	SizeBytes int64         `json:"size_bytes,omitempty"`
+	Entries   int           `json:"entries"`
+	Issues    []VerifyIssue `json:"issues"`
+}
+
+// OK reports whether no issue was found.
+func (report VerifyReport) OK() bool {
+	return len(report.Issues) == 0
+}
+
+func (report *VerifyReport) addIssue(check string, key string, message string) {
+	report.Issues = append(report.Issues, VerifyIssue{Check: check, Key: key, Message: message})
+}
+
+// Verify checks the integrity of the persisted data: JSON validity, duplicate
+// keys, key and entry size limits and TTL sanity, on the file for
+// LocalStorage, whose checksum is reported too. Backends without a file get
+// the entry checks on the loaded data. It goes through the admin lane so no
+// sync runs meanwhile.
+func (db *DB[T]) Verify() (VerifyReport, error) {
+	if db.closed.Load() {
+		return VerifyReport{}, dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "verify",
+		response: make(chan operationResult[T], 1),
+	}
+	result := db.submit(db.adminOps, op)
+	if result.report == nil {
+		return VerifyReport{}, result.err
+	}
+	return *result.report, result.err
+}
+
+func (db *DB[T]) verify() (VerifyReport, error) {
+	if local, ok := db.localStorage(); ok {
+		return VerifyFile[T](local.filePath)
+	}
+	report := VerifyReport{Entries: db.data.len()}
+	keys := db.data.keys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		verifyEntry(&report, key, db.data.entry(key))
+	}
+	return report, nil
+}
+
+// localStorage returns the LocalStorage the data lives in, if it does.
+func (db *DB[T]) localStorage() (*LocalStorage[T], bool) {
+	storage := db.storage
+	if replicated, ok := storage.(*replicatedStorage[T]); ok {
+		storage = replicated.Storage
+	}
+	local, ok := storage.(*LocalStorage[T])
+	return local, ok
+}
+
+// VerifyFile checks a database file written by LocalStorage (JSON, or gob for
+// ".bin" files) without opening it as a DB, so it works on a locked file too.
+// A file with its checksum recorded in "<path>.sha256", as ExportSnapshot
+// writes, is checked against it; the live data file of a DB has none, its
+// checksum is only reported for comparison with a known good copy. The error
+// is only set when the file can't be read; problems with its contents are
+// reported as issues.
+func VerifyFile[T any](path string) (VerifyReport, error) {
+	report := VerifyReport{Path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return report, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	report.SizeBytes, err = io.Copy(hash, file)
+	if err != nil {
+		return report, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+	report.Checksum = hex.EncodeToString(hash.Sum(nil))
+	recorded, found, err := recordedChecksum(path)
+	if err != nil {
+		return report, err
+	}
+	if found && recorded != report.Checksum {
+		report.addIssue(CheckChecksum, "", fmt.Sprintf("does not match %s", path+checksumExtension))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return report, dbError.FailedToLoadFile(fmt.Sprintf("%s", err))
+	}
+
+	if filepath.Ext(path) == ".bin" {
+		verifyGob[T](&report, file)
+	} else {
+		verifyJSON[T](&report, file)
+	}
+	return report, nil
+}
+
+func verifyGob[T any](report *VerifyReport, file io.ReadSeeker) {
+	data := make(map[string]DbData[T])
+	header, err := decodeGobFile(file, &data)
+	if err != nil {
+		report.addIssue(CheckJSON, "", fmt.Sprintf("invalid gob data: %s", err))
+		return
+	}
+	if header != nil {
+		verifySchema[T](report, *header)
+	}
+	report.Entries = len(data)
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		verifyEntry(report, key, data[key])
+	}
+}
+
+// verifyJSON walks the file token by token, like LocalStorage.Load, which
+// also catches the duplicate keys that decoding into a map would hide.
+func verifyJSON[T any](report *VerifyReport, file io.Reader) {
+	decoder := json.NewDecoder(file)
+	token, err := decoder.Token()
+	if err != nil {
+		report.addIssue(CheckJSON, "", fmt.Sprintf("invalid JSON: %s", err))
+		return
+	}
+	if token == nil { // "null" file
+		return
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		report.addIssue(CheckJSON, "", fmt.Sprintf("expected a JSON object, got %v", token))
+		return
+	}
+	seen := make(map[string]bool)
+	for decoder.More() {
+		keyToken, err := decoder.Token()
+		if err != nil {
+			report.addIssue(CheckJSON, "", fmt.Sprintf("invalid JSON at offset %d: %s", decoder.InputOffset(), err))
+			return
+		}
+		key := keyToken.(string)
+		if key == schemaHeaderKey {
+			var header schemaHeader
+			if err := decoder.Decode(&header); err != nil {
+				report.addIssue(CheckJSON, key, fmt.Sprintf("invalid schema header: %s", err))
+				return
+			}
+			verifySchema[T](report, header)
+			continue
+		}
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err != nil {
+			report.addIssue(CheckJSON, key, fmt.Sprintf("invalid JSON at offset %d: %s", decoder.InputOffset(), err))
+			return
+		}
+		report.Entries++
+		if seen[key] {
+			report.addIssue(CheckDuplicate, key, "key appears more than once, only the last entry is loaded")
+		}
+		seen[key] = true
+		var entry DbData[T]
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			report.addIssue(CheckJSON, key, fmt.Sprintf("invalid entry: %s", err))
+			continue
+		}
+		verifyEntry(report, key, entry)
+	}
+	if _, err := decoder.Token(); err != nil { // closing '}'
+		report.addIssue(CheckJSON, "", fmt.Sprintf("invalid JSON at offset %d: %s", decoder.InputOffset(), err))
+	}
+}
+
+// verifySchema reports a file header that doesn't match T.
+func verifySchema[T any](report *VerifyReport, header schemaHeader) {
+	if err := header.check(schemaOf[T]()); err != nil {
+		report.addIssue(CheckSchema, "", err.(*dbError.DBError).AdditionalInfo)
+	}
+}
+
+// verifyEntry runs the checks that apply to a single decoded entry.
+func verifyEntry[T any](report *VerifyReport, key string, entry DbData[T]) {
+	if len(key) > KeySizeLimit {
+		report.addIssue(CheckKeySize, key, fmt.Sprintf("key is %d bytes, the limit is %d", len(key), KeySizeLimit))
+	}
+	if _, err := entrySizeKB(entry, EntrySizeLimitMB*KB); err != nil {
+		report.addIssue(CheckEntrySize, key, err.(*dbError.DBError).AdditionalInfo)
+	}
+	if entry.Ttl != "" {
+		if seconds, err := strconv.Atoi(entry.Ttl); err != nil || seconds < 0 {
+			report.addIssue(CheckTTL, key, fmt.Sprintf("ttl %q is not a number of seconds", entry.Ttl))
+		}
+	}
+	if entry.Created_at.IsZero() {
+		report.addIssue(CheckTTL, key, "created_at is missing")
+	} else if entry.Created_at.After(time.Now().Add(maxClockSkew)) {
+		report.addIssue(CheckTTL, key, fmt.Sprintf("created_at %s is in the future", entry.Created_at.Format(time.RFC3339)))
+	}
+}
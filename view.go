@@ -0,0 +1,78 @@
+package main
+
+import (
+	"local-key-value-DB/dbError"
+	"sort"
+)
+
+// ReadTx is the consistent view of the data given to View. It is only valid
+// until the View function returns.
+type ReadTx[T any] struct {
+	db *DB[T]
+}
+
+// View runs fn with a read-only view of the data in which no write
+// interleaves: every write queued before View is applied, and the write
+// worker pauses until fn returns, so several keys read through tx reflect the
+// same state. Writes issued meanwhile wait, so fn should be short and must
+// not wait on writes of its own. Plain reads of the DB still work inside fn.
+// View works on read-only databases and followers too.
+func (db *DB[T]) View(fn func(tx ReadTx[T]) error) error {
+	if db.closed.Load() {
+		return dbError.DBAlreadyClosed("")
+	}
+	op := operation[T]{
+		action:   "view",
+		response: make(chan operationResult[T], 1),
+		release:  make(chan struct{}),
+	}
+	// also frees the worker if it paused after we stopped waiting
+	defer close(op.release)
+	if err := db.throttle(readKind, op); err != nil {
+		return err
+	}
+	deadline, timeout, stop := db.opDeadline()
+	defer stop()
+	op.deadline = deadline
+	if err := db.enqueue(db.writeOps, op, timeout); err != nil {
+		return err
+	}
+	if result, _ := db.await(op, timeout); result.err != nil {
+		return result.err
+	}
+	return fn(ReadTx[T]{db: db})
+}
+
+// pause holds the write worker for a View or a Freeze until the caller
+// releases it or the DB is closed.
+func (db *DB[T]) pause(op operation[T]) {
+	op.response <- operationResult[T]{}
+	select {
+	case <-op.release:
+	case <-db.closeCh:
+	}
+}
+
+// Get returns the entry stored under key, failing like Read for a missing or
+// expired one.
+func (tx ReadTx[T]) Get(key string) (DbData[T], error) {
+	return tx.db.read(key)
+}
+
+// Has reports whether key holds an entry that hasn't expired.
+func (tx ReadTx[T]) Has(key string) bool {
+	_, err := tx.Get(key)
+	return err == nil
+}
+
+// Keys lists, sorted, the keys of the entries that haven't expired.
+func (tx ReadTx[T]) Keys() []string {
+	keys := make([]string, 0, tx.db.data.len())
+	for _, key := range tx.db.data.keys() {
+		if !tx.db.isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"local-key-value-DB/dbError"
+	"sync"
+)
+
+// keyWatchers is the registry behind WaitFor: the channels to close when a
+// key is written.
+type keyWatchers struct {
+	mu      sync.Mutex
+	waiting map[string]map[chan struct{}]bool
+}
+
+func newKeyWatchers() *keyWatchers {
+	return &keyWatchers{waiting: make(map[string]map[chan struct{}]bool)}
+}
+
+func (w *keyWatchers) add(key string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ch := make(chan struct{})
+	if w.waiting[key] == nil {
+		w.waiting[key] = make(map[chan struct{}]bool)
+	}
+	w.waiting[key][ch] = true
+	return ch
+}
+
+func (w *keyWatchers) remove(key string, ch chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.waiting[key], ch)
+	if len(w.waiting[key]) == 0 {
+		delete(w.waiting, key)
+	}
+}
+
+// wake closes the channels of everyone waiting for key.
+func (w *keyWatchers) wake(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.waiting[key] {
+		close(ch)
+	}
+	delete(w.waiting, key)
+}
+
+// WaitFor returns the entry stored under key, waiting until it is created or
+// updated if there is none (or it expired), for producer/consumer handoffs:
+// the consumer waits on a key the producer creates. It fails with ctx's error
+// once ctx is done, or DBAlreadyClosed if the DB closes meanwhile.
+func (db *DB[T]) WaitFor(ctx context.Context, key string) (DbData[T], error) {
+	for {
+		// registered before reading, so a write in between isn't missed
+		written := db.watchers.add(key)
+		result := db.Read(key)
+		if result.err == nil {
+			db.watchers.remove(key, written)
+			return result.value, nil
+		}
+		if db.closed.Load() {
+			db.watchers.remove(key, written)
+			return DbData[T]{}, dbError.DBAlreadyClosed("")
+		}
+		select {
+		case <-written:
+			// read it again: it may be gone already
+		case <-ctx.Done():
+			db.watchers.remove(key, written)
+			return DbData[T]{}, ctx.Err()
+		case <-db.closeCh:
+			db.watchers.remove(key, written)
+			return DbData[T]{}, dbError.DBAlreadyClosed("")
+		}
+	}
+}